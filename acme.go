@@ -0,0 +1,961 @@
+package webca
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACME_ACCOUNTS    = ".webca.acme" // ACME accounts file, orders and authorizations live in memory only
+	ACME_DAYS        = 90            // default validity of certificates issued through ACME
+	ACME_EXPIRES     = 7 * 24 * time.Hour
+	ACME_MAX_ORDERS  = 100 // orders an account can have pending at once
+	ACME_NONCE_TTL   = time.Hour
+	ACME_MAX_NONCES  = 10000
+	ACME_MAX_REQUEST = 64 * 1024
+	ACME_ERROR       = "urn:ietf:params:acme:error:"
+
+	ACME_PENDING     = "pending"
+	ACME_PROCESSING  = "processing"
+	ACME_READY       = "ready"
+	ACME_VALID       = "valid"
+	ACME_INVALID     = "invalid"
+	ACME_DEACTIVATED = "deactivated"
+
+	HTTP_01     = "http-01"
+	DNS_01      = "dns-01"
+	TLS_ALPN_01 = "tls-alpn-01"
+)
+
+// ACMEPolicy enables ACME on a CA for the allowed domains, each allowing its subdomains too
+type ACMEPolicy struct {
+	Domains []string
+	Days    int // validity of the certificates issued, ACME_DAYS by default
+}
+
+// allows tells whether the policy allows issuing for the DNS name
+func (p *ACMEPolicy) allows(name string) bool {
+	name = strings.ToLower(strings.TrimPrefix(name, "*."))
+	for _, d := range p.Domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "*."))
+		if d != "" && (name == d || strings.HasSuffix(name, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// days returns the validity of the certificates issued under the policy
+func (p *ACMEPolicy) days() int {
+	if p.Days > 0 {
+		return p.Days
+	}
+	return ACME_DAYS
+}
+
+// acmeProblem is an ACME error, as a problem document (RFC 7807)
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Error returns the problem detail
+func (p *acmeProblem) Error() string {
+	return p.Detail
+}
+
+// acmeError returns a problem of the given ACME error type
+func acmeError(status int, typ, format string, args ...interface{}) *acmeProblem {
+	return &acmeProblem{Type: ACME_ERROR + typ, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+// acmeIdentifier is a name to be certified
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// acmeAccount is an ACME client account, bound to its key and a CA
+type acmeAccount struct {
+	ID         string
+	CA         string
+	Key        jsonWebKey
+	Thumbprint string
+	Contact    []string
+	Status     string
+	Created    time.Time
+}
+
+// acmeOrder is a request for a certificate
+type acmeOrder struct {
+	ID          string
+	Account     string
+	Status      string
+	Expires     time.Time
+	Identifiers []acmeIdentifier
+	Authzs      []string
+	Cert        []byte // PEM chain issued
+	Error       *acmeProblem
+}
+
+// acmeAuthz is the authorization of an account for an identifier, proven with any challenge
+type acmeAuthz struct {
+	ID         string
+	Account    string
+	Order      string
+	Identifier acmeIdentifier
+	Wildcard   bool
+	Status     string
+	Expires    time.Time
+	Challenges []*acmeChallenge
+}
+
+// acmeChallenge is a way to prove the control of an identifier
+type acmeChallenge struct {
+	ID        string
+	Type      string
+	Token     string
+	Status    string
+	Validated time.Time
+	Error     *acmeProblem
+}
+
+// acmeState holds the ACME accounts, orders, authorizations and nonces
+type acmeState struct {
+	sync.Mutex
+	nmutex   sync.Mutex // guards the nonces alone, so that replies can be sent with the lock held
+	nonces   map[string]time.Time
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	loaded   string // accounts file loaded
+}
+
+// acme is the ACME state of WebCA
+var acme = &acmeState{nonces: make(map[string]time.Time), accounts: make(map[string]*acmeAccount),
+	orders: make(map[string]*acmeOrder), authzs: make(map[string]*acmeAuthz)}
+
+// newNonce returns a fresh anti-replay nonce
+func (as *acmeState) newNonce() (string, error) {
+	nonce, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	as.nmutex.Lock()
+	defer as.nmutex.Unlock()
+	now := time.Now()
+	if len(as.nonces) > ACME_MAX_NONCES {
+		for n, issued := range as.nonces {
+			if now.Sub(issued) > ACME_NONCE_TTL {
+				delete(as.nonces, n)
+			}
+		}
+	}
+	as.nonces[nonce] = now
+	return nonce, nil
+}
+
+// useNonce consumes a nonce, returning false if it was not issued or was used already
+func (as *acmeState) useNonce(nonce string) bool {
+	as.nmutex.Lock()
+	defer as.nmutex.Unlock()
+	issued, ok := as.nonces[nonce]
+	delete(as.nonces, nonce)
+	return ok && time.Since(issued) <= ACME_NONCE_TTL
+}
+
+// loadAccounts reads the accounts file, once per working dir, with the lock held
+func (as *acmeState) loadAccounts() {
+	dir, err := os.Getwd()
+	file := filepath.Join(dir, ACME_ACCOUNTS)
+	if err != nil || as.loaded == file {
+		return
+	}
+	as.loaded, as.accounts = file, make(map[string]*acmeAccount)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	accounts := make([]*acmeAccount, 0)
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		log.Printf("(Warning) Failed to read the ACME accounts: %v", err)
+		return
+	}
+	for _, a := range accounts {
+		as.accounts[a.ID] = a
+	}
+}
+
+// saveAccounts writes the accounts file, with the lock held
+func (as *acmeState) saveAccounts() error {
+	accounts := make([]*acmeAccount, 0, len(as.accounts))
+	for _, a := range as.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Created.Before(accounts[j].Created) })
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ACME_ACCOUNTS+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(ACME_ACCOUNTS+".tmp", ACME_ACCOUNTS)
+}
+
+// acmeRequest is an ACME request being served for a CA
+type acmeRequest struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	ca      *Cert
+	policy  *ACMEPolicy
+	origin  string       // scheme and host the request was sent to
+	base    string       // URL of the CA's ACME endpoints
+	jwk     *jsonWebKey  // key of the request, when it is not signed by an account
+	account *acmeAccount // account signing the request
+	payload []byte       // empty on POST-as-GET requests
+}
+
+// url returns the absolute URL of an endpoint of the CA
+func (ar *acmeRequest) url(endpoint string, id ...string) string {
+	return strings.Join(append([]string{ar.base, endpoint}, id...), "/")
+}
+
+// reply sends an ACME response with a fresh nonce
+func (ar *acmeRequest) reply(status int, v interface{}) {
+	ar.headers()
+	if v == nil {
+		ar.w.WriteHeader(status)
+		return
+	}
+	ar.w.Header().Set("Content-Type", "application/json")
+	ar.w.WriteHeader(status)
+	json.NewEncoder(ar.w).Encode(v)
+}
+
+// headers sets the headers every ACME response carries
+func (ar *acmeRequest) headers() {
+	if nonce, err := acme.newNonce(); err == nil {
+		ar.w.Header().Set("Replay-Nonce", nonce)
+	}
+	ar.w.Header().Set("Cache-Control", "no-store")
+	ar.w.Header().Add("Link", "<"+ar.url("directory")+">;rel=\"index\"")
+}
+
+// fail sends an ACME problem
+func (ar *acmeRequest) fail(err error) {
+	p, ok := err.(*acmeProblem)
+	if !ok {
+		p = acmeError(http.StatusInternalServerError, "serverInternal", "%v", err)
+	}
+	ar.headers()
+	ar.w.Header().Set("Content-Type", "application/problem+json")
+	ar.w.WriteHeader(p.Status)
+	json.NewEncoder(ar.w).Encode(p)
+}
+
+// acmeServer serves the ACME (RFC 8555) endpoints of the CAs with an ACME policy, at
+// /acme/<CA name>/<endpoint>[/<id>]
+func acmeServer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/acme/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	cfg := LoadConfig()
+	ca := FindCert(parts[0])
+	if cfg == nil || cfg.ACME[parts[0]] == nil || ca == nil || !ca.Crt.IsCA || ca.Key == nil {
+		http.NotFound(w, r)
+		return
+	}
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	origin := scheme + "://" + r.Host
+	ar := &acmeRequest{w: w, r: r, ca: ca, policy: cfg.ACME[parts[0]], origin: origin,
+		base: origin + "/acme/" + url.PathEscape(parts[0])}
+	endpoint, id := parts[1], ""
+	if len(parts) == 3 {
+		id = parts[2]
+	}
+	switch endpoint {
+	case "directory":
+		ar.reply(http.StatusOK, map[string]interface{}{
+			"newNonce":   ar.url("new-nonce"),
+			"newAccount": ar.url("new-account"),
+			"newOrder":   ar.url("new-order"),
+			"meta":       map[string]interface{}{"externalAccountRequired": false},
+		})
+		return
+	case "new-nonce":
+		status := http.StatusNoContent
+		if r.Method == "HEAD" {
+			status = http.StatusOK
+		}
+		ar.reply(status, nil)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		ar.fail(acmeError(http.StatusMethodNotAllowed, "malformed", "Method not allowed"))
+		return
+	}
+	if err := ar.verify(endpoint == "new-account"); err != nil {
+		ar.fail(err)
+		return
+	}
+	var err error
+	switch endpoint {
+	case "new-account":
+		err = ar.newAccount()
+	case "acct":
+		err = ar.accountInfo(id)
+	case "new-order":
+		err = ar.newOrder()
+	case "order":
+		err = ar.orderInfo(id)
+	case "authz":
+		err = ar.authzInfo(id)
+	case "chall":
+		err = ar.challenge(id)
+	case "finalize":
+		err = ar.finalize(id)
+	case "cert":
+		err = ar.certificate(id)
+	default:
+		err = acmeError(http.StatusNotFound, "malformed", "Unknown endpoint %s", endpoint)
+	}
+	if err != nil {
+		ar.fail(err)
+	}
+}
+
+// verify checks the JWS of the request: its nonce, URL and signature by the account's key or,
+// if jwkAllowed, by the key it carries
+func (ar *acmeRequest) verify(jwkAllowed bool) error {
+	if !strings.HasPrefix(ar.r.Header.Get("Content-Type"), "application/jose+json") {
+		return acmeError(http.StatusUnsupportedMediaType, "malformed", "Wrong content type")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(ar.r.Body, ACME_MAX_REQUEST))
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "Wrong JWS: %v", err)
+	}
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *jsonWebKey
+	}
+	if err := decodeJWTPart(jws.Protected, &header); err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "Wrong JWS header: %v", err)
+	}
+	if !acme.useNonce(header.Nonce) {
+		return acmeError(http.StatusBadRequest, "badNonce", "Unknown or used nonce")
+	}
+	if header.URL != ar.origin+ar.r.URL.EscapedPath() {
+		return acmeError(http.StatusUnauthorized, "unauthorized", "JWS URL %s is not the request URL", header.URL)
+	}
+	if (header.JWK == nil) == (header.Kid == "") {
+		return acmeError(http.StatusBadRequest, "malformed", "JWS must carry either a key or a key ID")
+	}
+	var key jsonWebKey
+	if header.JWK != nil {
+		if !jwkAllowed {
+			return acmeError(http.StatusBadRequest, "malformed", "JWS must be signed by an account")
+		}
+		key, ar.jwk = *header.JWK, header.JWK
+	} else {
+		if jwkAllowed {
+			return acmeError(http.StatusBadRequest, "malformed", "JWS must carry the account key")
+		}
+		ar.account = acme.account(strings.TrimPrefix(header.Kid, ar.url("acct")+"/"), ar.ca.Crt.Subject.CommonName)
+		if ar.account == nil || !strings.HasPrefix(header.Kid, ar.url("acct")+"/") {
+			return acmeError(http.StatusBadRequest, "accountDoesNotExist", "Unknown account %s", header.Kid)
+		}
+		if ar.account.Status != ACME_VALID {
+			return acmeError(http.StatusUnauthorized, "unauthorized", "Account is %s", ar.account.Status)
+		}
+		key = ar.account.Key
+	}
+	pub, err := key.publicKey()
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "Wrong JWS signature encoding")
+	}
+	if err := verifyJWS(header.Alg, pub, jws.Protected+"."+jws.Payload, sig); err != nil {
+		if strings.HasPrefix(err.Error(), "Unsupported") {
+			return acmeError(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err)
+		}
+		return acmeError(http.StatusUnauthorized, "unauthorized", "%v", err)
+	}
+	if ar.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "Wrong JWS payload encoding")
+	}
+	return nil
+}
+
+// decodePayload decodes the JSON payload of the request
+func (ar *acmeRequest) decodePayload(v interface{}) error {
+	if err := json.Unmarshal(ar.payload, v); err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "Wrong payload: %v", err)
+	}
+	return nil
+}
+
+// thumbprint returns the JWK thumbprint (RFC 7638) of the key
+func (k jsonWebKey) thumbprint() string {
+	var canonical string
+	if k.Kty == "RSA" {
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// account returns the account with the ID on the CA, if any
+func (as *acmeState) account(id, ca string) *acmeAccount {
+	as.Lock()
+	defer as.Unlock()
+	as.loadAccounts()
+	if a := as.accounts[id]; a != nil && a.CA == ca {
+		return a
+	}
+	return nil
+}
+
+// accountView returns the ACME representation of the account
+func (ar *acmeRequest) accountView(a *acmeAccount) interface{} {
+	return map[string]interface{}{"status": a.Status, "contact": a.Contact,
+		"orders": ar.url("acct", a.ID, "orders")}
+}
+
+// newAccount registers the key of the request, or finds its existing account
+func (ar *acmeRequest) newAccount() error {
+	var req struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := ar.decodePayload(&req); err != nil {
+		return err
+	}
+	thumbprint := ar.jwk.thumbprint()
+	ca := ar.ca.Crt.Subject.CommonName
+	acme.Lock()
+	defer acme.Unlock()
+	acme.loadAccounts()
+	for _, a := range acme.accounts {
+		if a.CA == ca && a.Thumbprint == thumbprint {
+			ar.w.Header().Set("Location", ar.url("acct", a.ID))
+			ar.reply(http.StatusOK, ar.accountView(a))
+			return nil
+		}
+	}
+	if req.OnlyReturnExisting {
+		return acmeError(http.StatusBadRequest, "accountDoesNotExist", "No account for this key")
+	}
+	for _, c := range req.Contact {
+		if !strings.HasPrefix(c, "mailto:") {
+			return acmeError(http.StatusBadRequest, "unsupportedContact", "Unsupported contact %s", c)
+		}
+	}
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+	a := &acmeAccount{ID: id, CA: ca, Key: *ar.jwk, Thumbprint: thumbprint, Contact: req.Contact,
+		Status: ACME_VALID, Created: time.Now()}
+	acme.accounts[id] = a
+	if err := acme.saveAccounts(); err != nil {
+		delete(acme.accounts, id)
+		return err
+	}
+	record(AuditEntry{User: "acme:" + id, IP: clientIP(ar.r), Action: "acmeAccount", Target: ca,
+		Outcome: AUDIT_OK, Detail: strings.Join(req.Contact, " ")})
+	ar.w.Header().Set("Location", ar.url("acct", id))
+	ar.reply(http.StatusCreated, ar.accountView(a))
+	return nil
+}
+
+// accountInfo returns, updates or deactivates the account signing the request
+func (ar *acmeRequest) accountInfo(id string) error {
+	if id != ar.account.ID {
+		return acmeError(http.StatusUnauthorized, "unauthorized", "Not your account")
+	}
+	acme.Lock()
+	defer acme.Unlock()
+	if len(ar.payload) > 0 {
+		var req struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := ar.decodePayload(&req); err != nil {
+			return err
+		}
+		if req.Contact != nil {
+			ar.account.Contact = req.Contact
+		}
+		if req.Status == ACME_DEACTIVATED {
+			ar.account.Status = ACME_DEACTIVATED
+		}
+		if err := acme.saveAccounts(); err != nil {
+			return err
+		}
+	}
+	ar.reply(http.StatusOK, ar.accountView(ar.account))
+	return nil
+}
+
+// newOrder creates an order for the DNS names allowed by the CA's policy, with an
+// authorization for each
+func (ar *acmeRequest) newOrder() error {
+	var req struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := ar.decodePayload(&req); err != nil {
+		return err
+	}
+	if len(req.Identifiers) == 0 {
+		return acmeError(http.StatusBadRequest, "malformed", "No identifiers")
+	}
+	for _, ident := range req.Identifiers {
+		if ident.Type != "dns" {
+			return acmeError(http.StatusBadRequest, "unsupportedIdentifier", "Unsupported identifier type %s", ident.Type)
+		}
+		if !ar.policy.allows(ident.Value) {
+			return acmeError(http.StatusForbidden, "rejectedIdentifier", "%s is not allowed on %s",
+				ident.Value, ar.ca.Crt.Subject.CommonName)
+		}
+	}
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+	o := &acmeOrder{ID: id, Account: ar.account.ID, Status: ACME_PENDING, Expires: time.Now().Add(ACME_EXPIRES),
+		Identifiers: req.Identifiers}
+	authzs := make([]*acmeAuthz, 0, len(req.Identifiers))
+	for _, ident := range req.Identifiers {
+		az, err := newAuthz(o, ident)
+		if err != nil {
+			return err
+		}
+		authzs = append(authzs, az)
+		o.Authzs = append(o.Authzs, az.ID)
+	}
+	acme.Lock()
+	defer acme.Unlock()
+	acme.expireOrders(time.Now())
+	if acme.pendingOrders(ar.account.ID) >= ACME_MAX_ORDERS {
+		return acmeError(http.StatusTooManyRequests, "rateLimited", "Too many pending orders")
+	}
+	acme.orders[id] = o
+	for _, az := range authzs {
+		acme.authzs[az.ID] = az
+	}
+	ar.w.Header().Set("Location", ar.url("order", id))
+	ar.reply(http.StatusCreated, ar.orderView(o))
+	return nil
+}
+
+// expireOrders forgets the orders and authorizations past their expiry, with the lock held
+func (as *acmeState) expireOrders(now time.Time) {
+	for id, o := range as.orders {
+		if now.After(o.Expires) {
+			delete(as.orders, id)
+		}
+	}
+	for id, az := range as.authzs {
+		if now.After(az.Expires) {
+			delete(as.authzs, id)
+		}
+	}
+}
+
+// pendingOrders counts the orders of the account not valid or invalid yet, with the lock held
+func (as *acmeState) pendingOrders(account string) int {
+	count := 0
+	for _, o := range as.orders {
+		if o.Account == account && o.Status != ACME_VALID && o.Status != ACME_INVALID {
+			count++
+		}
+	}
+	return count
+}
+
+// newAuthz returns the authorization for an identifier of the order, wildcards can only be
+// proven with a DNS challenge
+func newAuthz(o *acmeOrder, ident acmeIdentifier) (*acmeAuthz, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	az := &acmeAuthz{ID: id, Account: o.Account, Order: o.ID, Identifier: ident, Status: ACME_PENDING,
+		Expires: o.Expires}
+	types := []string{HTTP_01, DNS_01, TLS_ALPN_01}
+	if strings.HasPrefix(ident.Value, "*.") {
+		az.Identifier.Value, az.Wildcard, types = strings.TrimPrefix(ident.Value, "*."), true, []string{DNS_01}
+	}
+	for _, typ := range types {
+		chid, err1 := randomToken()
+		token, err2 := randomToken()
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Failed to generate challenge tokens")
+		}
+		az.Challenges = append(az.Challenges, &acmeChallenge{ID: chid, Type: typ, Token: token, Status: ACME_PENDING})
+	}
+	return az, nil
+}
+
+// orderView returns the ACME representation of the order, with the lock held
+func (ar *acmeRequest) orderView(o *acmeOrder) interface{} {
+	if o.Status != ACME_VALID && o.Status != ACME_INVALID && time.Now().After(o.Expires) {
+		o.Status = ACME_INVALID
+	}
+	authzs := make([]string, 0, len(o.Authzs))
+	for _, id := range o.Authzs {
+		authzs = append(authzs, ar.url("authz", id))
+	}
+	view := map[string]interface{}{"status": o.Status, "expires": o.Expires.UTC().Format(time.RFC3339),
+		"identifiers": o.Identifiers, "authorizations": authzs, "finalize": ar.url("finalize", o.ID)}
+	if o.Status == ACME_VALID {
+		view["certificate"] = ar.url("cert", o.ID)
+	}
+	if o.Error != nil {
+		view["error"] = o.Error
+	}
+	return view
+}
+
+// order returns the order of the account signing the request, with the lock held
+func (ar *acmeRequest) order(id string) (*acmeOrder, error) {
+	o := acme.orders[id]
+	if o == nil || o.Account != ar.account.ID {
+		return nil, acmeError(http.StatusNotFound, "malformed", "Unknown order %s", id)
+	}
+	return o, nil
+}
+
+// orderInfo returns the order
+func (ar *acmeRequest) orderInfo(id string) error {
+	acme.Lock()
+	defer acme.Unlock()
+	o, err := ar.order(id)
+	if err != nil {
+		return err
+	}
+	ar.reply(http.StatusOK, ar.orderView(o))
+	return nil
+}
+
+// authzView returns the ACME representation of the authorization, with the lock held
+func (ar *acmeRequest) authzView(az *acmeAuthz) interface{} {
+	if az.Status == ACME_PENDING && time.Now().After(az.Expires) {
+		az.Status = ACME_INVALID
+	}
+	challenges := make([]interface{}, 0, len(az.Challenges))
+	for _, ch := range az.Challenges {
+		challenges = append(challenges, ar.challengeView(ch))
+	}
+	view := map[string]interface{}{"identifier": az.Identifier, "status": az.Status,
+		"expires": az.Expires.UTC().Format(time.RFC3339), "challenges": challenges}
+	if az.Wildcard {
+		view["wildcard"] = true
+	}
+	return view
+}
+
+// challengeView returns the ACME representation of the challenge, with the lock held
+func (ar *acmeRequest) challengeView(ch *acmeChallenge) interface{} {
+	view := map[string]interface{}{"type": ch.Type, "url": ar.url("chall", ch.ID), "token": ch.Token,
+		"status": ch.Status}
+	if !ch.Validated.IsZero() {
+		view["validated"] = ch.Validated.UTC().Format(time.RFC3339)
+	}
+	if ch.Error != nil {
+		view["error"] = ch.Error
+	}
+	return view
+}
+
+// authz returns the authorization of the account signing the request, with the lock held
+func (ar *acmeRequest) authz(id string) (*acmeAuthz, error) {
+	az := acme.authzs[id]
+	if az == nil || az.Account != ar.account.ID {
+		return nil, acmeError(http.StatusNotFound, "malformed", "Unknown authorization %s", id)
+	}
+	return az, nil
+}
+
+// authzInfo returns or deactivates the authorization
+func (ar *acmeRequest) authzInfo(id string) error {
+	acme.Lock()
+	defer acme.Unlock()
+	az, err := ar.authz(id)
+	if err != nil {
+		return err
+	}
+	if len(ar.payload) > 0 {
+		var req struct {
+			Status string `json:"status"`
+		}
+		if err := ar.decodePayload(&req); err != nil {
+			return err
+		}
+		if req.Status == ACME_DEACTIVATED {
+			az.Status = ACME_DEACTIVATED
+		}
+	}
+	ar.reply(http.StatusOK, ar.authzView(az))
+	return nil
+}
+
+// challenge validates the challenge when asked to, which proves its authorization when
+// successful and invalidates it otherwise
+func (ar *acmeRequest) challenge(id string) error {
+	acme.Lock()
+	var az *acmeAuthz
+	var ch *acmeChallenge
+	for _, a := range acme.authzs {
+		for _, c := range a.Challenges {
+			if c.ID == id && a.Account == ar.account.ID {
+				az, ch = a, c
+			}
+		}
+	}
+	if ch == nil {
+		acme.Unlock()
+		return acmeError(http.StatusNotFound, "malformed", "Unknown challenge %s", id)
+	}
+	start := len(ar.payload) > 0 && ch.Status == ACME_PENDING && az.Status == ACME_PENDING
+	if start {
+		ch.Status = ACME_PROCESSING
+	}
+	keyAuth := ch.Token + "." + ar.account.Thumbprint
+	typ, domain := ch.Type, az.Identifier.Value
+	acme.Unlock()
+	if start {
+		err := challenger.validate(typ, domain, ch.Token, keyAuth)
+		acme.Lock()
+		ch.Status, az.Status = ACME_VALID, ACME_VALID
+		if err != nil {
+			ch.Error, _ = err.(*acmeProblem)
+			if ch.Error == nil {
+				ch.Error = acmeError(http.StatusForbidden, "incorrectResponse", "%v", err)
+			}
+			ch.Status, az.Status = ACME_INVALID, ACME_INVALID
+		} else {
+			ch.Validated = time.Now()
+		}
+		acme.updateOrder(az.Order)
+		acme.Unlock()
+	}
+	acme.Lock()
+	defer acme.Unlock()
+	ar.w.Header().Add("Link", "<"+ar.url("authz", az.ID)+">;rel=\"up\"")
+	ar.reply(http.StatusOK, ar.challengeView(ch))
+	return nil
+}
+
+// updateOrder makes the order ready once all its authorizations are valid, or invalid as
+// soon as any of them is, with the lock held
+func (as *acmeState) updateOrder(id string) {
+	o := as.orders[id]
+	if o == nil || o.Status != ACME_PENDING {
+		return
+	}
+	ready := true
+	for _, azid := range o.Authzs {
+		switch as.authzs[azid].Status {
+		case ACME_VALID:
+		case ACME_PENDING:
+			ready = false
+		default:
+			o.Status = ACME_INVALID
+			return
+		}
+	}
+	if ready {
+		o.Status = ACME_READY
+	}
+}
+
+// finalize issues the certificate of a ready order for the CSR, which must ask for exactly
+// the names of the order
+func (ar *acmeRequest) finalize(id string) error {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := ar.decodePayload(&req); err != nil {
+		return err
+	}
+	acme.Lock()
+	defer acme.Unlock()
+	o, err := ar.order(id)
+	if err != nil {
+		return err
+	}
+	if o.Status != ACME_READY {
+		return acmeError(http.StatusForbidden, "orderNotReady", "Order is %s", o.Status)
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "badCSR", "Wrong CSR encoding")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "badCSR", "Wrong CSR: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, ident := range o.Identifiers {
+		names[strings.ToLower(ident.Value)] = true
+	}
+	requested := make(map[string]bool)
+	for _, name := range csr.DNSNames {
+		requested[strings.ToLower(name)] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && !names[cn] {
+		return acmeError(http.StatusBadRequest, "badCSR", "CSR common name %s was not ordered", cn)
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 || len(requested) != len(names) {
+		return acmeError(http.StatusBadRequest, "badCSR", "CSR names are not the ordered ones")
+	}
+	for name := range requested {
+		if !names[name] {
+			return acmeError(http.StatusBadRequest, "badCSR", "CSR name %s was not ordered", name)
+		}
+	}
+	name := pkix.Name{CommonName: csr.Subject.CommonName}
+	if name.CommonName == "" {
+		name.CommonName = o.Identifiers[0].Value
+	}
+	c, err := SignCSR(ar.ca, name, csr, ar.policy.days(), x509.ExtKeyUsageServerAuth)
+	e := AuditEntry{User: "acme:" + ar.account.ID, IP: clientIP(ar.r), Action: "acmeIssue",
+		Target: name.CommonName, Outcome: AUDIT_OK}
+	if c != nil {
+		e.Serial = serialOf(c.Crt)
+	}
+	if err != nil {
+		e.Outcome, e.Detail = AUDIT_FAILED, err.Error()
+		record(e)
+		o.Status, o.Error = ACME_INVALID, acmeError(http.StatusInternalServerError, "serverInternal", "%v", err)
+		switch err.(type) {
+		case *PolicyError:
+			o.Error = acmeError(http.StatusForbidden, "rejectedIdentifier", "%v", err)
+		case *LintError:
+			o.Error = acmeError(http.StatusBadRequest, "badCSR", "%v", err)
+		}
+		return o.Error
+	}
+	record(e)
+	o.Status, o.Cert = ACME_VALID, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Crt.Raw})
+	for p := ar.ca; p != nil && p.Parent != p && p.Parent != nil && p.Parent.Crt.Raw != nil; p = p.Parent {
+		o.Cert = append(o.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.Crt.Raw})...)
+	}
+	ar.w.Header().Set("Location", ar.url("order", o.ID))
+	ar.reply(http.StatusOK, ar.orderView(o))
+	return nil
+}
+
+// certificate downloads the certificate chain issued for an order
+func (ar *acmeRequest) certificate(id string) error {
+	acme.Lock()
+	defer acme.Unlock()
+	o, err := ar.order(id)
+	if err != nil {
+		return err
+	}
+	if o.Status != ACME_VALID {
+		return acmeError(http.StatusNotFound, "malformed", "No certificate for order %s", id)
+	}
+	ar.headers()
+	ar.w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	ar.w.Write(o.Cert)
+	return nil
+}
+
+// setACME sets the ACME policy and directory URL of a CA on the page
+func setACME(ps PageStatus, c *Cert) {
+	cfg := LoadConfig()
+	name := c.Crt.Subject.CommonName
+	ps["ACME"], ps["ACMEURL"] = cfg.ACME[name], ""
+	if cfg.ACME[name] != nil && cfg.WebCert != nil {
+		ps["ACMEURL"] = cfg.Listen.baseURL(cfg) + "/acme/" + url.PathEscape(name) + "/directory"
+	}
+}
+
+// acmePolicy enables ACME on the requested CA for the domains given, or disables it
+func acmePolicy(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	if !c.Crt.IsCA || c.Key == nil {
+		handleError(w, r, fmt.Errorf(tr("%s can't issue certificates!", name)))
+		return
+	}
+	cfg := LoadConfig()
+	action, detail := "acmeDisable", ""
+	if r.FormValue("enable") != "" {
+		policy := &ACMEPolicy{Domains: strings.Fields(strings.Replace(r.FormValue("domains"), ",", " ", -1))}
+		if days := r.FormValue("days"); days != "" {
+			if policy.Days, err = strconv.Atoi(days); err != nil || policy.Days < 1 {
+				err = fmt.Errorf(tr("Wrong validity days %s!", days))
+			}
+		}
+		if err == nil && len(policy.Domains) == 0 {
+			err = fmt.Errorf(tr("ACME needs some allowed domains!"))
+		}
+		if err != nil {
+			ps["Error"] = err.Error()
+			certControlPage(w, r, ps, c)
+			return
+		}
+		if cfg.ACME == nil {
+			cfg.ACME = make(map[string]*ACMEPolicy)
+		}
+		cfg.ACME[name] = policy
+		action, detail = "acmeEnable", strings.Join(policy.Domains, " ")
+	} else {
+		delete(cfg.ACME, name)
+	}
+	err = cfg.Save()
+	e := requestEntry(r, action, name, err)
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else {
+		e.Detail = detail
+	}
+	record(e)
+	certControlPage(w, r, ps, c)
+}
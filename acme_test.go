@@ -0,0 +1,309 @@
+package webca
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers TXT lookups from a map
+type fakeResolver map[string][]string
+
+func (fr fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return fr[name], nil
+}
+
+// acmeClient is a minimal ES256 ACME client
+type acmeClient struct {
+	t     *testing.T
+	key   *ecdsa.PrivateKey
+	jwk   jsonWebKey
+	kid   string
+	nonce string
+}
+
+func newACMEClient(t *testing.T, newNonce string) *acmeClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	coord := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32))) }
+	c := &acmeClient{t: t, key: key, jwk: jsonWebKey{Kty: "EC", Crv: "P-256", X: coord(key.X), Y: coord(key.Y)}}
+	resp, err := http.Head(newNonce)
+	dieOnError(t, err)
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	return c
+}
+
+// post sends the payload signed, or a POST-as-GET if it is nil, returning the status and body
+func (c *acmeClient) post(url string, payload interface{}) (*http.Response, []byte) {
+	header := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.kid == "" {
+		header["jwk"] = map[string]string{"kty": c.jwk.Kty, "crv": c.jwk.Crv, "x": c.jwk.X, "y": c.jwk.Y}
+	} else {
+		header["kid"] = c.kid
+	}
+	protected, _ := json.Marshal(header)
+	body := ""
+	if payload != nil {
+		data, _ := json.Marshal(payload)
+		body = base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(protected) + "." + body
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	dieOnError(c.t, err)
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	jws, _ := json.Marshal(map[string]string{"protected": base64.RawURLEncoding.EncodeToString(protected),
+		"payload": body, "signature": base64.RawURLEncoding.EncodeToString(sig)})
+	resp, err := http.Post(url, "application/jose+json", strings.NewReader(string(jws)))
+	dieOnError(c.t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	dieOnError(c.t, err)
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	return resp, data
+}
+
+// postJSON posts and decodes the JSON response, failing unless it has the status expected
+func (c *acmeClient) postJSON(url string, payload interface{}, status int, v interface{}) *http.Response {
+	resp, data := c.post(url, payload)
+	if resp.StatusCode != status {
+		c.t.Fatalf("POST %s got %d instead of %d: %s", url, resp.StatusCode, status, data)
+	}
+	if v != nil {
+		dieOnError(c.t, json.Unmarshal(data, v))
+	}
+	return resp
+}
+
+type testOrder struct {
+	Status         string
+	Authorizations []string
+	Finalize       string
+	Certificate    string
+}
+
+type testAuthz struct {
+	Identifier acmeIdentifier
+	Challenges []struct{ Type, URL, Token, Status string }
+}
+
+// proof sets up the response to a challenge of some type
+type proof struct {
+	typ   string
+	setup func(keyAuth string)
+}
+
+// order makes an order and proves its authorizations as given for each name, returning its status
+func (c *acmeClient) order(dir map[string]string, proofs map[string]proof) testOrder {
+	ids := make([]acmeIdentifier, 0)
+	for name := range proofs {
+		ids = append(ids, acmeIdentifier{Type: "dns", Value: name})
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Value > ids[j].Value }) // localhost first
+	var o testOrder
+	resp := c.postJSON(dir["newOrder"], map[string]interface{}{"identifiers": ids}, http.StatusCreated, &o)
+	url := resp.Header.Get("Location")
+	for _, authz := range o.Authorizations {
+		var az testAuthz
+		c.postJSON(authz, nil, http.StatusOK, &az)
+		name := az.Identifier.Value
+		if _, ok := proofs[name]; !ok {
+			name = "*." + name
+		}
+		for _, ch := range az.Challenges {
+			if ch.Type == proofs[name].typ {
+				proofs[name].setup(ch.Token + "." + c.jwk.thumbprint())
+				var result struct{ Status string }
+				c.postJSON(ch.URL, map[string]string{}, http.StatusOK, &result)
+				if result.Status != ACME_VALID {
+					c.t.Fatalf("%s challenge for %s was not valid: %s", ch.Type, name, result.Status)
+				}
+			}
+		}
+	}
+	c.postJSON(url, nil, http.StatusOK, &o)
+	return o
+}
+
+// finalize sends a CSR for the names and downloads the certificate chain issued
+func (c *acmeClient) finalize(o testOrder, names ...string) []*x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(c.t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	dieOnError(c.t, err)
+	c.postJSON(o.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, http.StatusOK, &o)
+	if o.Status != ACME_VALID || o.Certificate == "" {
+		c.t.Fatalf("Order was not issued: %+v", o)
+	}
+	resp, data := c.post(o.Certificate, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/pem-certificate-chain" {
+		c.t.Fatalf("Failed to download the certificate: %d %s", resp.StatusCode, data)
+	}
+	chain := make([]*x509.Certificate, 0)
+	for b, rest := pem.Decode(data); b != nil; b, rest = pem.Decode(rest) {
+		crt, err := x509.ParseCertificate(b.Bytes)
+		dieOnError(c.t, err)
+		chain = append(chain, crt)
+	}
+	return chain
+}
+
+// alpnCert returns a tls-alpn-01 challenge certificate for the domain
+func alpnCert(t *testing.T, domain, keyAuth string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	sum := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(sum[:])
+	dieOnError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+		DNSNames: []string{domain}, ExtraExtensions: []pkix.Extension{{Id: idPeAcmeIdentifier, Critical: true, Value: value}}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	dieOnError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// portOf returns the port a test server listens on
+func portOf(t *testing.T, addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	dieOnError(t, err)
+	var n int
+	fmt.Sscan(port, &n)
+	return n
+}
+
+func TestACME(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		web, err := GenCert(ca, "webca.test", 365)
+		dieOnError(t, err)
+		cfg := NewConfig(User{Username: "admin", Password: crypt("admin")}, ca, web, Mailer{})
+		cfg.ACME = map[string]*ACMEPolicy{"TestCA": {Domains: []string{"localhost", "example.com"}, Days: 30}}
+		dieOnError(t, cfg.Save())
+
+		var keyAuth string
+		challengeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(keyAuth, strings.TrimPrefix(r.URL.Path, ACME_HTTP_PATH)+".") {
+				fmt.Fprint(w, keyAuth)
+			}
+		}))
+		defer challengeSrv.Close()
+		var alpn tls.Certificate
+		tlsSrv, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{NextProtos: []string{ACME_TLS_ALPN},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &alpn, nil }})
+		dieOnError(t, err)
+		defer tlsSrv.Close()
+		go func() {
+			for {
+				conn, err := tlsSrv.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		resolver := fakeResolver{}
+		saved := *challenger
+		defer func() { *challenger = saved }()
+		challenger.httpPort, challenger.tlsPort = portOf(t, challengeSrv.Listener.Addr().String()), portOf(t, tlsSrv.Addr().String())
+		SetACMEResolver(resolver)
+
+		srv := httptest.NewServer(http.HandlerFunc(acmeServer))
+		defer srv.Close()
+		resp, err := http.Get(srv.URL + "/acme/TestCA/directory")
+		dieOnError(t, err)
+		dir := make(map[string]string)
+		json.NewDecoder(resp.Body).Decode(&dir)
+		resp.Body.Close()
+		if dir["newAccount"] != srv.URL+"/acme/TestCA/new-account" {
+			t.Fatalf("Unexpected directory %v", dir)
+		}
+		if resp, _ := http.Get(srv.URL + "/acme/Unknown/directory"); resp.StatusCode != http.StatusNotFound {
+			t.Fatal("ACME served on a CA without policy")
+		}
+
+		c := newACMEClient(t, dir["newNonce"])
+		resp = c.postJSON(dir["newAccount"], map[string]interface{}{"termsOfServiceAgreed": true,
+			"contact": []string{"mailto:admin@example.com"}}, http.StatusCreated, nil)
+		c.kid = resp.Header.Get("Location")
+
+		o := c.order(dir, map[string]proof{
+			"localhost": {HTTP_01, func(ka string) { keyAuth = ka }},
+			"*.example.com": {DNS_01, func(ka string) {
+				sum := sha256.Sum256([]byte(ka))
+				resolver["_acme-challenge.example.com"] = []string{base64.RawURLEncoding.EncodeToString(sum[:])}
+			}},
+		})
+		if o.Status != ACME_READY {
+			t.Fatalf("Order not ready after its challenges: %+v", o)
+		}
+		chain := c.finalize(o, "localhost", "*.example.com")
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Crt)
+		if _, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, DNSName: "www.example.com"}); err != nil {
+			t.Fatalf("Issued certificate does not verify: %v", err)
+		}
+		if days := chain[0].NotAfter.Sub(time.Now()).Hours() / 24; days > 30 || days < 29 {
+			t.Fatalf("Issued for %v days instead of the policy's 30", days)
+		}
+		if c := FindCert("localhost"); c == nil || c.Key != nil {
+			t.Fatal("Issued certificate not kept without a key")
+		}
+
+		o = c.order(dir, map[string]proof{
+			"localhost": {TLS_ALPN_01, func(ka string) { alpn = alpnCert(t, "localhost", ka) }},
+		})
+		if chain := c.finalize(o, "localhost"); len(chain) != 1 || serialOf(chain[0]) != serialOf(FindCert("localhost").Crt) {
+			t.Fatal("Certificate was not renewed through ACME")
+		}
+
+		resp, data := c.post(dir["newOrder"], map[string]interface{}{
+			"identifiers": []acmeIdentifier{{Type: "dns", Value: "evil.org"}}})
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(data), ACME_ERROR+"rejectedIdentifier") {
+			t.Fatalf("Order for a name out of the policy was not rejected: %d %s", resp.StatusCode, data)
+		}
+		acme.Lock()
+		for _, o := range acme.orders {
+			o.Expires = time.Now().Add(-time.Minute)
+		}
+		acme.Unlock()
+		localhost := map[string]interface{}{"identifiers": []acmeIdentifier{{Type: "dns", Value: "localhost"}}}
+		for i := 0; i < ACME_MAX_ORDERS; i++ {
+			c.postJSON(dir["newOrder"], localhost, http.StatusCreated, nil)
+		}
+		acme.Lock()
+		orders := len(acme.orders)
+		acme.Unlock()
+		if orders != ACME_MAX_ORDERS {
+			t.Fatalf("Kept %d orders instead of forgetting the expired ones", orders)
+		}
+		if resp, data := c.post(dir["newOrder"], localhost); resp.StatusCode != http.StatusTooManyRequests ||
+			!strings.Contains(string(data), ACME_ERROR+"rateLimited") {
+			t.Fatalf("Orders beyond the pending limit were not rejected: %d %s", resp.StatusCode, data)
+		}
+		c.nonce = "replayed"
+		if resp, data := c.post(c.kid, nil); !strings.Contains(string(data), ACME_ERROR+"badNonce") {
+			t.Fatalf("Unknown nonce was accepted: %d %s", resp.StatusCode, data)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package webca
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_LOG      = ".webca.audit" // audit log file, one JSON entry per line
+	AUDIT_OK       = "ok"
+	AUDIT_FAILED   = "failed"
+	AUDIT_PAGE     = 500 // most recent matching entries shown on the audit page
+	AUDIT_MAX_LINE = 1024 * 1024
+)
+
+// AuditEntry records who did what, from where, on which certificate and how it went. Each
+// entry is chained to the previous one by hash, so that changing or removing an entry breaks
+// the chain from there on
+type AuditEntry struct {
+	Seq     int64
+	Time    time.Time
+	User    string
+	IP      string
+	Action  string
+	Target  string // certificate or user name
+	Serial  string `json:",omitempty"` // certificate serial number, in hex
+	Outcome string
+	Detail  string `json:",omitempty"`
+	Prev    string // Hash of the previous entry, "" for the first one
+	Hash    string `json:",omitempty"`
+}
+
+// hash returns the hash chaining the entry, calculated over all its fields but Hash
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditFile appends entries to an audit log, remembering the last one to chain the next
+type auditFile struct {
+	sync.Mutex
+	file string
+	size int64 // size of the file when seq and last were known
+	seq  int64
+	last string
+}
+
+// auditTrail is the audit log of WebCA
+var auditTrail = &auditFile{file: AUDIT_LOG, size: -1}
+
+// append chains the entry to the last one and appends it to the log
+func (af *auditFile) append(e AuditEntry) error {
+	af.Lock()
+	defer af.Unlock()
+	size := int64(0)
+	if fi, err := os.Stat(af.file); err == nil {
+		size = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if size != af.size { // first append or appended by someone else, find the last entry again
+		entries, err := ReadAudit(af.file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		af.seq, af.last = 0, ""
+		if len(entries) > 0 {
+			af.seq, af.last = entries[len(entries)-1].Seq, entries[len(entries)-1].Hash
+		}
+	}
+	e.Seq, e.Prev = af.seq+1, af.last
+	e.Hash = e.hash()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(af.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	af.seq, af.last, af.size = e.Seq, e.Hash, size+int64(len(data)+1)
+	return nil
+}
+
+// ReadAudit reads all entries of the audit log file
+func ReadAudit(file string) ([]AuditEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), AUDIT_MAX_LINE)
+	for line := 1; scanner.Scan(); line++ {
+		e := AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("Failed to read audit entry at line %d: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// VerifyAudit checks the hash chain of the entries, returning an error on the first broken
+// link. Entries removed at the end of the log can only be detected against an older export
+func VerifyAudit(entries []AuditEntry) error {
+	prev := ""
+	for i, e := range entries {
+		if e.Seq != int64(i+1) {
+			return fmt.Errorf(tr("Audit entry %d found where %d was expected", e.Seq, i+1))
+		}
+		if e.Prev != prev || e.Hash != e.hash() {
+			return fmt.Errorf(tr("Audit entry %d was tampered with", e.Seq))
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// record appends an entry to the audit log, failures are warned about but don't stop WebCA
+func record(e AuditEntry) {
+	e.Time = time.Now().UTC()
+	if err := auditTrail.append(e); err != nil {
+		log.Printf("(Warning) Failed to audit %s of %s by %s: %v", e.Action, e.Target, e.User, err)
+	}
+}
+
+// auditRequest records an action by the user logged in on the request, failed if err is not nil
+func auditRequest(r *http.Request, action, target string, err error) {
+	record(requestEntry(r, action, target, err))
+}
+
+// auditCert records an action on certificate c, named target, by the user logged in on the request
+func auditCert(r *http.Request, action, target string, c *Cert, err error) {
+	e := requestEntry(r, action, target, err)
+	if c != nil && c.Crt != nil {
+		e.Serial = fmt.Sprintf("%X", c.Crt.SerialNumber)
+	}
+	record(e)
+}
+
+// requestEntry returns the audit entry of an action by the user logged in on the request, with
+// the error as detail if it failed
+func requestEntry(r *http.Request, action, target string, err error) AuditEntry {
+	e := AuditEntry{User: requestUsername(r), IP: clientIP(r), Action: action, Target: target,
+		Outcome: AUDIT_OK}
+	if err != nil {
+		e.Outcome, e.Detail = AUDIT_FAILED, err.Error()
+	}
+	return e
+}
+
+// requestUsername returns the name of the user logged in on the request's session, if any
+func requestUsername(r *http.Request) string {
+	id, err := requestSessionId(r)
+	if err != nil || id == "" {
+		return ""
+	}
+	smutex.RLock()
+	defer smutex.RUnlock()
+	if ss, err := sessionStore.Get(id); err == nil && ss != nil {
+		return ss.Values[LOGGEDUSER]
+	}
+	return ""
+}
+
+// AuditFilter selects audit entries, empty fields match anything
+type AuditFilter struct {
+	User, Action, Target, Outcome string
+	From, To                      time.Time
+}
+
+// readAuditFilter reads the audit filter from the request, dates are given as YYYY-MM-DD
+func readAuditFilter(r *http.Request) (AuditFilter, error) {
+	f := AuditFilter{User: strings.TrimSpace(r.FormValue("User")),
+		Action:  strings.TrimSpace(r.FormValue("Action")),
+		Target:  strings.TrimSpace(r.FormValue("Target")),
+		Outcome: r.FormValue("Outcome")}
+	var err error
+	if from := r.FormValue("From"); from != "" {
+		if f.From, err = time.Parse("2006-01-02", from); err != nil {
+			return f, fmt.Errorf(tr("Wrong date %s!", from))
+		}
+	}
+	if to := r.FormValue("To"); to != "" {
+		if f.To, err = time.Parse("2006-01-02", to); err != nil {
+			return f, fmt.Errorf(tr("Wrong date %s!", to))
+		}
+		f.To = f.To.Add(24 * time.Hour) // the whole day
+	}
+	return f, nil
+}
+
+// matches tells whether the entry passes the filter, the target matches names or serial
+// numbers containing it
+func (f AuditFilter) matches(e AuditEntry) bool {
+	target := strings.ToLower(f.Target)
+	return (f.User == "" || f.User == e.User) && (f.Action == "" || f.Action == e.Action) &&
+		(f.Outcome == "" || f.Outcome == e.Outcome) &&
+		(target == "" || strings.Contains(strings.ToLower(e.Target), target) ||
+			strings.Contains(strings.ToLower(e.Serial), target)) &&
+		(f.From.IsZero() || !e.Time.Before(f.From)) && (f.To.IsZero() || e.Time.Before(f.To))
+}
+
+// filter returns the entries matching the filter
+func (f AuditFilter) filter(entries []AuditEntry) []AuditEntry {
+	matching := make([]AuditEntry, 0)
+	for _, e := range entries {
+		if f.matches(e) {
+			matching = append(matching, e)
+		}
+	}
+	return matching
+}
+
+// readAuditTrail reads the audit log of WebCA, which is empty before the first entry
+func readAuditTrail() ([]AuditEntry, error) {
+	auditTrail.Lock()
+	defer auditTrail.Unlock()
+	entries, err := ReadAudit(auditTrail.file)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	return entries, err
+}
+
+// audit shows the most recent audit entries matching the filter, and whether the chain is intact
+func audit(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	entries, err := readAuditTrail()
+	if handleError(w, r, err) {
+		return
+	}
+	ps["Verified"] = true
+	if err := VerifyAudit(entries); err != nil {
+		ps["Verified"] = false
+		ps["Error"] = err.Error()
+	}
+	f, err := readAuditFilter(r)
+	if err != nil {
+		ps["Error"] = err.Error()
+	}
+	matching := f.filter(entries)
+	ps["Total"] = len(matching)
+	if len(matching) > AUDIT_PAGE {
+		matching = matching[len(matching)-AUDIT_PAGE:]
+	}
+	for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 { // newest first
+		matching[i], matching[j] = matching[j], matching[i]
+	}
+	ps["Entries"] = matching
+	ps["Filter"] = r.Form
+	ps["Query"] = r.Form.Encode()
+	err = templates.ExecuteTemplate(w, "audit", ps)
+	handleError(w, r, err)
+}
+
+// auditExport downloads the audit entries matching the filter as JSON lines
+func auditExport(w http.ResponseWriter, r *http.Request) {
+	f, err := readAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := readAuditTrail()
+	if handleError(w, r, err) {
+		return
+	}
+	w.Header().Set("Content-disposition", "attachment; filename=webca-audit.jsonl")
+	w.Header().Set("Content-type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range f.filter(entries) {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package webca
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuditChain(t *testing.T) {
+	inTempDir(t, func() {
+		af := &auditFile{file: AUDIT_LOG, size: -1}
+		for _, action := range []string{"gen", "renew", "delete"} {
+			dieOnError(t, af.append(AuditEntry{User: "admin", Action: action, Target: "x", Outcome: AUDIT_OK}))
+		}
+		other := &auditFile{file: AUDIT_LOG, size: -1} // another instance appending to the same log
+		dieOnError(t, other.append(AuditEntry{User: "admin", Action: "gen", Target: "y", Outcome: AUDIT_OK}))
+		dieOnError(t, af.append(AuditEntry{User: "admin", Action: "renew", Target: "y", Outcome: AUDIT_OK}))
+		entries, err := ReadAudit(AUDIT_LOG)
+		dieOnError(t, err)
+		if len(entries) != 5 {
+			t.Fatalf("Expected 5 entries but got %d", len(entries))
+		}
+		dieOnError(t, VerifyAudit(entries))
+		if got := (AuditFilter{Target: "Y"}).filter(entries); len(got) != 2 {
+			t.Fatalf("Filter by target found %d entries instead of 2", len(got))
+		}
+		data, err := ioutil.ReadFile(AUDIT_LOG)
+		dieOnError(t, err)
+		tampered := strings.Replace(string(data), `"Action":"delete"`, `"Action":"gen"`, 1)
+		dieOnError(t, ioutil.WriteFile(AUDIT_LOG, []byte(tampered), 0600))
+		entries, err = ReadAudit(AUDIT_LOG)
+		dieOnError(t, err)
+		if VerifyAudit(entries) == nil {
+			t.Fatal("Tampered entry not detected")
+		}
+		if VerifyAudit(append(entries[:1], entries[2:]...)) == nil {
+			t.Fatal("Removed entry not detected")
+		}
+	})
+}
+
+func TestAuditOperations(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+		jar, err := cookiejar.New(nil)
+		dieOnError(t, err)
+		client := &http.Client{Jar: jar}
+		token := getCSRF(t, client, webca.URL+"/")
+		resp, err := client.PostForm(webca.URL+"/login",
+			url.Values{"Username": {"admin"}, "Password": {"admin"}, CSRFFIELD: {token}})
+		dieOnError(t, err)
+		resp.Body.Close()
+		token = getCSRF(t, client, webca.URL+"/certControl?cert=localhost")
+		resp, err = client.PostForm(webca.URL+"/renew", url.Values{"cert": {"localhost"}, CSRFFIELD: {token}})
+		dieOnError(t, err)
+		resp.Body.Close()
+		resp, err = client.Get(webca.URL + "/audit.jsonl?Action=renew")
+		dieOnError(t, err)
+		defer resp.Body.Close()
+		export, err := ioutil.ReadAll(resp.Body)
+		dieOnError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(export)), "\n")
+		if len(lines) != 1 || !strings.Contains(lines[0], `"User":"admin"`) ||
+			!strings.Contains(lines[0], `"Target":"localhost"`) || !strings.Contains(lines[0], `"Outcome":"ok"`) {
+			t.Fatalf("Unexpected renewal audit:\n%s", export)
+		}
+		entries, err := ReadAudit(AUDIT_LOG)
+		dieOnError(t, err)
+		if len(entries) != 2 || entries[0].Action != "login" {
+			t.Fatalf("Unexpected audit log %v", entries)
+		}
+	})
+}
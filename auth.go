@@ -0,0 +1,118 @@
+package webca
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"math/bits"
+)
+
+// ErrBadCredentials is returned by Authenticators when the username or password are wrong
+var ErrBadCredentials = errors.New("Bad credentials")
+
+// Authenticator checks the credentials of users against a user directory
+type Authenticator interface {
+	// Name identifies the Authenticator on logs and as the Source of the Users it authenticates
+	Name() string
+	// Authenticate returns the User with the given credentials, ErrBadCredentials if they are
+	// wrong or any other error if the directory could not be checked
+	Authenticate(username, password string) (User, error)
+}
+
+// localAuth authenticates the users in the config with a local password
+type localAuth struct {
+	cfg       *config
+	adminOnly bool // when acting as fallback of a directory only local admins may log in
+}
+
+// Name identifies local users, which have an empty Source
+func (la localAuth) Name() string {
+	return ""
+}
+
+// Authenticate checks the password of a local user
+func (la localAuth) Authenticate(username, password string) (User, error) {
+	u := la.cfg.getUser(username)
+	if u.Username == "" || u.Source != "" || u.Password == "" ||
+		subtle.ConstantTimeCompare([]byte(u.Password), []byte(crypt(password))) != 1 {
+		return User{}, ErrBadCredentials
+	}
+	if la.adminOnly && u.role() != ROLE_ADMIN {
+		return User{}, ErrBadCredentials
+	}
+	return u, nil
+}
+
+// authenticators returns the Authenticators configured, in the order they are to be checked
+func (cfg *config) authenticators() []Authenticator {
+	if cfg.LDAP == nil || cfg.LDAP.URL == "" {
+		return []Authenticator{localAuth{cfg: cfg}}
+	}
+	auths := []Authenticator{cfg.LDAP}
+	if cfg.LDAP.LocalFallback {
+		auths = append(auths, localAuth{cfg: cfg, adminOnly: true})
+	}
+	return auths
+}
+
+// authenticate checks the credentials against the configured Authenticators in order, the first
+// accepting them wins. Users from directories are copied into the config keeping the local state
+// they had, such as their second factor enrolment, so the rest of WebCA can treat them as local
+func (cfg *config) authenticate(username, password string) (User, error) {
+	if username == "" || password == "" {
+		return User{}, ErrBadCredentials
+	}
+	for _, auth := range cfg.authenticators() {
+		u, err := auth.Authenticate(username, password)
+		if err == ErrBadCredentials {
+			continue
+		}
+		if err != nil {
+			log.Printf("(Warning) Authenticator %s failed: %v", auth.Name(), err)
+			continue
+		}
+		if auth.Name() == "" {
+			return u, nil
+		}
+		return cfg.mergeUser(u)
+	}
+	return User{}, ErrBadCredentials
+}
+
+// mergeUser saves a User authenticated by a directory into the config, returning it with the
+// local state it had
+func (cfg *config) mergeUser(u User) (User, error) {
+	old := cfg.getUser(u.Username)
+	ok := old.Username != ""
+	if ok && old.Source != u.Source {
+		log.Printf("(Warning) %s user %s shadows a %s user!", u.Source, u.Username, withDefault(old.Source, "local"))
+		return User{}, ErrBadCredentials
+	}
+	if ok && old.Fullname == u.Fullname && old.Email == u.Email && old.Role == u.Role {
+		return old, nil
+	}
+	var merged User
+	err := cfg.update(func(cfg *config) error {
+		merged = cfg.Users[u.Username] // directories own the identity and role, WebCA the rest
+		merged.Username, merged.Fullname, merged.Email = u.Username, u.Fullname, u.Email
+		merged.Role, merged.Source = u.Role, u.Source
+		cfg.Users[u.Username] = merged
+		return nil
+	})
+	return merged, err
+}
+
+// mappedRole returns the most powerful role mapped from the given groups, or "" if none is.
+// Groups are DNs on LDAP and plain names on OIDC, compared the LDAP way in both cases
+func mappedRole(groupRoles map[string]string, groups []string) string {
+	role := ""
+	for _, group := range groups {
+		for g, r := range groupRoles {
+			if _, ok := roles[r]; ok && equalDN(g, group) &&
+				bits.OnesCount(uint(roles[r])) > bits.OnesCount(uint(roles[role])) {
+				role = r
+			}
+		}
+	}
+	return role
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -20,7 +22,10 @@ import (
 const (
 	CERT_SUFFIX = ".pem"
 	KEY_SUFFIX  = ".key.pem"
+	CRL_SUFFIX  = ".crl"
+	CRL_DAYS    = 7 // days a CRL is valid for
 	MYFMT       = "2006/01/02"
+	MAX_NAME    = 200 // longest certificate name, to leave room for suffixes in file names
 )
 
 // Cert holds the certificate the key and links to parent and children
@@ -29,11 +34,13 @@ type Cert struct {
 	Key    *rsa.PrivateKey
 	Parent *Cert   // parent (CA) cert if any
 	Childs []*Cert // children (CA) certs if any
+	Cross  []*Cert // cross certificates of a CA, each with its signer as parent
 }
 
 // Certree holds a certificate tree
 type Certree struct {
 	names   map[string]*Cert
+	keyIds  map[string]*Cert // by SubjectKeyId
 	roots   []*Cert
 	foreign []*Cert
 }
@@ -46,11 +53,16 @@ var scerts sync.RWMutex
 
 // GenCACert generates a CA Certificate, that is a self signed certificate
 func GenCACert(name pkix.Name, days int) (*Cert, error) {
-	cert, err := genCert(nil, name, days)
+	return GenCACertWith(name, days, nil)
+}
+
+// GenCACertWith generates a CA Certificate restricted by the name constraints, if any
+func GenCACertWith(name pkix.Name, days int, nc *NameConstraints) (*Cert, error) {
+	cert, err := genCertAs(nil, name, days, true, nc)
 	if err != nil {
 		return nil, err
 	}
-	certree = nil // forces full reload later
+	invalidateCertree()
 	return cert, nil
 }
 
@@ -62,21 +74,266 @@ func GenCert(parent *Cert, certname string, days int) (*Cert, error) {
 	if err != nil {
 		return nil, err
 	}
-	certree = nil // forces full reload later
+	invalidateCertree()
+	return cert, nil
+}
+
+// GenIntermediateCert generates an intermediate CA Certificate signed by the parent CA and
+// restricted by the name constraints, if any
+func GenIntermediateCert(parent *Cert, certname string, days int, nc *NameConstraints) (*Cert, error) {
+	name := copyName(parent.Crt.Subject)
+	name.CommonName = certname
+	cert, err := genCertAs(parent, name, days, true, nc)
+	if err != nil {
+		return nil, err
+	}
+	invalidateCertree()
+	return cert, nil
+}
+
+// GenClientCert generates a TLS client Certificate for the given User signed by the parent CA,
+// recording its serial as the only one the User can log in with
+func GenClientCert(parent *Cert, u User, days int) (*Cert, error) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.getUser(u.Username).Username == "" {
+		return nil, fmt.Errorf("Can't issue a client certificate for unknown user %s", u.Username)
+	}
+	name := copyName(parent.Crt.Subject)
+	name.CommonName = u.Username
+	cert, err := genCert(parent, name, days, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	invalidateCertree()
+	err = cfg.update(func(cfg *config) error {
+		u = cfg.Users[u.Username]
+		u.ClientSerial = cert.Crt.SerialNumber.String()
+		cfg.Users[u.Username] = u
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record the client certificate of %s: %s", u.Username, err)
+	}
 	return cert, nil
 }
 
 // RenewCert renews the given certificate for the same duration as before from now
 func RenewCert(cert *Cert) (*Cert, error) {
+	return RenewCertBy(cert, "")
+}
+
+// RenewCertBy renews the given certificate on behalf of the named user, keeping the previous
+// version in its history
+func RenewCertBy(cert *Cert, username string) (*Cert, error) {
+	if err := archiveVersion(cert); err != nil {
+		return nil, fmt.Errorf("Failed to keep the previous version of %s: %s", cert.Crt.Subject.CommonName, err)
+	}
+	parent := cert.Parent
+	if parent == cert || bytes.Equal(cert.Crt.RawIssuer, cert.Crt.RawSubject) {
+		parent = nil // self signed again with the new key
+	}
 	days := int(cert.Crt.NotAfter.Sub(cert.Crt.NotBefore).Hours() / 24)
-	cert, err := genCert(cert.Parent, cert.Crt.Subject, days)
+	cert, err := genCertAs(parent, cert.Crt.Subject, days, cert.Crt.IsCA, constraintsOf(cert.Crt), cert.Crt.ExtKeyUsage...)
 	if err != nil {
 		return nil, err
 	}
-	certree = nil // forces full reload later
+	invalidateCertree()
+	if err := addVersion(cert, username); err != nil {
+		log.Printf("(Warning) Failed to record the new version of %s: %v", cert.Crt.Subject.CommonName, err)
+	}
 	return cert, nil
 }
 
+// ResignCertBy renews the given certificate on behalf of the named user keeping its key, so
+// only its serial and validity change. The key of the certificate is not needed unless it is
+// self signed, and children of a re-signed CA remain valid
+func ResignCertBy(cert *Cert, username string) (*Cert, error) {
+	certname := cert.Crt.Subject.CommonName
+	signer := cert.Parent
+	selfSigned := cert.Parent == nil || cert.Parent == cert || bytes.Equal(cert.Crt.RawIssuer, cert.Crt.RawSubject)
+	if selfSigned {
+		signer = cert
+	}
+	if signer.Key == nil || signer.Crt.Raw == nil {
+		return nil, fmt.Errorf("Can't renew %s without the key of %s", certname, signer.Crt.Subject.CommonName)
+	}
+	if err := archiveVersion(cert); err != nil {
+		return nil, fmt.Errorf("Failed to keep the previous version of %s: %s", certname, err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(9223372036854775807))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate random serial number: %s", err)
+	}
+	days := int(cert.Crt.NotAfter.Sub(cert.Crt.NotBefore).Hours() / 24)
+	now := time.Now()
+	tmpl := *cert.Crt // same subject, key identifier, usages and extensions
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = now.Add(-5 * time.Minute).UTC()
+	tmpl.NotAfter = now.AddDate(0, 0, days).UTC()
+	tmpl.SignatureAlgorithm = x509.UnknownSignatureAlgorithm // the one suiting the signer's key
+	tmpl.AuthorityKeyId = signer.Crt.SubjectKeyId
+	parent := signer.Crt
+	if selfSigned {
+		parent = &tmpl
+	} else {
+		clampValidity(&tmpl, signer.Crt)
+		if err := checkIssuance(signer, &tmpl, cert.Crt.PublicKey, days); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkLint(&tmpl, cert.Crt.PublicKey, parent); err != nil {
+		return nil, err
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &tmpl, parent, cert.Crt.PublicKey, signer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Certificate: %s", err)
+	}
+	crt, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the created Certificate: %s", err)
+	}
+	certname = certFile(*cert)
+	certOut, err := os.Create(certname)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open "+certname+" for writing: %s", err)
+	}
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	certOut.Close()
+	invalidateCertree()
+	renewed := &Cert{Crt: crt, Key: cert.Key, Parent: cert.Parent, Childs: cert.Childs}
+	if err := addVersion(renewed, username); err != nil {
+		log.Printf("(Warning) Failed to record the new version of %s: %v", crt.Subject.CommonName, err)
+	}
+	return renewed, nil
+}
+
+// SignCSR issues a Certificate with the given name for the public key and alternative names of
+// the CSR, signed by the parent CA. WebCA does not know the key of such certificates, which
+// replace any previous one with the same name issued by the same parent without a known key,
+// as renewals do
+func SignCSR(parent *Cert, name pkix.Name, csr *x509.CertificateRequest, days int, extUsage ...x509.ExtKeyUsage) (*Cert, error) {
+	if parent.Key == nil || !parent.Crt.IsCA {
+		return nil, fmt.Errorf("Can't sign certificates with %s", parent.Crt.Subject.CommonName)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("Wrong CSR signature: %s", err)
+	}
+	if err := checkFilename(name.CommonName); err != nil {
+		return nil, err
+	}
+	if old := FindCert(name.CommonName); old != nil {
+		if old.Key != nil || old.Parent == nil || old.Parent.Crt.Subject.CommonName != parent.Crt.Subject.CommonName {
+			return nil, fmt.Errorf("Name %s is already taken by another certificate", name.CommonName)
+		}
+		if err := archiveVersion(old); err != nil {
+			return nil, fmt.Errorf("Failed to keep the previous version of %s: %s", name.CommonName, err)
+		}
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(9223372036854775807))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate random serial number: %s", err)
+	}
+	ski, err := subjectKeyId(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        name,
+		NotBefore:      now.Add(-5 * time.Minute).UTC(),
+		NotAfter:       now.AddDate(0, 0, days).UTC(),
+		SubjectKeyId:   ski,
+		AuthorityKeyId: parent.Crt.SubjectKeyId,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    extUsage,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	clampValidity(tmpl, parent.Crt)
+	if err := checkIssuance(parent, tmpl, csr.PublicKey, days); err != nil {
+		return nil, err
+	}
+	if err := checkLint(tmpl, csr.PublicKey, parent.Crt); err != nil {
+		return nil, err
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, tmpl, parent.Crt, csr.PublicKey, parent.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Certificate: %s", err)
+	}
+	t := &Cert{Parent: parent}
+	if t.Crt, err = x509.ParseCertificate(derBytes); err != nil {
+		return nil, fmt.Errorf("Failed to parse the created Certificate: %s", err)
+	}
+	certname := certFile(*t)
+	certOut, err := os.Create(certname)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open "+certname+" for writing: %s", err)
+	}
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	certOut.Close()
+	invalidateCertree()
+	return t, nil
+}
+
+// GenCRL generates the DER encoded Certificate Revocation List of a CA signed by it
+// (webca does not revoke certificates, so the list is always empty)
+func GenCRL(ca *Cert) ([]byte, error) {
+	if !ca.Crt.IsCA || ca.Key == nil {
+		return nil, fmt.Errorf("Can't sign a CRL with %s", ca.Crt.Subject.CommonName)
+	}
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now.UTC(),
+		NextUpdate: now.AddDate(0, 0, CRL_DAYS).UTC(),
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.Crt, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create CRL: %s", err)
+	}
+	return crl, nil
+}
+
+// signedCRL is the last CRL signed by a CA, kept until its next update
+type signedCRL struct {
+	ca         *Cert // the CA as loaded when signing, replaced on any reload of the certree
+	der        []byte
+	nextUpdate time.Time
+}
+
+// crls caches the signed CRLs by CA name
+var crls = struct {
+	sync.Mutex
+	byName map[string]*signedCRL
+}{byName: make(map[string]*signedCRL)}
+
+// CachedCRL returns the CRL of a CA signed earlier, while still current and the CA has not
+// changed or been renewed since, or signs a new one otherwise
+func CachedCRL(ca *Cert) ([]byte, error) {
+	crls.Lock()
+	defer crls.Unlock()
+	name := ca.Crt.Subject.CommonName
+	if c := crls.byName[name]; c != nil && c.ca == ca && time.Now().Before(c.nextUpdate) {
+		return c.der, nil
+	}
+	der, err := GenCRL(ca)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the created CRL: %s", err)
+	}
+	crls.byName[name] = &signedCRL{ca: ca, der: der, nextUpdate: crl.NextUpdate}
+	return der, nil
+}
+
 // ListCerts returns the current Certree
 func ListCerts() *Certree {
 	return autoload()
@@ -84,10 +341,7 @@ func ListCerts() *Certree {
 
 // FindCert finds a certificate by name
 func FindCert(certname string) *Cert {
-	autoload()
-	scerts.RLock()
-	defer scerts.RUnlock()
-	return certree.names[certname]
+	return autoload().names[certname]
 }
 
 // ReadCert reads the Certificate Contents
@@ -109,18 +363,24 @@ func CloneCert(cert *Cert, newname string) *Cert {
 
 // DeleteCert deletes a certificate
 func DeleteCert(cert *Cert) bool {
-	scerts.Lock()
-	defer scerts.Unlock()
 	if err := os.Remove(certFile(*cert)); err != nil {
 		return false
 	}
-	if err := os.Remove(keyFile(*cert)); err != nil {
+	invalidateCertree()
+	// certificates signed from a CSR have no key
+	if err := os.Remove(keyFile(*cert)); err != nil && !os.IsNotExist(err) {
 		return false
 	}
-	certree = nil // forces full reload later
 	return true
 }
 
+// invalidateCertree forces a full reload of the certree on its next use
+func invalidateCertree() {
+	scerts.Lock()
+	defer scerts.Unlock()
+	certree = nil
+}
+
 // autoload will autoload certree
 func autoload() *Certree {
 	scerts.Lock()
@@ -157,20 +417,44 @@ func prepareName(name *pkix.Name) {
 	}
 }
 
-// genCert generates a certificated signed by itself or by another certificate
-func genCert(p *Cert, name pkix.Name, days int) (*Cert, error) {
+// clampValidity keeps the certificate from outliving the issuer
+func clampValidity(crt, issuer *x509.Certificate) {
+	if crt.NotAfter.After(issuer.NotAfter) {
+		crt.NotAfter = issuer.NotAfter
+	}
+}
+
+// genCert generates a certificated signed by itself or by another certificate,
+// restricted to the extended key usages given, if any, and as the issuance policy of the
+// signer requires. Self signed certificates are CAs
+func genCert(p *Cert, name pkix.Name, days int, extUsage ...x509.ExtKeyUsage) (*Cert, error) {
+	return genCertAs(p, name, days, p == nil, nil, extUsage...)
+}
+
+// genCertAs generates a certificate as genCert does, a CA one restricted by the name
+// constraints, if any, when ca is set
+func genCertAs(p *Cert, name pkix.Name, days int, ca bool, nc *NameConstraints, extUsage ...x509.ExtKeyUsage) (*Cert, error) {
+	if err := checkFilename(name.CommonName); err != nil {
+		return nil, err
+	}
 	t := &Cert{}
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	bits := RSA_BITS
+	if p != nil {
+		bits = policyOf(p).rsaBits()
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to generate private key: %s", err)
 	}
 	now := time.Now()
 	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(9223372036854775807))
-	ski := []byte{0, 0, 0, 0}
-	rand.Reader.Read(ski)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to generate random serial number: %s", err)
 	}
+	ski, err := subjectKeyId(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
 	//log.Println("serial:", serial)
 	//log.Println("ski:", ski)
 	t.Crt = &x509.Certificate{
@@ -181,28 +465,52 @@ func genCert(p *Cert, name pkix.Name, days int) (*Cert, error) {
 
 		SubjectKeyId: ski,
 		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  extUsage,
 	}
 	t.Key = key
-	if p == nil {
+	if ca {
 		t.Crt.BasicConstraintsValid = true
 		t.Crt.IsCA = true
 		t.Crt.MaxPathLen = 0
-		t.Crt.KeyUsage = t.Crt.KeyUsage | x509.KeyUsageCertSign
+		t.Crt.KeyUsage = t.Crt.KeyUsage | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		if nc != nil {
+			if err := nc.apply(t.Crt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !ca { // so clients matching names find the host name or IP address in it
+		t.Crt.DNSNames, t.Crt.IPAddresses = hostNames(t.Crt)
+	}
+	if p == nil {
+		t.Crt.AuthorityKeyId = ski // self signed
 		p = t
 		//log.Println("t.Key.PublicKey=", t.Key.PublicKey)
 		//log.Println("p.Key=", t.Key)
 	} else {
 		t.Parent = p
+		clampValidity(t.Crt, p.Crt)
+		t.Crt.AuthorityKeyId = p.Crt.SubjectKeyId
+		if err := checkIssuance(p, t.Crt, &key.PublicKey, days); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkLint(t.Crt, &t.Key.PublicKey, p.Crt); err != nil {
+		return nil, err
 	}
 
-	certname := name.CommonName + CERT_SUFFIX
-	keyname := name.CommonName + KEY_SUFFIX
+	certname := filename(name.CommonName) + CERT_SUFFIX
+	keyname := filename(name.CommonName) + KEY_SUFFIX
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, t.Crt, p.Crt, &t.Key.PublicKey, p.Key)
 	//log.Println("Generated:", tmpl)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create Certificate: %s", err)
 	}
+	if t.Crt, err = x509.ParseCertificate(derBytes); err != nil {
+		return nil, fmt.Errorf("Failed to parse the created Certificate: %s", err)
+	}
 
 	certOut, err := os.Create(certname)
 	if err != nil {
@@ -269,7 +577,7 @@ func readCert(name string) (*Cert, error) {
 
 // NewCertree generates an empty Certree
 func newCertree() *Certree {
-	return &Certree{make(map[string]*Cert), make([]*Cert, 0), make([]*Cert, 0)}
+	return &Certree{make(map[string]*Cert), make(map[string]*Cert), make([]*Cert, 0), make([]*Cert, 0)}
 }
 
 // loadCertree will load all found .pem certs and keys on a Certree
@@ -290,12 +598,13 @@ func loadCertree(dir string) *Certree {
 		return nil
 	}
 	defer f.Close()
+	certs := make([]*Cert, 0)
 	for fis, err := f.Readdir(100); err == nil; fis, err = f.Readdir(100) {
 		for _, fi := range fis {
 			if !fi.IsDir() && strings.HasSuffix(fi.Name(), CERT_SUFFIX) &&
 				!strings.HasSuffix(fi.Name(), KEY_SUFFIX) {
 				if crt, err := readCert(fi.Name()); err == nil {
-					ct.add(crt)
+					certs = append(certs, ct.register(crt))
 				} else {
 					log.Printf("(Warning) %s", err)
 				}
@@ -306,14 +615,19 @@ func loadCertree(dir string) *Certree {
 		log.Printf("(Warning) Can't read dir "+dir+":", err)
 		return nil
 	}
+	for _, c := range certs { // once all are known, so issuers are found whatever the order
+		ct.link(c)
+	}
+	ct.placeLooseEnds()
+	ct.loadCross()
 	if len(ct.roots) == 0 && len(ct.foreign) == 0 {
 		return nil
 	}
 	return ct
 }
 
-// add or replace a certificate in its ordered position within the Cert list
-func (ct *Certree) add(crt *Cert) {
+// register adds or replaces a certificate by name and key identifier, returning the one in the tree
+func (ct *Certree) register(crt *Cert) *Cert {
 	cn := ct.names[crt.Crt.Subject.CommonName]
 	if cn == nil { // if unknown, create and register in certnames
 		ct.names[crt.Crt.Subject.CommonName] = crt
@@ -322,35 +636,97 @@ func (ct *Certree) add(crt *Cert) {
 		cn.Crt = crt.Crt
 		cn.Key = crt.Key
 	}
+	if len(cn.Crt.SubjectKeyId) > 0 {
+		ct.keyIds[string(cn.Crt.SubjectKeyId)] = cn
+	}
+	return cn
+}
+
+// link places a registered certificate in its ordered position, as a root or under its issuer
+func (ct *Certree) link(cn *Cert) {
 	// if root just place it and we are done
-	if crt.Crt.Subject.CommonName == crt.Crt.Issuer.CommonName {
+	if isSelfSigned(cn.Crt) {
 		cn.Parent = cn
-		if crt.Key != nil {
+		if cn.Key != nil {
 			ct.roots = place(ct.roots, cn)
-			ct.foreign = remove(ct.foreign, cn)
 		} else {
 			ct.foreign = place(ct.foreign, cn)
 		}
 		return
-	} else { // otherwise we must find the parent and link the kid
-		parent := ct.names[crt.Crt.Issuer.CommonName]
-		if parent == nil { // if parent is unknown, generate a Cert for it and register
-			parent = &Cert{Crt: &x509.Certificate{Subject: copyName(crt.Crt.Issuer)},
-				Childs: make([]*Cert, 0),
-			}
-			ct.names[crt.Crt.Issuer.CommonName] = parent
+	}
+	// otherwise we must find the parent and link the kid
+	parent := ct.issuerOf(cn.Crt)
+	if parent == nil {
+		parent = ct.names[cn.Crt.Issuer.CommonName]
+	}
+	if parent == nil { // if parent is unknown, generate a Cert for it and register
+		parent = &Cert{Crt: &x509.Certificate{Subject: copyName(cn.Crt.Issuer)},
+			Childs: make([]*Cert, 0),
+		}
+		ct.names[cn.Crt.Issuer.CommonName] = parent
+	}
+	cn.Parent = parent
+	parent.Childs = place(parent.Childs, cn)
+}
+
+// issuerOf finds the issuer of the certificate in the tree: the one with its AuthorityKeyId
+// as SubjectKeyId or, for imported certificates without them, the one with its issuer name
+func (ct *Certree) issuerOf(crt *x509.Certificate) *Cert {
+	if len(crt.AuthorityKeyId) > 0 {
+		if p := ct.keyIds[string(crt.AuthorityKeyId)]; p != nil && p.Crt != crt {
+			return p
+		}
+	}
+	if p := ct.names[crt.Issuer.CommonName]; p != nil && p.Crt.Raw != nil && p.Crt != crt &&
+		bytes.Equal(p.Crt.RawSubject, crt.RawIssuer) {
+		return p
+	}
+	for _, p := range ct.names {
+		if p.Crt.Raw != nil && p.Crt != crt && bytes.Equal(p.Crt.RawSubject, crt.RawIssuer) {
+			return p
+		}
+	}
+	return nil
+}
+
+// placeLooseEnds places the top of the hierarchies with no known root with the rest
+func (ct *Certree) placeLooseEnds() {
+	for _, c := range ct.names {
+		current := c
+		for i := 0; current.Parent != nil && current.Parent != current && i < len(ct.names); i++ {
+			current = current.Parent
+		}
+		if current.Parent == nil { // loose end goes to rest
+			ct.foreign = place(ct.foreign, current)
 		}
-		cn.Parent = parent
-		parent.Childs = place(parent.Childs, cn)
 	}
-	// is this cert part of a known hierarchy or a loose end?
-	current := cn
-	for current.Parent != nil && current.Crt.Issuer.CommonName != current.Crt.Subject.CommonName {
-		current = current.Parent
+}
+
+// isSelfSigned tells whether the certificate was signed by its own key, as its key identifiers
+// tell or, lacking them, its subject and issuer names
+func isSelfSigned(crt *x509.Certificate) bool {
+	if len(crt.AuthorityKeyId) > 0 && len(crt.SubjectKeyId) > 0 {
+		return bytes.Equal(crt.AuthorityKeyId, crt.SubjectKeyId)
 	}
-	if current.Parent == nil { // loose end goes to rest
-		ct.foreign = place(ct.foreign, current)
+	return bytes.Equal(crt.RawIssuer, crt.RawSubject)
+}
+
+// subjectKeyId returns the key identifier of the public key as RFC 5280 4.2.1.2 (1) describes:
+// the SHA-1 hash of the subjectPublicKey bit string
+func subjectKeyId(pub interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the public key: %s", err)
 	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, fmt.Errorf("Failed to parse the public key: %s", err)
+	}
+	hash := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return hash[:], nil
 }
 
 // place kid in order under the given childs list and returns the new ordered and appended list
@@ -367,24 +743,6 @@ func place(childs []*Cert, kid *Cert) []*Cert {
 	return append(childs, candidate)
 }
 
-// remove will return a childs list where there is no kid
-func remove(childs []*Cert, kid *Cert) []*Cert {
-	for _, child := range kid.Childs {
-		childs = remove(childs, child)
-	}
-	candidate := kid
-	for i, _ := range childs {
-		// if found, remove
-		if candidate.Crt.Subject.CommonName == childs[i].Crt.Subject.CommonName {
-			for j := i; j < len(childs)-1; j++ {
-				childs[j] = childs[j+1]
-			}
-			return childs[:len(childs)-1]
-		}
-	}
-	return childs // not found, we return the same list
-}
-
 // String will return the recursive string representation for a Cert
 func (c *Cert) String() string {
 	return printCert(c, "  ")
@@ -435,9 +793,28 @@ func keyFile(crt Cert) string {
 	return filename(crt.Crt.Subject.CommonName) + KEY_SUFFIX
 }
 
-// filename filters a name to make sure is a legal filename
+// filename filters a name to make sure is a legal filename, replacing path separators,
+// control characters and a leading dot, so it can't reach outside the dir or hide in it
 func filename(name string) string {
-	return name // TODO ensure result is a proper filename without forbidden chars
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name[1:]
+	}
+	return name
+}
+
+// checkFilename fails unless the name of a certificate is a legal filename as it is, so
+// that different names never share files, and has no ".." to be mistaken for a parent dir
+func checkFilename(name string) error {
+	if name == "" || len(name) > MAX_NAME || filename(name) != name || strings.Contains(name, "..") {
+		return fmt.Errorf("Name %q can't be used as a certificate file name", name)
+	}
+	return nil
 }
 
 // showPeriod shows the period of a Certificate
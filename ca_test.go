@@ -1,10 +1,19 @@
 package webca
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func NewCert(name string, childs ...*Cert) *Cert {
@@ -15,7 +24,7 @@ func NewCert(name string, childs ...*Cert) *Cert {
 }
 
 func loadTestData() *Certree {
-	ct := NewCertree()
+	ct := newCertree()
 	ct.roots = []*Cert{
 		NewCert("TestCA1",
 			NewCert("Intermediate1",
@@ -36,7 +45,7 @@ func loadTestData() *Certree {
 	return ct
 }
 
-func gen(t *testing.T, cert *Cert) *Cert {
+func genTree(t *testing.T, cert *Cert) *Cert {
 	var gcert *Cert
 	var err error
 	if cert.Parent == nil {
@@ -48,7 +57,7 @@ func gen(t *testing.T, cert *Cert) *Cert {
 	}
 	for i, crt := range cert.Childs {
 		crt.Parent = gcert
-		cert.Childs[i] = gen(t, crt)
+		cert.Childs[i] = genTree(t, crt)
 	}
 	cert.Crt = gcert.Crt
 	cert.Key = gcert.Key
@@ -60,14 +69,14 @@ func TestCA(t *testing.T) {
 	dieOnError(t, os.MkdirAll("tests", 0750))
 	dieOnError(t, os.Chdir("tests"))
 	for i, crt := range ct0.roots {
-		ct0.roots[i] = gen(t, crt)
+		ct0.roots[i] = genTree(t, crt)
 	}
 	for _, crt := range ct0.foreign {
-		gen(t, crt)
+		genTree(t, crt)
 	}
 	dieOnError(t, os.Remove("SomeCA0.key.pem"))
 	dieOnError(t, os.Remove("SomeCA1.key.pem"))
-	ct := LoadCertree(".")
+	ct := loadCertree(".")
 	s0 := ct0.String()
 	s := ct.String()
 	if s != s0 {
@@ -85,3 +94,182 @@ func TestCA(t *testing.T) {
 	//certTree = LoadCertTree(".")
 	//log.Print("Renewed CertTree:\n", certTree)
 }
+
+func TestRenewSameKey(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		host, err := GenCert(ca, "host", 365)
+		dieOnError(t, err)
+		renewedCA, err := ResignCertBy(FindCert("TestCA"), "alice")
+		dieOnError(t, err)
+		if renewedCA.Key.N.Cmp(ca.Key.N) != 0 || serialOf(renewedCA.Crt) == serialOf(ca.Crt) ||
+			string(renewedCA.Crt.SubjectKeyId) != string(ca.Crt.SubjectKeyId) {
+			t.Fatal("CA re-sign changed its key or kept its serial")
+		}
+		if err := host.Crt.CheckSignatureFrom(renewedCA.Crt); err != nil {
+			t.Fatalf("Child of the re-signed CA is no longer valid: %v", err)
+		}
+		dieOnError(t, os.Remove("host"+KEY_SUFFIX)) // as if it was issued from a CSR
+		invalidateCertree()
+		renewed, err := ResignCertBy(FindCert("host"), "alice")
+		dieOnError(t, err)
+		if renewed.Crt.PublicKey.(*rsa.PublicKey).N.Cmp(host.Key.N) != 0 {
+			t.Fatal("Renewal with the same key changed the key")
+		}
+		if err := renewed.Crt.CheckSignatureFrom(renewedCA.Crt); err != nil {
+			t.Fatalf("Renewed certificate is not valid: %v", err)
+		}
+		if c := FindCert("host"); serialOf(c.Crt) != serialOf(renewed.Crt) || c.Key != nil {
+			t.Fatal("Renewed certificate was not stored")
+		}
+	})
+}
+
+func TestDeleteCert(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		_, err = GenCert(ca, "host", 90)
+		dieOnError(t, err)
+		dieOnError(t, os.Remove("host"+KEY_SUFFIX)) // as if it was issued from a CSR
+		if !DeleteCert(FindCert("host")) {
+			t.Fatal("Certificate without a key was not deleted")
+		}
+		if FindCert("host") != nil {
+			t.Fatal("Deleted certificate still in the tree")
+		}
+	})
+}
+
+func TestCachedCRL(t *testing.T) {
+	inTempDir(t, func() {
+		_, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		crl, err := CachedCRL(FindCert("TestCA"))
+		dieOnError(t, err)
+		again, err := CachedCRL(FindCert("TestCA"))
+		dieOnError(t, err)
+		if !bytes.Equal(crl, again) {
+			t.Fatal("CRL signed again while still current")
+		}
+		serveCRL := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h := http.StripPrefix("/crl/", http.HandlerFunc(crlServer))
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/crl/TestCA"+CRL_SUFFIX, nil))
+			return w
+		}
+		if w := serveCRL(); !bytes.Equal(w.Body.Bytes(), crl) {
+			t.Fatalf("Cached CRL not served: %d %s", w.Code, w.Body)
+		}
+		cached := crls.byName["TestCA"]
+		cached.nextUpdate = time.Now().Add(-time.Minute)
+		_, err = CachedCRL(FindCert("TestCA"))
+		dieOnError(t, err)
+		if crls.byName["TestCA"] == cached {
+			t.Fatal("CRL kept past its next update")
+		}
+		renewed, err := RenewCertBy(FindCert("TestCA"), "alice")
+		dieOnError(t, err)
+		after, err := CachedCRL(FindCert("TestCA"))
+		dieOnError(t, err)
+		list, err := x509.ParseRevocationList(after)
+		dieOnError(t, err)
+		if err := list.CheckSignatureFrom(renewed.Crt); err != nil {
+			t.Fatalf("CRL not signed again after renewing the CA: %v", err)
+		}
+		dieOnError(t, os.Remove("TestCA"+KEY_SUFFIX))
+		invalidateCertree()
+		if w := serveCRL(); w.Code != http.StatusNotFound {
+			t.Fatalf("CRL of a CA without its key not missing: %d %s", w.Code, w.Body)
+		}
+	})
+}
+
+// writeSignedBy writes a certificate named cn for a new key, signed by the key with the issuer
+// given, which tells its name and SubjectKeyId
+func writeSignedBy(t *testing.T, cn string, issuer *x509.Certificate, key *rsa.PrivateKey) {
+	pub, err := rsa.GenerateKey(rand.Reader, 1024)
+	dieOnError(t, err)
+	now := time.Now()
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(now.UnixNano()), Subject: pkix.Name{CommonName: cn},
+		NotBefore: now, NotAfter: now.AddDate(0, 0, 30)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &pub.PublicKey, key)
+	dieOnError(t, err)
+	dieOnError(t, ioutil.WriteFile(cn+CERT_SUFFIX, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+}
+
+func TestKeyIdentifiers(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		ski, err := subjectKeyId(&ca.Key.PublicKey)
+		dieOnError(t, err)
+		if len(ski) != 20 || !bytes.Equal(ca.Crt.SubjectKeyId, ski) || !bytes.Equal(ca.Crt.AuthorityKeyId, ski) {
+			t.Fatalf("Unexpected key identifiers of the CA %x %x", ca.Crt.SubjectKeyId, ca.Crt.AuthorityKeyId)
+		}
+		inter, err := GenIntermediateCert(ca, "zInter", 365, nil)
+		dieOnError(t, err)
+		leaf, err := GenCert(inter, "aLeaf", 30)
+		dieOnError(t, err)
+		if !bytes.Equal(leaf.Crt.AuthorityKeyId, inter.Crt.SubjectKeyId) || bytes.Equal(leaf.Crt.SubjectKeyId, inter.Crt.SubjectKeyId) {
+			t.Fatal("Unexpected key identifiers of the leaf")
+		}
+		other, err := GenCACert(pkix.Name{CommonName: "OtherCA"}, 365)
+		dieOnError(t, err)
+		lookalike := *other.Crt // named as TestCA, with the key of OtherCA
+		lookalike.Subject, lookalike.RawSubject = ca.Crt.Subject, ca.Crt.RawSubject
+		writeSignedBy(t, "byOther", &lookalike, other.Key)
+		imported := *ca.Crt // without key identifiers
+		imported.SubjectKeyId = nil
+		writeSignedBy(t, "imported", &imported, ca.Key)
+
+		invalidateCertree()
+		if c := FindCert("aLeaf"); c.Parent != FindCert("zInter") || c.Parent.Parent != FindCert("TestCA") {
+			t.Fatalf("Leaf not linked under its intermediate: %v", ListCerts())
+		}
+		if c := FindCert("byOther"); c.Parent != FindCert("OtherCA") {
+			t.Fatalf("Certificate linked by name rather than key identifier: %v", ListCerts())
+		}
+		if c := FindCert("imported"); len(c.Crt.AuthorityKeyId) != 0 || c.Parent != FindCert("TestCA") {
+			t.Fatalf("Certificate without key identifiers not linked by name: %v", ListCerts())
+		}
+		if len(ListCerts().foreign) != 0 {
+			t.Fatalf("Unexpected loose ends %v", ListCerts().foreign)
+		}
+	})
+}
+
+func TestFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"www.example.com": "www.example.com", "/tmp/pwn": "_tmp_pwn", "../ca": "_._ca",
+		".webca.cfg": "_webca.cfg", `a\b`: "a_b", "a\x00b": "a_b", "::1": "::1",
+	} {
+		if got := filename(name); got != want {
+			t.Errorf("filename(%q) = %q, expected %q", name, got, want)
+		}
+	}
+	inTempDir(t, func() {
+		testConfig(t)
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		dieOnError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+		dieOnError(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		dieOnError(t, err)
+		dir, err := ioutil.TempDir("", "outside")
+		dieOnError(t, err)
+		defer os.RemoveAll(dir)
+		for _, name := range []string{dir + "/pwned", "../pwned", ".pwned", ""} {
+			if _, err := SignCSR(FindCert("TestCA"), pkix.Name{CommonName: name}, csr, 30); err == nil {
+				t.Errorf("Signed a certificate named %q", name)
+			}
+			if _, err := GenCert(FindCert("TestCA"), name, 30); err == nil {
+				t.Errorf("Generated a certificate named %q", name)
+			}
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+			t.Fatalf("Wrote %s outside the CA dir", files[0].Name())
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package webca
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ACME_TLS_ALPN     = "acme-tls/1"
+	ACME_HTTP_PATH    = "/.well-known/acme-challenge/"
+	ACME_DNS_LABEL    = "_acme-challenge."
+	ACME_MAX_RESPONSE = 4096
+)
+
+// idPeAcmeIdentifier is the extension of tls-alpn-01 challenge certificates (RFC 8737)
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEResolver looks up the TXT records proving dns-01 challenges
+type ACMEResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// acmeChallenger validates the ACME challenges against the domains
+type acmeChallenger struct {
+	resolver ACMEResolver
+	httpPort int
+	tlsPort  int
+	timeout  time.Duration
+}
+
+// challenger validates the challenges of the ACME server
+var challenger = &acmeChallenger{resolver: net.DefaultResolver, httpPort: 80, tlsPort: 443,
+	timeout: 10 * time.Second}
+
+// SetACMEResolver replaces the DNS resolver validating dns-01 challenges
+func SetACMEResolver(resolver ACMEResolver) {
+	challenger.resolver = resolver
+}
+
+// validate checks the domain holds the key authorization as the challenge type requires
+func (ac *acmeChallenger) validate(typ, domain, token, keyAuth string) error {
+	switch typ {
+	case HTTP_01:
+		return ac.validateHTTP(domain, token, keyAuth)
+	case DNS_01:
+		return ac.validateDNS(domain, keyAuth)
+	case TLS_ALPN_01:
+		return ac.validateTLSALPN(domain, keyAuth)
+	}
+	return acmeError(http.StatusBadRequest, "malformed", "Unknown challenge type %s", typ)
+}
+
+// validateHTTP fetches the key authorization from the domain's well-known challenge path,
+// redirects are not followed
+func (ac *acmeChallenger) validateHTTP(domain, token, keyAuth string) error {
+	client := &http.Client{Timeout: ac.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	url := "http://" + net.JoinHostPort(domain, strconv.Itoa(ac.httpPort)) + ACME_HTTP_PATH + token
+	resp, err := client.Get(url)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "connection", "Failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return acmeError(http.StatusForbidden, "unauthorized", "%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ACME_MAX_RESPONSE))
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "connection", "Failed to read %s: %v", url, err)
+	}
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return acmeError(http.StatusForbidden, "incorrectResponse", "%s returned a wrong key authorization", url)
+	}
+	return nil
+}
+
+// validateDNS looks for the digest of the key authorization in the TXT records of the domain
+func (ac *acmeChallenger) validateDNS(domain, keyAuth string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ac.timeout)
+	defer cancel()
+	name := ACME_DNS_LABEL + domain
+	records, err := ac.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "dns", "Failed to look up TXT %s: %v", name, err)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	digest := base64.RawURLEncoding.EncodeToString(sum[:])
+	for _, record := range records {
+		if record == digest {
+			return nil
+		}
+	}
+	return acmeError(http.StatusForbidden, "incorrectResponse", "No TXT %s holds the key authorization", name)
+}
+
+// validateTLSALPN checks the domain negotiates acme-tls/1 presenting a certificate for just
+// the domain with the digest of the key authorization in its critical acmeIdentifier extension
+func (ac *acmeChallenger) validateTLSALPN(domain, keyAuth string) error {
+	addr := net.JoinHostPort(domain, strconv.Itoa(ac.tlsPort))
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: ac.timeout}, "tcp", addr, &tls.Config{
+		ServerName: domain, NextProtos: []string{ACME_TLS_ALPN},
+		InsecureSkipVerify: true, // the challenge certificate is self-signed by design
+	})
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "tls", "Failed to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != ACME_TLS_ALPN || len(state.PeerCertificates) == 0 {
+		return acmeError(http.StatusForbidden, "tls", "%s did not negotiate %s", addr, ACME_TLS_ALPN)
+	}
+	crt := state.PeerCertificates[0]
+	if len(crt.DNSNames) != 1 || !strings.EqualFold(crt.DNSNames[0], domain) || len(crt.IPAddresses) > 0 {
+		return acmeError(http.StatusForbidden, "incorrectResponse", "%s certificate is not just for %s", addr, domain)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range crt.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		var digest []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &digest); err != nil || len(rest) > 0 || !ext.Critical ||
+			!bytes.Equal(digest, sum[:]) {
+			return acmeError(http.StatusForbidden, "incorrectResponse", "%s certificate holds a wrong key authorization", addr)
+		}
+		return nil
+	}
+	return acmeError(http.StatusForbidden, "incorrectResponse", "%s certificate has no acmeIdentifier", addr)
+}
@@ -2,10 +2,45 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
 	"github.com/josvazg/webca"
 )
 
 func main() {
-	webca.WebCA()
+	s := webca.NewServer()
+	flag.StringVar(&s.Listen.Addr, "addr", "",
+		"address to bind, 0.0.0.0 or :: for all interfaces (default the web certificate name)")
+	flag.IntVar(&s.Listen.Port, "port", 0, "HTTPS port (default 443)")
+	flag.IntVar(&s.Listen.HTTPPort, "http", 0, "plain HTTP port redirecting to HTTPS (default none)")
+	flag.IntVar(&s.Listen.SetupPort, "setup", 0, "setup wizard HTTP port (default 80)")
+	flag.StringVar(&s.Listen.BaseURL, "url", "", "public base URL (default https://<addr>:<port>)")
+	sessions := flag.String("sessions", webca.SESSIONS_DIR,
+		"directory keeping the web sessions across restarts, empty to keep them in memory only")
+	flag.Parse()
+	if *sessions == "" {
+		s.Sessions = webca.NewMemorySessionStore()
+	} else {
+		st, err := webca.NewFileSessionStore(*sessions)
+		if err != nil {
+			log.Fatalf("Could not open the sessions store!: %s", err)
+		}
+		s.Sessions = st
+	}
+	if err := s.Start(); err != nil {
+		log.Fatalf("Could not start!: %s", err)
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		s.Shutdown(context.Background())
+	}()
+	if err := s.Wait(); err != nil {
+		log.Fatalf("Server failed!: %s", err)
+	}
 }
-
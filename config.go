@@ -1,10 +1,12 @@
 package webca
 
 import (
+	"crypto/rsa"
 	"encoding/gob"
 	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,23 +19,55 @@ var oneCfg sync.RWMutex
 // cachedCfg prevents from reading the config from file too many times
 var cachedCfg *config
 
+// init registers the key types found in certificates so that gob can save them in the config
+func init() {
+	gob.Register(&rsa.PublicKey{})
+}
+
 // User contains the App's User details
 type User struct {
 	Username, Fullname, Password, Email string
+	Role                                string    // see roles.go, "" for admins
+	TOTPSecret                          string    // base32 TOTP secret, "" if not enrolled
+	TOTPLast                            int64     // last TOTP time step used, to prevent replays
+	RecoveryCodes                       []string  // unused one-time recovery codes (hashed)
+	Source                              string    // Authenticator of the user, "" for local users
+	LockedUntil                         time.Time // account locked after too many failed logins till then
+	ClientSerial                        string    // serial of the client certificate issued to log in, if any
+}
+
+// Listen contains the App's network settings, zero values mean defaults
+type Listen struct {
+	Addr      string // address to bind, "0.0.0.0" or "::" for all interfaces, the web cert name by default
+	Port      int    // HTTPS port
+	HTTPPort  int    // optional plain HTTP port redirecting to HTTPS and serving the public endpoints
+	SetupPort int    // plain HTTP port for the setup wizard
+	BaseURL   string // public base URL, https://<Addr or web cert name>:<Port> by default
 }
 
 // config contains the App's Configuration
 type config struct {
-	Mailer  *Mailer
-	Advance int // days before the cert. expires that the notification will be sent
-	Users   map[string]User
-	WebCert *Cert
+	Mailer         *Mailer
+	Advance        int // days before the cert. expires that the notification will be sent
+	Users          map[string]User
+	WebCert        *Cert
+	Listen         Listen
+	ClientCA       string                     // name of the CA issuing and verifying users' client certificates
+	Require2FA     map[string]bool            // roles required to log in with a second factor
+	LDAP           *LDAPConfig                // LDAP directory authenticating users, if any
+	OIDC           *OIDCConfig                // OpenID Connect provider for single sign-on, if any
+	NotifyLockouts bool                       // email the admins when an account gets locked
+	ACME           map[string]*ACMEPolicy     // CAs serving ACME, by name
+	EST            *ESTConfig                 // EST enrollment of devices, if enabled
+	SCEP           *SCEPConfig                // SCEP enrollment of network equipment, if enabled
+	Policies       map[string]*IssuancePolicy // issuance policies of the CAs, by name
 }
 
 // New Config creates a new Config
 func NewConfig(u User, cacert *Cert, cert *Cert, m Mailer) *config {
 	log.Println("cert=", cert)
-	cfg := &config{Mailer: &m, Advance: 15, Users: make(map[string]User), WebCert: cert}
+	cfg := &config{Mailer: &m, Advance: 15, Users: make(map[string]User), WebCert: cert,
+		Require2FA: make(map[string]bool)}
 	cfg.Users[u.Username] = u
 	log.Println("New Cfg=", cfg)
 	return cfg
@@ -70,6 +104,22 @@ func LoadConfig() *config {
 func (cfg *config) Save() error {
 	oneCfg.Lock()
 	defer oneCfg.Unlock()
+	return cfg.save()
+}
+
+// update applies the changes to the config and saves it, serialized with other updates and
+// with readers of its users. Nothing is saved when the changes fail
+func (cfg *config) update(change func(cfg *config) error) error {
+	oneCfg.Lock()
+	defer oneCfg.Unlock()
+	if err := change(cfg); err != nil {
+		return err
+	}
+	return cfg.save()
+}
+
+// save puts the config state into persistent storage, with oneCfg already locked
+func (cfg *config) save() error {
 	f, err := os.OpenFile(WEBCA_CFG, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		log.Println("can't open")
@@ -82,6 +132,7 @@ func (cfg *config) Save() error {
 		log.Println("can't save")
 		return err
 	}
+	cachedCfg = cfg
 	return nil
 }
 
@@ -90,8 +141,36 @@ func (cfg *config) getWebCert() Cert {
 	return *cfg.WebCert
 }
 
+// getClientCA returns the CA configured to issue and verify users' client certificates, or
+// nil if there is none or it is not dedicated to them
+func (cfg *config) getClientCA() *Cert {
+	ca := FindCert(cfg.ClientCA)
+	if ca == nil || ca.Crt == nil || !ca.Crt.IsCA || ca.Key == nil || cfg.sharedCA(cfg.ClientCA) != "" {
+		return nil
+	}
+	return ca
+}
+
+// sharedCA returns what else the named CA issues certificates for, "" if nothing: the web
+// certificate or the ACME, EST and SCEP enrollments
+func (cfg *config) sharedCA(name string) string {
+	switch {
+	case cfg.WebCert != nil && cfg.WebCert.Parent != nil && cfg.WebCert.Parent.Crt.Subject.CommonName == name:
+		return "the web certificate"
+	case cfg.ACME[name] != nil:
+		return "ACME"
+	case cfg.EST != nil && cfg.EST.CA == name:
+		return "EST"
+	case cfg.SCEP != nil && cfg.SCEP.CA == name:
+		return "SCEP"
+	}
+	return ""
+}
+
 // User returns a copy of the User named username
 func (cfg *config) getUser(username string) User {
+	oneCfg.RLock()
+	defer oneCfg.RUnlock()
 	return cfg.Users[username]
 }
 
@@ -0,0 +1,179 @@
+package webca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NameConstraints limits the names a CA, and the CAs under it, can certify (RFC 5280 4.2.1.10).
+// Domains match their subdomains too, unless they start with a dot to match subdomains only
+type NameConstraints struct {
+	PermittedDNS, ExcludedDNS       []string // DNS domains
+	PermittedIPs, ExcludedIPs       []string // CIDR ranges
+	PermittedEmails, ExcludedEmails []string // mailboxes, or the domains of their addresses
+	PermittedURIs, ExcludedURIs     []string // domains of the URI hosts
+	Critical                        bool     // whether relying parties must understand them
+}
+
+// empty tells whether the name constraints constrain nothing
+func (nc *NameConstraints) empty() bool {
+	return len(nc.PermittedDNS)+len(nc.ExcludedDNS)+len(nc.PermittedIPs)+len(nc.ExcludedIPs)+
+		len(nc.PermittedEmails)+len(nc.ExcludedEmails)+len(nc.PermittedURIs)+len(nc.ExcludedURIs) == 0
+}
+
+// apply sets the name constraints on the CA certificate template
+func (nc *NameConstraints) apply(tmpl *x509.Certificate) error {
+	ranges := func(cidrs []string) ([]*net.IPNet, error) {
+		nets := make([]*net.IPNet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("Wrong IP range %s: %s", cidr, err)
+			}
+			nets = append(nets, ipnet)
+		}
+		return nets, nil
+	}
+	var err error
+	if tmpl.PermittedIPRanges, err = ranges(nc.PermittedIPs); err != nil {
+		return err
+	}
+	if tmpl.ExcludedIPRanges, err = ranges(nc.ExcludedIPs); err != nil {
+		return err
+	}
+	tmpl.PermittedDNSDomains, tmpl.ExcludedDNSDomains = nc.PermittedDNS, nc.ExcludedDNS
+	tmpl.PermittedEmailAddresses, tmpl.ExcludedEmailAddresses = nc.PermittedEmails, nc.ExcludedEmails
+	tmpl.PermittedURIDomains, tmpl.ExcludedURIDomains = nc.PermittedURIs, nc.ExcludedURIs
+	tmpl.PermittedDNSDomainsCritical = nc.Critical
+	return nil
+}
+
+// constraintsOf returns the name constraints of the certificate, or nil if it has none
+func constraintsOf(crt *x509.Certificate) *NameConstraints {
+	cidrs := func(nets []*net.IPNet) []string {
+		ranges := make([]string, 0, len(nets))
+		for _, ipnet := range nets {
+			ranges = append(ranges, ipnet.String())
+		}
+		return ranges
+	}
+	nc := &NameConstraints{PermittedDNS: crt.PermittedDNSDomains, ExcludedDNS: crt.ExcludedDNSDomains,
+		PermittedIPs: cidrs(crt.PermittedIPRanges), ExcludedIPs: cidrs(crt.ExcludedIPRanges),
+		PermittedEmails: crt.PermittedEmailAddresses, ExcludedEmails: crt.ExcludedEmailAddresses,
+		PermittedURIs: crt.PermittedURIDomains, ExcludedURIs: crt.ExcludedURIDomains,
+		Critical: crt.PermittedDNSDomainsCritical}
+	if nc.empty() {
+		return nil
+	}
+	return nc
+}
+
+// matchDomain tells whether the host is in the domain constraint
+func matchDomain(host, domain string) bool {
+	host, domain = strings.ToLower(host), strings.ToLower(domain)
+	if strings.HasPrefix(domain, ".") {
+		return strings.HasSuffix(host, domain)
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// matchEmail tells whether the email address is the mailbox or in the domain constraint
+func matchEmail(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+	return matchDomain(email[strings.LastIndex(email, "@")+1:], constraint)
+}
+
+// nameViolations returns why the name of a kind breaks the permitted and excluded constraints
+func nameViolations(kind, name string, permitted, excluded []string, match func(name, constraint string) bool) []string {
+	violations := make([]string, 0)
+	ok := len(permitted) == 0
+	for _, constraint := range permitted {
+		ok = ok || match(name, constraint)
+	}
+	if !ok {
+		violations = append(violations, fmt.Sprintf("%s %s is not within the permitted %s", kind, name,
+			strings.Join(permitted, ", ")))
+	}
+	for _, constraint := range excluded {
+		if match(name, constraint) {
+			violations = append(violations, fmt.Sprintf("%s %s is within the excluded %s", kind, name, constraint))
+		}
+	}
+	return violations
+}
+
+// violations returns what the names of the certificate break of the name constraints
+func (nc *NameConstraints) violations(tmpl *x509.Certificate) []string {
+	violations := make([]string, 0)
+	dnsNames, ips := hostNames(tmpl)
+	for _, name := range dnsNames {
+		violations = append(violations, nameViolations("DNS name", name, nc.PermittedDNS, nc.ExcludedDNS, matchDomain)...)
+	}
+	for _, ip := range ips {
+		violations = append(violations, nameViolations("IP address", ip.String(), nc.PermittedIPs, nc.ExcludedIPs,
+			func(name, cidr string) bool { return inRange(net.ParseIP(name), cidr) })...)
+	}
+	for _, email := range tmpl.EmailAddresses {
+		violations = append(violations, nameViolations("email", email, nc.PermittedEmails, nc.ExcludedEmails, matchEmail)...)
+	}
+	for _, uri := range tmpl.URIs {
+		violations = append(violations, nameViolations("URI", uri.String(), nc.PermittedURIs, nc.ExcludedURIs,
+			func(_, domain string) bool { return matchDomain(uri.Hostname(), domain) })...)
+	}
+	return violations
+}
+
+// checkConstraints checks the names of the certificate the CA is about to issue against the
+// name constraints of the CA and the CAs above it
+func checkConstraints(ca *Cert, tmpl *x509.Certificate) error {
+	for p := ca; p != nil && p.Crt != nil; p = p.Parent {
+		if nc := constraintsOf(p.Crt); nc != nil {
+			if violations := nc.violations(tmpl); len(violations) > 0 {
+				return &PolicyError{Rule: "name constraints", CA: p.Crt.Subject.CommonName,
+					Name: tmpl.Subject.CommonName, Violations: violations}
+			}
+		}
+		if p.Parent == p {
+			break
+		}
+	}
+	return nil
+}
+
+// checkIssuance checks the certificate the CA is about to issue for the public key and days
+// against the name constraints above it and its issuance policy
+func checkIssuance(ca *Cert, tmpl *x509.Certificate, pub interface{}, days int) error {
+	if err := checkConstraints(ca, tmpl); err != nil {
+		return err
+	}
+	return checkPolicy(ca, tmpl, pub, days)
+}
+
+// readConstraints reads the name constraints of the prefixed form fields, nil if there are none
+func readConstraints(prefix string, r *http.Request) (*NameConstraints, error) {
+	nc := &NameConstraints{
+		PermittedDNS:    splitNames(r.FormValue(prefix + ".PermittedDNS")),
+		ExcludedDNS:     splitNames(r.FormValue(prefix + ".ExcludedDNS")),
+		PermittedIPs:    splitNames(r.FormValue(prefix + ".PermittedIPs")),
+		ExcludedIPs:     splitNames(r.FormValue(prefix + ".ExcludedIPs")),
+		PermittedEmails: splitNames(r.FormValue(prefix + ".PermittedEmails")),
+		ExcludedEmails:  splitNames(r.FormValue(prefix + ".ExcludedEmails")),
+		PermittedURIs:   splitNames(r.FormValue(prefix + ".PermittedURIs")),
+		ExcludedURIs:    splitNames(r.FormValue(prefix + ".ExcludedURIs")),
+		Critical:        r.FormValue(prefix+".Critical") != "",
+	}
+	if nc.empty() {
+		return nil, nil
+	}
+	for _, cidr := range append(append([]string{}, nc.PermittedIPs...), nc.ExcludedIPs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf(tr("Wrong IP range %s, use CIDR notation as in 10.0.0.0/8!", cidr))
+		}
+	}
+	return nc, nil
+}
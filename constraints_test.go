@@ -0,0 +1,133 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConstraintViolations(t *testing.T) {
+	nc := &NameConstraints{PermittedDNS: []string{"example.com", ".partner.com"}, ExcludedDNS: []string{"secret.example.com"},
+		PermittedIPs: []string{"10.0.0.0/8"}, PermittedEmails: []string{"example.com", "boss@partner.com"},
+		ExcludedURIs: []string{"evil.org"}}
+	for i, test := range []struct {
+		dnsName, ip, email, uri string
+		violation               string
+	}{
+		{"www.example.com", "", "", "", ""},
+		{"partner.com", "", "", "", "DNS name partner.com is not within the permitted"},
+		{"www.partner.com", "", "", "", ""},
+		{"db.secret.example.com", "", "", "", "is within the excluded secret.example.com"},
+		{"", "10.1.1.1", "", "", ""},
+		{"", "192.168.1.1", "", "", "IP address 192.168.1.1 is not within the permitted 10.0.0.0/8"},
+		{"", "", "someone@mail.example.com", "", ""},
+		{"", "", "other@partner.com", "", "email other@partner.com is not within the permitted"},
+		{"", "", "boss@partner.com", "", ""},
+		{"", "", "", "https://api.evil.org/x", "URI https://api.evil.org/x is within the excluded evil.org"},
+	} {
+		tmpl := &x509.Certificate{Subject: pkix.Name{CommonName: "test"}}
+		if test.dnsName != "" {
+			tmpl.DNSNames = []string{test.dnsName}
+		}
+		if test.ip != "" {
+			tmpl.IPAddresses = []net.IP{net.ParseIP(test.ip)}
+		}
+		if test.email != "" {
+			tmpl.EmailAddresses = []string{test.email}
+		}
+		if test.uri != "" {
+			u, err := url.Parse(test.uri)
+			dieOnError(t, err)
+			tmpl.URIs = []*url.URL{u}
+		}
+		violations := strings.Join(nc.violations(tmpl), "; ")
+		if (test.violation == "" && violations != "") || !strings.Contains(violations, test.violation) {
+			t.Errorf("%d: expected %q violation, got %q", i, test.violation, violations)
+		}
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		nc := &NameConstraints{PermittedDNS: []string{"partner.com"}, ExcludedIPs: []string{"0.0.0.0/0"}, Critical: true}
+		_, err := GenIntermediateCert(FindCert("TestCA"), "PartnerCA", 365, nc)
+		dieOnError(t, err)
+		partner := FindCert("PartnerCA")
+		if partner == nil || !partner.Crt.IsCA || partner.Key == nil || partner.Parent != FindCert("TestCA") {
+			t.Fatalf("Unexpected intermediate CA %v", partner)
+		}
+		if got := constraintsOf(partner.Crt); got == nil || got.PermittedDNS[0] != "partner.com" ||
+			got.ExcludedIPs[0] != "0.0.0.0/0" || !got.Critical {
+			t.Fatalf("Unexpected name constraints %v", got)
+		}
+
+		leaf, err := GenCert(partner, "www.partner.com", 30)
+		dieOnError(t, err)
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(FindCert("TestCA").Crt)
+		intermediates.AddCert(partner.Crt)
+		if _, err := leaf.Crt.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+			t.Fatalf("Failed to verify the chain of the leaf: %v", err)
+		}
+		if _, err := GenCert(partner, "www.example.com", 30); err == nil ||
+			!strings.Contains(err.Error(), "breaks the name constraints of PartnerCA") {
+			t.Fatalf("Issued a name out of the name constraints: %v", err)
+		}
+		if FindCert("www.example.com") != nil {
+			t.Fatal("Kept a certificate forbidden by the name constraints")
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		dieOnError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "api"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, key)
+		dieOnError(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		dieOnError(t, err)
+		if _, err := SignCSR(partner, csr.Subject, csr, 30); err == nil || !strings.Contains(err.Error(), "10.0.0.1 is within the excluded") {
+			t.Fatalf("Signed a CSR out of the name constraints: %v", err)
+		}
+
+		renewed, err := RenewCert(partner)
+		dieOnError(t, err)
+		if !renewed.Crt.IsCA || constraintsOf(renewed.Crt) == nil {
+			t.Fatal("Renewal lost the CA flag or the name constraints")
+		}
+	})
+}
+
+func TestGenIntermediate(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+
+		admin, token := loggedClient(t, webca.URL, "admin", "admin")
+		token = getCSRF(t, admin, webca.URL+"/cert?parent=TestCA")
+		form := url.Values{"parent": {"TestCA"}, "Cert.CommonName": {"www.example.com"}, "Cert.Duration": {"365"},
+			"Cert.PermittedDNS": {"example.com"}}
+		if _, body := postRequestForm(t, admin, webca.URL+"/gen", token, form); !strings.Contains(body, "Only CAs can have name constraints") {
+			t.Fatal("Generated a leaf certificate with name constraints")
+		}
+		form.Set("Cert.CommonName", "DeptCA")
+		form.Set("Cert.IsCA", "on")
+		postRequestForm(t, admin, webca.URL+"/gen", token, form)
+		dept := FindCert("DeptCA")
+		if dept == nil || !dept.Crt.IsCA || len(dept.Crt.PermittedDNSDomains) != 1 {
+			t.Fatalf("Unexpected intermediate CA %v", dept)
+		}
+		if _, body := postRequestForm(t, admin, webca.URL+"/certControl", token, url.Values{"cert": {"DeptCA"}}); !strings.Contains(body, "Permitted domains: example.com") {
+			t.Fatal("Name constraints not shown")
+		}
+	})
+}
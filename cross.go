@@ -0,0 +1,270 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const CROSS_DIR = ".webca.cross" // cross certificates of each CA, on a dir per name
+
+// crossFile returns the file of the cross certificate of the named CA issued by the signer
+func crossFile(certname, signer string) string {
+	return filepath.Join(CROSS_DIR, filename(certname), filename(signer)+CERT_SUFFIX)
+}
+
+// CrossSign issues a cross certificate for the subject and public key of the CA signed by
+// another CA, valid while both are. The CA gets the signer as another issuer, so clients
+// trusting only the signer can still build a chain to it
+func CrossSign(ca, signer *Cert) (*Cert, error) {
+	certname, signername := ca.Crt.Subject.CommonName, signer.Crt.Subject.CommonName
+	if !ca.Crt.IsCA {
+		return nil, fmt.Errorf("Can't cross-sign %s, it is not a CA", certname)
+	}
+	if !signer.Crt.IsCA || signer.Key == nil {
+		return nil, fmt.Errorf("Can't cross-sign with %s", signername)
+	}
+	for p := signer; p != nil; p = p.Parent {
+		if p == ca {
+			return nil, fmt.Errorf("Can't cross-sign %s with itself or its subordinate %s", certname, signername)
+		}
+		if p.Parent == p {
+			break
+		}
+	}
+	notAfter := ca.Crt.NotAfter
+	if signer.Crt.NotAfter.Before(notAfter) {
+		notAfter = signer.Crt.NotAfter
+	}
+	der, err := signCross(ca, signer, notAfter)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the created Certificate: %s", err)
+	}
+	file := crossFile(certname, signername)
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("Failed to write "+file+": %s", err)
+	}
+	invalidateCertree()
+	return &Cert{Crt: crt, Parent: signer}, nil
+}
+
+// signCross signs a certificate for the subject and public key of the CA with the signer, valid
+// until notAfter, after checking it against the signer's policy and the lint rules
+func signCross(ca, signer *Cert, notAfter time.Time) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(9223372036854775807))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate random serial number: %s", err)
+	}
+	now := time.Now()
+	tmpl := *ca.Crt // same subject, key identifier, usages, constraints and extensions
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = now.Add(-5 * time.Minute).UTC()
+	tmpl.NotAfter = notAfter
+	tmpl.SignatureAlgorithm = x509.UnknownSignatureAlgorithm // the one suiting the signer's key
+	tmpl.AuthorityKeyId = signer.Crt.SubjectKeyId
+	days := int(tmpl.NotAfter.Sub(now).Hours() / 24)
+	if err := checkIssuance(signer, &tmpl, ca.Crt.PublicKey, days); err != nil {
+		return nil, err
+	}
+	if err := checkLint(&tmpl, ca.Crt.PublicKey, signer.Crt); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, signer.Crt, ca.Crt.PublicKey, signer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to cross-sign %s: %s", ca.Crt.Subject.CommonName, err)
+	}
+	return der, nil
+}
+
+// loadCross links the cross certificates of the CAs in the tree to their signers, skipping
+// those for a key the CA no longer has
+func (ct *Certree) loadCross() {
+	for name, c := range ct.names {
+		if c.Crt.Raw == nil || !c.Crt.IsCA {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(CROSS_DIR, filename(name), "*"+CERT_SUFFIX))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				log.Printf("(Warning) Failed to read %s: %v", file, err)
+				continue
+			}
+			b, _ := pem.Decode(data)
+			if b == nil {
+				log.Printf("(Warning) Failed to find a certificate in %s", file)
+				continue
+			}
+			crt, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				log.Printf("(Warning) Failed to parse certificate %s: %v", file, err)
+				continue
+			}
+			signer := ct.issuerOf(crt)
+			if signer == nil || signer == c || !bytes.Equal(crt.RawSubjectPublicKeyInfo, c.Crt.RawSubjectPublicKeyInfo) {
+				continue // signer gone or CA re-keyed
+			}
+			c.Cross = append(c.Cross, &Cert{Crt: crt, Parent: signer})
+		}
+	}
+}
+
+// Chain is a certification path from a certificate up to a root
+type Chain struct {
+	Via   string // the CAs cross-signing the certificate or those above it on the way, if any
+	Certs []*x509.Certificate
+}
+
+// issuance is a certificate for a CA, its own or a cross certificate, and its signer
+type issuance struct {
+	crt    *x509.Certificate
+	signer *Cert // nil when self signed or unknown
+	cross  bool
+}
+
+// issuances returns the certificates of the CA: its own and then its cross certificates
+func issuances(c *Cert) []issuance {
+	signer := c.Parent
+	if signer == c || (signer != nil && signer.Crt.Raw == nil) {
+		signer = nil
+	}
+	list := []issuance{{c.Crt, signer, false}}
+	for _, x := range c.Cross {
+		list = append(list, issuance{x.Crt, x.Parent, true})
+	}
+	return list
+}
+
+// Chains returns the certification paths of the certificate: through its issuers first, and
+// then through the CAs cross-signing it or any CA above it
+func Chains(c *Cert) []Chain {
+	chains := make([]Chain, 0)
+	seen := map[*Cert]bool{c: true}
+	for _, is := range issuances(c) {
+		chains = append(chains, chainsOf(is, nil, seen)...)
+	}
+	return chains
+}
+
+// chainsOf returns the certification paths from the issued certificate up to a root, avoiding
+// the CAs already seen on the way
+func chainsOf(is issuance, via []string, seen map[*Cert]bool) []Chain {
+	if is.cross {
+		via = append(via[:len(via):len(via)], is.signer.Crt.Subject.CommonName)
+	}
+	if is.signer == nil {
+		return []Chain{{Via: strings.Join(via, ", "), Certs: []*x509.Certificate{is.crt}}}
+	}
+	if seen[is.signer] {
+		return nil
+	}
+	seen[is.signer] = true
+	defer delete(seen, is.signer)
+	chains := make([]Chain, 0)
+	for _, up := range issuances(is.signer) {
+		for _, chain := range chainsOf(up, via, seen) {
+			chains = append(chains, Chain{Via: chain.Via, Certs: append([]*x509.Certificate{is.crt}, chain.Certs...)})
+		}
+	}
+	return chains
+}
+
+// crossSignCA cross-signs the CA with the signer chosen
+func crossSignCA(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	signer, err := FindCertOrFail(r.FormValue("signer"))
+	var x *Cert
+	if err == nil {
+		x, err = CrossSign(c, signer)
+	}
+	auditCert(r, "crossSign", name, x, err)
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else {
+		c = FindCert(name)
+	}
+	certControlPage(w, r, ps, c)
+}
+
+// crossServer serves the cross certificate of a CA by a signer
+func crossServer(w http.ResponseWriter, r *http.Request) {
+	c := FindCert(r.FormValue("cert"))
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, x := range c.Cross {
+		if signer := x.Parent.Crt.Subject.CommonName; signer == r.FormValue("signer") {
+			w.Header().Set("Content-disposition",
+				"attachment; filename="+c.Crt.Subject.CommonName+"-by-"+signer+CERT_SUFFIX)
+			w.Header().Set("Content-type", "application/x-pem-file")
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: x.Crt.Raw})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// chainServer serves the certification path of a certificate via the cross-signing CAs given,
+// if any, as PEM
+func chainServer(w http.ResponseWriter, r *http.Request) {
+	c := FindCert(r.FormValue("cert"))
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, chain := range Chains(c) {
+		if chain.Via == r.FormValue("via") {
+			w.Header().Set("Content-disposition", "attachment; filename="+c.Crt.Subject.CommonName+"-chain"+CERT_SUFFIX)
+			w.Header().Set("Content-type", "application/x-pem-file")
+			for _, crt := range chain.Certs {
+				pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+			}
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// setCross sets the certification paths of the certificate on its page and, for a CA, the
+// CAs that could cross-sign it
+func setCross(ps PageStatus, c *Cert) {
+	ps["Chains"] = Chains(c)
+	signers := make([]string, 0)
+	if c.Crt.IsCA {
+		for _, name := range issuingCAs() {
+			if name != c.Crt.Subject.CommonName {
+				signers = append(signers, name)
+			}
+		}
+	}
+	ps["CrossSigners"] = signers
+}
@@ -0,0 +1,79 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCrossSign(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		_, err := GenCACert(pkix.Name{CommonName: "NewRoot"}, 730)
+		dieOnError(t, err)
+		_, err = GenCert(FindCert("NewRoot"), "www.example.com", 90)
+		dieOnError(t, err)
+		_, err = GenIntermediateCert(FindCert("NewRoot"), "SubCA", 365, nil)
+		dieOnError(t, err)
+		if _, err := CrossSign(FindCert("NewRoot"), FindCert("SubCA")); err == nil {
+			t.Fatal("Cross-signed a CA with its own subordinate")
+		}
+
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+		admin, token := loggedClient(t, webca.URL, "admin", "admin")
+		token = getCSRF(t, admin, webca.URL+"/certControl?cert=NewRoot")
+		_, body := postRequestForm(t, admin, webca.URL+"/crossSign", token, url.Values{"cert": {"NewRoot"}, "signer": {"TestCA"}})
+		if !strings.Contains(body, "signer=TestCA") {
+			t.Fatal("Cross certificate not shown")
+		}
+		newRoot := FindCert("NewRoot")
+		if len(newRoot.Cross) != 1 || newRoot.Cross[0].Parent != FindCert("TestCA") || newRoot.Parent != newRoot {
+			t.Fatalf("Unexpected issuers of the cross-signed CA %v", newRoot.Cross)
+		}
+		resp, err := admin.Get(webca.URL + "/")
+		dieOnError(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		dieOnError(t, err)
+		if !strings.Contains(string(data), "also issued by TestCA") {
+			t.Fatal("Cross-signing CA not shown in the tree")
+		}
+		_, err = CrossSign(FindCert("TestCA"), FindCert("NewRoot")) // both ways
+		dieOnError(t, err)
+
+		leaf := FindCert("www.example.com")
+		chains := Chains(leaf)
+		if len(chains) != 2 || chains[0].Via != "" || len(chains[0].Certs) != 2 || chains[1].Via != "TestCA" {
+			t.Fatalf("Unexpected chains %v", chains)
+		}
+		resp, err = admin.Get(webca.URL + "/chain?cert=www.example.com&via=TestCA")
+		dieOnError(t, err)
+		data, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		dieOnError(t, err)
+		crts := make([]*x509.Certificate, 0)
+		for b, rest := pem.Decode(data); b != nil; b, rest = pem.Decode(rest) {
+			crt, err := x509.ParseCertificate(b.Bytes)
+			dieOnError(t, err)
+			crts = append(crts, crt)
+		}
+		if len(crts) != 3 || crts[2].Subject.CommonName != "TestCA" {
+			t.Fatalf("Unexpected chain via TestCA %v", crts)
+		}
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(crts[2])
+		intermediates.AddCert(crts[1])
+		if _, err := crts[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+			t.Fatalf("Leaf of the new root does not verify against the old one: %v", err)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package webca
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	CSRFTOKEN = "CSRFToken" // session key and page attribute of the session's CSRF token
+	CSRFFIELD = "_csrf"     // form field carrying the CSRF token
+)
+
+// requestCSRFToken returns the CSRF token of the request's session, or "" if it has none
+func requestCSRFToken(r *http.Request) string {
+	id, err := requestSessionId(r)
+	if err != nil || id == "" {
+		return ""
+	}
+	smutex.RLock()
+	defer smutex.RUnlock()
+	if ss, err := sessionStore.Get(id); err == nil && ss != nil {
+		return ss.Values[CSRFTOKEN]
+	}
+	return ""
+}
+
+// validCSRF tells whether the request was posted with the session's CSRF token
+func validCSRF(r *http.Request, s session) bool {
+	token := s[CSRFTOKEN]
+	posted := r.PostFormValue(CSRFFIELD)
+	return r.Method == "POST" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(posted), []byte(token)) == 1
+}
+
+// checkCSRF refuses POST requests without the session's CSRF token, returning false if so
+func checkCSRF(w http.ResponseWriter, r *http.Request, s session) bool {
+	if r.Method == "POST" && !validCSRF(r, s) {
+		http.Error(w, tr("Invalid or expired form, reload the page and try again"), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// postOnly invokes handler f ONLY IF the request is a POST with the session's CSRF token, as
+// all requests changing state must be
+func postOnly(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, tr("Method Not Allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := SessionFor(w, r)
+		if handleError(w, r, err) {
+			return
+		}
+		if checkCSRF(w, r, s) {
+			f(w, r)
+		}
+	})
+}
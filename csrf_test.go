@@ -0,0 +1,91 @@
+package webca
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+// csrfInput finds the CSRF token on a page
+var csrfInput = regexp.MustCompile(`name="_csrf" value="([^"]+)"`)
+
+// getCSRF gets the page at url and returns the CSRF token on it
+func getCSRF(t *testing.T, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	dieOnError(t, err)
+	defer resp.Body.Close()
+	page, err := ioutil.ReadAll(resp.Body)
+	dieOnError(t, err)
+	m := csrfInput.FindSubmatch(page)
+	if m == nil {
+		t.Fatalf("No CSRF token on %s:\n%s", url, page)
+	}
+	return string(m[1])
+}
+
+func TestCSRF(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+		jar, err := cookiejar.New(nil)
+		dieOnError(t, err)
+		client := &http.Client{Jar: jar}
+		u, _ := url.Parse(webca.URL)
+		token := getCSRF(t, client, webca.URL+"/")
+		before := jar.Cookies(u)[0]
+		if before.Value == "" {
+			t.Fatal("No session cookie")
+		}
+		resp, err := client.PostForm(webca.URL+"/login", url.Values{"Username": {"admin"}, "Password": {"admin"}})
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Login without CSRF token was not refused: %s", resp.Status)
+		}
+		resp, err = client.PostForm(webca.URL+"/login",
+			url.Values{"Username": {"admin"}, "Password": {"admin"}, CSRFFIELD: {token}})
+		dieOnError(t, err)
+		resp.Body.Close()
+		if after := jar.Cookies(u)[0]; after.Value == before.Value {
+			t.Fatal("Session ID was not rotated on login")
+		}
+		resp, err = client.Get(webca.URL + "/renew?cert=localhost")
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("Renew by GET was not refused: %s", resp.Status)
+		}
+		resp, err = client.PostForm(webca.URL+"/renew", url.Values{"cert": {"localhost"}, CSRFFIELD: {token}})
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Renew with the CSRF token from before logging in was not refused: %s", resp.Status)
+		}
+		token = getCSRF(t, client, webca.URL+"/certControl?cert=localhost")
+		serial := FindCert("localhost").Crt.SerialNumber
+		resp, err = client.PostForm(webca.URL+"/renew", url.Values{"cert": {"localhost"}, CSRFFIELD: {token}})
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || FindCert("localhost").Crt.SerialNumber.Cmp(serial) == 0 {
+			t.Fatalf("Renew with the CSRF token failed: %s", resp.Status)
+		}
+	})
+}
+
+func TestSessionCookie(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "https://localhost/", nil)
+	_, err := SessionFor(w, r)
+	dieOnError(t, err)
+	c := w.Result().Cookies()[0]
+	if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Session cookie not hardened: %s", w.Header().Get("Set-Cookie"))
+	}
+}
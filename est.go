@@ -0,0 +1,340 @@
+package webca
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	EST_PATH        = "/.well-known/est/"
+	EST_DAYS        = 365 // default validity of the certificates enrolled
+	EST_MAX_REQUEST = 64 * 1024
+
+	EST_CLIENT = "client" // profile of certificates for TLS client authentication
+	EST_SERVER = "server" // profile of certificates for TLS servers
+	EST_DEVICE = "device" // profile of certificates for both
+)
+
+// estProfiles maps the EST profiles to the extended key usages of the certificates enrolled
+var estProfiles = map[string][]x509.ExtKeyUsage{
+	EST_CLIENT: {x509.ExtKeyUsageClientAuth},
+	EST_SERVER: {x509.ExtKeyUsageServerAuth},
+	EST_DEVICE: {x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+}
+
+// ESTConfig enrolls devices with certificates of a CA through EST (RFC 7030)
+type ESTConfig struct {
+	CA      string            // name of the CA issuing the devices' certificates
+	Profile string            // EST_CLIENT, EST_SERVER or EST_DEVICE, EST_CLIENT by default
+	Days    int               // validity of the certificates enrolled, EST_DAYS by default
+	Devices map[string]string // crypted passwords of the devices, by name
+}
+
+// days returns the validity of the certificates enrolled
+func (ec *ESTConfig) days() int {
+	if ec.Days > 0 {
+		return ec.Days
+	}
+	return EST_DAYS
+}
+
+// usages returns the extended key usages of the certificates enrolled
+func (ec *ESTConfig) usages() []x509.ExtKeyUsage {
+	if usages, ok := estProfiles[ec.Profile]; ok {
+		return usages
+	}
+	return estProfiles[EST_CLIENT]
+}
+
+// getCA returns the CA enrolling the devices, or nil if it can't issue certificates
+func (ec *ESTConfig) getCA() *Cert {
+	ca := FindCert(ec.CA)
+	if ca == nil || ca.Crt == nil || !ca.Crt.IsCA || ca.Key == nil {
+		return nil
+	}
+	return ca
+}
+
+// DeviceNames returns the names of the devices with EST credentials, sorted
+func (ec *ESTConfig) DeviceNames() []string {
+	names := make([]string, 0, len(ec.Devices))
+	for name := range ec.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// estServer serves the EST endpoints enrolling devices under the configured CA
+func estServer(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.EST == nil || cfg.EST.getCA() == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ca := cfg.EST.getCA()
+	switch operation := strings.TrimPrefix(r.URL.Path, EST_PATH); operation {
+	case "cacerts":
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		chain := []*x509.Certificate{ca.Crt}
+		for p := ca; p.Parent != nil && p.Parent != p && p.Parent.Crt.Raw != nil; p = p.Parent {
+			chain = append(chain, p.Parent.Crt)
+		}
+		estReply(w, chain...)
+	case "simpleenroll", "simplereenroll":
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		estEnroll(w, r, cfg, ca, operation == "simplereenroll")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// estReply sends the certificates as EST does
+func estReply(w http.ResponseWriter, crts ...*x509.Certificate) {
+	der, err := certsOnly(crts...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(der)))
+}
+
+// estClientCert returns the current certificate the client authenticated with, if it was issued
+// by the EST CA
+func estClientCert(r *http.Request, ca *Cert) *Cert {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return currentCert(r.TLS.PeerCertificates[0], ca)
+}
+
+// currentCert returns the Cert of crt if it was issued by the CA and has not been superseded
+func currentCert(crt *x509.Certificate, ca *Cert) *Cert {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Crt)
+	if _, err := crt.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil
+	}
+	c := FindCert(crt.Subject.CommonName)
+	if c == nil || !c.Crt.Equal(crt) { // superseded certificates can't enroll anymore
+		return nil
+	}
+	return c
+}
+
+// estDevice returns the name of the device authenticated with HTTP basic credentials, or ""
+func estDevice(r *http.Request, cfg *config) (string, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	now := time.Now()
+	keys := []string{"device:" + name, ipKey(clientIP(r))}
+	if wait := guard.wait(now, keys...); wait > 0 {
+		return "", fmt.Errorf(tr("Too many failed logins, try again in %s", wait.Round(time.Second)))
+	}
+	crypted, ok := cfg.EST.Devices[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(crypted), []byte(crypt(password))) != 1 {
+		guard.fail(now, keys...)
+		recordLoginFailure("device:"+name, clientIP(r), "EST")
+		return "", nil
+	}
+	guard.reset(keys...)
+	return name, nil
+}
+
+// estEnroll issues a certificate for the CSR of an authenticated device. Devices authenticate
+// with their HTTP basic credentials or with their current certificate, which is required to
+// re-enroll keeping the same subject and alternative names
+func estEnroll(w http.ResponseWriter, r *http.Request, cfg *config, ca *Cert, reenroll bool) {
+	identity, current := "", estClientCert(r, ca)
+	if current != nil {
+		identity = current.Crt.Subject.CommonName
+	} else if !reenroll {
+		device, err := estDevice(r, cfg)
+		if err != nil {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		identity = device
+	}
+	if identity == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="WebCA EST"`)
+		http.Error(w, tr("Access Denied"), http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, EST_MAX_REQUEST))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		http.Error(w, "Wrong CSR encoding", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Wrong CSR: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := estCheckCSR(csr, identity, current, reenroll); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := csr.Subject
+	name.CommonName = identity
+	c, err := SignCSR(ca, name, csr, cfg.EST.days(), cfg.EST.usages()...)
+	action := "estEnroll"
+	if reenroll {
+		action = "estReenroll"
+	}
+	e := AuditEntry{User: "device:" + identity, IP: clientIP(r), Action: action, Target: identity, Outcome: AUDIT_OK}
+	if err != nil {
+		e.Outcome, e.Detail = AUDIT_FAILED, err.Error()
+		record(e)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.Serial = serialOf(c.Crt)
+	record(e)
+	estReply(w, c.Crt)
+}
+
+// estCheckCSR checks the CSR asks for the device's identity and, on re-enrollment, for the
+// same subject and alternative names of its current certificate
+func estCheckCSR(csr *x509.CertificateRequest, identity string, current *Cert, reenroll bool) error {
+	if csr.Subject.CommonName != "" && csr.Subject.CommonName != identity {
+		return fmt.Errorf("CSR subject %s is not %s", csr.Subject.CommonName, identity)
+	}
+	if !reenroll {
+		return nil
+	}
+	if !sameIdentity(csr, current.Crt) {
+		return fmt.Errorf("CSR must keep the subject and alternative names of %s", identity)
+	}
+	return nil
+}
+
+// sameIdentity tells whether the CSR keeps the subject and alternative names of the certificate
+func sameIdentity(csr *x509.CertificateRequest, crt *x509.Certificate) bool {
+	return csr.Subject.String() == crt.Subject.String() &&
+		sameNames(csr.DNSNames, crt.DNSNames) && sameNames(csr.EmailAddresses, crt.EmailAddresses) &&
+		fmt.Sprint(csr.IPAddresses) == fmt.Sprint(crt.IPAddresses) && fmt.Sprint(csr.URIs) == fmt.Sprint(crt.URIs)
+}
+
+// sameNames tells whether both lists hold the same names, in any order
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// setEST sets the EST settings on the page of the CA enrolling the devices
+func setEST(ps PageStatus, c *Cert) {
+	cfg := LoadConfig()
+	ps["EST"], ps["ESTURL"], ps["ESTProfiles"] = nil, "", []string{EST_CLIENT, EST_SERVER, EST_DEVICE}
+	if cfg.EST != nil && cfg.EST.CA == c.Crt.Subject.CommonName {
+		ps["EST"] = cfg.EST
+		if cfg.WebCert != nil {
+			ps["ESTURL"] = cfg.Listen.baseURL(cfg) + EST_PATH
+		}
+	}
+}
+
+// est applies the EST action requested on the CA: enabling, disabling or managing the devices
+func est(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	cfg := LoadConfig()
+	action := r.FormValue("action")
+	err = applyESTAction(cfg, c, action, r)
+	if err == nil {
+		err = cfg.Save()
+	}
+	target := c.Crt.Subject.CommonName
+	if device := r.FormValue("Device"); device != "" {
+		target = device
+	}
+	record(requestEntry(r, "est."+action, target, err))
+	if err != nil {
+		ps["Error"] = err.Error()
+	}
+	certControlPage(w, r, ps, c)
+}
+
+// applyESTAction applies the EST action requested on the config for the CA
+func applyESTAction(cfg *config, c *Cert, action string, r *http.Request) error {
+	name := c.Crt.Subject.CommonName
+	if action == "enable" {
+		if !c.Crt.IsCA || c.Key == nil {
+			return fmt.Errorf(tr("%s can't issue certificates!", name))
+		}
+		est := &ESTConfig{CA: name, Profile: r.FormValue("Profile"), Devices: make(map[string]string)}
+		if _, ok := estProfiles[est.Profile]; !ok {
+			return fmt.Errorf(tr("Unknown profile %s!", est.Profile))
+		}
+		if days := r.FormValue("Days"); days != "" {
+			if _, err := fmt.Sscan(days, &est.Days); err != nil || est.Days < 1 {
+				return fmt.Errorf(tr("Wrong validity days %s!", days))
+			}
+		}
+		if cfg.EST != nil && cfg.EST.CA == name {
+			est.Devices = cfg.EST.Devices
+		}
+		cfg.EST = est
+		return nil
+	}
+	if cfg.EST == nil || cfg.EST.CA != name {
+		return fmt.Errorf(tr("%s does not enroll devices through EST!", name))
+	}
+	device := r.FormValue("Device")
+	switch action {
+	case "disable":
+		cfg.EST = nil
+	case "addDevice":
+		password := r.FormValue("Password")
+		if device == "" || strings.ContainsAny(device, ":/") || password == "" {
+			return fmt.Errorf(tr("Devices need a name without ':' or '/' and a password!"))
+		}
+		if cfg.EST.Devices == nil {
+			cfg.EST.Devices = make(map[string]string)
+		}
+		cfg.EST.Devices[device] = crypt(password)
+	case "removeDevice":
+		delete(cfg.EST.Devices, device)
+	default:
+		return fmt.Errorf(tr("Unknown EST action %s!", action))
+	}
+	return nil
+}
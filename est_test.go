@@ -0,0 +1,105 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// parseCertsOnly decodes an EST certs-only response
+func parseCertsOnly(t *testing.T, body string) []*x509.Certificate {
+	der, err := base64.StdEncoding.DecodeString(body)
+	dieOnError(t, err)
+	crts, err := readCertsOnly(der)
+	dieOnError(t, err)
+	return crts
+}
+
+// estCSR returns a base64 CSR for a new key with the subject and DNS names
+func estCSR(t *testing.T, cn string, names ...string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn}, DNSNames: names}, key)
+	dieOnError(t, err)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// estRequest serves an EST request, authenticated with the basic credentials or the client
+// certificate given, if any
+func estRequest(method, operation, body, device, password string, crt *x509.Certificate) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, EST_PATH+operation, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/pkcs10")
+	if device != "" {
+		r.SetBasicAuth(device, password)
+	}
+	if crt != nil {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{crt}}
+	}
+	w := httptest.NewRecorder()
+	estServer(w, r)
+	return w
+}
+
+func TestEST(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		web, err := GenCert(ca, "webca.test", 365)
+		dieOnError(t, err)
+		cfg := NewConfig(User{Username: "admin", Password: crypt("admin")}, ca, web, Mailer{})
+		cfg.EST = &ESTConfig{CA: "TestCA", Profile: EST_DEVICE, Days: 30,
+			Devices: map[string]string{"sensor1": crypt("secret")}}
+		dieOnError(t, cfg.Save())
+
+		w := estRequest("GET", "cacerts", "", "", "", nil)
+		if crts := parseCertsOnly(t, w.Body.String()); len(crts) != 1 || !crts[0].Equal(ca.Crt) {
+			t.Fatalf("Unexpected CA certificates %v", crts)
+		}
+		if w := estRequest("POST", "simpleenroll", estCSR(t, "sensor1"), "", "", nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Enrolled without credentials: %d", w.Code)
+		}
+		if w := estRequest("POST", "simpleenroll", estCSR(t, "sensor1"), "sensor1", "wrong", nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Enrolled with a wrong password: %d", w.Code)
+		}
+		if w := estRequest("POST", "simpleenroll", estCSR(t, "sensor2"), "sensor1", "secret", nil); w.Code != http.StatusBadRequest {
+			t.Fatalf("Enrolled a device as another one: %d", w.Code)
+		}
+		w = estRequest("POST", "simpleenroll", estCSR(t, "sensor1", "sensor1.lan"), "sensor1", "secret", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to enroll: %d %s", w.Code, w.Body)
+		}
+		first := parseCertsOnly(t, w.Body.String())[0]
+		if first.Subject.CommonName != "sensor1" || len(first.ExtKeyUsage) != 2 || first.CheckSignatureFrom(ca.Crt) != nil {
+			t.Fatalf("Unexpected enrolled certificate %v", first.Subject)
+		}
+		if c := FindCert("sensor1"); c == nil || !c.Crt.Equal(first) {
+			t.Fatal("Enrolled certificate is not in the Certree")
+		}
+
+		if w := estRequest("POST", "simplereenroll", estCSR(t, "sensor1", "sensor1.lan"), "sensor1", "secret", nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Re-enrolled without the current certificate: %d", w.Code)
+		}
+		if w := estRequest("POST", "simplereenroll", estCSR(t, "sensor1", "other.lan"), "", "", first); w.Code != http.StatusBadRequest {
+			t.Fatalf("Re-enrolled changing the names: %d", w.Code)
+		}
+		w = estRequest("POST", "simplereenroll", estCSR(t, "sensor1", "sensor1.lan"), "", "", first)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to re-enroll: %d %s", w.Code, w.Body)
+		}
+		if second := parseCertsOnly(t, w.Body.String())[0]; second.Equal(first) || second.Subject.CommonName != "sensor1" {
+			t.Fatal("Re-enrollment did not issue a new certificate")
+		}
+		if w := estRequest("POST", "simplereenroll", estCSR(t, "sensor1", "sensor1.lan"), "", "", first); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Re-enrolled with a superseded certificate: %d", w.Code)
+		}
+	})
+}
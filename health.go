@@ -0,0 +1,155 @@
+package webca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// CertHealth holds the problems found verifying a certificate against the CAs above it
+type CertHealth struct {
+	Cert     *Cert
+	Problems []string
+}
+
+// verifier verifies certificates at a given time, caching the CRLs of the CAs on the way
+type verifier struct {
+	now  time.Time
+	crls map[*Cert]*x509.RevocationList
+}
+
+// newVerifier returns a verifier for the current time
+func newVerifier() *verifier {
+	return &verifier{now: time.Now(), crls: make(map[*Cert]*x509.RevocationList)}
+}
+
+// VerifyCert verifies the certificate against the CAs above it
+func VerifyCert(c *Cert) *CertHealth {
+	return &CertHealth{Cert: c, Problems: newVerifier().verify(c)}
+}
+
+// VerifyTree verifies every certificate of the tree, sorted by name
+func VerifyTree() []*CertHealth {
+	v := newVerifier()
+	health := make([]*CertHealth, 0)
+	ct := ListCerts()
+	if ct == nil {
+		return health
+	}
+	for _, c := range ct.names {
+		if c.Crt.Raw != nil { // not just the placeholder of an unknown issuer
+			health = append(health, &CertHealth{Cert: c, Problems: v.verify(c)})
+		}
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Cert.Crt.Subject.CommonName < health[j].Cert.Crt.Subject.CommonName
+	})
+	return health
+}
+
+// problemsOf returns what is wrong with the certificate (for templates)
+func problemsOf(c *Cert) []string {
+	return newVerifier().verify(c)
+}
+
+// verify returns the problems of the certificate: a key not matching it, a signature not
+// from the key of its CA, expired certificates on its chain, outliving its CA, revoked
+// ancestors or a chain that does not build
+func (v *verifier) verify(c *Cert) []string {
+	problems := make([]string, 0)
+	if c.Key != nil && !c.Key.PublicKey.Equal(c.Crt.PublicKey) {
+		problems = append(problems, "its key does not match its public key")
+	}
+	if v.now.After(c.Crt.NotAfter) {
+		problems = append(problems, fmt.Sprintf("expired on %s", c.Crt.NotAfter.Format(MYFMT)))
+	} else if v.now.Before(c.Crt.NotBefore) {
+		problems = append(problems, fmt.Sprintf("not valid until %s", c.Crt.NotBefore.Format(MYFMT)))
+	}
+	if c.Parent == c {
+		if err := c.Crt.CheckSignature(c.Crt.SignatureAlgorithm, c.Crt.RawTBSCertificate, c.Crt.Signature); err != nil {
+			problems = append(problems, fmt.Sprintf("its self signature does not verify: %s", err))
+		}
+		return problems
+	}
+	p := c.Parent
+	if p == nil || p.Crt.Raw == nil {
+		return append(problems, fmt.Sprintf("its issuer %s is unknown", c.Crt.Issuer.CommonName))
+	}
+	ca := p.Crt.Subject.CommonName
+	if err := c.Crt.CheckSignatureFrom(p.Crt); err != nil {
+		problems = append(problems, fmt.Sprintf("its signature does not verify with the key of %s: %s", ca, err))
+	}
+	if c.Crt.NotAfter.After(p.Crt.NotAfter) {
+		problems = append(problems, fmt.Sprintf("outlives its CA %s, valid until %s", ca, p.Crt.NotAfter.Format(MYFMT)))
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for a := c; a.Parent != a; a = a.Parent {
+		if a.Parent == nil || a.Parent.Crt.Raw == nil {
+			return append(problems, fmt.Sprintf("the issuer %s of %s is unknown",
+				a.Crt.Issuer.CommonName, a.Crt.Subject.CommonName))
+		}
+		if a != c && v.now.After(a.Crt.NotAfter) {
+			problems = append(problems, fmt.Sprintf("its issuer %s expired on %s",
+				a.Crt.Subject.CommonName, a.Crt.NotAfter.Format(MYFMT)))
+		}
+		if v.revoked(a) {
+			problems = append(problems, fmt.Sprintf("%s was revoked by %s",
+				a.Crt.Subject.CommonName, a.Parent.Crt.Subject.CommonName))
+		}
+		if a.Parent.Parent == a.Parent {
+			roots.AddCert(a.Parent.Crt)
+		} else {
+			intermediates.AddCert(a.Parent.Crt)
+		}
+	}
+	if len(problems) > 0 {
+		return problems // the chain can't build either
+	}
+	if _, err := c.Crt.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: v.now,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		problems = append(problems, fmt.Sprintf("its chain does not verify: %s", err))
+	}
+	return problems
+}
+
+// revoked tells whether the certificate is listed on the CRL of its CA, when WebCA has its key
+func (v *verifier) revoked(c *Cert) bool {
+	crl, ok := v.crls[c.Parent]
+	if !ok {
+		if c.Parent.Key != nil {
+			if der, err := GenCRL(c.Parent); err == nil {
+				crl, _ = x509.ParseRevocationList(der)
+			}
+		}
+		v.crls[c.Parent] = crl
+	}
+	if crl == nil {
+		return false
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(c.Crt.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// health shows the verification report of every certificate in the tree
+func health(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	report := VerifyTree()
+	broken := 0
+	for _, h := range report {
+		if len(h.Problems) > 0 {
+			broken++
+		}
+	}
+	ps["Report"], ps["Broken"] = report, broken
+	err := templates.ExecuteTemplate(w, "health", ps)
+	handleError(w, r, err)
+}
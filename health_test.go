@@ -0,0 +1,105 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// healthOf returns the problems found for the named certificate verifying the whole tree
+func healthOf(t *testing.T, name string) string {
+	for _, h := range VerifyTree() {
+		if h.Cert.Crt.Subject.CommonName == name {
+			return strings.Join(h.Problems, "; ")
+		}
+	}
+	t.Fatalf("%s not verified", name)
+	return ""
+}
+
+func TestHealth(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		ca := FindCert("TestCA")
+		partner, err := GenIntermediateCert(ca, "PartnerCA", 365, nil)
+		dieOnError(t, err)
+		_, err = GenCert(partner, "leaf", 30)
+		dieOnError(t, err)
+		for _, h := range VerifyTree() {
+			if len(h.Problems) > 0 {
+				t.Fatalf("Unexpected problems of %s: %v", h.Cert.Crt.Subject.CommonName, h.Problems)
+			}
+		}
+
+		impostor, err := rsa.GenerateKey(rand.Reader, 1024)
+		dieOnError(t, err)
+		now := time.Now()
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(666), Subject: pkix.Name{CommonName: "forged"},
+			NotBefore: now, NotAfter: now.AddDate(0, 0, 30)}
+		lookalike := *ca.Crt // same name as the CA, another key
+		lookalike.PublicKey = &impostor.PublicKey
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, &lookalike, &impostor.PublicKey, impostor)
+		dieOnError(t, err)
+		dieOnError(t, ioutil.WriteFile("forged"+CERT_SUFFIX, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+		keyPEM, err := ioutil.ReadFile("PartnerCA" + KEY_SUFFIX)
+		dieOnError(t, err)
+		dieOnError(t, ioutil.WriteFile("leaf"+KEY_SUFFIX, keyPEM, 0600))
+		clamped, err := GenCert(partner, "clamped", 400)
+		dieOnError(t, err)
+		if !clamped.Crt.NotAfter.Equal(partner.Crt.NotAfter) {
+			t.Fatalf("Issued till %v, outliving its CA valid till %v", clamped.Crt.NotAfter, partner.Crt.NotAfter)
+		}
+		tmpl = &x509.Certificate{SerialNumber: big.NewInt(400), Subject: pkix.Name{CommonName: "long"},
+			NotBefore: now, NotAfter: now.AddDate(0, 0, 400), AuthorityKeyId: partner.Crt.SubjectKeyId}
+		der, err = x509.CreateCertificate(rand.Reader, tmpl, partner.Crt, &impostor.PublicKey, partner.Key)
+		dieOnError(t, err)
+		dieOnError(t, ioutil.WriteFile("long"+CERT_SUFFIX, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+		old, err := GenIntermediateCert(ca, "OldCA", 0, nil)
+		dieOnError(t, err)
+		_, err = GenCert(old, "orphan", 0)
+		dieOnError(t, err)
+		invalidateCertree()
+		time.Sleep(10 * time.Millisecond) // for the zero days certificates to expire
+
+		for name, problem := range map[string]string{
+			"forged": "its signature does not verify with the key of TestCA",
+			"leaf":   "its key does not match its public key",
+			"long":   "outlives its CA PartnerCA",
+			"orphan": "its issuer OldCA expired on",
+		} {
+			if problems := healthOf(t, name); !strings.Contains(problems, problem) {
+				t.Errorf("Expected %q for %s, got %q", problem, name, problems)
+			}
+		}
+		for _, name := range []string{"PartnerCA", "clamped"} {
+			if problems := healthOf(t, name); problems != "" {
+				t.Fatalf("Unexpected problems of the healthy %s: %s", name, problems)
+			}
+		}
+
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+		admin, _ := loggedClient(t, webca.URL, "admin", "admin")
+		for _, page := range []string{"/", "/health"} {
+			resp, err := admin.Get(webca.URL + page)
+			dieOnError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			dieOnError(t, err)
+			if !strings.Contains(string(body), "does not verify with the key of TestCA") {
+				t.Fatalf("Broken certificates not shown on %s", page)
+			}
+		}
+	})
+}
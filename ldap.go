@@ -0,0 +1,486 @@
+package webca
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	LDAP_SOURCE        = "ldap"
+	LDAP_TIMEOUT       = 10 * time.Second
+	LDAP_USER_FILTER   = "(uid=%s)"
+	LDAP_GROUP_ATTR    = "memberOf"
+	LDAP_NAME_ATTR     = "cn"
+	LDAP_MAIL_ATTR     = "mail"
+	LDAP_MAX_MESSAGE   = 1 << 20
+	LDAP_SCOPE_SUBTREE = 2
+)
+
+// LDAP protocol operation tags (RFC 4511)
+const (
+	ldapBindRequest     = 0
+	ldapBindResponse    = 1
+	ldapUnbindRequest   = 2
+	ldapSearchRequest   = 3
+	ldapSearchEntry     = 4
+	ldapSearchDone      = 5
+	ldapSearchReference = 19
+)
+
+// LDAPConfig contains the settings to authenticate users against an LDAP directory
+type LDAPConfig struct {
+	URL           string            // ldap://host[:port] or ldaps://host[:port]
+	CACert        string            // name of the WebCA CA trusted for ldaps://, system roots if empty
+	BindDN        string            // service account searching users, anonymous if empty
+	BindPassword  string            // service account password
+	BaseDN        string            // where to search users
+	UserFilter    string            // filter finding a user, %s is the escaped username
+	GroupAttr     string            // user attribute listing its groups' DNs
+	GroupRoles    map[string]string // group DN to WebCA role
+	LocalFallback bool              // whether local admins can still log in with their password
+}
+
+// Name identifies the Users authenticated by LDAP
+func (lc *LDAPConfig) Name() string {
+	return LDAP_SOURCE
+}
+
+// Authenticate finds the user with the service account, binds as it to check the password and
+// maps its groups to a role. Users in no mapped group are refused
+func (lc *LDAPConfig) Authenticate(username, password string) (User, error) {
+	conn, err := lc.dial()
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+	if err := conn.bind(lc.BindDN, lc.BindPassword); err != nil {
+		return User{}, fmt.Errorf("Failed to bind as %s: %s", lc.BindDN, err)
+	}
+	filter := fmt.Sprintf(withDefault(lc.UserFilter, LDAP_USER_FILTER), ldapEscape(username))
+	groupAttr := withDefault(lc.GroupAttr, LDAP_GROUP_ATTR)
+	entries, err := conn.search(lc.BaseDN, filter, LDAP_NAME_ATTR, LDAP_MAIL_ATTR, groupAttr)
+	if err != nil {
+		return User{}, fmt.Errorf("Failed to search %s: %s", filter, err)
+	}
+	if len(entries) != 1 {
+		return User{}, ErrBadCredentials
+	}
+	entry := entries[0]
+	if err := conn.bind(entry.DN, password); err == errLDAPInvalidCredentials {
+		return User{}, ErrBadCredentials
+	} else if err != nil {
+		return User{}, fmt.Errorf("Failed to bind as %s: %s", entry.DN, err)
+	}
+	role := mappedRole(lc.GroupRoles, entry.values(groupAttr))
+	if role == "" {
+		return User{}, ErrBadCredentials
+	}
+	return User{Username: username, Fullname: entry.value(LDAP_NAME_ATTR),
+		Email: entry.value(LDAP_MAIL_ATTR), Role: role, Source: LDAP_SOURCE}, nil
+}
+
+// dial connects to the LDAP server
+func (lc *LDAPConfig) dial() (*ldapConn, error) {
+	u, err := url.Parse(lc.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: LDAP_TIMEOUT}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+		tc := &tls.Config{ServerName: u.Hostname()}
+		if lc.CACert != "" {
+			ca := FindCert(lc.CACert)
+			if ca == nil {
+				return nil, fmt.Errorf("Unknown LDAP CA %s", lc.CACert)
+			}
+			tc.RootCAs = x509.NewCertPool()
+			tc.RootCAs.AddCert(ca.Crt)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tc)
+	default:
+		return nil, fmt.Errorf("Unsupported LDAP URL %s", lc.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(LDAP_TIMEOUT))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// withDefault returns value, or def if value is empty
+func withDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// ldapEscape escapes a value to be used in an LDAP filter (RFC 4515)
+func ldapEscape(value string) string {
+	var sb strings.Builder
+	for _, b := range []byte(value) {
+		if b == '*' || b == '(' || b == ')' || b == '\\' || b == 0 || b >= 0x80 {
+			fmt.Fprintf(&sb, "\\%02x", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// equalDN compares two DNs ignoring case and the spaces around separators
+func equalDN(a, b string) bool {
+	normalize := func(dn string) string {
+		parts := strings.Split(dn, ",")
+		for i, part := range parts {
+			kv := strings.SplitN(part, "=", 2)
+			for j := range kv {
+				kv[j] = strings.TrimSpace(kv[j])
+			}
+			parts[i] = strings.Join(kv, "=")
+		}
+		return strings.Join(parts, ",")
+	}
+	return strings.EqualFold(normalize(a), normalize(b))
+}
+
+// ldapConn is a minimal LDAPv3 client connection, supporting just simple binds and searches
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+// ldapMessage is the envelope of all LDAP requests and responses
+type ldapMessage struct {
+	ID       int
+	Op       asn1.RawValue
+	Controls asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// ldapResult is the result of LDAP operations
+type ldapResult struct {
+	Code      asn1.Enumerated
+	MatchedDN []byte
+	Message   []byte
+	Referral  asn1.RawValue `asn1:"optional,tag:3"`
+}
+
+// ldapBind is an LDAP simple bind request
+type ldapBind struct {
+	Version  int
+	Name     []byte
+	Password []byte `asn1:"tag:0"`
+}
+
+// ldapSearch is an LDAP search request
+type ldapSearch struct {
+	BaseDN     []byte
+	Scope      asn1.Enumerated
+	Deref      asn1.Enumerated
+	SizeLimit  int
+	TimeLimit  int
+	TypesOnly  bool
+	Filter     asn1.RawValue
+	Attributes [][]byte
+}
+
+// ldapAttribute is an attribute of an LDAP entry
+type ldapAttribute struct {
+	Type   []byte
+	Values [][]byte `asn1:"set"`
+}
+
+// ldapSearchResult is an LDAP search result entry as sent on the wire
+type ldapSearchResult struct {
+	DN         []byte
+	Attributes []ldapAttribute
+}
+
+// ldapEntry is an entry found on the directory
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string // by lowercase attribute name
+}
+
+// values returns the values of the entry's attribute
+func (e ldapEntry) values(attr string) []string {
+	return e.Attributes[strings.ToLower(attr)]
+}
+
+// value returns the first value of the entry's attribute, or ""
+func (e ldapEntry) value(attr string) string {
+	if values := e.values(attr); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// errLDAPInvalidCredentials is the error of binds with a wrong DN or password
+var errLDAPInvalidCredentials = fmt.Errorf("Invalid credentials")
+
+// bind authenticates the connection, anonymously if dn is empty
+func (c *ldapConn) bind(dn, password string) error {
+	if dn != "" && password == "" {
+		return errLDAPInvalidCredentials // or the server would take it as an unauthenticated bind
+	}
+	op, err := asn1.MarshalWithParams(ldapBind{3, []byte(dn), []byte(password)},
+		fmt.Sprintf("application,tag:%d", ldapBindRequest))
+	if err != nil {
+		return err
+	}
+	if err := c.send(op); err != nil {
+		return err
+	}
+	resp, err := c.receive(ldapBindResponse)
+	if err != nil {
+		return err
+	}
+	return resultError(resp)
+}
+
+// search returns the entries in the subtree of baseDN matching the filter
+func (c *ldapConn) search(baseDN, filter string, attrs ...string) ([]ldapEntry, error) {
+	f, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	req := ldapSearch{BaseDN: []byte(baseDN), Scope: LDAP_SCOPE_SUBTREE, TimeLimit: int(LDAP_TIMEOUT.Seconds()),
+		Filter: asn1.RawValue{FullBytes: f}}
+	for _, attr := range attrs {
+		req.Attributes = append(req.Attributes, []byte(attr))
+	}
+	op, err := asn1.MarshalWithParams(req, fmt.Sprintf("application,tag:%d", ldapSearchRequest))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.send(op); err != nil {
+		return nil, err
+	}
+	entries := make([]ldapEntry, 0)
+	for {
+		resp, err := c.receive(ldapSearchEntry, ldapSearchReference, ldapSearchDone)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Tag {
+		case ldapSearchDone:
+			return entries, resultError(resp)
+		case ldapSearchEntry:
+			var e ldapSearchResult
+			_, err := asn1.UnmarshalWithParams(resp.FullBytes, &e,
+				fmt.Sprintf("application,tag:%d", ldapSearchEntry))
+			if err != nil {
+				return nil, err
+			}
+			entry := ldapEntry{DN: string(e.DN), Attributes: make(map[string][]string)}
+			for _, a := range e.Attributes {
+				name := strings.ToLower(string(a.Type))
+				for _, v := range a.Values {
+					entry.Attributes[name] = append(entry.Attributes[name], string(v))
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// Close unbinds and closes the connection
+func (c *ldapConn) Close() error {
+	c.send([]byte{0x40 | ldapUnbindRequest, 0})
+	return c.conn.Close()
+}
+
+// send sends a protocol operation in a new message
+func (c *ldapConn) send(op []byte) error {
+	c.id++
+	msg, err := asn1.Marshal(ldapMessage{ID: c.id, Op: asn1.RawValue{FullBytes: op}})
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(msg)
+	return err
+}
+
+// receive reads the next response to the last message sent, which must be one of the given ops
+func (c *ldapConn) receive(ops ...int) (asn1.RawValue, error) {
+	data, err := readBER(c.r)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	var msg ldapMessage
+	if _, err := asn1.Unmarshal(data, &msg); err != nil {
+		return asn1.RawValue{}, err
+	}
+	if msg.ID != c.id {
+		return asn1.RawValue{}, fmt.Errorf("Unexpected LDAP message id %d", msg.ID)
+	}
+	for _, op := range ops {
+		if msg.Op.Class == asn1.ClassApplication && msg.Op.Tag == op {
+			return msg.Op, nil
+		}
+	}
+	return asn1.RawValue{}, fmt.Errorf("Unexpected LDAP operation %d", msg.Op.Tag)
+}
+
+// resultError returns the error of an LDAP result, or nil on success
+func resultError(op asn1.RawValue) error {
+	var res ldapResult
+	_, err := asn1.UnmarshalWithParams(op.FullBytes, &res, fmt.Sprintf("application,tag:%d", op.Tag))
+	if err != nil {
+		return err
+	}
+	switch res.Code {
+	case 0:
+		return nil
+	case 49:
+		return errLDAPInvalidCredentials
+	}
+	return fmt.Errorf("LDAP error %d %s", res.Code, res.Message)
+}
+
+// readBER reads a whole BER encoded element from r
+func readBER(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("Unsupported BER length")
+		}
+		lenBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lenBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lenBytes...)
+		length = 0
+		for _, b := range lenBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > LDAP_MAX_MESSAGE {
+		return nil, fmt.Errorf("LDAP message too big (%d bytes)", length)
+	}
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+	_, err := io.ReadFull(r, data[len(header):])
+	return data, err
+}
+
+// parseLDAPFilter encodes an RFC 4515 filter string. Only and, or, not, equality and presence
+// filters are supported, which is all user filters usually need
+func parseLDAPFilter(filter string) ([]byte, error) {
+	f, rest, err := parseFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("Trailing data on LDAP filter: %s", rest)
+	}
+	return f, nil
+}
+
+// parseFilter encodes the filter at the beginning of s returning the rest of s
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("LDAP filter must start with '(': %s", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("Unterminated LDAP filter")
+	}
+	switch s[0] {
+	case '&', '|', '!':
+		tag := map[byte]int{'&': 0, '|': 1, '!': 2}[s[0]]
+		s = s[1:]
+		var content []byte
+		for strings.HasPrefix(s, "(") {
+			f, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			content = append(content, f...)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", fmt.Errorf("Unterminated LDAP filter")
+		}
+		f, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag,
+			IsCompound: true, Bytes: content})
+		return f, s[1:], err
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("Unterminated LDAP filter")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("Unsupported LDAP filter: %s", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if value == "*" {
+		f, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: []byte(attr)})
+		return f, rest, err
+	}
+	if strings.ContainsAny(attr, "~<>:") || strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("Unsupported LDAP filter: %s", item)
+	}
+	unescaped, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := asn1.Marshal(struct{ Attr, Value []byte }{[]byte(attr), unescaped})
+	if err != nil {
+		return nil, "", err
+	}
+	var ava asn1.RawValue
+	asn1.Unmarshal(content, &ava)
+	f, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3,
+		IsCompound: true, Bytes: ava.Bytes})
+	return f, rest, err
+}
+
+// ldapUnescape decodes the \XX escapes of an LDAP filter value
+func ldapUnescape(value string) ([]byte, error) {
+	out := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			out = append(out, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return nil, fmt.Errorf("Wrong escape on LDAP filter value: %s", value)
+		}
+		b, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("Wrong escape on LDAP filter value: %s", value)
+		}
+		out = append(out, b...)
+		i += 2
+	}
+	return out, nil
+}
@@ -0,0 +1,208 @@
+package webca
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeLDAPEntry is an entry on the fakeLDAP directory
+type fakeLDAPEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// fakeLDAP is an in-process LDAP stand-in serving simple binds and searches over a fixed directory
+type fakeLDAP struct {
+	ln      net.Listener
+	entries map[string]fakeLDAPEntry // by DN
+}
+
+// startFakeLDAP starts serving the entries on a local port
+func startFakeLDAP(t *testing.T, entries map[string]fakeLDAPEntry) *fakeLDAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	fl := &fakeLDAP{ln: ln, entries: entries}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fl.serve(conn)
+		}
+	}()
+	return fl
+}
+
+// URL returns the ldap:// URL of the fake directory
+func (fl *fakeLDAP) URL() string {
+	return "ldap://" + fl.ln.Addr().String()
+}
+
+// serve answers the requests on a connection until unbind
+func (fl *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(id, tag int, v interface{}) {
+		op, _ := asn1.MarshalWithParams(v, fmt.Sprintf("application,tag:%d", tag))
+		msg, _ := asn1.Marshal(ldapMessage{ID: id, Op: asn1.RawValue{FullBytes: op}})
+		conn.Write(msg)
+	}
+	for {
+		data, err := readBER(r)
+		if err != nil {
+			return
+		}
+		var msg ldapMessage
+		if _, err := asn1.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		switch msg.Op.Tag {
+		case ldapBindRequest:
+			var bind ldapBind
+			asn1.UnmarshalWithParams(msg.Op.FullBytes, &bind, "application,tag:0")
+			code := 49
+			if e, ok := fl.entries[string(bind.Name)]; ok && e.password == string(bind.Password) {
+				code = 0
+			}
+			reply(msg.ID, ldapBindResponse, ldapResult{Code: asn1.Enumerated(code)})
+		case ldapSearchRequest:
+			var search ldapSearch
+			asn1.UnmarshalWithParams(msg.Op.FullBytes, &search, "application,tag:3")
+			for dn, e := range fl.entries {
+				if !strings.HasSuffix(dn, string(search.BaseDN)) || !matchFilter(search.Filter, e.attrs) {
+					continue
+				}
+				result := ldapSearchResult{DN: []byte(dn)}
+				for _, attr := range search.Attributes {
+					a := ldapAttribute{Type: attr}
+					for _, v := range e.attrs[string(attr)] {
+						a.Values = append(a.Values, []byte(v))
+					}
+					result.Attributes = append(result.Attributes, a)
+				}
+				reply(msg.ID, ldapSearchEntry, result)
+			}
+			reply(msg.ID, ldapSearchDone, ldapResult{})
+		default:
+			return
+		}
+	}
+}
+
+// matchFilter evaluates the encoded and, or, not, equality and presence filters on attrs
+func matchFilter(f asn1.RawValue, attrs map[string][]string) bool {
+	children := func() []asn1.RawValue {
+		var fs []asn1.RawValue
+		for rest := f.Bytes; len(rest) > 0; {
+			var child asn1.RawValue
+			rest, _ = asn1.Unmarshal(rest, &child)
+			fs = append(fs, child)
+		}
+		return fs
+	}
+	switch f.Tag {
+	case 0:
+		for _, child := range children() {
+			if !matchFilter(child, attrs) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		for _, child := range children() {
+			if matchFilter(child, attrs) {
+				return true
+			}
+		}
+		return false
+	case 2:
+		return !matchFilter(children()[0], attrs)
+	case 3:
+		var attr, value asn1.RawValue
+		rest, _ := asn1.Unmarshal(f.Bytes, &attr)
+		asn1.Unmarshal(rest, &value)
+		for _, v := range attrs[string(attr.Bytes)] {
+			if strings.EqualFold(v, string(value.Bytes)) {
+				return true
+			}
+		}
+		return false
+	case 7:
+		return len(attrs[string(f.Bytes)]) > 0
+	}
+	return false
+}
+
+func TestLDAPFilter(t *testing.T) {
+	for filter, match := range map[string]bool{
+		"(uid=alice)":                              true,
+		"(&(objectClass=*)(uid=alice))":            true,
+		"(|(uid=bob)(!(uid=alice)))":               false,
+		"(uid=" + ldapEscape("alice)(uid=*") + ")": false,
+	} {
+		f, err := parseLDAPFilter(filter)
+		dieOnError(t, err)
+		var rv asn1.RawValue
+		_, err = asn1.Unmarshal(f, &rv)
+		dieOnError(t, err)
+		attrs := map[string][]string{"uid": {"alice"}, "objectClass": {"person"}}
+		if matchFilter(rv, attrs) != match {
+			t.Fatalf("Filter %s should match=%v", filter, match)
+		}
+	}
+	for _, filter := range []string{"uid=alice", "(uid=alice", "(uid=al*)", "(uid=alice))"} {
+		if _, err := parseLDAPFilter(filter); err == nil {
+			t.Fatalf("Wrong filter %s was accepted", filter)
+		}
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	inTempDir(t, func() {
+		fl := startFakeLDAP(t, map[string]fakeLDAPEntry{
+			"cn=webca,dc=example,dc=com": {password: "service"},
+			"uid=alice,ou=people,dc=example,dc=com": {password: "alicepw", attrs: map[string][]string{
+				"uid": {"alice"}, "cn": {"Alice"}, "mail": {"alice@example.com"},
+				"memberOf": {"cn=auditors,ou=groups,dc=example,dc=com", "cn=PKI, ou=groups, dc=example, dc=com"},
+			}},
+			"uid=bob,ou=people,dc=example,dc=com": {password: "bobpw", attrs: map[string][]string{
+				"uid": {"bob"}, "memberOf": {"cn=others,ou=groups,dc=example,dc=com"},
+			}},
+		})
+		defer fl.ln.Close()
+		cfg := testConfig(t)
+		cfg.LDAP = &LDAPConfig{URL: fl.URL(), BindDN: "cn=webca,dc=example,dc=com", BindPassword: "service",
+			BaseDN: "dc=example,dc=com", GroupRoles: map[string]string{
+				"cn=auditors,ou=groups,dc=example,dc=com": ROLE_AUDITOR,
+				"cn=pki,ou=groups,dc=example,dc=com":      ROLE_OPERATOR,
+			}}
+		u, err := cfg.authenticate("alice", "alicepw")
+		dieOnError(t, err)
+		if u.Role != ROLE_OPERATOR || u.Source != LDAP_SOURCE || u.Email != "alice@example.com" {
+			t.Fatalf("Unexpected LDAP user %+v", u)
+		}
+		if saved := LoadConfig().getUser("alice"); saved.Role != ROLE_OPERATOR {
+			t.Fatalf("LDAP user was not saved in the config: %+v", saved)
+		}
+		for _, creds := range [][2]string{{"alice", "wrong"}, {"bob", "bobpw"}, {"alice", ""},
+			{"*", "alicepw"}, {"admin", "admin"}} {
+			if _, err := cfg.authenticate(creds[0], creds[1]); err != ErrBadCredentials {
+				t.Fatalf("Expected %v for %v but got %v", ErrBadCredentials, creds, err)
+			}
+		}
+		if _, err := (localAuth{cfg: cfg}).Authenticate("alice", ""); err != ErrBadCredentials {
+			t.Fatal("LDAP user logged in as a local user without password")
+		}
+		cfg.LDAP.LocalFallback = true
+		_, err = cfg.authenticate("admin", "admin")
+		dieOnError(t, err)
+		cfg.LDAP.URL = "ldap://127.0.0.1:1"
+		_, err = cfg.authenticate("admin", "admin")
+		dieOnError(t, err)
+	})
+}
@@ -0,0 +1,289 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Lint levels and limits, after the CA/Browser Forum baseline requirements and RFC 5280
+const (
+	LINT_ERROR     = "error"   // blocks issuing the certificate
+	LINT_WARNING   = "warning" // reported only
+	LINT_RSA_BITS  = 2048      // minimum RSA key size
+	LINT_LEAF_DAYS = 398       // maximum validity of TLS server certificates
+	LINT_WEAK_BITS = 1024      // RSA keys below this are errors, not just warnings
+)
+
+// Finding is something wrong the linter found in a certificate
+type Finding struct {
+	Level   string
+	Rule    string
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s: %s", f.Level, f.Rule, f.Message)
+}
+
+// LintError reports the errors the linter found in a certificate about to be issued
+type LintError struct {
+	Name     string
+	Findings []Finding
+}
+
+func (le *LintError) Error() string {
+	msgs := make([]string, 0, len(le.Findings))
+	for _, f := range le.Findings {
+		msgs = append(msgs, f.Message)
+	}
+	return fmt.Sprintf("Certificate %s is malformed: %s", le.Name, strings.Join(msgs, "; "))
+}
+
+// linter collects the findings on a certificate
+type linter []Finding
+
+func (l *linter) errorf(rule, format string, args ...interface{}) {
+	*l = append(*l, Finding{LINT_ERROR, rule, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(rule, format string, args ...interface{}) {
+	*l = append(*l, Finding{LINT_WARNING, rule, fmt.Sprintf(format, args...)})
+}
+
+// LintCert lints a certificate of the tree
+func LintCert(c *Cert) []Finding {
+	issuer := c.Crt
+	if c.Parent != nil {
+		issuer = c.Parent.Crt
+	}
+	return lint(c.Crt, c.Crt.PublicKey, issuer)
+}
+
+// checkLint lints the template of a certificate for the public key about to be signed by the
+// issuer, itself when self signed, failing with a LintError on errors and logging warnings
+func checkLint(tmpl *x509.Certificate, pub interface{}, issuer *x509.Certificate) error {
+	errors := make([]Finding, 0)
+	for _, f := range lint(tmpl, pub, issuer) {
+		if f.Level == LINT_ERROR {
+			errors = append(errors, f)
+		} else {
+			log.Printf("(Warning) Issuing %s: %s", tmpl.Subject.CommonName, f.Message)
+		}
+	}
+	if len(errors) > 0 {
+		return &LintError{Name: tmpl.Subject.CommonName, Findings: errors}
+	}
+	return nil
+}
+
+// lint checks the certificate for the public key signed by the issuer, itself when self signed
+func lint(crt *x509.Certificate, pub interface{}, issuer *x509.Certificate) []Finding {
+	l := make(linter, 0)
+	l.lintSerial(crt)
+	l.lintValidity(crt)
+	l.lintKey(pub)
+	l.lintKeyIds(crt, issuer == crt)
+	if crt.IsCA {
+		l.lintCA(crt)
+	} else {
+		l.lintLeaf(crt)
+	}
+	l.lintNames(crt)
+	switch crt.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		l.errorf("signature.weak", "signed with the weak %s algorithm", crt.SignatureAlgorithm)
+	}
+	return l
+}
+
+// lintSerial checks the serial is a positive number of up to 20 octets (RFC 5280 4.1.2.2)
+func (l *linter) lintSerial(crt *x509.Certificate) {
+	if crt.SerialNumber == nil || crt.SerialNumber.Sign() <= 0 {
+		l.errorf("serial.positive", "serial number must be positive")
+	} else if crt.SerialNumber.Cmp(new(big.Int).Lsh(big.NewInt(1), 159)) >= 0 {
+		l.errorf("serial.length", "serial number is longer than 20 octets")
+	}
+}
+
+// lintValidity checks the validity period, that TLS server certificates must keep short
+func (l *linter) lintValidity(crt *x509.Certificate) {
+	if !crt.NotAfter.After(crt.NotBefore) {
+		l.errorf("validity.order", "not after %s is not later than not before %s",
+			crt.NotAfter.Format(MYFMT), crt.NotBefore.Format(MYFMT))
+		return
+	}
+	days := int(crt.NotAfter.Sub(crt.NotBefore).Hours() / 24)
+	if !crt.IsCA && days > LINT_LEAF_DAYS && serverAuth(crt) {
+		l.warnf("validity.long", "validity of %d days exceeds the %d days browsers accept", days, LINT_LEAF_DAYS)
+	}
+}
+
+// lintKey checks the public key is strong enough
+func (l *linter) lintKey(pub interface{}) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if bits := k.N.BitLen(); bits < LINT_WEAK_BITS {
+			l.errorf("key.weak", "RSA key of %d bits is too weak", bits)
+		} else if bits < LINT_RSA_BITS {
+			l.warnf("key.weak", "RSA key of %d bits is shorter than %d", bits, LINT_RSA_BITS)
+		}
+		if k.E < 3 || k.E%2 == 0 {
+			l.errorf("key.exponent", "RSA public exponent %d is invalid", k.E)
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() && k.Curve != elliptic.P521() {
+			l.errorf("key.curve", "curve %s is not P-256, P-384 or P-521", k.Curve.Params().Name)
+		}
+	}
+}
+
+// lintKeyIds checks the subject and authority key identifiers (RFC 5280 4.2.1.1 and 4.2.1.2)
+func (l *linter) lintKeyIds(crt *x509.Certificate, selfSigned bool) {
+	if len(crt.AuthorityKeyId) == 0 && !selfSigned {
+		l.errorf("aki.missing", "authority key identifier is missing")
+	}
+	if len(crt.SubjectKeyId) == 0 {
+		if crt.IsCA {
+			l.errorf("ski.missing", "subject key identifier of a CA is missing")
+		} else {
+			l.warnf("ski.missing", "subject key identifier is missing")
+		}
+	}
+}
+
+// lintCA checks the basic constraints, key usage and name constraints of a CA
+func (l *linter) lintCA(crt *x509.Certificate) {
+	if !crt.BasicConstraintsValid {
+		l.errorf("ca.basicConstraints", "CA without basic constraints")
+	}
+	if crt.KeyUsage&x509.KeyUsageCertSign == 0 {
+		l.errorf("ca.keyUsage", "CA key usage lacks certificate signing")
+	}
+	if crt.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		l.warnf("ca.keyUsage", "CA key usage lacks CRL signing")
+	}
+	if nc := constraintsOf(crt); nc != nil && !nc.Critical {
+		l.warnf("ca.nameConstraints", "name constraints are not critical")
+	}
+}
+
+// lintLeaf checks the key usage and names of an end entity certificate
+func (l *linter) lintLeaf(crt *x509.Certificate) {
+	if crt.KeyUsage&(x509.KeyUsageCertSign|x509.KeyUsageCRLSign) != 0 {
+		l.errorf("leaf.keyUsage", "certificate that is not a CA can sign certificates or CRLs")
+	}
+	sans := len(crt.DNSNames) + len(crt.IPAddresses) + len(crt.EmailAddresses) + len(crt.URIs)
+	if sans == 0 && serverAuth(crt) {
+		l.warnf("san.missing", "no subject alternative names, clients matching names ignore the common name")
+	}
+	if sans > 0 {
+		if dnsNames, ips := hostNames(&x509.Certificate{Subject: crt.Subject, ExtKeyUsage: crt.ExtKeyUsage}); len(dnsNames)+len(ips) > 0 &&
+			!hasName(crt, dnsNames, ips) {
+			l.errorf("cn.notInSAN", "common name %s is not among the subject alternative names", crt.Subject.CommonName)
+		}
+	}
+}
+
+// lintNames checks the subject is not empty and the DNS names are well formed
+func (l *linter) lintNames(crt *x509.Certificate) {
+	if len(crt.Subject.ToRDNSequence()) == 0 && len(crt.DNSNames)+len(crt.IPAddresses)+
+		len(crt.EmailAddresses)+len(crt.URIs) == 0 {
+		l.errorf("subject.empty", "empty subject and no subject alternative names")
+	}
+	for _, name := range crt.DNSNames {
+		if !validDNSName(name) {
+			l.errorf("san.dnsName", "DNS name %q is malformed", name)
+		}
+	}
+}
+
+// serverAuth tells whether the certificate can authenticate TLS servers
+func serverAuth(crt *x509.Certificate) bool {
+	if len(crt.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, usage := range crt.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// hasName tells whether the certificate has all the DNS names and IP addresses as alternative names
+func hasName(crt *x509.Certificate, dnsNames []string, ips []net.IP) bool {
+	for _, name := range dnsNames {
+		found := false
+		for _, san := range crt.DNSNames {
+			found = found || strings.EqualFold(san, name)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		found := false
+		for _, san := range crt.IPAddresses {
+			found = found || san.Equal(ip)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// validDNSName tells whether the name is made of valid labels, with a wildcard only as the
+// whole leftmost one
+func validDNSName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for i, label := range strings.Split(name, ".") {
+		if label == "*" && i == 0 && strings.Count(name, ".") > 1 {
+			continue
+		}
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lintExport returns the findings on the certificate named, or on all of them, as JSON
+func lintExport(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	findings := make(map[string][]Finding)
+	if name := r.FormValue("cert"); name != "" {
+		c, err := FindCertOrFail(name)
+		if handleError(w, r, err) {
+			return
+		}
+		findings[name] = LintCert(c)
+	} else if ct := ListCerts(); ct != nil {
+		for name, c := range ct.names {
+			if c.Crt.Raw != nil { // not just the placeholder of an unknown issuer
+				findings[name] = LintCert(c)
+			}
+		}
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(findings)
+}
@@ -0,0 +1,117 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rules returns the rules of the findings at the level given
+func rules(findings []Finding, level string) string {
+	matching := make([]string, 0)
+	for _, f := range findings {
+		if f.Level == level {
+			matching = append(matching, f.Rule)
+		}
+	}
+	return strings.Join(matching, ",")
+}
+
+func TestLint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	now := time.Now()
+	issuer := &x509.Certificate{SubjectKeyId: []byte{1}}
+	leaf := func(cn string, days int, dnsNames ...string) *x509.Certificate {
+		return &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: cn},
+			NotBefore: now, NotAfter: now.AddDate(0, 0, days), SubjectKeyId: []byte{2}, AuthorityKeyId: []byte{1},
+			KeyUsage: x509.KeyUsageDigitalSignature, DNSNames: dnsNames}
+	}
+	weak := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 511), E: 65537}
+	for i, test := range []struct {
+		crt              *x509.Certificate
+		pub              interface{}
+		errors, warnings string
+	}{
+		{leaf("www.example.com", 90, "www.example.com"), &key.PublicKey, "", ""},
+		{leaf("www.example.com", 90), &key.PublicKey, "", "san.missing"},
+		{leaf("www.example.com", 90, "api.example.com"), &key.PublicKey, "cn.notInSAN", ""},
+		{leaf("api", 500, "api.example.com", "*.*.example.com"), &key.PublicKey, "san.dnsName", "validity.long"},
+		{leaf("api", 90, "api.example.com"), weak, "key.weak", ""},
+		{&x509.Certificate{SerialNumber: big.NewInt(-1), NotBefore: now, NotAfter: now, IsCA: true,
+			KeyUsage: x509.KeyUsageCRLSign}, &key.PublicKey,
+			"serial.positive,validity.order,aki.missing,ski.missing,ca.basicConstraints,ca.keyUsage,subject.empty", ""},
+	} {
+		findings := lint(test.crt, test.pub, issuer)
+		if got := rules(findings, LINT_ERROR); got != test.errors {
+			t.Errorf("%d: expected errors %q, got %q", i, test.errors, got)
+		}
+		if got := rules(findings, LINT_WARNING); got != test.warnings {
+			t.Errorf("%d: expected warnings %q, got %q", i, test.warnings, got)
+		}
+	}
+}
+
+func TestLintIssuance(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		ca := FindCert("TestCA")
+		c, err := GenCert(ca, "www.example.com", 90)
+		dieOnError(t, err)
+		if len(c.Crt.DNSNames) != 1 || c.Crt.DNSNames[0] != "www.example.com" {
+			t.Fatalf("Host name not among the alternative names %v", c.Crt.DNSNames)
+		}
+		c, err = genCert(ca, pkix.Name{CommonName: "john.doe"}, 90, x509.ExtKeyUsageClientAuth)
+		dieOnError(t, err)
+		if len(c.Crt.DNSNames) > 0 || len(LintCert(c)) > 0 {
+			t.Fatalf("Client certificate got the user name as a host name %v", c.Crt.DNSNames)
+		}
+		for _, c := range []*Cert{ca, FindCert("www.example.com")} {
+			if findings := LintCert(c); len(findings) > 0 {
+				t.Fatalf("Unexpected findings on %s: %v", c.Crt.Subject.CommonName, findings)
+			}
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		dieOnError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "api.example.com"}, DNSNames: []string{"www.example.org"}}, key)
+		dieOnError(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		dieOnError(t, err)
+		if _, err := SignCSR(ca, csr.Subject, csr, 30); err == nil || !strings.Contains(err.Error(), "is not among the subject alternative names") {
+			t.Fatalf("Signed a malformed certificate: %v", err)
+		}
+		if FindCert("api.example.com") != nil {
+			t.Fatal("Kept a malformed certificate")
+		}
+		longCA, err := GenCACert(pkix.Name{CommonName: "LongCA"}, 1000)
+		dieOnError(t, err)
+		_, err = SignCSR(longCA, pkix.Name{CommonName: "api"}, csr, 500, x509.ExtKeyUsageServerAuth)
+		dieOnError(t, err)
+
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+		admin, _ := loggedClient(t, webca.URL, "admin", "admin")
+		resp, err := admin.Get(webca.URL + "/lint.json")
+		dieOnError(t, err)
+		defer resp.Body.Close()
+		findings := make(map[string][]Finding)
+		dieOnError(t, json.NewDecoder(resp.Body).Decode(&findings))
+		if got := rules(findings["api"], LINT_WARNING); got != "validity.long" || len(findings["TestCA"]) != 0 {
+			t.Fatalf("Unexpected findings %v", findings)
+		}
+	})
+}
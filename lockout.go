@@ -0,0 +1,205 @@
+package webca
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LOGIN_FREE_FAILURES    = 3                // failures allowed before backing off
+	LOGIN_BACKOFF          = time.Second      // first backoff delay, doubled on each further failure
+	LOGIN_BACKOFF_MAX      = 5 * time.Minute  // longest backoff delay
+	LOGIN_LOCKOUT_FAILURES = 10               // failures locking the account of a username
+	LOGIN_LOCKOUT          = 30 * time.Minute // how long accounts stay locked unless an admin unlocks them
+	LOGIN_FORGET           = time.Hour        // failures older than this are forgotten
+	LOGIN_MAX_TRACKED      = 10000            // failure counters kept before forgetting old ones
+)
+
+// loginFailures counts the consecutive login failures of a username or client address
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// loginGuard slows down password guessing, backing off exponentially on consecutive failures
+type loginGuard struct {
+	sync.Mutex
+	failures map[string]*loginFailures
+}
+
+// guard tracks the login failures by username and by client address
+var guard = &loginGuard{failures: make(map[string]*loginFailures)}
+
+// userKey and ipKey return the guard keys of a username and a client address
+func userKey(username string) string { return "user:" + username }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// backoff returns the delay after count consecutive failures
+func backoff(count int) time.Duration {
+	if count < LOGIN_FREE_FAILURES {
+		return 0
+	}
+	delay := LOGIN_BACKOFF
+	for i := LOGIN_FREE_FAILURES; i < count && delay < LOGIN_BACKOFF_MAX; i++ {
+		delay *= 2
+	}
+	if delay > LOGIN_BACKOFF_MAX {
+		delay = LOGIN_BACKOFF_MAX
+	}
+	return delay
+}
+
+// wait returns how long logins for any of the keys must wait before trying again
+func (g *loginGuard) wait(now time.Time, keys ...string) time.Duration {
+	g.Lock()
+	defer g.Unlock()
+	longest := time.Duration(0)
+	for _, key := range keys {
+		if f := g.failures[key]; f != nil {
+			if left := f.last.Add(backoff(f.count)).Sub(now); left > longest {
+				longest = left
+			}
+		}
+	}
+	return longest
+}
+
+// fail records a failure for all keys, returning the consecutive failures of the first one
+func (g *loginGuard) fail(now time.Time, keys ...string) int {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.failures) > LOGIN_MAX_TRACKED {
+		for key, f := range g.failures {
+			if now.Sub(f.last) > LOGIN_FORGET {
+				delete(g.failures, key)
+			}
+		}
+	}
+	count := 0
+	for i, key := range keys {
+		f := g.failures[key]
+		if f == nil || now.Sub(f.last) > LOGIN_FORGET {
+			f = &loginFailures{}
+			g.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if i == 0 {
+			count = f.count
+		}
+	}
+	return count
+}
+
+// reset forgets the failures of the keys
+func (g *loginGuard) reset(keys ...string) {
+	g.Lock()
+	defer g.Unlock()
+	for _, key := range keys {
+		delete(g.failures, key)
+	}
+}
+
+// clientIP returns the address of the client connected, proxies are not trusted
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// locked tells whether the User's account is locked at time now
+func (u User) locked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
+}
+
+// Locked tells whether the User's account is locked now
+func (u User) Locked() bool {
+	return u.locked(time.Now())
+}
+
+// loginAllowed returns an error if the username can't try to log in from the request now,
+// because it or its client are backing off or the account is locked
+func loginAllowed(cfg *config, username string, r *http.Request, now time.Time) error {
+	if wait := guard.wait(now, userKey(username), ipKey(clientIP(r))); wait > 0 {
+		return fmt.Errorf(tr("Too many failed logins, try again in %s", wait.Round(time.Second)))
+	}
+	if cfg.getUser(username).locked(now) {
+		return fmt.Errorf(tr("Account locked after too many failed logins, try again later or ask an admin"))
+	}
+	return nil
+}
+
+// loginFailed records a failed login, locking the account when it failed too many times
+func loginFailed(cfg *config, username string, r *http.Request, reason string, now time.Time) {
+	ip := clientIP(r)
+	count := guard.fail(now, userKey(username), ipKey(ip))
+	recordLoginFailure(username, ip, reason)
+	if u := cfg.getUser(username); u.Username == "" || count < LOGIN_LOCKOUT_FAILURES || u.locked(now) {
+		return
+	}
+	var u User
+	err := cfg.update(func(cfg *config) error {
+		u = cfg.Users[username]
+		u.LockedUntil = now.Add(LOGIN_LOCKOUT)
+		cfg.Users[username] = u
+		return nil
+	})
+	if err != nil {
+		log.Printf("(Warning) Failed to lock %s: %v", username, err)
+	}
+	destroySessionsOf(username)
+	record(AuditEntry{User: username, IP: ip, Action: "lock", Target: username, Outcome: AUDIT_OK,
+		Detail: fmt.Sprintf("locked till %s", u.LockedUntil.Format(time.RFC3339))})
+	if cfg.NotifyLockouts {
+		go notifyAdmins(cfg, tr("Account %s locked", username),
+			tr("The account %s was locked after %d failed logins, the last from %s.\n", username, count, ip))
+	}
+}
+
+// loginSucceeded forgets the failures of the username
+func loginSucceeded(username string) {
+	guard.reset(userKey(username))
+}
+
+// unlock unlocks the User's account and forgets its failures
+func (u *User) unlock() {
+	u.LockedUntil = time.Time{}
+	guard.reset(userKey(u.Username))
+}
+
+// recordLoginFailure records a failed login on the audit log
+func recordLoginFailure(username, ip, reason string) {
+	record(AuditEntry{User: username, IP: ip, Action: "login", Target: username,
+		Outcome: AUDIT_FAILED, Detail: reason})
+}
+
+// notifyAdmins emails the admins with an email address
+func notifyAdmins(cfg *config, subject, body string) {
+	notifyUsers(cfg, func(u User) bool { return u.role() == ROLE_ADMIN }, subject, body)
+}
+
+// notifyUsers emails the users chosen with an email address
+func notifyUsers(cfg *config, chosen func(u User) bool, subject, body string) {
+	if cfg.Mailer == nil || cfg.Mailer.Server == "" {
+		return
+	}
+	emails := make([]string, 0)
+	oneCfg.RLock()
+	for _, u := range cfg.Users {
+		if chosen(u) && u.Email != "" {
+			emails = append(emails, u.Email)
+		}
+	}
+	oneCfg.RUnlock()
+	for _, email := range emails {
+		if err := cfg.Mailer.SendMail(email, subject, body); err != nil {
+			log.Printf("(Warning) Failed to email %s: %v", email, err)
+		}
+	}
+}
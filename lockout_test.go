@@ -0,0 +1,84 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	for count, want := range map[int]time.Duration{0: 0, LOGIN_FREE_FAILURES - 1: 0,
+		LOGIN_FREE_FAILURES: LOGIN_BACKOFF, LOGIN_FREE_FAILURES + 2: 4 * LOGIN_BACKOFF,
+		100: LOGIN_BACKOFF_MAX} {
+		if got := backoff(count); got != want {
+			t.Fatalf("Backoff after %d failures is %s, expected %s", count, got, want)
+		}
+	}
+	g := &loginGuard{failures: make(map[string]*loginFailures)}
+	now := time.Now()
+	for i := 0; i < LOGIN_FREE_FAILURES; i++ {
+		g.fail(now, userKey("x"), ipKey("10.0.0.1"))
+	}
+	if g.wait(now, userKey("y"), ipKey("10.0.0.1")) != LOGIN_BACKOFF {
+		t.Fatal("Client address is not backing off")
+	}
+	if g.wait(now.Add(LOGIN_BACKOFF), userKey("x")) != 0 {
+		t.Fatal("Backoff did not end")
+	}
+	if g.fail(now.Add(LOGIN_FORGET+time.Second), userKey("x")) != 1 {
+		t.Fatal("Old failures were not forgotten")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	inTempDir(t, func() {
+		guard = &loginGuard{failures: make(map[string]*loginFailures)}
+		defer func() { guard = &loginGuard{failures: make(map[string]*loginFailures)} }()
+		cfg := testConfig(t)
+		r := httptest.NewRequest("POST", "/login", nil)
+		now := time.Now()
+		for i := 0; i < LOGIN_LOCKOUT_FAILURES; i++ {
+			now = now.Add(LOGIN_BACKOFF_MAX)
+			if err := loginAllowed(cfg, "admin", r, now); err != nil {
+				t.Fatalf("Login %d refused too soon: %v", i, err)
+			}
+			loginFailed(cfg, "admin", r, "test", now)
+		}
+		if !LoadConfig().getUser("admin").locked(now) {
+			t.Fatal("Account was not locked")
+		}
+		guard.reset(userKey("admin"), ipKey(clientIP(r))) // only the lock is left
+		login := func() string {
+			form := url.Values{"Username": {"admin"}, "Password": {"admin"}}
+			r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			login(w, r)
+			if w.Code == http.StatusFound {
+				return ""
+			}
+			return w.Body.String()
+		}
+		if page := login(); !strings.Contains(page, "Account locked") {
+			t.Fatalf("Locked account could log in:\n%s", page)
+		}
+		u := cfg.getUser("admin")
+		u.unlock()
+		cfg.Users["admin"] = u
+		if page := login(); page != "" {
+			t.Fatalf("Unlocked account could not log in:\n%s", page)
+		}
+		u.TOTPSecret, _ = newTOTPSecret()
+		cfg.Users["admin"] = u
+		guard.fail(time.Now(), userKey("admin"))
+		if page := login(); !strings.Contains(page, "login2") {
+			t.Fatalf("Second factor not asked:\n%s", page)
+		}
+		if guard.failures[userKey("admin")] == nil {
+			t.Fatal("Password alone forgot the failures of a user with a second factor")
+		}
+	})
+}
@@ -0,0 +1,473 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDC_SOURCE         = "oidc"
+	OIDCLOGIN           = "OIDCLogin" // session key of the oidcLogin in progress
+	OIDC_TIMEOUT        = 10 * time.Second
+	OIDC_CACHE          = time.Hour // how long discovery documents and keys are cached
+	OIDC_USERNAME_CLAIM = "preferred_username"
+	OIDC_GROUPS_CLAIM   = "groups"
+	OIDC_CLOCK_SKEW     = 2 * time.Minute
+	OIDC_MAX_RESPONSE   = 1 << 20
+)
+
+// OIDCConfig contains the settings to log users in with an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer        string            // issuer URL, its discovery document is at /.well-known/openid-configuration
+	ClientID      string            // client registered on the provider
+	ClientSecret  string            // client secret, empty for public clients relying on PKCE alone
+	CACert        string            // name of the WebCA CA trusted for the provider, system roots if empty
+	RedirectURL   string            // https://<this host>/sso/callback by default, must be registered on the provider
+	UsernameClaim string            // claim with the WebCA username, preferred_username by default
+	GroupsClaim   string            // claim with the user's groups, groups by default
+	GroupRoles    map[string]string // group to WebCA role
+	DefaultRole   string            // role of users in no mapped group, "" to refuse them
+}
+
+// oidcLogin holds the secrets of an authorization request until the provider redirects back
+type oidcLogin struct {
+	State, Nonce, Verifier, RedirectURL, URL string
+}
+
+// oidcProvider is the discovered metadata and signing keys of a provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	keys                  map[string]crypto.PublicKey
+	fetched               time.Time
+}
+
+// oidcProviders caches the providers by issuer
+var oidcProviders = struct {
+	sync.Mutex
+	m map[string]*oidcProvider
+}{m: make(map[string]*oidcProvider)}
+
+// client returns the HTTP client to talk to the provider
+func (oc *OIDCConfig) client() (*http.Client, error) {
+	u, err := url.Parse(oc.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && !isLoopback(u.Hostname()) {
+		return nil, fmt.Errorf("OIDC issuer %s must use https", oc.Issuer)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if oc.CACert != "" {
+		ca := FindCert(oc.CACert)
+		if ca == nil {
+			return nil, fmt.Errorf("Unknown OIDC CA %s", oc.CACert)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.Crt)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: OIDC_TIMEOUT}, nil
+}
+
+// isLoopback tells whether host is a loopback name or address
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// provider returns the provider metadata and keys, from the cache unless refresh is requested
+func (oc *OIDCConfig) provider(refresh bool) (*oidcProvider, error) {
+	oidcProviders.Lock()
+	defer oidcProviders.Unlock()
+	p := oidcProviders.m[oc.Issuer]
+	if p != nil && !refresh && time.Since(p.fetched) < OIDC_CACHE {
+		return p, nil
+	}
+	client, err := oc.client()
+	if err != nil {
+		return nil, err
+	}
+	p = &oidcProvider{}
+	wellKnown := strings.TrimSuffix(oc.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(client, wellKnown, p); err != nil {
+		return nil, err
+	}
+	if p.Issuer != oc.Issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch: expected %s but got %s", oc.Issuer, p.Issuer)
+	}
+	if p.keys, err = fetchJWKS(client, p.JWKSURI); err != nil {
+		return nil, err
+	}
+	p.fetched = time.Now()
+	oidcProviders.m[oc.Issuer] = p
+	return p, nil
+}
+
+// getJSON decodes the JSON document at url into v
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to get %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE)).Decode(v)
+}
+
+// jsonWebKey is a public key of a JWKS
+type jsonWebKey struct {
+	Kty, Kid, Use, Alg string
+	N, E               string // RSA
+	Crv, X, Y          string // EC
+}
+
+// fetchJWKS returns the signing keys of the JSON Web Key Set at url, by key id
+func fetchJWKS(client *http.Client, url string) (map[string]crypto.PublicKey, error) {
+	var jwks struct{ Keys []jsonWebKey }
+	if err := getJSON(client, url, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the RSA or P-256 public key of the JSON Web Key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, fmt.Errorf("Wrong RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || k.Crv != "P-256" {
+			return nil, fmt.Errorf("Wrong or unsupported EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := key.ECDH(); err != nil { // not on the curve
+			return nil, fmt.Errorf("Wrong EC key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+// randomToken returns a random URL safe token
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// redirectURL returns the URL the provider sends the user back to
+func (oc *OIDCConfig) redirectURL(r *http.Request) string {
+	if oc.RedirectURL != "" {
+		return oc.RedirectURL
+	}
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + "/sso/callback"
+}
+
+// sso starts the authorization code flow with PKCE, redirecting the user to the provider
+func sso(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := cfg.OIDC.provider(false)
+	if handleError(w, r, err) {
+		return
+	}
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	login := oidcLogin{RedirectURL: cfg.OIDC.redirectURL(r), URL: r.FormValue("URL")}
+	for _, token := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *token, err = randomToken(); handleError(w, r, err) {
+			return
+		}
+	}
+	data, err := json.Marshal(login)
+	if handleError(w, r, err) {
+		return
+	}
+	s[OIDCLOGIN] = string(data)
+	s.Save()
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.OIDC.ClientID},
+		"redirect_uri":          {login.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), 302)
+}
+
+// ssoCallback completes the authorization code flow and logs the user in
+func ssoCallback(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	var login oidcLogin
+	err = json.Unmarshal([]byte(s[OIDCLOGIN]), &login)
+	delete(s, OIDCLOGIN) // one use only
+	s.Save()
+	state := r.FormValue("state")
+	if err != nil || login.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		http.Error(w, tr("Wrong SSO state!"), http.StatusBadRequest)
+		return
+	}
+	u, err := cfg.OIDC.exchange(r.FormValue("code"), login)
+	if err == nil {
+		u, err = cfg.mergeUser(u)
+	}
+	if err != nil {
+		if e := r.FormValue("error"); e != "" {
+			err = fmt.Errorf("%s %s", e, r.FormValue("error_description"))
+		}
+		ps := newPageStatus(r)
+		ps["Error"] = tr("SSO login failed: %s", err)
+		ps["URL"] = login.URL
+		ps["SSO"] = true
+		err := templates.ExecuteTemplate(w, "login", ps)
+		handleError(w, r, err)
+		return
+	}
+	logUserIn(w, r, s, cfg, u, login.URL)
+}
+
+// exchange redeems the authorization code for an ID token and returns the User it identifies
+func (oc *OIDCConfig) exchange(code string, login oidcLogin) (User, error) {
+	if code == "" {
+		return User{}, ErrBadCredentials
+	}
+	p, err := oc.provider(false)
+	if err != nil {
+		return User{}, err
+	}
+	client, err := oc.client()
+	if err != nil {
+		return User{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {login.RedirectURL},
+		"code_verifier": {login.Verifier},
+		"client_id":     {oc.ClientID},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return User{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if oc.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oc.ClientID), url.QueryEscape(oc.ClientSecret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return User{}, err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE)).Decode(&token); err != nil {
+		return User{}, fmt.Errorf("Failed to decode token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return User{}, fmt.Errorf("Token request failed: %s %s", resp.Status, token.Error)
+	}
+	claims, err := oc.verifyIDToken(token.IDToken, login.Nonce, time.Now())
+	if err != nil {
+		return User{}, err
+	}
+	return oc.userFor(claims)
+}
+
+// verifyIDToken checks the signature, issuer, audience, times and nonce of the ID token and
+// returns its claims
+func (oc *OIDCConfig) verifyIDToken(idToken, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	var header struct{ Alg, Kid string }
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed ID token signature")
+	}
+	p, err := oc.provider(false)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := p.keys[header.Kid]
+	if !ok { // the provider may have rotated its keys
+		if p, err = oc.provider(true); err != nil {
+			return nil, err
+		}
+		if key, ok = p.keys[header.Kid]; !ok {
+			return nil, fmt.Errorf("Unknown ID token key %s", header.Kid)
+		}
+	}
+	if err := verifyJWS(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != oc.Issuer {
+		return nil, fmt.Errorf("Wrong ID token issuer %s", iss)
+	}
+	if !audienceContains(claims["aud"], oc.ClientID) {
+		return nil, fmt.Errorf("ID token not issued for %s", oc.ClientID)
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(OIDC_CLOCK_SKEW)) {
+		return nil, fmt.Errorf("Expired ID token")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(OIDC_CLOCK_SKEW)) {
+		return nil, fmt.Errorf("ID token issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("Wrong ID token nonce")
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64url JSON part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("Malformed ID token: %s", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Malformed ID token: %s", err)
+	}
+	return nil
+}
+
+// verifyJWS checks the JWS signature of signed with the key, only RS256 and ES256 are supported
+func verifyJWS(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(sig) == 64 {
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if !ecdsa.Verify(k, digest[:], r, s) {
+				return fmt.Errorf("Wrong signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported signature algorithm %s", alg)
+}
+
+// audienceContains tells whether the aud claim, a string or an array of them, contains clientID
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userFor maps the ID token claims to a User, refusing users with no role
+func (oc *OIDCConfig) userFor(claims map[string]interface{}) (User, error) {
+	username, _ := claims[withDefault(oc.UsernameClaim, OIDC_USERNAME_CLAIM)].(string)
+	if username == "" {
+		return User{}, fmt.Errorf("ID token has no %s claim", withDefault(oc.UsernameClaim, OIDC_USERNAME_CLAIM))
+	}
+	groups := make([]string, 0)
+	switch g := claims[withDefault(oc.GroupsClaim, OIDC_GROUPS_CLAIM)].(type) {
+	case string:
+		groups = append(groups, g)
+	case []interface{}:
+		for _, v := range g {
+			if group, ok := v.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	role := mappedRole(oc.GroupRoles, groups)
+	if _, ok := roles[oc.DefaultRole]; role == "" && ok {
+		role = oc.DefaultRole
+	}
+	if role == "" {
+		return User{}, fmt.Errorf(tr("%s has no WebCA role", username))
+	}
+	fullname, _ := claims["name"].(string)
+	email, _ := claims["email"].(string)
+	return User{Username: username, Fullname: fullname, Email: email, Role: role, Source: OIDC_SOURCE}, nil
+}
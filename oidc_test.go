@@ -0,0 +1,154 @@
+package webca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a local OpenID Connect provider that authorizes a fixed user right away
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	codes  map[string]url.Values // authorization requests by code
+}
+
+// newMockIssuer starts a mock issuer that will put the given claims on its ID tokens
+func newMockIssuer(t *testing.T, claims map[string]interface{}) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	dieOnError(t, err)
+	mi := &mockIssuer{key: key, claims: claims, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": mi.URL,
+			"authorization_endpoint": mi.URL + "/authorize", "token_endpoint": mi.URL + "/token",
+			"jwks_uri": mi.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig", "alg": "RS256",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := randomToken()
+		mi.codes[code] = r.URL.Query()
+		http.Redirect(w, r, r.FormValue("redirect_uri")+"?code="+code+"&state="+r.FormValue("state"), 302)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := mi.codes[r.FormValue("code")]
+		delete(mi.codes, r.FormValue("code"))
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || req.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(verifier[:]) ||
+			req.Get("redirect_uri") != r.FormValue("redirect_uri") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": mi.sign(t, req.Get("nonce"))})
+	})
+	mi.Server = httptest.NewServer(mux)
+	return mi
+}
+
+// sign returns an RS256 ID token with the issuer claims and the nonce
+func (mi *mockIssuer) sign(t *testing.T, nonce string) string {
+	claims := map[string]interface{}{"iss": mi.URL, "aud": "webca", "nonce": nonce,
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix()}
+	for k, v := range mi.claims {
+		claims[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, mi.key, crypto.SHA256, digest[:])
+	dieOnError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestSSOLogin(t *testing.T) {
+	inTempDir(t, func() {
+		mi := newMockIssuer(t, map[string]interface{}{"preferred_username": "carol", "name": "Carol",
+			"groups": []string{"staff", "pki-operators"}})
+		defer mi.Close()
+		cfg := testConfig(t)
+		cfg.OIDC = &OIDCConfig{Issuer: mi.URL, ClientID: "webca",
+			GroupRoles: map[string]string{"pki-operators": ROLE_OPERATOR}}
+		dieOnError(t, cfg.Save())
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+		jar, err := cookiejar.New(nil)
+		dieOnError(t, err)
+		client := &http.Client{Jar: jar}
+		resp, err := client.Get(webca.URL + "/sso?URL=/certControl%3Fcert%3Dlocalhost")
+		dieOnError(t, err)
+		page, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		dieOnError(t, err)
+		if resp.Request.URL.Path != "/certControl" || !strings.Contains(string(page), "Logged as: Carol") {
+			t.Fatalf("SSO did not log in to %s:\n%s", resp.Request.URL, page)
+		}
+		if u := LoadConfig().getUser("carol"); u.Role != ROLE_OPERATOR || u.Source != OIDC_SOURCE {
+			t.Fatalf("SSO user was not created just in time: %+v", u)
+		}
+		resp, err = http.Get(webca.URL + "/sso/callback?code=stolen&state=guessed")
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Callback without the login state was accepted: %s", resp.Status)
+		}
+		mi.claims["groups"] = []string{"staff"}
+		jar, _ = cookiejar.New(nil)
+		client.Jar = jar
+		resp, err = client.Get(webca.URL + "/sso")
+		dieOnError(t, err)
+		page, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(page), "Logged as") {
+			t.Fatal("SSO user with no mapped group was logged in")
+		}
+	})
+}
+
+func TestIDTokenVerification(t *testing.T) {
+	inTempDir(t, func() {
+		mi := newMockIssuer(t, map[string]interface{}{"preferred_username": "carol"})
+		defer mi.Close()
+		oc := &OIDCConfig{Issuer: mi.URL, ClientID: "webca"}
+		token := mi.sign(t, "n1")
+		_, err := oc.verifyIDToken(token, "n1", time.Now())
+		dieOnError(t, err)
+		if _, err := oc.verifyIDToken(token, "n2", time.Now()); err == nil {
+			t.Fatal("ID token with the wrong nonce was accepted")
+		}
+		if _, err := oc.verifyIDToken(token, "n1", time.Now().Add(time.Hour)); err == nil {
+			t.Fatal("Expired ID token was accepted")
+		}
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(map[string]interface{}{"iss": mi.URL, "aud": "webca", "nonce": "n1",
+			"exp": time.Now().Add(time.Minute).Unix(), "preferred_username": "admin"})
+		parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+		if _, err := oc.verifyIDToken(strings.Join(parts, "."), "n1", time.Now()); err == nil {
+			t.Fatal("Forged ID token was accepted")
+		}
+		if _, err := (&OIDCConfig{Issuer: mi.URL, ClientID: "other"}).verifyIDToken(token, "n1", time.Now()); err == nil {
+			t.Fatal("ID token for another client was accepted")
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package webca
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+)
+
+const (
+	P12_SUFFIX     = ".p12"
+	P12_ITERATIONS = 2048
+)
+
+// PKCS#12 (RFC 7292) object identifiers
+var (
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSHA1                   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidPBEWithSHAAnd3DES      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidShroudedKeyBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidFriendlyName           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	pkcs12KeyID          byte = 1
+	pkcs12IVID           byte = 2
+	pkcs12MACID          byte = 3
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// EncodePKCS12 packs a certificate, its private key and its CA chain as a password protected
+// PKCS#12 file a browser can import, using the widely supported SHA1/3DES algorithms
+func EncodePKCS12(cert *Cert, password string) ([]byte, error) {
+	if cert.Key == nil {
+		return nil, fmt.Errorf("Can't pack %s in PKCS#12 without its key", cert.Crt.Subject.CommonName)
+	}
+	bmpPasswd := bmpString(password)
+	localKeyID := sha1.Sum(cert.Crt.Raw)
+	attrs, err := bagAttributes(localKeyID[:], cert.Crt.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	// certificate bags: the cert itself first and then its CA chain
+	certBags := make([]safeBag, 0)
+	for c := cert; c != nil; c = c.Parent {
+		bag, err := newCertBag(c.Crt.Raw)
+		if err != nil {
+			return nil, err
+		}
+		if c == cert {
+			bag.Attributes = attrs
+		}
+		certBags = append(certBags, *bag)
+		if c.Parent == c || c.Parent == nil || c.Parent.Crt.Raw == nil {
+			break
+		}
+	}
+	// shrouded key bag
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(cert.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the private key: %s", err)
+	}
+	encKey, err := pbEncrypt(pkcs8, bmpPasswd)
+	if err != nil {
+		return nil, err
+	}
+	keyBag := newBag(oidShroudedKeyBag, encKey)
+	keyBag.Attributes = attrs
+	// authenticated safe with both bag sets as plain data
+	safe := make([]contentInfo, 0, 2)
+	for _, bags := range [][]safeBag{certBags, []safeBag{*keyBag}} {
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		safe = append(safe, *ci)
+	}
+	authSafe, err := asn1.Marshal(safe)
+	if err != nil {
+		return nil, err
+	}
+	pfx := pfxPdu{Version: 3}
+	if pfx.AuthSafe.Content, err = explicitOctets(authSafe); err != nil {
+		return nil, err
+	}
+	pfx.AuthSafe.ContentType = oidData
+	// MAC over the authenticated safe
+	pfx.MacData.MacSalt = make([]byte, 8)
+	if _, err = rand.Read(pfx.MacData.MacSalt); err != nil {
+		return nil, err
+	}
+	pfx.MacData.Iterations = P12_ITERATIONS
+	macKey := pkcs12KDF(bmpPasswd, pfx.MacData.MacSalt, P12_ITERATIONS, pkcs12MACID, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authSafe)
+	pfx.MacData.Mac.Algorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}
+	pfx.MacData.Mac.Digest = mac.Sum(nil)
+	return asn1.Marshal(pfx)
+}
+
+// bagAttributes returns the localKeyID and friendlyName bag attributes
+func bagAttributes(localKeyID []byte, name string) ([]pkcs12Attribute, error) {
+	id, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	bmpName := bmpString(name)
+	friendly, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpName[:len(bmpName)-2]})
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal,
+			IsCompound: true, Bytes: id}},
+		{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal,
+			IsCompound: true, Bytes: friendly}},
+	}, nil
+}
+
+// newCertBag wraps a DER certificate in a safe bag
+func newCertBag(der []byte) (*safeBag, error) {
+	cb, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: der})
+	if err != nil {
+		return nil, err
+	}
+	return newBag(oidCertBag, cb), nil
+}
+
+// newBag returns a safe bag of the given type holding the DER value
+func newBag(id asn1.ObjectIdentifier, der []byte) *safeBag {
+	return &safeBag{ID: id,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}}
+}
+
+// dataContentInfo wraps the bags as a data ContentInfo
+func dataContentInfo(bags []safeBag) (*contentInfo, error) {
+	der, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, err
+	}
+	content, err := explicitOctets(der)
+	if err != nil {
+		return nil, err
+	}
+	return &contentInfo{ContentType: oidData, Content: content}, nil
+}
+
+// explicitOctets returns der as an OCTET STRING inside an explicit [0] tag
+func explicitOctets(der []byte) (asn1.RawValue, error) {
+	octets, err := asn1.Marshal(der)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets}, nil
+}
+
+// pbEncrypt encrypts data with pbeWithSHAAnd3-KeyTripleDES-CBC returning an EncryptedPrivateKeyInfo
+func pbEncrypt(data, bmpPasswd []byte) ([]byte, error) {
+	params := pbeParams{Salt: make([]byte, 8), Iterations: P12_ITERATIONS}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, err
+	}
+	key := pkcs12KDF(bmpPasswd, params.Salt, params.Iterations, pkcs12KeyID, 24)
+	iv := pkcs12KDF(bmpPasswd, params.Salt, params.Iterations, pkcs12IVID, des.BlockSize)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := des.BlockSize - len(data)%des.BlockSize
+	padded := make([]byte, len(data), len(data)+padding)
+	copy(padded, data)
+	for i := 0; i < padding; i++ {
+		padded = append(padded, byte(padding))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	rawParams, err := asn1.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3DES,
+			Parameters: asn1.RawValue{FullBytes: rawParams}},
+		EncryptedData: padded,
+	})
+}
+
+// pkcs12KDF derives size bytes of key material for the given purpose id as in RFC 7292 B.2
+func pkcs12KDF(bmpPasswd, salt []byte, iterations int, id byte, size int) []byte {
+	const v, u = 64, sha1.Size
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(src)+v-1)/v))
+		for i := range out {
+			out[i] = src[i%len(src)]
+		}
+		return out
+	}
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	I := append(fill(salt), fill(bmpPasswd)...)
+	one := big.NewInt(1)
+	out := make([]byte, 0, size+u)
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(A)
+			A = sum[:]
+		}
+		out = append(out, A...)
+		// I_j = (I_j + B + 1) mod 2^(v*8) for every v bytes block of I
+		B := new(big.Int).SetBytes(fill(A)[:v])
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, B).Add(Ij, one)
+			b := Ij.Bytes()
+			if len(b) > v {
+				b = b[len(b)-v:]
+			}
+			block := I[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(b):], b)
+		}
+	}
+	return out[:size]
+}
+
+// bmpString encodes s as a null terminated UTF-16 big endian BMPString
+func bmpString(s string) []byte {
+	out := make([]byte, 0, 2*len(s)+2)
+	for _, r := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0)
+}
@@ -0,0 +1,414 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// PKCS#7 / CMS (RFC 5652) object identifiers
+var (
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidContentType       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSAEncryption     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidAES128CBC         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC        = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"optional,tag:0"`
+}
+
+// signedMessage is a parsed and verified PKCS#7 SignedData
+type signedMessage struct {
+	Content []byte                   // signed content, nil if there is none
+	Attrs   map[string]asn1.RawValue // first value of each signed attribute, by OID
+	Signer  *x509.Certificate        // certificate of the signer, as found in the message
+	Certs   []*x509.Certificate      // certificates carried in the message
+	Hash    crypto.Hash              // digest algorithm of the signer, to sign replies alike
+}
+
+// certsOnly encodes the certificates as a DER degenerate PKCS#7 SignedData, with no signers
+func certsOnly(crts ...*x509.Certificate) ([]byte, error) {
+	var raw []byte
+	for _, crt := range crts {
+		raw = append(raw, crt.Raw...)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      []signerInfo{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData,
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+}
+
+// readCertsOnly decodes the certificates of a DER degenerate PKCS#7 SignedData
+func readCertsOnly(der []byte) ([]*x509.Certificate, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("Malformed PKCS#7 signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Malformed PKCS#7 signed data: %s", err)
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
+
+// newAttribute returns a single valued attribute, strings are encoded as PrintableString
+func newAttribute(id asn1.ObjectIdentifier, value interface{}) (pkcs12Attribute, error) {
+	var der []byte
+	var err error
+	if s, ok := value.(string); ok {
+		der, err = asn1.MarshalWithParams(s, "printable")
+	} else {
+		der, err = asn1.Marshal(value)
+	}
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+	return pkcs12Attribute{ID: id, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal,
+		IsCompound: true, Bytes: der}}, nil
+}
+
+// digestFor returns the digest function of a digest algorithm, SHA-256 or SHA-1
+func digestFor(alg asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case alg.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case alg.Equal(oidSHA1):
+		return crypto.SHA1, true
+	}
+	return 0, false
+}
+
+// signMessage returns a PKCS#7 SignedData of the content, signed with the key of the signer
+// certificate along with the given attributes and carrying the certificates
+func signMessage(content []byte, attrs []pkcs12Attribute, hash crypto.Hash, signer *x509.Certificate,
+	key *rsa.PrivateKey, certs ...*x509.Certificate) ([]byte, error) {
+	digestAlg, sigAlg := oidSHA256, oidSHA256WithRSA
+	if hash == crypto.SHA1 {
+		digestAlg, sigAlg = oidSHA1, oidSHA1WithRSA
+	}
+	h := hash.New()
+	h.Write(content)
+	contentType, err := newAttribute(oidContentType, oidData)
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := newAttribute(oidMessageDigest, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([][]byte, 0, len(attrs)+2)
+	for _, attr := range append([]pkcs12Attribute{contentType, messageDigest}, attrs...) {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 }) // DER SET OF order
+	signedAttrs := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+		Bytes: bytes.Join(encoded, nil)}
+	set, err := attributeSet(signedAttrs)
+	if err != nil {
+		return nil, err
+	}
+	h = hash.New()
+	h.Write(set)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	for _, crt := range certs {
+		raw = append(raw, crt.Raw...)
+	}
+	econtent := contentInfo{ContentType: oidData}
+	if content != nil {
+		if econtent.Content, err = explicitOctets(content); err != nil {
+			return nil, err
+		}
+	}
+	algorithm := pkix.AlgorithmIdentifier{Algorithm: digestAlg, Parameters: asn1.NullRawValue}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{algorithm},
+		ContentInfo:      econtent,
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: signer.RawIssuer}, Serial: signer.SerialNumber},
+			DigestAlgorithm:    algorithm,
+			SignedAttrs:        signedAttrs,
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg, Parameters: asn1.NullRawValue},
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData,
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+}
+
+// attributeSet re-encodes the [0] tagged signed attributes as the SET they are signed as
+func attributeSet(signedAttrs asn1.RawValue) ([]byte, error) {
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true,
+		Bytes: signedAttrs.Bytes})
+}
+
+// verifyMessage parses a PKCS#7 SignedData and checks its first signer's RSA signature over
+// the signed attributes and content, the signer certificate must be carried in the message
+func verifyMessage(der []byte) (*signedMessage, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil || len(rest) > 0 || !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("Malformed PKCS#7 signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Malformed PKCS#7 signed data: %s", err)
+	}
+	if len(sd.SignerInfos) == 0 || len(sd.SignerInfos[0].SignedAttrs.Bytes) == 0 {
+		return nil, fmt.Errorf("PKCS#7 signed data has no signed attributes")
+	}
+	msg := &signedMessage{Attrs: make(map[string]asn1.RawValue)}
+	var err error
+	if msg.Certs, err = x509.ParseCertificates(sd.Certificates.Bytes); err != nil {
+		return nil, fmt.Errorf("Malformed PKCS#7 certificates: %s", err)
+	}
+	si := sd.SignerInfos[0]
+	for _, crt := range msg.Certs {
+		if bytes.Equal(crt.RawIssuer, si.SID.Issuer.FullBytes) && crt.SerialNumber.Cmp(si.SID.Serial) == 0 {
+			msg.Signer = crt
+		}
+	}
+	pub, ok := publicRSA(msg.Signer)
+	if !ok {
+		return nil, fmt.Errorf("PKCS#7 signer certificate is missing or has no RSA key")
+	}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &msg.Content); err != nil {
+			return nil, fmt.Errorf("Malformed PKCS#7 content: %s", err)
+		}
+	}
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr pkcs12Attribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, fmt.Errorf("Malformed PKCS#7 signed attributes: %s", err)
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Value.Bytes, &value); err == nil {
+			msg.Attrs[attr.ID.String()] = value
+		}
+	}
+	hash, ok := digestFor(si.DigestAlgorithm.Algorithm)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(msg.Content)
+	if digest := msg.Attrs[oidMessageDigest.String()]; !bytes.Equal(digest.Bytes, h.Sum(nil)) {
+		return nil, fmt.Errorf("PKCS#7 content does not match its digest")
+	}
+	set, err := attributeSet(si.SignedAttrs)
+	if err != nil {
+		return nil, err
+	}
+	h = hash.New()
+	h.Write(set)
+	if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), si.Signature); err != nil {
+		return nil, fmt.Errorf("Wrong PKCS#7 signature")
+	}
+	msg.Hash = hash
+	return msg, nil
+}
+
+// publicRSA returns the RSA public key of the certificate, if any
+func publicRSA(crt *x509.Certificate) (*rsa.PublicKey, bool) {
+	if crt == nil {
+		return nil, false
+	}
+	pub, ok := crt.PublicKey.(*rsa.PublicKey)
+	return pub, ok
+}
+
+// contentCipher returns the block cipher and key size of a content encryption algorithm
+func contentCipher(alg asn1.ObjectIdentifier) (func(key []byte) (cipher.Block, error), int, bool) {
+	switch {
+	case alg.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, true
+	case alg.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, true
+	case alg.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, true
+	}
+	return nil, 0, false
+}
+
+// envelope encrypts the content for the RSA key of the recipient certificate as a PKCS#7
+// EnvelopedData, with a CBC content encryption algorithm
+func envelope(content []byte, recipient *x509.Certificate, alg asn1.ObjectIdentifier) ([]byte, error) {
+	pub, ok := publicRSA(recipient)
+	if !ok {
+		return nil, fmt.Errorf("Recipient %s has no RSA key", recipient.Subject.CommonName)
+	}
+	newCipher, size, ok := contentCipher(alg)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported content encryption algorithm %s", alg)
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(content)%block.BlockSize()
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	ed, err := asn1.Marshal(envelopedData{
+		RecipientInfos: []keyTransRecipientInfo{{
+			RID:                    issuerAndSerial{Issuer: asn1.RawValue{FullBytes: recipient.RawIssuer}, Serial: recipient.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: params}},
+			EncryptedContent:           encrypted,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidEnvelopedData,
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: ed}})
+}
+
+// openEnvelope decrypts a PKCS#7 EnvelopedData for the recipient certificate with its key,
+// returning the content and its encryption algorithm
+func openEnvelope(der []byte, recipient *x509.Certificate, key *rsa.PrivateKey) ([]byte, asn1.ObjectIdentifier, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, nil, fmt.Errorf("Malformed PKCS#7 enveloped data")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, nil, fmt.Errorf("Malformed PKCS#7 enveloped data: %s", err)
+	}
+	var encryptedKey []byte
+	for _, ri := range ed.RecipientInfos {
+		if bytes.Equal(ri.RID.Issuer.FullBytes, recipient.RawIssuer) && ri.RID.Serial.Cmp(recipient.SerialNumber) == 0 {
+			encryptedKey = ri.EncryptedKey
+		}
+	}
+	if encryptedKey == nil {
+		return nil, nil, fmt.Errorf("PKCS#7 enveloped data is not for %s", recipient.Subject.CommonName)
+	}
+	eci := ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	newCipher, size, ok := contentCipher(alg)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported content encryption algorithm %s", alg)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("Malformed PKCS#7 content encryption parameters")
+	}
+	contentKey := make([]byte, size)
+	if err := rsa.DecryptPKCS1v15SessionKey(rand.Reader, key, encryptedKey, contentKey); err != nil {
+		return nil, nil, err
+	}
+	block, err := newCipher(contentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	content := eci.EncryptedContent
+	if len(iv) != block.BlockSize() || len(content) == 0 || len(content)%block.BlockSize() != 0 {
+		return nil, nil, fmt.Errorf("Malformed PKCS#7 encrypted content")
+	}
+	content = append([]byte{}, content...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, content)
+	padding := int(content[len(content)-1])
+	if padding == 0 || padding > block.BlockSize() ||
+		!bytes.Equal(content[len(content)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, nil, fmt.Errorf("Wrong PKCS#7 content key or padding")
+	}
+	return content[:len(content)-padding], alg, nil
+}
@@ -0,0 +1,299 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Key types and subject fields issuance policies can restrict
+const (
+	KEY_RSA     = "RSA"
+	KEY_ECDSA   = "ECDSA"
+	KEY_ED25519 = "Ed25519"
+	RSA_BITS    = 2048 // size of the keys WebCA generates, unless a policy asks for more
+)
+
+// policyKeyTypes and policySubjectFields are the choices offered on the policy form
+var (
+	policyKeyTypes      = []string{KEY_RSA, KEY_ECDSA, KEY_ED25519}
+	policySubjectFields = []string{"O", "OU", "C", "ST", "L"}
+)
+
+// IssuancePolicy restricts the certificates a CA issues, whatever issues them: the UI, CSR
+// signing or any enrollment protocol. Zero values do not restrict anything
+type IssuancePolicy struct {
+	PermittedDNS   []string // domains DNS names must be in, subdomains included
+	ExcludedDNS    []string // domains DNS names must not be in, subdomains included
+	PermittedIPs   []string // CIDR ranges IP addresses must be in
+	ExcludedIPs    []string // CIDR ranges IP addresses must not be in
+	KeyTypes       []string // KEY_RSA, KEY_ECDSA or KEY_ED25519
+	MinRSABits     int
+	MinECBits      int
+	MaxDays        int
+	RequiredFields []string // subject fields that can't be empty: O, OU, C, ST or L
+	NoWildcards    bool     // forbid wildcard DNS names
+}
+
+// PolicyError reports why the policy or the name constraints of a CA forbid issuing a certificate
+type PolicyError struct {
+	Rule, CA, Name string // Rule is "policy" or "name constraints"
+	Violations     []string
+}
+
+func (pe *PolicyError) Error() string {
+	return fmt.Sprintf("Issuing %s breaks the %s of %s: %s", pe.Name, pe.Rule, pe.CA, strings.Join(pe.Violations, "; "))
+}
+
+// policyOf returns the issuance policy of the CA, or nil if it has none
+func policyOf(ca *Cert) *IssuancePolicy {
+	cfg := LoadConfig()
+	if cfg == nil || ca == nil || ca.Crt == nil {
+		return nil
+	}
+	return cfg.Policies[ca.Crt.Subject.CommonName]
+}
+
+// checkPolicy checks the certificate the CA is about to issue for the public key and days
+// against its issuance policy, if any
+func checkPolicy(ca *Cert, tmpl *x509.Certificate, pub interface{}, days int) error {
+	p := policyOf(ca)
+	if p == nil {
+		return nil
+	}
+	if violations := p.violations(tmpl, pub, days); len(violations) > 0 {
+		return &PolicyError{Rule: "policy", CA: ca.Crt.Subject.CommonName, Name: tmpl.Subject.CommonName, Violations: violations}
+	}
+	return nil
+}
+
+// rsaBits returns the size of the RSA keys to generate, at least the policy minimum
+func (p *IssuancePolicy) rsaBits() int {
+	if p != nil && p.MinRSABits > RSA_BITS {
+		return p.MinRSABits
+	}
+	return RSA_BITS
+}
+
+// HasKeyType tells whether the policy allows the key type explicitly (for templates)
+func (p *IssuancePolicy) HasKeyType(keyType string) bool {
+	return contains(p.KeyTypes, keyType)
+}
+
+// Requires tells whether the policy requires the subject field (for templates)
+func (p *IssuancePolicy) Requires(field string) bool {
+	return contains(p.RequiredFields, field)
+}
+
+// contains tells whether the list has the string
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// inDomain tells whether the DNS name is the domain or one of its subdomains
+func inDomain(name, domain string) bool {
+	name, domain = strings.ToLower(strings.TrimPrefix(name, "*.")), strings.ToLower(domain)
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// inRange tells whether the IP address is in the CIDR range
+func inRange(ip net.IP, cidr string) bool {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	return err == nil && ipnet.Contains(ip)
+}
+
+// hostNames returns the DNS names and IP addresses of the certificate, its common name included
+// when it is a host name or an IP address and the certificate can authenticate servers
+func hostNames(tmpl *x509.Certificate) ([]string, []net.IP) {
+	dnsNames, ips := append([]string{}, tmpl.DNSNames...), append([]net.IP{}, tmpl.IPAddresses...)
+	cn := tmpl.Subject.CommonName
+	switch {
+	case !serverAuth(tmpl): // users' names may look like host names too
+	case net.ParseIP(cn) != nil:
+		ips = append(ips, net.ParseIP(cn))
+	case strings.Contains(cn, ".") && validDNSName(cn) && !contains(dnsNames, cn):
+		dnsNames = append(dnsNames, cn) // a host name
+	}
+	return dnsNames, ips
+}
+
+// violations returns what the certificate for the public key and days breaks of the policy
+func (p *IssuancePolicy) violations(tmpl *x509.Certificate, pub interface{}, days int) []string {
+	violations := make([]string, 0)
+	dnsNames, ips := hostNames(tmpl)
+	for _, name := range dnsNames {
+		violations = append(violations, p.dnsViolations(name)...)
+	}
+	for _, ip := range ips {
+		violations = append(violations, p.ipViolations(ip)...)
+	}
+	violations = append(violations, p.keyViolations(pub)...)
+	if p.MaxDays > 0 && days > p.MaxDays {
+		violations = append(violations, fmt.Sprintf("validity of %d days exceeds the maximum of %d", days, p.MaxDays))
+	}
+	fields := map[string][]string{"O": tmpl.Subject.Organization, "OU": tmpl.Subject.OrganizationalUnit,
+		"C": tmpl.Subject.Country, "ST": tmpl.Subject.Province, "L": tmpl.Subject.Locality}
+	for _, field := range p.RequiredFields {
+		if strings.TrimSpace(strings.Join(fields[field], "")) == "" {
+			violations = append(violations, fmt.Sprintf("subject field %s is required", field))
+		}
+	}
+	return violations
+}
+
+// dnsViolations returns what the DNS name breaks of the policy
+func (p *IssuancePolicy) dnsViolations(name string) []string {
+	violations := make([]string, 0)
+	if strings.HasPrefix(name, "*.") && p.NoWildcards {
+		violations = append(violations, fmt.Sprintf("wildcard name %s is not allowed", name))
+	}
+	permitted := len(p.PermittedDNS) == 0
+	for _, domain := range p.PermittedDNS {
+		permitted = permitted || inDomain(name, domain)
+	}
+	if !permitted {
+		violations = append(violations, fmt.Sprintf("DNS name %s is not in the permitted domains %s", name,
+			strings.Join(p.PermittedDNS, ", ")))
+	}
+	for _, domain := range p.ExcludedDNS {
+		if inDomain(name, domain) {
+			violations = append(violations, fmt.Sprintf("DNS name %s is in the excluded domain %s", name, domain))
+		}
+	}
+	return violations
+}
+
+// ipViolations returns what the IP address breaks of the policy
+func (p *IssuancePolicy) ipViolations(ip net.IP) []string {
+	violations := make([]string, 0)
+	permitted := len(p.PermittedIPs) == 0
+	for _, cidr := range p.PermittedIPs {
+		permitted = permitted || inRange(ip, cidr)
+	}
+	if !permitted {
+		violations = append(violations, fmt.Sprintf("IP address %s is not in the permitted ranges %s", ip,
+			strings.Join(p.PermittedIPs, ", ")))
+	}
+	for _, cidr := range p.ExcludedIPs {
+		if inRange(ip, cidr) {
+			violations = append(violations, fmt.Sprintf("IP address %s is in the excluded range %s", ip, cidr))
+		}
+	}
+	return violations
+}
+
+// keyViolations returns what the public key breaks of the policy
+func (p *IssuancePolicy) keyViolations(pub interface{}) []string {
+	keyType, bits, min := "", 0, 0
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		keyType, bits, min = KEY_RSA, k.N.BitLen(), p.MinRSABits
+	case *ecdsa.PublicKey:
+		keyType, bits, min = KEY_ECDSA, k.Curve.Params().BitSize, p.MinECBits
+	case ed25519.PublicKey:
+		keyType = KEY_ED25519
+	default:
+		return []string{fmt.Sprintf("key type %T is not supported", pub)}
+	}
+	if len(p.KeyTypes) > 0 && !contains(p.KeyTypes, keyType) {
+		return []string{fmt.Sprintf("%s keys are not allowed, only %s", keyType, strings.Join(p.KeyTypes, ", "))}
+	}
+	if bits < min {
+		return []string{fmt.Sprintf("%s key of %d bits is shorter than the minimum of %d", keyType, bits, min)}
+	}
+	return nil
+}
+
+// setPolicy sets the issuance policy of the CA on its page, empty if it has none
+func setPolicy(ps PageStatus, c *Cert) {
+	ps["Policy"] = &IssuancePolicy{}
+	if p := policyOf(c); p != nil {
+		ps["Policy"] = p
+	}
+	ps["KeyTypes"], ps["SubjectFields"] = policyKeyTypes, policySubjectFields
+}
+
+// issuancePolicy sets or, when nothing is restricted, removes the issuance policy of the CA
+func issuancePolicy(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	name := c.Crt.Subject.CommonName
+	cfg := LoadConfig()
+	p, err := readPolicy(r)
+	if err == nil && !c.Crt.IsCA {
+		err = fmt.Errorf(tr("%s can't issue certificates!", name))
+	}
+	if err == nil {
+		if cfg.Policies == nil {
+			cfg.Policies = make(map[string]*IssuancePolicy)
+		}
+		delete(cfg.Policies, name)
+		if p != nil {
+			cfg.Policies[name] = p
+		}
+		err = cfg.Save()
+	}
+	auditCert(r, "issuancePolicy", name, c, err)
+	if err != nil {
+		ps["Error"] = err.Error()
+	}
+	certControlPage(w, r, ps, c)
+}
+
+// readPolicy reads the issuance policy from the request, nil if it restricts nothing
+func readPolicy(r *http.Request) (*IssuancePolicy, error) {
+	p := &IssuancePolicy{
+		PermittedDNS: splitNames(r.FormValue("PermittedDNS")),
+		ExcludedDNS:  splitNames(r.FormValue("ExcludedDNS")),
+		PermittedIPs: splitNames(r.FormValue("PermittedIPs")),
+		ExcludedIPs:  splitNames(r.FormValue("ExcludedIPs")),
+		NoWildcards:  r.FormValue("NoWildcards") != "",
+	}
+	for _, cidr := range append(append([]string{}, p.PermittedIPs...), p.ExcludedIPs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf(tr("Wrong IP range %s, use CIDR notation as in 10.0.0.0/8!", cidr))
+		}
+	}
+	for _, keyType := range policyKeyTypes {
+		if r.FormValue("KeyType."+keyType) != "" {
+			p.KeyTypes = append(p.KeyTypes, keyType)
+		}
+	}
+	for _, field := range policySubjectFields {
+		if r.FormValue("Required."+field) != "" {
+			p.RequiredFields = append(p.RequiredFields, field)
+		}
+	}
+	for field, value := range map[string]*int{"MinRSABits": &p.MinRSABits, "MinECBits": &p.MinECBits,
+		"MaxDays": &p.MaxDays} {
+		if s := strings.TrimSpace(r.FormValue(field)); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf(tr("Wrong %s %s!", field, s))
+			}
+			*value = n
+		}
+	}
+	if len(p.PermittedDNS)+len(p.ExcludedDNS)+len(p.PermittedIPs)+len(p.ExcludedIPs)+len(p.KeyTypes)+
+		len(p.RequiredFields)+p.MinRSABits+p.MinECBits+p.MaxDays == 0 && !p.NoWildcards {
+		return nil, nil // restricts nothing
+	}
+	return p, nil
+}
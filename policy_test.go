@@ -0,0 +1,101 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPolicyViolations(t *testing.T) {
+	p := &IssuancePolicy{PermittedDNS: []string{"example.com"}, ExcludedDNS: []string{"secret.example.com"},
+		PermittedIPs: []string{"10.0.0.0/8"}, ExcludedIPs: []string{"10.6.6.0/24"}, KeyTypes: []string{KEY_RSA},
+		MinRSABits: 2048, MaxDays: 90, RequiredFields: []string{"O"}, NoWildcards: true}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	dieOnError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	dieOnError(t, err)
+	ok := pkix.Name{CommonName: "www.example.com", Organization: []string{"WebCA"}}
+	for i, test := range []struct {
+		name      pkix.Name
+		dnsNames  []string
+		ip        string
+		pub       interface{}
+		days      int
+		violation string
+	}{
+		{ok, nil, "", &rsaKey.PublicKey, 90, "shorter than the minimum of 2048"},
+		{ok, nil, "", &ecKey.PublicKey, 90, "ECDSA keys are not allowed"},
+		{ok, []string{"www.example.org"}, "", &ecKey.PublicKey, 90, "www.example.org is not in the permitted domains"},
+		{ok, []string{"db.secret.example.com"}, "", &ecKey.PublicKey, 90, "in the excluded domain secret.example.com"},
+		{ok, []string{"*.example.com"}, "", &ecKey.PublicKey, 90, "wildcard name *.example.com is not allowed"},
+		{ok, nil, "192.168.1.1", &ecKey.PublicKey, 90, "192.168.1.1 is not in the permitted ranges"},
+		{ok, nil, "10.6.6.6", &ecKey.PublicKey, 90, "in the excluded range 10.6.6.0/24"},
+		{ok, nil, "", &ecKey.PublicKey, 91, "validity of 91 days exceeds the maximum of 90"},
+		{pkix.Name{CommonName: "www.example.com"}, nil, "", &ecKey.PublicKey, 90, "subject field O is required"},
+		{pkix.Name{CommonName: "evil.org", Organization: []string{"WebCA"}}, nil, "", &ecKey.PublicKey, 90,
+			"evil.org is not in the permitted domains"},
+	} {
+		tmpl := &x509.Certificate{Subject: test.name, DNSNames: test.dnsNames}
+		if test.ip != "" {
+			tmpl.IPAddresses = []net.IP{net.ParseIP(test.ip)}
+		}
+		if violations := p.violations(tmpl, test.pub, test.days); !strings.Contains(strings.Join(violations, "; "), test.violation) {
+			t.Errorf("%d: expected %q violation, got %v", i, test.violation, violations)
+		}
+	}
+	p.KeyTypes = append(p.KeyTypes, KEY_ECDSA)
+	tmpl := &x509.Certificate{Subject: ok, DNSNames: []string{"api.example.com"}, IPAddresses: []net.IP{net.ParseIP("10.1.2.3")}}
+	if violations := p.violations(tmpl, &ecKey.PublicKey, 30); len(violations) != 0 {
+		t.Fatalf("Unexpected violations %v", violations)
+	}
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	inTempDir(t, func() {
+		cfg := testConfig(t)
+		cfg.Policies = map[string]*IssuancePolicy{"TestCA": {PermittedDNS: []string{"example.com"},
+			KeyTypes: []string{KEY_RSA}, MinRSABits: 2048, MaxDays: 30}}
+		dieOnError(t, cfg.Save())
+		ca := FindCert("TestCA")
+
+		c, err := GenCert(ca, "www.example.com", 30)
+		dieOnError(t, err)
+		if c.Key.N.BitLen() != 2048 {
+			t.Fatalf("Generated a %d bits key below the policy minimum", c.Key.N.BitLen())
+		}
+		if _, err := GenCert(ca, "www.example.org", 30); err == nil || !strings.Contains(err.Error(), "breaks the policy of TestCA") {
+			t.Fatalf("Generated a name out of the permitted domains: %v", err)
+		}
+		if FindCert("www.example.org") != nil {
+			t.Fatal("Kept a certificate forbidden by the policy")
+		}
+		if _, err := ResignCertBy(c, "admin"); err != nil {
+			t.Fatalf("Failed to renew within the policy: %v", err)
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		dieOnError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "api.example.com"}}, key)
+		dieOnError(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		dieOnError(t, err)
+		if _, err := SignCSR(ca, csr.Subject, csr, 30); err == nil || !strings.Contains(err.Error(), "ECDSA keys are not allowed") {
+			t.Fatalf("Signed a CSR with a key type not allowed: %v", err)
+		}
+		cfg.Policies["TestCA"].KeyTypes = nil
+		dieOnError(t, cfg.Save())
+		if _, err := SignCSR(ca, csr.Subject, csr, 31); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+			t.Fatalf("Signed a CSR for too long: %v", err)
+		}
+		if _, err := SignCSR(ca, csr.Subject, csr, 30); err != nil {
+			t.Fatalf("Failed to sign a CSR within the policy: %v", err)
+		}
+	})
+}
@@ -0,0 +1,449 @@
+package webca
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+const (
+	QR_SCALE = 6 // pixels per QR module
+	QR_QUIET = 4 // quiet zone around the QR code in modules
+)
+
+// qrECCPerBlock and qrBlocks hold the error correction layout for level M by version (1 to 10)
+var (
+	qrECCPerBlock = []int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26}
+	qrBlocks      = []int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5}
+)
+
+// qrCode is a QR code symbol (ISO/IEC 18004) in byte mode with error correction level M
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// QRCodePNG writes data as a QR code PNG image, for authenticator apps to scan it
+func QRCodePNG(w io.Writer, data []byte) error {
+	qr, err := newQRCode(data)
+	if err != nil {
+		return err
+	}
+	side := (qr.size + 2*QR_QUIET) * QR_SCALE
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			mx, my := x/QR_SCALE-QR_QUIET, y/QR_SCALE-QR_QUIET
+			dark := mx >= 0 && my >= 0 && mx < qr.size && my < qr.size && qr.modules[my][mx]
+			if dark {
+				img.SetGray(x, y, color.Gray{0})
+			} else {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// newQRCode encodes data in the smallest version that fits it
+func newQRCode(data []byte) (*qrCode, error) {
+	for version := 1; version < len(qrBlocks); version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		capacity := qrDataCodewords(version) * 8
+		if 4+countBits+len(data)*8 > capacity {
+			continue
+		}
+		bits := make([]bool, 0, capacity)
+		bits = appendBits(bits, 4, 4) // byte mode
+		bits = appendBits(bits, uint(len(data)), countBits)
+		for _, b := range data {
+			bits = appendBits(bits, uint(b), 8)
+		}
+		for i := 0; i < 4 && len(bits) < capacity; i++ { // terminator
+			bits = append(bits, false)
+		}
+		for len(bits)%8 != 0 {
+			bits = append(bits, false)
+		}
+		codewords := make([]byte, 0, capacity/8)
+		for i := 0; i < len(bits); i += 8 {
+			var b byte
+			for j := 0; j < 8; j++ {
+				if bits[i+j] {
+					b |= 1 << uint(7-j)
+				}
+			}
+			codewords = append(codewords, b)
+		}
+		for pad := byte(0xEC); len(codewords) < capacity/8; pad ^= 0xEC ^ 0x11 {
+			codewords = append(codewords, pad)
+		}
+		return qrBuild(version, qrInterleave(version, codewords)), nil
+	}
+	return nil, fmt.Errorf("Too much data for a QR code: %d bytes", len(data))
+}
+
+// appendBits appends the n lower bits of val, most significant first
+func appendBits(bits []bool, val uint, n int) []bool {
+	for i := n - 1; i >= 0; i-- {
+		bits = append(bits, (val>>uint(i))&1 != 0)
+	}
+	return bits
+}
+
+// qrRawModules returns the number of modules available for data and error correction
+func qrRawModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// qrDataCodewords returns the number of data codewords of the version at level M
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrBlocks[version]
+}
+
+// qrInterleave splits data in blocks, adds their Reed-Solomon codewords and interleaves them
+func qrInterleave(version int, data []byte) []byte {
+	numBlocks, eccLen := qrBlocks[version], qrECCPerBlock[version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		dat := append([]byte{}, data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(dat, divisor)
+		if i < numShort {
+			dat = append(dat, 0)
+		}
+		blocks[i] = append(dat, ecc...)
+	}
+	result := make([]byte, 0, raw)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrBuild places the function patterns and codewords, choosing the mask with the lowest penalty
+func qrBuild(version int, codewords []byte) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{size: size, modules: newGrid(size), function: newGrid(size)}
+	qr.drawFunctionPatterns(version)
+	qr.drawCodewords(codewords)
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if p := qr.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		qr.applyMask(mask) // undo
+	}
+	qr.applyMask(best)
+	qr.drawFormatBits(best)
+	return qr
+}
+
+// newGrid returns a size x size grid of modules
+func newGrid(size int) [][]bool {
+	grid := make([][]bool, size)
+	for i := range grid {
+		grid[i] = make([]bool, size)
+	}
+	return grid
+}
+
+// set sets a function module
+func (qr *qrCode) set(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// drawFunctionPatterns draws timing, finder, alignment and version patterns and reserves
+// the format bits area
+func (qr *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < qr.size; i++ {
+		qr.set(6, i, i%2 == 0)
+		qr.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {qr.size - 4, 3}, {3, qr.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && y >= 0 && x < qr.size && y < qr.size {
+					d := maxAbs(dx, dy)
+					qr.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qr.alignmentPositions(version)
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.set(pos[i]+dx, pos[j]+dy, maxAbs(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	qr.drawFormatBits(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := qr.size-11+i%3, i/3
+			qr.set(a, b, dark)
+			qr.set(b, a, dark)
+		}
+	}
+}
+
+// alignmentPositions returns the alignment pattern centre coordinates of the version
+func (qr *qrCode) alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, qr.size-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// drawFormatBits draws both copies of the format bits for level M and the given mask
+func (qr *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		qr.set(8, i, bit(i))
+	}
+	qr.set(8, 7, bit(6))
+	qr.set(8, 8, bit(7))
+	qr.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qr.set(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.set(8, qr.size-15+i, bit(i))
+	}
+	qr.set(8, qr.size-8, true)
+}
+
+// drawCodewords places the codewords bits in zigzag order over the non function modules
+func (qr *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if !qr.function[y][x] && i < len(data)*8 {
+					qr.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the non function modules selected by the mask pattern
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !qr.function[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to read: same colour runs and blocks, finder-like
+// patterns and dark/light imbalance
+func (qr *qrCode) penalty() int {
+	result, dark := 0, 0
+	at := func(x, y int, transposed bool) bool {
+		if transposed {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			run := 1
+			for x := 1; x <= qr.size; x++ {
+				if x < qr.size && at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= qr.size; x++ {
+				if at(x, y, transposed) && !at(x+1, y, transposed) && at(x+2, y, transposed) &&
+					at(x+3, y, transposed) && at(x+4, y, transposed) && !at(x+5, y, transposed) &&
+					at(x+6, y, transposed) && (qr.lightRun(x-4, x, y, transposed) ||
+					qr.lightRun(x+7, x+11, y, transposed)) {
+					result += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := qr.modules[y][x]
+				if c == qr.modules[y][x-1] && c == qr.modules[y-1][x] && c == qr.modules[y-1][x-1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := qr.size * qr.size
+	k := (maxAbs(dark*20-total*10, 0)+total-1)/total - 1
+	if k > 0 {
+		result += k * 10
+	}
+	return result
+}
+
+// lightRun tells whether modules from..to (exclusive) on the line are light or outside the symbol
+func (qr *qrCode) lightRun(from, to, y int, transposed bool) bool {
+	for x := from; x < to; x++ {
+		if x < 0 || x >= qr.size {
+			continue
+		}
+		if (transposed && qr.modules[x][y]) || (!transposed && qr.modules[y][x]) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxAbs returns the greatest absolute value of a and b
+func maxAbs(a, b int) int {
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,616 @@
+package webca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CERT_REQUESTS     = ".webca.requests" // certificate requests and their history, as JSON
+	REQUEST_DAYS      = 365               // default validity of the certificates requested
+	REQUEST_KEY_BITS  = 2048              // size of the keys WebCA generates for requests without a CSR
+	REQUEST_PENDING   = "pending"
+	REQUEST_ISSUED    = "issued"
+	REQUEST_REJECTED  = "rejected"
+	REQUEST_CANCELLED = "cancelled"
+)
+
+// CertRequest is a certificate requested by a user, to be approved or rejected by another one
+type CertRequest struct {
+	ID            int
+	Requester     string
+	Created       time.Time
+	CA            string   // name of the CA to issue the certificate
+	CommonName    string   // name of the certificate
+	SANs          []string // DNS names, IP addresses and email addresses
+	Profile       string   // EST_CLIENT, EST_SERVER or EST_DEVICE usages, as for EST
+	Days          int
+	Justification string
+	CSR           []byte `json:",omitempty"` // DER CSR, nil when WebCA generates the key on approval
+	Status        string
+	Approver      string `json:",omitempty"` // who approved or rejected it
+	Reason        string `json:",omitempty"` // given by the approver when rejecting it
+	Serial        string `json:",omitempty"` // of the certificate issued
+	History       []RequestEvent
+}
+
+// RequestEvent is something done on a certificate request
+type RequestEvent struct {
+	Time   time.Time
+	User   string
+	Action string
+	Detail string `json:",omitempty"`
+}
+
+// requestsMutex serializes the changes to the certificate requests file
+var requestsMutex sync.Mutex
+
+// log appends an event to the history of the request
+func (cr *CertRequest) log(username, action, detail string) {
+	cr.History = append(cr.History, RequestEvent{Time: time.Now(), User: username, Action: action, Detail: detail})
+}
+
+// Pending tells whether the request still awaits a decision
+func (cr *CertRequest) Pending() bool {
+	return cr.Status == REQUEST_PENDING
+}
+
+// Generated tells whether WebCA generates the key of the certificate, instead of signing a CSR
+func (cr *CertRequest) Generated() bool {
+	return len(cr.CSR) == 0
+}
+
+// Collisions warns about what else goes by the name of the request: a user, whose client
+// certificate it would look like, or a certificate it would replace or clash with
+func (cr *CertRequest) Collisions() []string {
+	warnings := make([]string, 0)
+	if cfg := LoadConfig(); cfg != nil {
+		if cfg.getUser(cr.CommonName).Username != "" {
+			warnings = append(warnings, tr("%s is also the name of a user!", cr.CommonName))
+		}
+	}
+	if c := FindCert(cr.CommonName); c != nil && c.Crt.Raw != nil {
+		warnings = append(warnings, tr("There is already a certificate named %s, issued by %s!",
+			cr.CommonName, c.Crt.Issuer.CommonName))
+	}
+	return warnings
+}
+
+// visibleTo tells whether the User can see the request, approvers see them all
+func (cr *CertRequest) visibleTo(u User) bool {
+	return cr.Requester == u.Username || u.can(PERM_APPROVE)
+}
+
+// decidableBy tells whether the User can approve, edit or reject the request, not its requester
+func (cr *CertRequest) decidableBy(u User) bool {
+	return cr.Pending() && u.can(PERM_APPROVE) && cr.Requester != u.Username
+}
+
+// readRequests reads all certificate requests, there are none before the first one
+func readRequests() ([]*CertRequest, error) {
+	reqs := make([]*CertRequest, 0)
+	data, err := ioutil.ReadFile(CERT_REQUESTS)
+	if os.IsNotExist(err) {
+		return reqs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		return nil, fmt.Errorf("Failed to read the certificate requests: %s", err)
+	}
+	return reqs, nil
+}
+
+// saveRequests writes all certificate requests, with requestsMutex held
+func saveRequests(reqs []*CertRequest) error {
+	data, err := json.MarshalIndent(reqs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(CERT_REQUESTS+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(CERT_REQUESTS+".tmp", CERT_REQUESTS)
+}
+
+// findRequest returns the request with the ID, or nil
+func findRequest(reqs []*CertRequest, id int) *CertRequest {
+	for _, cr := range reqs {
+		if cr.ID == id {
+			return cr
+		}
+	}
+	return nil
+}
+
+// issuingCAs returns the names of the CAs that can issue requested certificates
+func issuingCAs() []string {
+	names := make([]string, 0)
+	ct := ListCerts()
+	if ct == nil {
+		return names
+	}
+	for _, c := range ct.names {
+		if c.Crt.IsCA && c.Key != nil {
+			names = append(names, c.Crt.Subject.CommonName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitNames splits a list of names separated by commas or spaces
+func splitNames(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' })
+}
+
+// parseCSR parses a CSR in PEM or base64 DER
+func parseCSR(s string) (*x509.CertificateRequest, error) {
+	der := []byte(nil)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), "")); err != nil {
+			return nil, fmt.Errorf(tr("The CSR is neither PEM nor base64!"))
+		}
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf(tr("Wrong CSR: %s", err))
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf(tr("Wrong CSR signature: %s", err))
+	}
+	return csr, nil
+}
+
+// csrSANs returns the alternative names of the CSR, as they are kept on requests
+func csrSANs(csr *x509.CertificateRequest) []string {
+	sans := append([]string{}, csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return append(sans, csr.EmailAddresses...)
+}
+
+// setSANs sets the alternative names of the request on the certificate request template
+func setSANs(tmpl *x509.CertificateRequest, sans []string) {
+	tmpl.DNSNames, tmpl.IPAddresses, tmpl.EmailAddresses = nil, nil, nil
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if strings.Contains(san, "@") {
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, san)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+}
+
+// readRequestSettings reads what is to be issued from the request form into the certificate
+// request, these are the settings approvers can edit. The name is kept when none is given
+func readRequestSettings(cr *CertRequest, r *http.Request) error {
+	cr.CA = r.FormValue("CA")
+	if ca := FindCert(cr.CA); ca == nil || !ca.Crt.IsCA || ca.Key == nil {
+		return fmt.Errorf(tr("%s can't issue certificates!", cr.CA))
+	}
+	if cn := strings.TrimSpace(r.FormValue("CommonName")); cn != "" {
+		cr.CommonName = cn
+	}
+	if cr.CommonName == "" {
+		return fmt.Errorf(tr("Can't create a certificate with no name!"))
+	}
+	if checkFilename(cr.CommonName) != nil {
+		return fmt.Errorf(tr("%s can't be the name of a certificate!", cr.CommonName))
+	}
+	cr.SANs = splitNames(r.FormValue("SANs"))
+	cr.Profile = r.FormValue("Profile")
+	if _, ok := estProfiles[cr.Profile]; !ok {
+		return fmt.Errorf(tr("Unknown profile %s!", cr.Profile))
+	}
+	cr.Days = REQUEST_DAYS
+	if days := r.FormValue("Days"); days != "" {
+		if _, err := fmt.Sscan(days, &cr.Days); err != nil || cr.Days < 1 {
+			return fmt.Errorf(tr("Wrong validity days %s!", days))
+		}
+	}
+	return nil
+}
+
+// newRequest returns the certificate request submitted by the user, named and with the
+// alternative names of its CSR unless others are given
+func newRequest(r *http.Request, username string) (*CertRequest, error) {
+	cr := &CertRequest{Requester: username, Created: time.Now(), Status: REQUEST_PENDING,
+		Justification: strings.TrimSpace(r.FormValue("Justification"))}
+	var csr *x509.CertificateRequest
+	if s := strings.TrimSpace(r.FormValue("CSR")); s != "" {
+		var err error
+		if csr, err = parseCSR(s); err != nil {
+			return nil, err
+		}
+		cr.CSR, cr.CommonName = csr.Raw, csr.Subject.CommonName
+	}
+	if err := readRequestSettings(cr, r); err != nil {
+		return nil, err
+	}
+	if csr != nil && len(cr.SANs) == 0 {
+		cr.SANs = csrSANs(csr)
+	}
+	if cr.Justification == "" {
+		return nil, fmt.Errorf(tr("Justify why the certificate is needed!"))
+	}
+	return cr, nil
+}
+
+// issueRequest issues the certificate requested, signing its CSR or a new key generated by
+// WebCA, which is kept like those of the certificates generated from the UI
+func issueRequest(cr *CertRequest) (*Cert, error) {
+	ca := FindCert(cr.CA)
+	if ca == nil {
+		return nil, fmt.Errorf("CA %s not found", cr.CA)
+	}
+	name := copyName(ca.Crt.Subject)
+	name.CommonName = cr.CommonName
+	var key *rsa.PrivateKey
+	var csr *x509.CertificateRequest
+	var err error
+	if cr.Generated() {
+		if key, err = rsa.GenerateKey(rand.Reader, REQUEST_KEY_BITS); err != nil {
+			return nil, fmt.Errorf("Failed to generate private key: %s", err)
+		}
+		tmpl := &x509.CertificateRequest{Subject: name}
+		setSANs(tmpl, cr.SANs)
+		der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create the CSR: %s", err)
+		}
+		if csr, err = x509.ParseCertificateRequest(der); err != nil {
+			return nil, err
+		}
+	} else {
+		if csr, err = x509.ParseCertificateRequest(cr.CSR); err != nil {
+			return nil, err
+		}
+		setSANs(csr, cr.SANs) // the names approved, the signature covers the raw CSR only
+	}
+	c, err := SignCSR(ca, name, csr, cr.Days, estProfiles[cr.Profile]...)
+	if err != nil || key == nil {
+		return c, err
+	}
+	keyname := keyFile(*c)
+	keyOut, err := os.OpenFile(keyname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open "+keyname+" for writing: %s", err)
+	}
+	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyOut.Close()
+	c.Key = key
+	invalidateCertree()
+	return c, nil
+}
+
+// requestURL returns the URL of the request page
+func requestURL(cfg *config, cr *CertRequest) string {
+	if cfg.WebCert == nil {
+		return fmt.Sprintf("/request?id=%d", cr.ID)
+	}
+	return fmt.Sprintf("%s/request?id=%d", cfg.Listen.baseURL(cfg), cr.ID)
+}
+
+// notifyApprovers emails the users who can decide on the new request
+func notifyApprovers(cfg *config, cr *CertRequest) {
+	subject := tr("Certificate request #%d for %s", cr.ID, cr.CommonName)
+	body := tr("%s requests a certificate for %s issued by %s:\n\n%s\n\nApprove or reject it at %s\n",
+		cr.Requester, cr.CommonName, cr.CA, cr.Justification, requestURL(cfg, cr))
+	notifyUsers(cfg, func(u User) bool { return u.can(PERM_APPROVE) && u.Username != cr.Requester },
+		subject, body)
+}
+
+// notifyRequester emails the requester the decision on the request
+func notifyRequester(cfg *config, cr *CertRequest) {
+	subject := tr("Certificate request #%d for %s %s", cr.ID, cr.CommonName, cr.Status)
+	body := tr("%s has %s your request: %s\n\nSee it at %s\n", cr.Approver, cr.Status, cr.Reason,
+		requestURL(cfg, cr))
+	if cr.Status == REQUEST_ISSUED {
+		body = tr("%s has approved your request, download the certificate at %s\n", cr.Approver,
+			requestURL(cfg, cr))
+	}
+	notifyUsers(cfg, func(u User) bool { return u.Username == cr.Requester }, subject, body)
+}
+
+// requests shows the certificate requests the user can see, pending ones first, and submits
+// new ones
+func requests(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u := ps[LOGGEDUSER].(User)
+	if r.Method == "POST" {
+		cr, err := newRequest(r, u.Username)
+		if err == nil {
+			err = submitRequest(cr)
+		}
+		e := requestEntry(r, "request.submit", r.FormValue("CommonName"), err)
+		if err == nil {
+			e.Target, e.Detail = cr.CommonName, fmt.Sprintf("#%d", cr.ID)
+		}
+		record(e)
+		if err == nil {
+			notifyApprovers(LoadConfig(), cr)
+			http.Redirect(w, r, fmt.Sprintf("/request?id=%d", cr.ID), 302)
+			return
+		}
+		ps["Error"] = err.Error()
+	}
+	ps["CSR"], ps["Justification"] = r.FormValue("CSR"), r.FormValue("Justification")
+	ps["Settings"] = settingsForm(r.FormValue("CA"), r.FormValue("CommonName"), r.FormValue("SANs"),
+		r.FormValue("Profile"), r.FormValue("Days"))
+	reqs, err := visibleRequests(u)
+	if handleError(w, r, err) {
+		return
+	}
+	queue, history := make([]*CertRequest, 0), make([]*CertRequest, 0)
+	for _, cr := range reqs {
+		if cr.Pending() {
+			queue = append(queue, cr)
+		} else {
+			history = append(history, cr)
+		}
+	}
+	ps["Queue"], ps["History"] = queue, history
+	err = templates.ExecuteTemplate(w, "requests", ps)
+	handleError(w, r, err)
+}
+
+// settingsForm returns what the form of the request settings shows
+func settingsForm(ca, cn, sans, profile string, days interface{}) PageStatus {
+	return PageStatus{"CA": ca, "CommonName": cn, "SANs": sans, "Profile": profile, "Days": days,
+		"CAs": issuingCAs(), "Profiles": []string{EST_SERVER, EST_CLIENT, EST_DEVICE}}
+}
+
+// submitRequest numbers and stores the new request
+func submitRequest(cr *CertRequest) error {
+	requestsMutex.Lock()
+	defer requestsMutex.Unlock()
+	reqs, err := readRequests()
+	if err != nil {
+		return err
+	}
+	cr.ID = 1
+	if len(reqs) > 0 {
+		cr.ID = reqs[len(reqs)-1].ID + 1
+	}
+	how := "CSR"
+	if cr.Generated() {
+		how = "key generated by WebCA"
+	}
+	cr.log(cr.Requester, "submit", how)
+	return saveRequests(append(reqs, cr))
+}
+
+// visibleRequests returns the requests the user can see, newest first
+func visibleRequests(u User) ([]*CertRequest, error) {
+	reqs, err := readRequests()
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]*CertRequest, 0, len(reqs))
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if reqs[i].visibleTo(u) {
+			visible = append(visible, reqs[i])
+		}
+	}
+	return visible, nil
+}
+
+// requestOrFail returns the request with the ID given on the http request if the user can see it
+func requestOrFail(r *http.Request, u User) (*CertRequest, error) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return nil, fmt.Errorf(tr("Wrong request id %s!", r.FormValue("id")))
+	}
+	reqs, err := readRequests()
+	if err != nil {
+		return nil, err
+	}
+	if cr := findRequest(reqs, id); cr != nil && cr.visibleTo(u) {
+		return cr, nil
+	}
+	return nil, fmt.Errorf(tr("Request #%d not found!", id))
+}
+
+// request shows a certificate request and applies the decisions of approvers on it, or the
+// cancellation of its requester
+func request(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u := ps[LOGGEDUSER].(User)
+	cr, err := requestOrFail(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		action := r.FormValue("action")
+		decided, c, err := decideRequest(cr.ID, u, action, r)
+		if decided != nil {
+			cr = decided
+		}
+		e := requestEntry(r, "request."+action, cr.CommonName, err)
+		e.Detail = strings.TrimSpace(fmt.Sprintf("#%d %s", cr.ID, e.Detail))
+		if c != nil {
+			e.Serial = serialOf(c.Crt)
+		}
+		record(e)
+		if err != nil {
+			ps["Error"] = err.Error()
+		} else if action != "edit" {
+			notifyRequester(LoadConfig(), cr)
+		}
+	}
+	ps["Request"] = cr
+	ps["CanDecide"] = cr.decidableBy(u)
+	ps["CanCancel"] = cr.Pending() && cr.Requester == u.Username
+	ps["CanDownloadKey"] = cr.Status == REQUEST_ISSUED && cr.Generated() && cr.Requester == u.Username
+	ps["Settings"] = settingsForm(cr.CA, cr.CommonName, strings.Join(cr.SANs, ", "), cr.Profile, cr.Days)
+	err = templates.ExecuteTemplate(w, "request", ps)
+	handleError(w, r, err)
+}
+
+// decideRequest applies the action of the user on the pending request: editing, approving
+// (with any edits) or rejecting it, or cancelling it when the user is the requester. It returns
+// the request, as changed if it succeeds, and the certificate issued, if any
+func decideRequest(id int, u User, action string, r *http.Request) (*CertRequest, *Cert, error) {
+	requestsMutex.Lock()
+	defer requestsMutex.Unlock()
+	reqs, err := readRequests()
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := findRequest(reqs, id)
+	if cr == nil || !cr.visibleTo(u) {
+		return nil, nil, fmt.Errorf(tr("Request #%d not found!", id))
+	}
+	before := *cr
+	if !cr.Pending() {
+		return &before, nil, fmt.Errorf(tr("Request #%d is already %s!", id, cr.Status))
+	}
+	if action == "cancel" {
+		if cr.Requester != u.Username {
+			return &before, nil, fmt.Errorf(tr("Only %s can cancel request #%d!", cr.Requester, id))
+		}
+		cr.Status = REQUEST_CANCELLED
+		cr.log(u.Username, action, "")
+		return cr, nil, saveRequests(reqs)
+	}
+	if !cr.decidableBy(u) {
+		return &before, nil, fmt.Errorf(tr("You can't decide on request #%d!", id))
+	}
+	var c *Cert
+	switch action {
+	case "edit", "approve":
+		if err := readRequestSettings(cr, r); err != nil {
+			return &before, nil, err
+		}
+		if changes := requestChanges(&before, cr); changes != "" {
+			cr.log(u.Username, "edit", changes)
+		}
+		if action == "edit" {
+			break
+		}
+		if c, err = issueRequest(cr); err != nil {
+			return &before, nil, err
+		}
+		cr.Status, cr.Approver, cr.Serial = REQUEST_ISSUED, u.Username, serialOf(c.Crt)
+		cr.log(u.Username, action, "serial "+cr.Serial)
+	case "reject":
+		cr.Status, cr.Approver, cr.Reason = REQUEST_REJECTED, u.Username, strings.TrimSpace(r.FormValue("Reason"))
+		cr.log(u.Username, action, cr.Reason)
+	default:
+		return &before, nil, fmt.Errorf(tr("Unknown action %s!", action))
+	}
+	return cr, c, saveRequests(reqs)
+}
+
+// requestChanges describes what an edit changed of the request
+func requestChanges(before, after *CertRequest) string {
+	changes := make([]string, 0)
+	change := func(what string, from, to interface{}) {
+		if fmt.Sprint(from) != fmt.Sprint(to) {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", what, from, to))
+		}
+	}
+	change("CA", before.CA, after.CA)
+	change("name", before.CommonName, after.CommonName)
+	change("SANs", before.SANs, after.SANs)
+	change("profile", before.Profile, after.Profile)
+	change("days", before.Days, after.Days)
+	return strings.Join(changes, ", ")
+}
+
+// requestDownload downloads the certificate issued for a request, or the PKCS#12 bundle with its
+// key generated by WebCA when its requester posts a password for it
+func requestDownload(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u := ps[LOGGEDUSER].(User)
+	cr, err := requestOrFail(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c := FindCert(cr.CommonName)
+	if cr.Status != REQUEST_ISSUED || c == nil || serialOf(c.Crt) != cr.Serial {
+		http.Error(w, tr("The certificate of request #%d is not available!", cr.ID), http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		crt, err := ReadCert(c)
+		if handleError(w, r, err) {
+			return
+		}
+		w.Header().Set("Content-disposition", "attachment; filename="+cr.CommonName+CERT_SUFFIX)
+		w.Header().Set("Content-type", "application/x-pem-file")
+		w.Write(crt)
+		return
+	}
+	if !cr.Generated() || cr.Requester != u.Username || c.Key == nil {
+		http.Error(w, tr("Access Denied"), http.StatusForbidden)
+		return
+	}
+	password := r.FormValue("Password")
+	if password == "" {
+		http.Error(w, tr("Type some password!"), http.StatusBadRequest)
+		return
+	}
+	p12, err := EncodePKCS12(c, password)
+	auditCert(r, "request.downloadKey", cr.CommonName, c, err)
+	if handleError(w, r, err) {
+		return
+	}
+	w.Header().Set("Content-disposition", "attachment; filename="+cr.CommonName+P12_SUFFIX)
+	w.Header().Set("Content-type", "application/x-pkcs12")
+	w.Write(p12)
+}
+
+// requestsExport lists the certificate requests the user can see as JSON, newest first and
+// optionally filtered by status
+func requestsExport(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	reqs, err := visibleRequests(ps[LOGGEDUSER].(User))
+	if handleError(w, r, err) {
+		return
+	}
+	status := r.FormValue("Status")
+	matching := make([]*CertRequest, 0, len(reqs))
+	for _, cr := range reqs {
+		if status == "" || cr.Status == status {
+			matching = append(matching, cr)
+		}
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(matching)
+}
@@ -0,0 +1,169 @@
+package webca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loggedClient returns a client logged in WebCA as the user, with its CSRF token
+func loggedClient(t *testing.T, webca, username, password string) (*http.Client, string) {
+	jar, err := cookiejar.New(nil)
+	dieOnError(t, err)
+	client := &http.Client{Jar: jar}
+	token := getCSRF(t, client, webca+"/")
+	resp, err := client.PostForm(webca+"/login",
+		url.Values{"Username": {username}, "Password": {password}, CSRFFIELD: {token}})
+	dieOnError(t, err)
+	resp.Body.Close()
+	return client, getCSRF(t, client, webca+"/requests")
+}
+
+// postRequestForm posts the form with the CSRF token, returning the response body
+func postRequestForm(t *testing.T, client *http.Client, u, token string, form url.Values) (*http.Response, string) {
+	form.Set(CSRFFIELD, token)
+	resp, err := client.PostForm(u, form)
+	dieOnError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	dieOnError(t, err)
+	return resp, string(body)
+}
+
+// listRequests returns the requests the client sees with the status given, if any
+func listRequests(t *testing.T, client *http.Client, webca, status string) []CertRequest {
+	resp, err := client.Get(webca + "/requests.json?Status=" + status)
+	dieOnError(t, err)
+	defer resp.Body.Close()
+	reqs := make([]CertRequest, 0)
+	dieOnError(t, json.NewDecoder(resp.Body).Decode(&reqs))
+	return reqs
+}
+
+func TestRequests(t *testing.T) {
+	inTempDir(t, func() {
+		cfg := testConfig(t)
+		cfg.Users["rita"] = User{Username: "rita", Password: crypt("rita"), Role: ROLE_REQUESTER}
+		cfg.Users["andy"] = User{Username: "andy", Password: crypt("andy"), Role: ROLE_APPROVER}
+		dieOnError(t, cfg.Save())
+		mux := http.NewServeMux()
+		prepareWebCA(mux)
+		webca := httptest.NewServer(mux)
+		defer webca.Close()
+
+		rita, ritaToken := loggedClient(t, webca.URL, "rita", "rita")
+		resp, _ := postRequestForm(t, rita, webca.URL+"/requests", ritaToken, url.Values{
+			"CA": {"TestCA"}, "CommonName": {"app1"}, "SANs": {"app1.example.com, 10.0.0.1"},
+			"Profile": {EST_SERVER}, "Justification": {"New application server"}})
+		if resp.Request.URL.Path != "/request" || resp.Request.URL.Query().Get("id") != "1" {
+			t.Fatalf("Request not submitted, got to %s", resp.Request.URL)
+		}
+		_, body := postRequestForm(t, rita, webca.URL+"/request", ritaToken, url.Values{"id": {"1"}, "action": {"approve"}})
+		if !strings.Contains(body, "decide on request #1") {
+			t.Fatal("Requester approved a request")
+		}
+		admin, adminToken := loggedClient(t, webca.URL, "admin", "admin")
+		postRequestForm(t, admin, webca.URL+"/requests", adminToken, url.Values{
+			"CA": {"TestCA"}, "CommonName": {"admin1"}, "Profile": {EST_CLIENT}, "Justification": {"Mine"}})
+		_, body = postRequestForm(t, admin, webca.URL+"/request", adminToken, url.Values{"id": {"2"}, "action": {"approve"},
+			"CA": {"TestCA"}, "CommonName": {"admin1"}, "Profile": {EST_CLIENT}})
+		if !strings.Contains(body, "decide on request #2") {
+			t.Fatal("Approved own request")
+		}
+
+		andy, andyToken := loggedClient(t, webca.URL, "andy", "andy")
+		if pending := listRequests(t, andy, webca.URL, REQUEST_PENDING); len(pending) != 2 || pending[0].ID != 2 {
+			t.Fatalf("Unexpected pending requests %v", pending)
+		}
+		andyToken = getCSRF(t, andy, webca.URL+"/request?id=1") // with the decision forms
+		settings := url.Values{"id": {"1"}, "CA": {"TestCA"}, "CommonName": {"app1"},
+			"SANs": {"app1.example.com, 10.0.0.1"}, "Profile": {EST_SERVER}, "Days": {"30"}}
+		settings.Set("action", "approve")
+		postRequestForm(t, andy, webca.URL+"/request", andyToken, settings)
+		reqs := listRequests(t, rita, webca.URL, "")
+		if len(reqs) != 1 || reqs[0].Status != REQUEST_ISSUED || reqs[0].Approver != "andy" {
+			t.Fatalf("Unexpected requests of the requester %v", reqs)
+		}
+		if h := reqs[0].History; len(h) != 3 || h[1].Action != "edit" || !strings.Contains(h[1].Detail, "days 365 -> 30") {
+			t.Fatalf("Unexpected history %v", h)
+		}
+		c := FindCert("app1")
+		if c == nil || c.Key == nil || serialOf(c.Crt) != reqs[0].Serial || len(c.Crt.DNSNames) != 1 ||
+			len(c.Crt.IPAddresses) != 1 || c.Crt.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth ||
+			c.Crt.NotAfter.After(time.Now().AddDate(0, 0, 31)) {
+			t.Fatalf("Unexpected issued certificate %v", c)
+		}
+
+		resp, err := rita.Get(webca.URL + "/request/download?id=1")
+		dieOnError(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		dieOnError(t, err)
+		if block, _ := pem.Decode(data); block == nil || block.Type != "CERTIFICATE" {
+			t.Fatalf("Unexpected certificate download %s", data)
+		}
+		resp, _ = postRequestForm(t, andy, webca.URL+"/request/download", andyToken, url.Values{"id": {"1"}, "Password": {"p12"}})
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Approver downloaded the requester's key: %d", resp.StatusCode)
+		}
+		resp, _ = postRequestForm(t, rita, webca.URL+"/request/download", ritaToken, url.Values{"id": {"1"}, "Password": {"p12"}})
+		if resp.Header.Get("Content-type") != "application/x-pkcs12" {
+			t.Fatalf("Failed to download the key: %d", resp.StatusCode)
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		dieOnError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "svc"}, DNSNames: []string{"svc.example.com"}}, key)
+		dieOnError(t, err)
+		csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+		postRequestForm(t, rita, webca.URL+"/requests", ritaToken, url.Values{"CSR": {csr},
+			"CA": {"TestCA"}, "Profile": {EST_CLIENT}, "Justification": {"Service account"}})
+		postRequestForm(t, andy, webca.URL+"/request", andyToken, url.Values{"id": {"3"}, "action": {"reject"},
+			"Reason": {"Use the shared one"}})
+		reqs = listRequests(t, rita, webca.URL, "")
+		if len(reqs) != 2 || reqs[0].CommonName != "svc" || reqs[0].SANs[0] != "svc.example.com" ||
+			reqs[0].Status != REQUEST_REJECTED || reqs[0].Reason != "Use the shared one" || FindCert("svc") != nil {
+			t.Fatalf("Unexpected rejected request %v", reqs[0])
+		}
+		entries, err := ReadAudit(AUDIT_LOG)
+		dieOnError(t, err)
+		if last := entries[len(entries)-1]; last.Action != "request.reject" || last.User != "andy" || last.Detail != "#3" {
+			t.Fatalf("Unexpected audit entry %v", last)
+		}
+
+		_, body = postRequestForm(t, rita, webca.URL+"/requests", ritaToken, url.Values{
+			"CA": {"TestCA"}, "CommonName": {"../pwned"}, "Profile": {EST_CLIENT}, "Justification": {"Escape"}})
+		if !strings.Contains(body, "be the name of a certificate") {
+			t.Fatal("Requested a certificate named as a path")
+		}
+		for i, cn := range []string{"admin", "app1"} {
+			id := strconv.Itoa(4 + i)
+			postRequestForm(t, rita, webca.URL+"/requests", ritaToken, url.Values{
+				"CA": {"TestCA"}, "CommonName": {cn}, "Profile": {EST_CLIENT}, "Justification": {"Lookalike"}})
+			resp, err := andy.Get(webca.URL + "/request?id=" + id)
+			dieOnError(t, err)
+			data, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			dieOnError(t, err)
+			page := string(data)
+			if strings.Contains(page, "is also the name of a user") != (cn == "admin") ||
+				strings.Contains(page, "already a certificate named") != (cn == "app1") {
+				t.Fatalf("Approver not warned about the name %s", cn)
+			}
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package webca
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Role names
+const (
+	ROLE_ADMIN     = "admin"     // manages users and certificates, including CA keys
+	ROLE_OPERATOR  = "operator"  // manages certificates, including CA keys
+	ROLE_AUDITOR   = "auditor"   // browses and downloads certificates and the audit log only
+	ROLE_REQUESTER = "requester" // browses certificates and requests new ones
+	ROLE_APPROVER  = "approver"  // browses certificates and approves or rejects the requests of others
+)
+
+// permission is something a role may be allowed to do
+type permission int
+
+const (
+	PERM_READ    permission = 1 << iota // browse and download certificates
+	PERM_ISSUE                          // generate, renew, clone and delete certificates
+	PERM_KEYS                           // download private keys, CA keys included
+	PERM_ADMIN                          // manage users and security settings
+	PERM_AUDIT                          // browse and export the audit log
+	PERM_REQUEST                        // request certificates
+	PERM_APPROVE                        // approve, edit or reject the certificate requests of others
+)
+
+// permissionNames maps the permission names used in templates to permissions
+var permissionNames = map[string]permission{
+	"read": PERM_READ, "issue": PERM_ISSUE, "keys": PERM_KEYS, "admin": PERM_ADMIN,
+	"audit": PERM_AUDIT, "request": PERM_REQUEST, "approve": PERM_APPROVE,
+}
+
+// roles holds the permissions granted to each role
+var roles = map[string]permission{
+	ROLE_ADMIN:     PERM_READ | PERM_ISSUE | PERM_KEYS | PERM_ADMIN | PERM_AUDIT | PERM_REQUEST | PERM_APPROVE,
+	ROLE_OPERATOR:  PERM_READ | PERM_ISSUE | PERM_KEYS | PERM_REQUEST | PERM_APPROVE,
+	ROLE_AUDITOR:   PERM_READ | PERM_AUDIT,
+	ROLE_REQUESTER: PERM_READ | PERM_REQUEST,
+	ROLE_APPROVER:  PERM_READ | PERM_REQUEST | PERM_APPROVE,
+}
+
+// roleNames returns the sorted names of all roles
+func roleNames() []string {
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keyRoles returns the sorted names of the roles that can access CA keys
+func keyRoles() []string {
+	names := make([]string, 0)
+	for _, name := range roleNames() {
+		if roles[name]&PERM_KEYS != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// role returns the User's role, users from before roles existed are admins
+func (u User) role() string {
+	if u.Role == "" {
+		return ROLE_ADMIN
+	}
+	return u.Role
+}
+
+// can tells whether the User's role grants the permission
+func (u User) can(p permission) bool {
+	return roles[u.role()]&p == p
+}
+
+// Can tells whether the User's role grants the named permission (for templates)
+func (u User) Can(name string) bool {
+	p, ok := permissionNames[name]
+	return ok && u.can(p)
+}
+
+// permControl invokes handler f ONLY IF we are logged in with a role granting the permission
+func permControl(p permission, f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return permControlHandler(p, http.HandlerFunc(f))
+}
+
+// permControlHandler invokes handler h ONLY IF we are logged in with a role granting the permission
+func permControlHandler(p permission, h http.Handler) http.Handler {
+	return accessControlHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := SessionFor(w, r)
+		if handleError(w, r, err) {
+			return
+		}
+		u, _ := s.User()
+		if !u.can(p) {
+			http.Error(w, tr("Access Denied"), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
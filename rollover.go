@@ -0,0 +1,140 @@
+package webca
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	OLD_WITH_NEW = "OldWithNew" // old CA public key certified with the new CA key
+	NEW_WITH_OLD = "NewWithOld" // new CA public key certified with the old CA key
+)
+
+// CARenewal reports the renewal of a CA and what happened to its children
+type CARenewal struct {
+	CA       *Cert    // the renewed CA
+	SameKey  bool     // whether the CA kept its key, so its children are still valid
+	Rollover bool     // whether the rollover certificates were issued
+	Reissued []*Cert  // children re-issued under the new CA key
+	Orphaned []*Cert  // children still signed by the old CA key, valid through OldWithNew only
+	Failed   []string // children that failed to be re-issued, with the reason
+}
+
+// RenewCABy renews a CA on behalf of the named user. Keeping the key keeps its children
+// valid, otherwise the old and new keys are cross-signed for a rollover and, if asked to,
+// the children are re-issued under the new key keeping theirs. Once re-keyed, the report is
+// returned even if the rollover certificates failed to be issued, along with the error
+func RenewCABy(ca *Cert, rekey, reissue bool, username string) (*CARenewal, error) {
+	if !rekey {
+		renewed, err := ResignCertBy(ca, username)
+		if err != nil {
+			return nil, err
+		}
+		return &CARenewal{CA: renewed, SameKey: true}, nil
+	}
+	old := &Cert{Crt: ca.Crt, Key: ca.Key}
+	childs := append([]*Cert{}, ca.Childs...)
+	renewed, err := RenewCertBy(ca, username)
+	if err != nil {
+		return nil, err
+	}
+	report := &CARenewal{CA: renewed}
+	if len(childs) == 0 {
+		return report, nil
+	}
+	if old.Key != nil {
+		err = issueRollover(old, renewed) // the new key is already in place, so go on anyway
+		report.Rollover = err == nil
+	}
+	for _, child := range childs {
+		if !reissue {
+			report.Orphaned = append(report.Orphaned, child)
+			continue
+		}
+		child.Parent = renewed
+		c, err := ResignCertBy(child, username)
+		if err != nil {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", child.Crt.Subject.CommonName, err))
+			continue
+		}
+		report.Reissued = append(report.Reissued, c)
+	}
+	invalidateCertree()
+	return report, err
+}
+
+// rolloverFile returns the file of a rollover certificate issued when renewing the CA into
+// the version with the given serial
+func rolloverFile(certname, serial, kind string) string {
+	return filepath.Join(versionsDir(certname), serial+"-"+kind+CERT_SUFFIX)
+}
+
+// issueRollover issues the OldWithNew and NewWithOld rollover certificates between the old and
+// renewed CA, valid while the old CA is
+func issueRollover(old, renewed *Cert) error {
+	certname := renewed.Crt.Subject.CommonName
+	for _, cross := range []struct {
+		kind            string
+		subject, signer *Cert
+	}{
+		{OLD_WITH_NEW, old, renewed},
+		{NEW_WITH_OLD, renewed, old},
+	} {
+		der, err := signCross(cross.subject, cross.signer, old.Crt.NotAfter)
+		if err != nil {
+			return err
+		}
+		file := rolloverFile(certname, serialOf(renewed.Crt), cross.kind)
+		out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to open "+file+" for writing: %s", err)
+		}
+		err = pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to write "+file+": %s", err)
+		}
+	}
+	return nil
+}
+
+// ReadRollover reads a rollover certificate issued when renewing the CA into the version with
+// the given serial
+func ReadRollover(ca *Cert, serial, kind string) ([]byte, error) {
+	if kind != OLD_WITH_NEW && kind != NEW_WITH_OLD {
+		return nil, fmt.Errorf(tr("Unknown rollover certificate %s!", kind))
+	}
+	versions, err := readVersions(ca.Crt.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	if findVersion(versions, serial) < 0 { // also keeps serial from escaping the versions dir
+		return nil, fmt.Errorf(tr("%s has no version %s!", ca.Crt.Subject.CommonName, serial))
+	}
+	return ioutil.ReadFile(rolloverFile(ca.Crt.Subject.CommonName, serial, kind))
+}
+
+// rolloverServer serves a rollover certificate of a CA
+func rolloverServer(w http.ResponseWriter, r *http.Request) {
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	serial, kind := r.FormValue("serial"), r.FormValue("kind")
+	data, err := ReadRollover(c, serial, kind)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-disposition",
+		"attachment; filename="+c.Crt.Subject.CommonName+"-"+serial+"-"+kind+CERT_SUFFIX)
+	w.Header().Set("Content-type", "application/x-pem-file")
+	w.Write(data)
+}
@@ -0,0 +1,89 @@
+package webca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+)
+
+// verifies tells whether c chains up to the CA, maybe through the intermediates
+func verifies(c, ca *Cert, intermediates ...[]byte) bool {
+	pool, roots := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(ca.Crt)
+	for _, data := range intermediates {
+		b, _ := pem.Decode(data)
+		if crt, err := x509.ParseCertificate(b.Bytes); err == nil {
+			pool.AddCert(crt)
+		}
+	}
+	_, err := c.Crt.Verify(x509.VerifyOptions{Roots: roots, Intermediates: pool})
+	return err == nil
+}
+
+func TestCARollover(t *testing.T) {
+	inTempDir(t, func() {
+		old, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		for _, name := range []string{"host1", "host2"} {
+			_, err := GenCert(old, name, 365)
+			dieOnError(t, err)
+		}
+		report, err := RenewCABy(FindCert("TestCA"), true, false, "alice")
+		dieOnError(t, err)
+		ca := report.CA
+		if !ca.Crt.IsCA || ca.Key.N.Cmp(old.Key.N) == 0 || !report.Rollover || len(report.Orphaned) != 2 {
+			t.Fatalf("Unexpected re-key of a CA %+v", report)
+		}
+		oldWithNew, err := ReadRollover(FindCert("TestCA"), serialOf(ca.Crt), OLD_WITH_NEW)
+		dieOnError(t, err)
+		newWithOld, err := ReadRollover(FindCert("TestCA"), serialOf(ca.Crt), NEW_WITH_OLD)
+		dieOnError(t, err)
+		host1 := FindCert("host1")
+		if verifies(host1, ca) || !verifies(host1, ca, oldWithNew) {
+			t.Fatal("Old children must verify through the OldWithNew certificate only")
+		}
+		host2, err := GenCert(FindCert("TestCA"), "host2", 365)
+		dieOnError(t, err)
+		if !verifies(host2, old, newWithOld) {
+			t.Fatal("New children must verify under the old CA through the NewWithOld certificate")
+		}
+
+		report, err = RenewCABy(FindCert("TestCA"), true, true, "alice")
+		dieOnError(t, err)
+		if len(report.Reissued) != 2 || len(report.Failed) != 0 {
+			t.Fatalf("Unexpected re-issue %+v", report)
+		}
+		for _, name := range []string{"host1", "host2"} {
+			if c := FindCert(name); !verifies(c, report.CA) || c.Key == nil {
+				t.Fatalf("%s was not re-issued under the new CA key", name)
+			}
+		}
+
+		report, err = RenewCABy(FindCert("TestCA"), false, false, "alice")
+		dieOnError(t, err)
+		if !report.SameKey || !verifies(FindCert("host1"), report.CA) {
+			t.Fatal("Children became invalid when renewing the CA with the same key")
+		}
+	})
+}
+
+func TestRolloverChecks(t *testing.T) {
+	inTempDir(t, func() {
+		cfg := testConfig(t)
+		_, err := GenCert(FindCert("TestCA"), "host1", 20)
+		dieOnError(t, err)
+		cfg.Policies = map[string]*IssuancePolicy{"TestCA": {MaxDays: 30}}
+		dieOnError(t, cfg.Save())
+		report, err := RenewCABy(FindCert("TestCA"), true, false, "alice")
+		if err == nil {
+			t.Fatal("Issued rollover certificates breaking the policy of the CA")
+		} else if _, ok := err.(*PolicyError); !ok {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if report == nil || report.Rollover || len(report.Orphaned) != 2 ||
+			serialOf(FindCert("TestCA").Crt) != serialOf(report.CA.Crt) {
+			t.Fatalf("Re-keyed CA not reported along with the failed rollover: %+v", report)
+		}
+	})
+}
@@ -0,0 +1,457 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SCEP_PATH          = "/scep"
+	SCEP_DAYS          = 365 // default validity of the certificates enrolled
+	SCEP_CHALLENGE_TTL = 24  // default hours a challenge password lasts
+	SCEP_MAX_REQUEST   = 64 * 1024
+	SCEP_CAPS          = "POSTPKIOperation\nRenewal\nSHA-256\nSHA-1\nAES\nDES3\nSCEPStandard\n"
+
+	SCEP_CERT_REP    = "3"
+	SCEP_RENEWAL_REQ = "17"
+	SCEP_PKCS_REQ    = "19"
+
+	SCEP_SUCCESS = "0"
+	SCEP_FAILURE = "2"
+
+	SCEP_BAD_ALG           = "0"
+	SCEP_BAD_MESSAGE_CHECK = "1"
+	SCEP_BAD_REQUEST       = "2"
+	SCEP_BAD_CERT_ID       = "4"
+)
+
+// SCEP (RFC 8894) message attributes
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+)
+
+// SCEPConfig enrolls network equipment with certificates of a CA through SCEP
+type SCEPConfig struct {
+	CA         string // name of the CA issuing the certificates
+	Profile    string // EST_CLIENT, EST_SERVER or EST_DEVICE, as for EST, EST_CLIENT by default
+	Days       int    // validity of the certificates enrolled, SCEP_DAYS by default
+	Challenges []SCEPChallenge
+}
+
+// SCEPChallenge is a single use challenge password authorizing an enrollment, only its hash is kept
+type SCEPChallenge struct {
+	ID        string // short identifier shown instead of the password
+	Hash      string // SHA-256 of the password, in hex
+	Subject   string // common name the password can enroll
+	Expires   time.Time
+	CreatedBy string
+}
+
+// Expired tells whether the challenge password can't be used anymore
+func (sc SCEPChallenge) Expired() bool {
+	return !time.Now().Before(sc.Expires)
+}
+
+// scepMutex serializes enrollments, so that each challenge password is used only once
+var scepMutex sync.Mutex
+
+// days returns the validity of the certificates enrolled
+func (sc *SCEPConfig) days() int {
+	if sc.Days > 0 {
+		return sc.Days
+	}
+	return SCEP_DAYS
+}
+
+// usages returns the extended key usages of the certificates enrolled
+func (sc *SCEPConfig) usages() []x509.ExtKeyUsage {
+	if usages, ok := estProfiles[sc.Profile]; ok {
+		return usages
+	}
+	return estProfiles[EST_CLIENT]
+}
+
+// getCA returns the CA enrolling the equipment, or nil if it can't issue certificates
+func (sc *SCEPConfig) getCA() *Cert {
+	ca := FindCert(sc.CA)
+	if ca == nil || ca.Crt == nil || !ca.Crt.IsCA || ca.Key == nil {
+		return nil
+	}
+	return ca
+}
+
+// challengeHash returns the hash kept of a challenge password
+func challengeHash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// newChallenge adds a challenge password valid for the hours given, returning it. It is
+// hexadecimal, as equipment often has to take it typed in and as a PrintableString
+func (sc *SCEPConfig) newChallenge(subject string, hours int, createdBy string) (string, error) {
+	if subject == "" {
+		return "", fmt.Errorf(tr("Type the common name the challenge password enrolls!"))
+	}
+	if err := checkFilename(subject); err != nil {
+		return "", err
+	}
+	if FindCert(subject) != nil {
+		return "", fmt.Errorf(tr("%s already has a certificate, renew it or delete it first!", subject))
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(b)
+	hash := challengeHash(password)
+	sc.prune()
+	sc.Challenges = append(sc.Challenges, SCEPChallenge{ID: hash[:8], Hash: hash, Subject: subject,
+		Expires: time.Now().Add(time.Duration(hours) * time.Hour), CreatedBy: createdBy})
+	return password, nil
+}
+
+// prune forgets the expired challenge passwords
+func (sc *SCEPConfig) prune() {
+	challenges := make([]SCEPChallenge, 0, len(sc.Challenges))
+	for _, c := range sc.Challenges {
+		if !c.Expired() {
+			challenges = append(challenges, c)
+		}
+	}
+	sc.Challenges = challenges
+}
+
+// findChallenge returns the index of the valid challenge password for the common name, or -1
+func (sc *SCEPConfig) findChallenge(password, cn string) int {
+	hash := challengeHash(password)
+	for i, c := range sc.Challenges {
+		if c.Hash == hash && !c.Expired() && c.Subject == cn {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeChallenge forgets the challenge password with the ID
+func (sc *SCEPConfig) removeChallenge(id string) {
+	for i, c := range sc.Challenges {
+		if c.ID == id {
+			sc.Challenges = append(sc.Challenges[:i], sc.Challenges[i+1:]...)
+			return
+		}
+	}
+}
+
+// scepServer serves the SCEP operations enrolling equipment under the configured CA
+func scepServer(w http.ResponseWriter, r *http.Request) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.SCEP == nil || cfg.SCEP.getCA() == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ca := cfg.SCEP.getCA()
+	switch r.URL.Query().Get("operation") {
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, SCEP_CAPS)
+	case "GetCACert":
+		if ca.Parent == nil || ca.Parent == ca || ca.Parent.Crt.Raw == nil {
+			w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			w.Write(ca.Crt.Raw)
+			return
+		}
+		chain := []*x509.Certificate{ca.Crt}
+		for p := ca; p.Parent != nil && p.Parent != p && p.Parent.Crt.Raw != nil; p = p.Parent {
+			chain = append(chain, p.Parent.Crt)
+		}
+		der, err := certsOnly(chain...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+		w.Write(der)
+	case "PKIOperation":
+		var der []byte
+		var err error
+		if r.Method == "POST" {
+			der, err = ioutil.ReadAll(io.LimitReader(r.Body, SCEP_MAX_REQUEST))
+		} else {
+			der, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+		}
+		if err != nil {
+			http.Error(w, "Wrong PKI message encoding", http.StatusBadRequest)
+			return
+		}
+		reply, err := scepOperation(r, cfg, ca, der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		w.Write(reply)
+	default:
+		http.Error(w, "Unknown SCEP operation", http.StatusBadRequest)
+	}
+}
+
+// scepOperation serves a PKI message, replying with a CertRep signed by the CA and carrying
+// the certificate issued, if any, encrypted for the requester
+func scepOperation(r *http.Request, cfg *config, ca *Cert, der []byte) ([]byte, error) {
+	msg, err := verifyMessage(der)
+	if err != nil {
+		return nil, err
+	}
+	attr := func(id asn1.ObjectIdentifier) []byte { return msg.Attrs[id.String()].Bytes }
+	transactionID := string(attr(oidSCEPTransactionID))
+	if transactionID == "" {
+		return nil, fmt.Errorf("PKI message has no transaction ID")
+	}
+	status, content := SCEP_SUCCESS, []byte(nil)
+	c, alg, failInfo := scepEnroll(r, cfg, ca, msg, string(attr(oidSCEPMessageType)))
+	if failInfo == "" {
+		if der, err := certsOnly(c.Crt); err != nil {
+			failInfo = SCEP_BAD_REQUEST
+		} else if content, err = envelope(der, msg.Signer, alg); err != nil {
+			failInfo = SCEP_BAD_ALG
+		}
+	}
+	if failInfo != "" {
+		status, content = SCEP_FAILURE, nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{
+		oidSCEPMessageType.String():    SCEP_CERT_REP,
+		oidSCEPPKIStatus.String():      status,
+		oidSCEPTransactionID.String():  transactionID,
+		oidSCEPSenderNonce.String():    nonce,
+		oidSCEPRecipientNonce.String(): attr(oidSCEPSenderNonce),
+	}
+	if failInfo != "" {
+		values[oidSCEPFailInfo.String()] = failInfo
+	}
+	attrs := make([]pkcs12Attribute, 0, len(values))
+	for _, id := range []asn1.ObjectIdentifier{oidSCEPMessageType, oidSCEPPKIStatus, oidSCEPFailInfo,
+		oidSCEPSenderNonce, oidSCEPRecipientNonce, oidSCEPTransactionID} {
+		if value, ok := values[id.String()]; ok {
+			a, err := newAttribute(id, value)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, a)
+		}
+	}
+	return signMessage(content, attrs, msg.Hash, ca.Crt, ca.Key, ca.Crt)
+}
+
+// scepEnroll issues the certificate requested by a PKCSReq, authorized by a challenge password,
+// or a RenewalReq, signed with the current certificate of the same subject. It returns the
+// SCEP failInfo when it fails
+func scepEnroll(r *http.Request, cfg *config, ca *Cert, msg *signedMessage, messageType string) (*Cert, asn1.ObjectIdentifier, string) {
+	if messageType != SCEP_PKCS_REQ && messageType != SCEP_RENEWAL_REQ {
+		return nil, nil, SCEP_BAD_REQUEST
+	}
+	csrDER, alg, err := openEnvelope(msg.Content, ca.Crt, ca.Key)
+	if err != nil {
+		return nil, nil, SCEP_BAD_MESSAGE_CHECK
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil || csr.CheckSignature() != nil || checkFilename(csr.Subject.CommonName) != nil {
+		return nil, alg, SCEP_BAD_REQUEST
+	}
+	cn := csr.Subject.CommonName
+	scepMutex.Lock()
+	defer scepMutex.Unlock()
+	challenge := -1
+	action := "scepEnroll"
+	if messageType == SCEP_PKCS_REQ {
+		if !bytes.Equal(msg.Signer.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+			return nil, alg, SCEP_BAD_MESSAGE_CHECK
+		}
+		if FindCert(cn) != nil { // only the current certificate can replace itself, renewing
+			return nil, alg, SCEP_BAD_REQUEST
+		}
+		if challenge = cfg.SCEP.findChallenge(csrChallenge(csr), cn); challenge < 0 {
+			recordLoginFailure("device:"+cn, clientIP(r), "SCEP")
+			return nil, alg, SCEP_BAD_REQUEST
+		}
+		if !scepNamesAllowed(ca, csr) {
+			return nil, alg, SCEP_BAD_REQUEST
+		}
+	} else {
+		action = "scepRenew"
+		current := currentCert(msg.Signer, ca)
+		if current == nil || current.Crt.Subject.String() != csr.Subject.String() {
+			return nil, alg, SCEP_BAD_CERT_ID
+		}
+		if !sameIdentity(csr, current.Crt) {
+			return nil, alg, SCEP_BAD_REQUEST
+		}
+	}
+	c, err := SignCSR(ca, csr.Subject, csr, cfg.SCEP.days(), cfg.SCEP.usages()...)
+	e := AuditEntry{User: "device:" + cn, IP: clientIP(r), Action: action, Target: cn, Outcome: AUDIT_OK}
+	if err != nil {
+		e.Outcome, e.Detail = AUDIT_FAILED, err.Error()
+		record(e)
+		return nil, alg, SCEP_BAD_REQUEST
+	}
+	e.Serial = serialOf(c.Crt)
+	if challenge >= 0 {
+		e.Detail = "challenge " + cfg.SCEP.Challenges[challenge].ID
+		cfg.SCEP.Challenges = append(cfg.SCEP.Challenges[:challenge], cfg.SCEP.Challenges[challenge+1:]...)
+		if err := cfg.Save(); err != nil {
+			e.Detail += " not removed: " + err.Error()
+		}
+	}
+	record(e)
+	return c, alg, ""
+}
+
+// scepNamesAllowed tells whether the CSR asks for no other alternative names than the host name
+// or IP address of its subject, unless the CA has an issuance policy deciding on them
+func scepNamesAllowed(ca *Cert, csr *x509.CertificateRequest) bool {
+	if policyOf(ca) != nil {
+		return true
+	}
+	dnsNames, ips := hostNames(&x509.Certificate{Subject: csr.Subject})
+	for _, name := range csr.DNSNames {
+		if !contains(dnsNames, name) {
+			return false
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if len(ips) == 0 || !ip.Equal(ips[0]) {
+			return false
+		}
+	}
+	return len(csr.EmailAddresses) == 0 && len(csr.URIs) == 0
+}
+
+// csrChallenge returns the challenge password attribute of the CSR, if any
+func csrChallenge(csr *x509.CertificateRequest) string {
+	var info struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []pkcs12Attribute `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &info); err != nil {
+		return ""
+	}
+	for _, attr := range info.Attributes {
+		var value asn1.RawValue
+		if attr.ID.Equal(oidChallengePassword) {
+			if _, err := asn1.Unmarshal(attr.Value.Bytes, &value); err == nil {
+				return string(value.Bytes)
+			}
+		}
+	}
+	return ""
+}
+
+// setSCEP sets the SCEP settings on the page of the CA enrolling the equipment
+func setSCEP(ps PageStatus, c *Cert) {
+	cfg := LoadConfig()
+	ps["SCEP"], ps["SCEPURL"] = nil, ""
+	if cfg.SCEP != nil && cfg.SCEP.CA == c.Crt.Subject.CommonName {
+		ps["SCEP"] = cfg.SCEP
+		if cfg.WebCert != nil {
+			ps["SCEPURL"] = cfg.Listen.baseURL(cfg) + SCEP_PATH
+		}
+	}
+}
+
+// scep applies the SCEP action requested on the CA: enabling, disabling or managing the
+// challenge passwords, showing new ones just once
+func scep(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	cfg := LoadConfig()
+	action := r.FormValue("action")
+	scepMutex.Lock()
+	password, err := applySCEPAction(cfg, c, action, requestUsername(r), r)
+	if err == nil {
+		err = cfg.Save()
+	}
+	scepMutex.Unlock()
+	e := requestEntry(r, "scep."+action, c.Crt.Subject.CommonName, err)
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else if password != "" {
+		ps["SCEPPassword"] = password
+		e.Detail = "challenge " + challengeHash(password)[:8]
+	}
+	record(e)
+	certControlPage(w, r, ps, c)
+}
+
+// applySCEPAction applies the SCEP action requested on the config for the CA, returning the
+// challenge password generated, if any
+func applySCEPAction(cfg *config, c *Cert, action, username string, r *http.Request) (string, error) {
+	name := c.Crt.Subject.CommonName
+	if action == "enable" {
+		if !c.Crt.IsCA || c.Key == nil {
+			return "", fmt.Errorf(tr("%s can't issue certificates!", name))
+		}
+		sc := &SCEPConfig{CA: name, Profile: r.FormValue("Profile")}
+		if _, ok := estProfiles[sc.Profile]; !ok {
+			return "", fmt.Errorf(tr("Unknown profile %s!", sc.Profile))
+		}
+		if days := r.FormValue("Days"); days != "" {
+			if _, err := fmt.Sscan(days, &sc.Days); err != nil || sc.Days < 1 {
+				return "", fmt.Errorf(tr("Wrong validity days %s!", days))
+			}
+		}
+		if cfg.SCEP != nil && cfg.SCEP.CA == name {
+			sc.Challenges = cfg.SCEP.Challenges
+		}
+		cfg.SCEP = sc
+		return "", nil
+	}
+	if cfg.SCEP == nil || cfg.SCEP.CA != name {
+		return "", fmt.Errorf(tr("%s does not enroll equipment through SCEP!", name))
+	}
+	switch action {
+	case "disable":
+		cfg.SCEP = nil
+	case "challenge":
+		hours := SCEP_CHALLENGE_TTL
+		if h := r.FormValue("Hours"); h != "" {
+			if _, err := fmt.Sscan(h, &hours); err != nil || hours < 1 {
+				return "", fmt.Errorf(tr("Wrong validity hours %s!", h))
+			}
+		}
+		return cfg.SCEP.newChallenge(strings.TrimSpace(r.FormValue("Subject")), hours, username)
+	case "revoke":
+		cfg.SCEP.removeChallenge(r.FormValue("ID"))
+	default:
+		return "", fmt.Errorf(tr("Unknown SCEP action %s!", action))
+	}
+	return "", nil
+}
@@ -0,0 +1,190 @@
+package webca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// scepCSR returns a CSR for the key, common name and DNS names carrying the challenge password,
+// if any
+func scepCSR(t *testing.T, key *rsa.PrivateKey, cn, password string, dnsNames ...string) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}, key)
+	dieOnError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	dieOnError(t, err)
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []pkcs12Attribute `asn1:"tag:0"`
+	}
+	_, err = asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs)
+	dieOnError(t, err)
+	if password != "" {
+		attr, err := newAttribute(oidChallengePassword, password)
+		dieOnError(t, err)
+		tbs.Attributes = append(tbs.Attributes, attr)
+	}
+	tbsDER, err := asn1.Marshal(tbs)
+	dieOnError(t, err)
+	sum := sha256.Sum256(tbsDER)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	dieOnError(t, err)
+	der, err = asn1.Marshal(struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}{asn1.RawValue{FullBytes: tbsDER}, pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA,
+		Parameters: asn1.NullRawValue}, asn1.BitString{Bytes: sig, BitLength: len(sig) * 8}})
+	dieOnError(t, err)
+	return der
+}
+
+// selfSigned returns the self signed certificate equipment signs its first request with
+func selfSigned(t *testing.T, key *rsa.PrivateKey, cn string) *x509.Certificate {
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: cn},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	dieOnError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	dieOnError(t, err)
+	return crt
+}
+
+// scepRequest posts a PKI message with the CSR signed by the equipment, returning the CertRep
+// status and the certificate issued, if any
+func scepRequest(t *testing.T, ca *Cert, messageType string, csr []byte, signer *x509.Certificate,
+	key *rsa.PrivateKey) (string, *x509.Certificate) {
+	env, err := envelope(csr, ca.Crt, oidAES128CBC)
+	dieOnError(t, err)
+	var attrs []pkcs12Attribute
+	for _, a := range []struct {
+		id    asn1.ObjectIdentifier
+		value interface{}
+	}{{oidSCEPMessageType, messageType}, {oidSCEPTransactionID, "test-transaction"},
+		{oidSCEPSenderNonce, []byte("0123456789abcdef")}} {
+		attr, err := newAttribute(a.id, a.value)
+		dieOnError(t, err)
+		attrs = append(attrs, attr)
+	}
+	der, err := signMessage(env, attrs, crypto.SHA256, signer, key, signer)
+	dieOnError(t, err)
+	r := httptest.NewRequest("POST", SCEP_PATH+"?operation=PKIOperation", bytes.NewReader(der))
+	w := httptest.NewRecorder()
+	scepServer(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PKI operation failed: %d %s", w.Code, w.Body)
+	}
+	reply, err := verifyMessage(w.Body.Bytes())
+	dieOnError(t, err)
+	if !reply.Signer.Equal(ca.Crt) {
+		t.Fatal("CertRep is not signed by the CA")
+	}
+	if nonce := reply.Attrs[oidSCEPRecipientNonce.String()].Bytes; string(nonce) != "0123456789abcdef" {
+		t.Fatalf("Unexpected recipient nonce %q", nonce)
+	}
+	status := string(reply.Attrs[oidSCEPPKIStatus.String()].Bytes)
+	if status != SCEP_SUCCESS {
+		return status, nil
+	}
+	content, _, err := openEnvelope(reply.Content, signer, key)
+	dieOnError(t, err)
+	crts, err := readCertsOnly(content)
+	dieOnError(t, err)
+	return status, crts[0]
+}
+
+func TestSCEP(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		web, err := GenCert(ca, "webca.test", 365)
+		dieOnError(t, err)
+		cfg := NewConfig(User{Username: "admin", Password: crypt("admin")}, ca, web, Mailer{})
+		cfg.SCEP = &SCEPConfig{CA: "TestCA", Profile: EST_SERVER}
+		password, err := cfg.SCEP.newChallenge("router1", 1, "admin")
+		dieOnError(t, err)
+		expired, err := cfg.SCEP.newChallenge("router1", 1, "admin")
+		dieOnError(t, err)
+		cfg.SCEP.Challenges[1].Expires = time.Now().Add(-time.Minute)
+		takeover, err := cfg.SCEP.newChallenge("router1", 1, "admin")
+		dieOnError(t, err)
+		for _, subject := range []string{"", "/tmp/pwned", "../pwned", ".pwned", "a..b", "webca.test"} {
+			if _, err := cfg.SCEP.newChallenge(subject, 1, "admin"); err == nil {
+				t.Fatalf("Challenge password for %q", subject)
+			}
+		}
+		dieOnError(t, cfg.Save())
+
+		w := httptest.NewRecorder()
+		scepServer(w, httptest.NewRequest("GET", SCEP_PATH+"?operation=GetCACaps", nil))
+		if !bytes.Contains(w.Body.Bytes(), []byte("POSTPKIOperation")) {
+			t.Fatalf("Unexpected capabilities %q", w.Body)
+		}
+		w = httptest.NewRecorder()
+		scepServer(w, httptest.NewRequest("GET", SCEP_PATH+"?operation=GetCACert", nil))
+		if crt, err := x509.ParseCertificate(w.Body.Bytes()); err != nil || !crt.Equal(ca.Crt) {
+			t.Fatalf("Unexpected CA certificate: %v", err)
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		dieOnError(t, err)
+		self := selfSigned(t, key, "router1")
+		if status, _ := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, key, "router1", "wrong"), self, key); status != SCEP_FAILURE {
+			t.Fatal("Enrolled with a wrong challenge password")
+		}
+		if status, _ := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, key, "router1", expired), self, key); status != SCEP_FAILURE {
+			t.Fatal("Enrolled with an expired challenge password")
+		}
+		if status, _ := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, key, "router2", password), self, key); status != SCEP_FAILURE {
+			t.Fatal("Enrolled another subject with the challenge password")
+		}
+		if status, _ := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, key, "router1", password, "webca.test"), self, key); status != SCEP_FAILURE {
+			t.Fatal("Enrolled names besides the subject of the challenge password")
+		}
+		status, first := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, key, "router1", password), self, key)
+		if status != SCEP_SUCCESS || first.Subject.CommonName != "router1" || first.CheckSignatureFrom(ca.Crt) != nil {
+			t.Fatalf("Failed to enroll: status %s", status)
+		}
+		if c := FindCert("router1"); c == nil || !c.Crt.Equal(first) {
+			t.Fatal("Enrolled certificate is not in the Certree")
+		}
+		if status, _ := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, key, "router1", password), self, key); status != SCEP_FAILURE {
+			t.Fatal("Reused a challenge password")
+		}
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		dieOnError(t, err)
+		other := selfSigned(t, otherKey, "router1")
+		if status, _ := scepRequest(t, ca, SCEP_PKCS_REQ, scepCSR(t, otherKey, "router1", takeover), other, otherKey); status != SCEP_FAILURE {
+			t.Fatal("Replaced an enrolled certificate with a challenge password")
+		}
+
+		newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		dieOnError(t, err)
+		if status, _ := scepRequest(t, ca, SCEP_RENEWAL_REQ, scepCSR(t, newKey, "router1", ""), self, key); status != SCEP_FAILURE {
+			t.Fatal("Renewed without the current certificate")
+		}
+		if status, _ := scepRequest(t, ca, SCEP_RENEWAL_REQ, scepCSR(t, newKey, "router1", "", "webca.test"), first, key); status != SCEP_FAILURE {
+			t.Fatal("Renewal added alternative names")
+		}
+		status, second := scepRequest(t, ca, SCEP_RENEWAL_REQ, scepCSR(t, newKey, "router1", ""), first, key)
+		if status != SCEP_SUCCESS || second.Equal(first) || second.Subject.CommonName != "router1" {
+			t.Fatalf("Failed to renew: status %s", status)
+		}
+		if status, _ := scepRequest(t, ca, SCEP_RENEWAL_REQ, scepCSR(t, newKey, "router1", ""), first, key); status != SCEP_FAILURE {
+			t.Fatal("Renewed with a superseded certificate")
+		}
+	})
+}
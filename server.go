@@ -0,0 +1,435 @@
+package webca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SETUPGRACE    = 5 * time.Minute  // time the setup listener keeps redirecting once the setup is done
+	SHUTDOWNGRACE = 10 * time.Second // time given to in-flight requests on a graceful shutdown
+	RENEWCHECK    = 12 * time.Hour   // how often the web certificate expiration is checked
+)
+
+// address is a complex bind address
+type address struct {
+	addr string
+	tls  bool
+}
+
+// String prints this address properly
+func (a address) String() string {
+	prefix := "http"
+	if a.tls {
+		prefix = "https"
+	}
+	return prefix + "://" + a.addr
+}
+
+// Server owns the http.Server instances of a running WebCA: the plain HTTP listener for the
+// setup wizard, the TLS listener for the configured app and the optional plain HTTP listener
+// redirecting to it
+type Server struct {
+	// Listen overrides the configured network settings, zero values are taken from the config
+	Listen Listen
+	// Sessions keeps the web sessions, on files at SESSIONS_DIR by default
+	Sessions SessionStore
+
+	mutex      sync.Mutex
+	setupLock  sync.Mutex // serializes the setup wizard submissions
+	setupSrv   *http.Server
+	webSrv     *http.Server
+	httpSrv    *http.Server
+	tlsCert    *tls.Certificate // web certificate currently served
+	configured bool
+	errs       chan error
+	done       chan struct{}
+	renewer    sync.WaitGroup // the web certificate auto renewal, till shut down
+}
+
+// NewServer creates a WebCA Server, not started yet
+func NewServer() *Server {
+	return &Server{errs: make(chan error, 3), done: make(chan struct{})}
+}
+
+// WebCA starts and serves the WebApp till it fails
+func WebCA() {
+	s := NewServer()
+	if err := s.Start(); err != nil {
+		log.Fatalf("Could not start!: %s", err)
+	}
+	if err := s.Wait(); err != nil {
+		log.Fatalf("Server failed!: %s", err)
+	}
+}
+
+// Start runs the setup wizard listener if there is no config yet or the TLS app listener otherwise.
+// It returns as soon as the listeners are bound, requests are served in the background
+func (s *Server) Start() error {
+	if s.Sessions == nil {
+		st, err := NewFileSessionStore(SESSIONS_DIR)
+		if err != nil {
+			return fmt.Errorf("Failed to open the sessions store: %s", err)
+		}
+		s.Sessions = st
+	}
+	SetSessionStore(s.Sessions)
+	if LoadConfig() == nil {
+		return s.startSetup()
+	}
+	return s.startWeb(true)
+}
+
+// Wait blocks till the Server is shut down (returning nil) or any of its listeners fails
+func (s *Server) Wait() error {
+	select {
+	case err := <-s.errs:
+		return err
+	case <-s.done:
+		return nil
+	}
+}
+
+// Shutdown stops all listeners gracefully, waiting for in-flight requests till ctx expires and
+// for any web certificate renewal under way
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var errs error
+	for _, srv := range []*http.Server{s.setupSrv, s.webSrv, s.httpSrv} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
+	s.setupSrv, s.webSrv, s.httpSrv = nil, nil, nil
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.renewer.Wait()
+	return errs
+}
+
+// WebURL returns the public base URL of the WebCA, or "" if it is not configured yet
+func (s *Server) WebURL() string {
+	cfg := LoadConfig()
+	if cfg == nil {
+		return ""
+	}
+	return s.settings().baseURL(cfg)
+}
+
+// settings returns the effective network settings: the Server's own, then the configured ones
+// and finally the defaults
+func (s *Server) settings() Listen {
+	l := s.Listen
+	if cfg := LoadConfig(); cfg != nil {
+		l = l.merge(cfg.Listen)
+	}
+	return l.merge(Listen{Port: PORT, SetupPort: SETUPPORT})
+}
+
+// prepare prepares the Web handlers for the setup wizard if there is no HTTPS config or
+// the normal app if the app is already configured
+func (s *Server) prepare(smux *http.ServeMux) address {
+	cfg := LoadConfig()
+	if cfg == nil {
+		return s.prepareSetup(smux)
+	}
+	prepareWebCA(smux)
+	return address{s.settings().webAddr(cfg), true}
+}
+
+// startSetup binds the setup wizard listener
+func (s *Server) startSetup() error {
+	smux := http.NewServeMux()
+	addr := s.prepareSetup(smux)
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Go to %v\n", addr)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setupSrv = &http.Server{Handler: smux}
+	go s.serve(s.setupSrv, ln, false)
+	return nil
+}
+
+// startWeb binds the TLS listener of the configured app and, if withHTTP is set and there is a
+// configured HTTP port, the plain HTTP listener as well
+func (s *Server) startWeb(withHTTP bool) error {
+	smux := http.NewServeMux()
+	addr := s.prepare(smux)
+	if _, err := s.getCertificate(nil); err != nil {
+		return err
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	var hln net.Listener
+	var hmux *http.ServeMux
+	l := s.settings()
+	if withHTTP && l.HTTPPort != 0 {
+		hmux = http.NewServeMux()
+		haddr := s.prepareHTTP(hmux)
+		if hln, err = listen(haddr); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	log.Printf("Go to %v\n", s.WebURL())
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.webSrv = &http.Server{Handler: smux, TLSConfig: &tls.Config{
+		GetCertificate:     s.getCertificate,
+		GetConfigForClient: s.getConfigForClient,
+	}}
+	go s.serve(s.webSrv, ln, true)
+	if hln != nil {
+		s.httpSrv = &http.Server{Handler: hmux}
+		go s.serve(s.httpSrv, hln, false)
+	}
+	s.renewer.Add(1)
+	go s.autoRenew()
+	return nil
+}
+
+// prepareHTTP prepares the plain HTTP listener handlers: the public endpoints and a redirection
+// to HTTPS for everything else
+func (s *Server) prepareHTTP(smux *http.ServeMux) address {
+	preparePublic(smux)
+	smux.HandleFunc("/", s.redirectToWeb)
+	l := s.settings()
+	return address{net.JoinHostPort(l.bindHost(LoadConfig()), strconv.Itoa(l.HTTPPort)), false}
+}
+
+// redirectToWeb redirects the request to the same path on the WebCA public base URL
+func (s *Server) redirectToWeb(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, s.WebURL()+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// getCertificate returns the web certificate as currently found in the Certree, so that any
+// renewal or replacement of config.WebCert is served from the next TLS handshake on
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c, err := findWebCert()
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tlsCert != nil && s.tlsCert.Leaf == c.Crt {
+		return s.tlsCert, nil
+	}
+	if c.Key == nil {
+		return nil, fmt.Errorf("Web certificate %s has no key!", c.Crt.Subject.CommonName)
+	}
+	crt := &tls.Certificate{Certificate: [][]byte{c.Crt.Raw}, PrivateKey: c.Key, Leaf: c.Crt}
+	if c.Parent != nil && c.Parent != c && c.Parent.Crt.Raw != nil {
+		crt.Certificate = append(crt.Certificate, c.Parent.Crt.Raw)
+	}
+	s.tlsCert = crt
+	return crt, nil
+}
+
+// getConfigForClient returns the TLS config for a handshake, requesting a client certificate
+// verified against the configured client CA, if any, so that users can log in with it, and
+// against the EST CA, so that devices can re-enroll with theirs
+func (s *Server) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	tc := &tls.Config{GetCertificate: s.getCertificate, NextProtos: []string{"h2", "http/1.1"}}
+	if cfg := LoadConfig(); cfg != nil {
+		cas := []*Cert{cfg.getClientCA()}
+		if cfg.EST != nil {
+			cas = append(cas, cfg.EST.getCA())
+		}
+		for _, ca := range cas {
+			if ca == nil {
+				continue
+			}
+			if tc.ClientCAs == nil {
+				tc.ClientAuth, tc.ClientCAs = tls.VerifyClientCertIfGiven, x509.NewCertPool()
+			}
+			tc.ClientCAs.AddCert(ca.Crt)
+		}
+	}
+	return tc, nil
+}
+
+// findWebCert finds the configured web certificate in the Certree
+func findWebCert() (*Cert, error) {
+	cfg := LoadConfig()
+	if cfg == nil || cfg.WebCert == nil {
+		return nil, fmt.Errorf("%s", tr("No web certificate configured!"))
+	}
+	return FindCertOrFail(cfg.getWebCert().Crt.Subject.CommonName)
+}
+
+// autoRenew renews the web certificate when it gets closer to expire than the configured
+// Advance days, checking every RENEWCHECK till the Server is shut down
+func (s *Server) autoRenew() {
+	defer s.renewer.Done()
+	ticker := time.NewTicker(RENEWCHECK)
+	defer ticker.Stop()
+	for {
+		if err := renewWebCertIfNeeded(time.Now()); err != nil {
+			log.Printf("(Warning) Web certificate auto renewal failed: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// renewWebCertIfNeeded renews the web certificate if it expires within the Advance days from now
+func renewWebCertIfNeeded(now time.Time) error {
+	c, err := findWebCert()
+	if err != nil {
+		return err
+	}
+	if now.AddDate(0, 0, LoadConfig().Advance).Before(c.Crt.NotAfter) {
+		return nil
+	}
+	log.Printf("Renewing web certificate %s expiring on %s...",
+		c.Crt.Subject.CommonName, c.Crt.NotAfter.Format(MYFMT))
+	_, err = RenewCert(c)
+	return err
+}
+
+// serve runs srv on ln till it gets closed, reporting any other failure to Wait
+func (s *Server) serve(srv *http.Server, ln net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		s.errs <- err
+	}
+}
+
+// switchToWeb starts the TLS app listener once the setup is done. The setup listener keeps
+// redirecting to it: for SETUPGRACE before shutting down gracefully, or for good when it is
+// bound to the configured HTTP port, as it then serves as the plain HTTP listener
+func (s *Server) switchToWeb() error {
+	s.mutex.Lock()
+	s.configured = true
+	s.mutex.Unlock()
+	l := s.settings()
+	keepSetup := l.HTTPPort != 0 && l.HTTPPort == l.SetupPort
+	if err := s.startWeb(!keepSetup); err != nil {
+		return err
+	}
+	if !keepSetup {
+		time.AfterFunc(SETUPGRACE, s.shutdownSetup)
+	}
+	return nil
+}
+
+// shutdownSetup stops the setup listener gracefully
+func (s *Server) shutdownSetup() {
+	s.mutex.Lock()
+	srv := s.setupSrv
+	s.setupSrv = nil
+	s.mutex.Unlock()
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWNGRACE)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("(Warning) Setup listener shutdown: %s", err)
+	}
+}
+
+// isConfigured tells whether the setup has already been completed on this Server
+func (s *Server) isConfigured() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.configured
+}
+
+// listen binds the address or explains how to choose another one
+func listen(a address) (net.Listener, error) {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on %v (check the configured address and ports): %s",
+			a, err)
+	}
+	return ln, nil
+}
+
+// merge returns the Listen settings with its unset values taken from defaults
+func (l Listen) merge(defaults Listen) Listen {
+	if l.Addr == "" {
+		l.Addr = defaults.Addr
+	}
+	if l.Port == 0 {
+		l.Port = defaults.Port
+	}
+	if l.HTTPPort == 0 {
+		l.HTTPPort = defaults.HTTPPort
+	}
+	if l.SetupPort == 0 {
+		l.SetupPort = defaults.SetupPort
+	}
+	if l.BaseURL == "" {
+		l.BaseURL = defaults.BaseURL
+	}
+	return l
+}
+
+// bindHost returns the host to bind, the web certificate name if no address was given
+func (l Listen) bindHost(cfg *config) string {
+	if l.Addr == "" {
+		return cfg.getWebCert().Crt.Subject.CommonName
+	}
+	return l.Addr
+}
+
+// webAddr returns the HTTPS bind address
+func (l Listen) webAddr(cfg *config) string {
+	return net.JoinHostPort(l.bindHost(cfg), strconv.Itoa(l.Port))
+}
+
+// setupAddr returns the setup wizard bind address, on SETUPADDR if no address was given
+func (l Listen) setupAddr() string {
+	host := l.Addr
+	if host == "" {
+		host = SETUPADDR
+	}
+	return net.JoinHostPort(host, strconv.Itoa(l.SetupPort))
+}
+
+// baseURL returns the public base URL, built from the bind address (or the web certificate name
+// when binding to all interfaces) unless explicitly configured
+func (l Listen) baseURL(cfg *config) string {
+	if l.BaseURL != "" {
+		return strings.TrimSuffix(l.BaseURL, "/")
+	}
+	host := l.Addr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = cfg.getWebCert().Crt.Subject.CommonName
+	}
+	if l.Port == PORT {
+		return "https://" + host
+	}
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(l.Port))
+}
@@ -0,0 +1,261 @@
+package webca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a local TCP port nobody is listening on
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// inTempDir runs f on a fresh temporary working dir with no cached config, certree or audit log, sessions
+// are kept in memory again afterwards
+func inTempDir(t *testing.T, f func()) {
+	dir, err := ioutil.TempDir("", "webca")
+	dieOnError(t, err)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	dieOnError(t, err)
+	dieOnError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	cachedCfg = nil
+	invalidateCertree()
+	auditTrail = &auditFile{file: AUDIT_LOG, size: -1}
+	defer func() {
+		cachedCfg = nil
+		invalidateCertree()
+	}()
+	defer SetSessionStore(NewMemorySessionStore())
+	f()
+}
+
+// testConfig saves a config with a TestCA signed localhost web certificate listening on local ports
+func testConfig(t *testing.T) *config {
+	ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+	dieOnError(t, err)
+	crt, err := GenCert(ca, "localhost", 365)
+	dieOnError(t, err)
+	cfg := NewConfig(User{Username: "admin", Password: crypt("admin")}, ca, crt, Mailer{})
+	cfg.Listen = Listen{Addr: "127.0.0.1", Port: freePort(t), HTTPPort: freePort(t)}
+	dieOnError(t, cfg.Save())
+	return cfg
+}
+
+// serveLocal serves h for the server s on a local port, returning its base URL
+func serveLocal(t *testing.T, s *Server, srv **http.Server, h http.Handler) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	s.mutex.Lock()
+	*srv = &http.Server{Handler: h}
+	go s.serve(*srv, ln, false)
+	s.mutex.Unlock()
+	return "http://" + ln.Addr().String()
+}
+
+func TestServerLifecycle(t *testing.T) {
+	inTempDir(t, func() {
+		testConfig(t)
+		s := NewServer()
+		setupURL := serveLocal(t, s, &s.setupSrv, http.HandlerFunc(s.smartSwitch))
+		webURL := serveLocal(t, s, &s.webSrv, http.NotFoundHandler())
+		s.configured = true
+		w := httptest.NewRecorder()
+		s.smartSwitch(w, httptest.NewRequest("GET", "/certControl?cert=localhost", nil))
+		if loc := w.Header().Get("Location"); w.Code != http.StatusFound || loc != s.WebURL()+"/certControl?cert=localhost" {
+			t.Fatalf("Stale setup request was not redirected to the app but got %d '%s'", w.Code, loc)
+		}
+
+		dieOnError(t, s.Shutdown(context.Background()))
+		dieOnError(t, s.Wait())
+		for _, url := range []string{setupURL, webURL} {
+			if _, err := http.Get(url + "/"); err == nil {
+				t.Fatalf("%s still serving after shutdown", url)
+			}
+		}
+		dieOnError(t, s.Shutdown(context.Background())) // shutting down twice is harmless
+	})
+}
+
+func TestServerFailure(t *testing.T) {
+	s := NewServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	dieOnError(t, err)
+	ln.Close()
+	go s.serve(&http.Server{}, ln, false)
+	select {
+	case err := <-waitErr(s):
+		if err == nil {
+			t.Fatal("Listener failure not reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return on a listener failure")
+	}
+}
+
+// waitErr returns a channel getting what Wait returns
+func waitErr(s *Server) chan error {
+	c := make(chan error, 1)
+	go func() { c <- s.Wait() }()
+	return c
+}
+
+func TestWebCertAutoRenew(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		crt, err := GenCert(ca, "localhost", 30)
+		dieOnError(t, err)
+		cfg := NewConfig(User{Username: "admin", Password: crypt("admin")}, ca, crt, Mailer{})
+		dieOnError(t, cfg.Save())
+		s := NewServer()
+		served, err := s.getCertificate(nil)
+		dieOnError(t, err)
+		if len(served.Certificate) != 2 || served.Leaf.SerialNumber.Cmp(crt.Crt.SerialNumber) != 0 {
+			t.Fatal("Web certificate not served with its CA from the Certree")
+		}
+
+		dieOnError(t, renewWebCertIfNeeded(time.Now()))
+		if FindCert("localhost").Crt.SerialNumber.Cmp(crt.Crt.SerialNumber) != 0 {
+			t.Fatal("Web certificate renewed too early")
+		}
+		dieOnError(t, renewWebCertIfNeeded(time.Now().AddDate(0, 0, 30-cfg.Advance)))
+		renewed := FindCert("localhost")
+		if renewed.Crt.SerialNumber.Cmp(crt.Crt.SerialNumber) == 0 {
+			t.Fatal("Web certificate not renewed within the advance days")
+		}
+		served, err = s.getCertificate(nil)
+		dieOnError(t, err)
+		if served.Leaf.SerialNumber.Cmp(renewed.Crt.SerialNumber) != 0 {
+			t.Fatal("Renewed web certificate not served on the next handshake")
+		}
+	})
+}
+
+func TestServer(t *testing.T) {
+	inTempDir(t, func() {
+		cfg := testConfig(t)
+		s := NewServer()
+		dieOnError(t, s.Start())
+		webAddr := fmt.Sprintf("127.0.0.1:%d", cfg.Listen.Port)
+		if s.WebURL() != "https://"+webAddr {
+			t.Fatalf("Unexpected web URL %s", s.WebURL())
+		}
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		httpURL := fmt.Sprintf("http://127.0.0.1:%d", cfg.Listen.HTTPPort)
+		resp, err := client.Get(httpURL + "/certControl?cert=localhost")
+		dieOnError(t, err)
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); loc != s.WebURL()+"/certControl?cert=localhost" {
+			t.Fatalf("Plain HTTP was not redirected to HTTPS but to '%s'", loc)
+		}
+		resp, err = client.Get(httpURL + "/crt/TestCA.pem")
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CA certificate not public over plain HTTP: %s", resp.Status)
+		}
+		serial := func() *big.Int {
+			conn, err := tls.Dial("tcp", webAddr, &tls.Config{InsecureSkipVerify: true})
+			dieOnError(t, err)
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].SerialNumber
+		}
+		before := serial()
+		_, err = RenewCert(FindCert("localhost"))
+		dieOnError(t, err)
+		if serial().Cmp(before) == 0 {
+			t.Fatal("Renewed web certificate was not served on the next handshake")
+		}
+		dieOnError(t, s.Shutdown(context.Background()))
+		dieOnError(t, s.Wait())
+	})
+}
+
+func TestClientCertLogin(t *testing.T) {
+	inTempDir(t, func() {
+		cfg := testConfig(t)
+		_, err := GenCACert(pkix.Name{CommonName: "UsersCA"}, 365)
+		dieOnError(t, err)
+		cfg.ClientCA = "TestCA"
+		if cfg.getClientCA() != nil {
+			t.Fatal("The web certificate CA was accepted as client CA")
+		}
+		cfg.ClientCA = "UsersCA"
+		dieOnError(t, cfg.Save())
+		s := NewServer()
+		dieOnError(t, s.Start())
+		defer s.Shutdown(context.Background())
+		get := func(c *Cert) (*http.Response, string) {
+			client := &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       []tls.Certificate{{Certificate: [][]byte{c.Crt.Raw}, PrivateKey: c.Key}},
+				}},
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Get(s.WebURL() + "/")
+			dieOnError(t, err)
+			defer resp.Body.Close()
+			page, err := ioutil.ReadAll(resp.Body)
+			dieOnError(t, err)
+			return resp, string(page)
+		}
+		stale, err := GenClientCert(FindCert("UsersCA"), cfg.getUser("admin"), CLIENT_DAYS)
+		dieOnError(t, err)
+		c, err := GenClientCert(FindCert("UsersCA"), cfg.getUser("admin"), CLIENT_DAYS)
+		dieOnError(t, err)
+		_, err = EncodePKCS12(c, "secret")
+		dieOnError(t, err)
+		if _, page := get(c); !strings.Contains(page, "Logged as") {
+			t.Fatalf("Client certificate did not log in:\n%s", page)
+		}
+		dieOnError(t, os.Remove("admin"+CERT_SUFFIX))
+		dieOnError(t, os.Remove("admin"+KEY_SUFFIX))
+		invalidateCertree()
+		other, err := GenCert(FindCert("UsersCA"), "admin", 30)
+		dieOnError(t, err)
+		for _, c := range []*Cert{stale, other} {
+			if _, page := get(c); strings.Contains(page, "Logged as") {
+				t.Fatalf("Logged in with a client certificate not issued to the user %v", c.Crt.SerialNumber)
+			}
+		}
+
+		u := cfg.getUser("admin")
+		u.LockedUntil = time.Now().Add(time.Hour)
+		cfg.Users["admin"] = u
+		dieOnError(t, cfg.Save())
+		if _, page := get(c); strings.Contains(page, "Logged as") || !strings.Contains(page, "Account locked") {
+			t.Fatalf("Client certificate logged in a locked account:\n%s", page)
+		}
+		u.LockedUntil = time.Time{}
+		cfg.Users["admin"] = u
+		cfg.Require2FA[u.role()] = true
+		dieOnError(t, cfg.Save())
+		if resp, page := get(c); strings.Contains(page, "Logged as") || resp.Header.Get("Location") != "/totp" {
+			t.Fatalf("Client certificate skipped the required second factor:\n%s", page)
+		}
+	})
+}
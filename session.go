@@ -3,79 +3,246 @@ package webca
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"log"
 	"net/http"
 	"sync"
+	"time"
 )
 
 const (
-	SESSIONID = "goSessionId"
+	SESSIONID       = "goSessionId"
+	SESSION_TIMEOUT = 8 * time.Hour    // absolute session lifetime
+	SESSION_IDLE    = 30 * time.Minute // idle session lifetime
+	SESSION_PRUNE   = 5 * time.Minute  // how often expired sessions are removed
+	SESSION_TOUCH   = time.Minute      // how often the last use of a session is stored
 )
 
-// session type
-type session map[string]interface{}
+// session type, values are plain strings so that any SessionStore can keep them safely
+type session map[string]string
 
-// sessions holds all sessions
-var sessions map[string]session
+// sessionStore keeps all sessions, in memory unless the Server is configured otherwise
+var sessionStore SessionStore = NewMemorySessionStore()
 
 // mutex lock for session access
 var smutex sync.RWMutex
 
-// requestSessionId retrieves the session cookie from the request or creates a new one
-func requestSessionId(w http.ResponseWriter, r *http.Request) (string,error) {
-	cookie,e:=r.Cookie(SESSIONID)
-	if e!=nil && e!=http.ErrNoCookie {
-		return "",e
+// pruning starts the goroutine removing expired sessions once
+var pruning sync.Once
+
+// SetSessionStore replaces the SessionStore, existing sessions are not moved to the new one
+func SetSessionStore(st SessionStore) {
+	smutex.Lock()
+	defer smutex.Unlock()
+	sessionStore = st
+}
+
+// requestSessionId retrieves the session ID from the request cookie, or "" if there is none
+// or it can't be a session ID
+func requestSessionId(r *http.Request) (string, error) {
+	cookie, e := r.Cookie(SESSIONID)
+	if e == http.ErrNoCookie {
+		return "", nil
+	}
+	if e != nil {
+		return "", e
 	}
-	if e==http.ErrNoCookie || cookie==nil {
-		id,e:=genId()
-		if e!=nil {
-			return "",e
+	if !validId(cookie.Value) {
+		return "", nil
+	}
+	return cookie.Value, nil
+}
+
+// setSessionCookie sets the session id cookie on the response and the request. The cookie is
+// hidden from scripts, not sent on cross-site subrequests and, over TLS, never sent in clear
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, sessionCookie(r, id, 0))
+	replaceCookie(r, &http.Cookie{Name: SESSIONID, Value: id}) // for future references of this request
+}
+
+// sessionCookie returns the session id cookie for the request
+func sessionCookie(r *http.Request, id string, maxAge int) *http.Cookie {
+	return &http.Cookie{Name: SESSIONID, Value: id, Path: "/", MaxAge: maxAge,
+		Secure: r.TLS != nil, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+}
+
+// replaceCookie sets cookie on the request, replacing any other with the same name
+func replaceCookie(r *http.Request, cookie *http.Cookie) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != cookie.Name {
+			r.AddCookie(c)
 		}
-		cookie=&http.Cookie{Name:SESSIONID,Value:id,Path:"/", MaxAge:0}
-		http.SetCookie(w,cookie)
-		r.AddCookie(cookie) // for future references of this request
-	}	
-	return cookie.Value,nil
+	}
+	r.AddCookie(cookie)
 }
 
-// SessionFor gets a session bound to a Request by Session ID
+// SessionFor gets a session bound to a Request by Session ID. Requests with no session, an
+// unknown one or an expired one get a new session with a new ID
 func SessionFor(w http.ResponseWriter, r *http.Request) (session, error) {
-	id,e := requestSessionId(w,r)
-	if e!=nil {
+	pruning.Do(func() { go pruneLoop() })
+	id, e := requestSessionId(r)
+	if e != nil {
 		return nil, e
 	}
-	smutex.RLock()
-	defer smutex.RUnlock()
-	if sessions==nil {
-		sessions=make(map[string]session)
+	smutex.Lock()
+	defer smutex.Unlock()
+	now := time.Now()
+	var ss *StoredSession
+	if id != "" {
+		if ss, e = sessionStore.Get(id); e != nil {
+			return nil, e
+		}
+	}
+	if ss != nil && ss.expired(now) {
+		if e = sessionStore.Delete(id); e != nil {
+			return nil, e
+		}
+		ss = nil
+	}
+	if ss == nil {
+		if id, e = genId(); e != nil {
+			return nil, e
+		}
+		token, e := genId()
+		if e != nil {
+			return nil, e
+		}
+		ss = &StoredSession{Values: session{SESSIONID: id, CSRFTOKEN: token}, Created: now, Seen: now}
+		if e = sessionStore.Put(ss); e != nil {
+			return nil, e
+		}
+		setSessionCookie(w, r, id)
+	} else if now.Sub(ss.Seen) > SESSION_TOUCH {
+		ss.Seen = now
+		if e = sessionStore.Put(ss); e != nil {
+			return nil, e
+		}
+	}
+	return ss.Values.clone(), nil // this copy allows concurrent session access
+}
+
+// expired tells whether the session is past its absolute or idle timeout
+func (ss *StoredSession) expired(now time.Time) bool {
+	return now.Sub(ss.Created) > SESSION_TIMEOUT || now.Sub(ss.Seen) > SESSION_IDLE
+}
+
+// pruneSessions removes the expired sessions
+func pruneSessions(now time.Time) {
+	deleteSessions(func(ss *StoredSession) bool { return ss.expired(now) })
+}
+
+// pruneLoop prunes the expired sessions periodically
+func pruneLoop() {
+	for now := range time.Tick(SESSION_PRUNE) {
+		pruneSessions(now)
+	}
+}
+
+// deleteSessions removes the sessions matching the condition
+func deleteSessions(matches func(ss *StoredSession) bool) {
+	smutex.Lock()
+	defer smutex.Unlock()
+	all, err := sessionStore.List()
+	if err != nil {
+		log.Printf("(Warning) Failed to list sessions: %v", err)
+		return
+	}
+	for _, ss := range all {
+		if !matches(ss) {
+			continue
+		}
+		if err := sessionStore.Delete(ss.Values.Id()); err != nil {
+			log.Printf("(Warning) Failed to delete session: %v", err)
+		}
 	}
-	s := sessions[id]
-	if s==nil {
-		s=make(session)
-		s[SESSIONID]=id
-		sessions[id]=s
+}
+
+// Destroy removes the session from the server and clears its cookie
+func (s session) Destroy(w http.ResponseWriter, r *http.Request) {
+	smutex.Lock()
+	defer smutex.Unlock()
+	if err := sessionStore.Delete(s.Id()); err != nil {
+		log.Printf("(Warning) Failed to delete session: %v", err)
 	}
-	return s.clone(), nil // this copy allows concurrent session access
+	http.SetCookie(w, sessionCookie(r, "", -1))
+}
+
+// Rotate moves the session to a new ID and CSRF token, so that an ID known before logging in
+// (maybe planted by an attacker) is useless afterwards
+func (s session) Rotate(w http.ResponseWriter, r *http.Request) error {
+	id, err := genId()
+	if err != nil {
+		return err
+	}
+	token, err := genId()
+	if err != nil {
+		return err
+	}
+	smutex.Lock()
+	defer smutex.Unlock()
+	ss, err := sessionStore.Get(s.Id())
+	if err != nil || ss == nil {
+		return err // or destroyed meanwhile
+	}
+	if err := sessionStore.Delete(s.Id()); err != nil {
+		return err
+	}
+	s[SESSIONID], s[CSRFTOKEN] = id, token
+	ss.Values = s.clone()
+	if err := sessionStore.Put(ss); err != nil {
+		return err
+	}
+	setSessionCookie(w, r, id)
+	return nil
+}
+
+// destroySessionsOf removes all sessions of the named user, logged or pending to log in
+func destroySessionsOf(username string) {
+	deleteSessions(func(ss *StoredSession) bool {
+		return ss.Values[LOGGEDUSER] == username || ss.Values[PENDINGUSER] == username
+	})
 }
 
 // Id returns the session ID or ""
 func (s session) Id() string {
-	if s[SESSIONID]!=nil {
-		return s[SESSIONID].(string)
+	return s[SESSIONID]
+}
+
+// User returns the logged User, as currently configured
+func (s session) User() (User, bool) {
+	name := s[LOGGEDUSER]
+	if name == "" {
+		return User{}, false
+	}
+	if fakedLogin && name == fakeUser.Username {
+		return fakeUser, true
 	}
-	return ""
+	cfg := LoadConfig()
+	if cfg == nil {
+		return User{}, false
+	}
+	u := cfg.getUser(name)
+	return u, u.Username != ""
 }
 
-// Save stores the session state 
+// Save stores the session state, unless it was destroyed meanwhile
 func (s session) Save() {
 	smutex.Lock()
 	defer smutex.Unlock()
-	sessions[s.Id()] = s.clone()
+	ss, err := sessionStore.Get(s.Id())
+	if err == nil && ss != nil {
+		ss.Values = s.clone()
+		err = sessionStore.Put(ss)
+	}
+	if err != nil {
+		log.Printf("(Warning) Failed to save session: %v", err)
+	}
 }
 
 // clone makes a copy of a session and returns it
 func (s session) clone() session {
-	c := make(session,len(s))
+	c := make(session, len(s))
 	for k, v := range s {
 		c[k] = v
 	}
@@ -94,3 +261,9 @@ func genId() (string, error) {
 	uuid[4] = 0x40 // version 4 Pseudo Random, see page 7
 	return hex.EncodeToString(uuid), nil
 }
+
+// validId tells whether id looks like an ID generated by genId
+func validId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
@@ -2,7 +2,9 @@ package webca
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func dieOnError(t *testing.T, err error) {
@@ -26,14 +28,83 @@ func equal(s1, s2 session) bool {
 func TestSessions(t *testing.T) {
 	r,err := http.NewRequest("get", "/", nil)
 	dieOnError(t, err)
-	s, err := SessionFor(r)
+	s, err := SessionFor(httptest.NewRecorder(), r)
 	dieOnError(t, err)
 	s["a"] = "A"
 	s.Save()
-	s2, err := SessionFor(r)
+	s2, err := SessionFor(httptest.NewRecorder(), r)
 	dieOnError(t, err)
 	if !equal(s,s2) {
-		t.Fatal("Session save failed! s=%v vs s2=%v\n", s, s2)
+		t.Fatalf("Session save failed! s=%v vs s2=%v\n", s, s2)
 	}
 }
 
+
+// withCookies returns a request carrying the cookies set on the recorded response
+func withCookies(t *testing.T, w *httptest.ResponseRecorder) *http.Request {
+	r, err := http.NewRequest("GET", "/", nil)
+	dieOnError(t, err)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSessionExpiry(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/", nil)
+	dieOnError(t, err)
+	s, err := SessionFor(w, r)
+	dieOnError(t, err)
+	now := time.Now()
+	ss, err := sessionStore.Get(s.Id())
+	dieOnError(t, err)
+	if ss.expired(now) || !ss.expired(now.Add(SESSION_IDLE+time.Second)) {
+		t.Fatal("Idle timeout not honoured")
+	}
+	ss.Seen = now.Add(SESSION_TIMEOUT)
+	if !ss.expired(now.Add(SESSION_TIMEOUT + time.Second)) {
+		t.Fatal("Absolute timeout not honoured")
+	}
+	pruneSessions(now.Add(SESSION_IDLE + time.Second))
+	s2, err := SessionFor(httptest.NewRecorder(), withCookies(t, w))
+	dieOnError(t, err)
+	if s2.Id() == s.Id() {
+		t.Fatal("Expired session was not pruned")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	logged := func(name string) (*httptest.ResponseRecorder, session) {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		dieOnError(t, err)
+		s, err := SessionFor(w, r)
+		dieOnError(t, err)
+		s[LOGGEDUSER] = name
+		s.Save()
+		return w, s
+	}
+	w1, s1 := logged("alice")
+	w2, s2 := logged("alice")
+	w3, s3 := logged("bob")
+	r := withCookies(t, w1)
+	r.Form = map[string][]string{"everywhere": {"true"}}
+	w := httptest.NewRecorder()
+	logout(w, r)
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Fatalf("Logout did not clear the session cookie: %v", c)
+	}
+	s1.Save() // must not resurrect it
+	for _, c := range []struct {
+		w     *httptest.ResponseRecorder
+		s     session
+		alive bool
+	}{{w1, s1, false}, {w2, s2, false}, {w3, s3, true}} {
+		s, err := SessionFor(httptest.NewRecorder(), withCookies(t, c.w))
+		dieOnError(t, err)
+		if (s.Id() == c.s.Id()) != c.alive {
+			t.Fatalf("Session of %v alive should be %v", c.s[LOGGEDUSER], c.alive)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package webca
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SESSIONS_DIR    = ".webca.sessions"
+	SESSION_SUFFIX  = ".json"
+	SESSION_TMPFILE = ".tmp"
+)
+
+// StoredSession is a session as kept by a SessionStore, with its timestamps
+type StoredSession struct {
+	Values  session
+	Created time.Time
+	Seen    time.Time
+}
+
+// SessionStore keeps the sessions by ID. Implementations are called with the sessions lock held
+// and must return copies of the sessions they keep
+type SessionStore interface {
+	// Get returns the session with the given ID, or nil if there is none
+	Get(id string) (*StoredSession, error)
+	// Put stores the session, replacing any other with the same ID
+	Put(ss *StoredSession) error
+	// Delete removes the session with the given ID, if any
+	Delete(id string) error
+	// List returns all sessions
+	List() ([]*StoredSession, error)
+}
+
+// copy returns a deep copy of the StoredSession
+func (ss *StoredSession) copy() *StoredSession {
+	c := *ss
+	c.Values = ss.Values.clone()
+	return &c
+}
+
+// memorySessionStore keeps sessions in memory, they are lost on restart
+type memorySessionStore struct {
+	sync.Mutex
+	sessions map[string]*StoredSession
+}
+
+// NewMemorySessionStore returns a SessionStore keeping sessions in memory
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]*StoredSession)}
+}
+
+// Get returns the session with the given ID, or nil if there is none
+func (ms *memorySessionStore) Get(id string) (*StoredSession, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if ss := ms.sessions[id]; ss != nil {
+		return ss.copy(), nil
+	}
+	return nil, nil
+}
+
+// Put stores the session
+func (ms *memorySessionStore) Put(ss *StoredSession) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.sessions[ss.Values.Id()] = ss.copy()
+	return nil
+}
+
+// Delete removes the session with the given ID
+func (ms *memorySessionStore) Delete(id string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+// List returns all sessions
+func (ms *memorySessionStore) List() ([]*StoredSession, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	all := make([]*StoredSession, 0, len(ms.sessions))
+	for _, ss := range ms.sessions {
+		all = append(all, ss.copy())
+	}
+	return all, nil
+}
+
+// fileSessionStore keeps each session as a JSON file on a directory, so sessions survive
+// restarts and can be shared by several WebCA instances. Files are named after a hash of the
+// session ID, so that listing the directory does not reveal valid session IDs
+type fileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore returns a SessionStore keeping sessions on files at dir
+func NewFileSessionStore(dir string) (SessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+// file returns the path of the file for the session ID
+func (fs *fileSessionStore) file(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(fs.dir, hex.EncodeToString(sum[:])+SESSION_SUFFIX)
+}
+
+// Get returns the session with the given ID, or nil if there is none
+func (fs *fileSessionStore) Get(id string) (*StoredSession, error) {
+	ss, err := fs.read(fs.file(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == nil && ss.Values.Id() != id {
+		return nil, nil
+	}
+	return ss, err
+}
+
+// read decodes the session in file
+func (fs *fileSessionStore) read(file string) (*StoredSession, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ss := &StoredSession{}
+	if err := json.Unmarshal(data, ss); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Put stores the session, replacing its file atomically
+func (fs *fileSessionStore) Put(ss *StoredSession) error {
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return err
+	}
+	file := fs.file(ss.Values.Id())
+	tmp := file + SESSION_TMPFILE
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Delete removes the session file
+func (fs *fileSessionStore) Delete(id string) error {
+	err := os.Remove(fs.file(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns all sessions, skipping unreadable files
+func (fs *fileSessionStore) List() ([]*StoredSession, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]*StoredSession, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), SESSION_SUFFIX) {
+			continue
+		}
+		if ss, err := fs.read(filepath.Join(fs.dir, f.Name())); err == nil {
+			all = append(all, ss)
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,51 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	inTempDir(t, func() {
+		st, err := NewFileSessionStore(SESSIONS_DIR)
+		dieOnError(t, err)
+		SetSessionStore(st)
+		w := httptest.NewRecorder()
+		s, err := SessionFor(w, httptest.NewRequest("GET", "/", nil))
+		dieOnError(t, err)
+		s[LOGGEDUSER] = "admin"
+		s.Save()
+		// a restart opens the same store again
+		st, err = NewFileSessionStore(SESSIONS_DIR)
+		dieOnError(t, err)
+		SetSessionStore(st)
+		s2, err := SessionFor(httptest.NewRecorder(), withCookies(t, w))
+		dieOnError(t, err)
+		if !equal(s, s2) {
+			t.Fatalf("Session did not survive the restart: %v vs %v", s, s2)
+		}
+		all, err := st.List()
+		dieOnError(t, err)
+		if len(all) != 1 || all[0].Created.IsZero() {
+			t.Fatalf("Unexpected sessions listed: %v", all)
+		}
+		pruneSessions(time.Now().Add(SESSION_TIMEOUT + time.Second))
+		if ss, err := st.Get(s.Id()); err != nil || ss != nil {
+			t.Fatalf("Expired session was not pruned: %v %v", ss, err)
+		}
+	})
+}
+
+func TestForgedSessionId(t *testing.T) {
+	for _, id := range []string{"../../etc/passwd", "0123456789abcdef0123456789abcdef"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: SESSIONID, Value: id})
+		s, err := SessionFor(httptest.NewRecorder(), r)
+		dieOnError(t, err)
+		if s.Id() == id {
+			t.Fatalf("Session was created with the client chosen id %s", id)
+		}
+	}
+}
@@ -2,48 +2,48 @@ package webca
 
 import (
 	"crypto/x509/pkix"
-	"fmt"
 	"log"
 	"net/http"
-	"sync"
 )
 
 const (
-	SETUPADDR = "127.0.0.1"
-	SETUPPORT = 80
+	SETUPADDR = "127.0.0.1" // default setup wizard bind address
+	SETUPPORT = 80          // default setup wizard port
 )
 
 // CertSetup contains the config to generate a certificate
 type CertSetup struct {
-	Name     pkix.Name
-	Duration int
+	Name        pkix.Name
+	Duration    int
+	IsCA        bool             // for an intermediate CA, roots always are
+	Constraints *NameConstraints // of a CA, if any
 }
 
-// oneSetup holds the setup lock
-var oneSetup sync.Mutex
-
-// setupDone tells whether the configuration has been applied or not
-var setupDone bool
-
-// rootFunc points to the root function that is different on setup and normal mode
-var rootFunc func(w http.ResponseWriter, r *http.Request)
-
-// PrepareSetup prepares the Web handlers for the setup wizard
-func PrepareSetup(smux *http.ServeMux) address {
+// prepareSetup prepares the Web handlers for the setup wizard
+func (s *Server) prepareSetup(smux *http.ServeMux) address {
 	log.Printf("(Warning) Starting WebCA setup...")
-	rootFunc = showSetup
-	smux.HandleFunc("/", smartSwitch)
+	smux.HandleFunc("/", s.smartSwitch)
 	smux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("img"))))
 	smux.Handle("/favicon.ico", http.FileServer(http.Dir("img")))
 	smux.Handle("/crt/", http.StripPrefix("/crt/", certServer(http.Dir("."))))
-	smux.HandleFunc("/setup", setup)
-	smux.HandleFunc("/restart", restart)
-	return address{addr: fmt.Sprintf("%s:%v", SETUPADDR, SETUPPORT), tls: false}
+	smux.HandleFunc("/setup", s.setup)
+	smux.HandleFunc("/restart", s.restart)
+	return address{addr: s.settings().setupAddr(), tls: false}
 }
 
-// smartSwitch redirects to showSetup or index depending on whether the setup is done or not
-func smartSwitch(w http.ResponseWriter, r *http.Request) {
-	rootFunc(w, r)
+// smartSwitch shows the setup wizard until the setup is done, then it redirects any stale request
+// on the setup listener to the same path on the WebCA TLS listener
+func (s *Server) smartSwitch(w http.ResponseWriter, r *http.Request) {
+	if !s.isConfigured() {
+		showSetup(w, r)
+		return
+	}
+	webURL := s.WebURL()
+	if webURL == "" {
+		s.restart(w, r)
+		return
+	}
+	http.Redirect(w, r, webURL+r.URL.RequestURI(), http.StatusFound)
 }
 
 // showSetup shows the setup wizard form
@@ -62,25 +62,26 @@ func showSetup(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// setup checks and saves the initial setup from the wizard form
-func setup(w http.ResponseWriter, r *http.Request) {
+// setup checks and saves the initial setup from the wizard form and then switches to the TLS listener
+func (s *Server) setup(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Checking whether to do setup or not...")
-	oneSetup.Lock()
-	defer oneSetup.Unlock()
-	if !setupDone {
+	s.setupLock.Lock()
+	defer s.setupLock.Unlock()
+	if !s.isConfigured() {
 		user := readUser(r)
 		certs := make(map[string]*CertSetup, 2)
 		for _, prefix := range []string{"CA", "Cert"} {
 			crt, err := readCertSetup(prefix, r)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 			certs[prefix] = crt
 		}
 		mailer := readMailer(r)
 		ca, c := certs["CA"], certs["Cert"]
 		user.Password = crypt(user.Password)
-		log.Printf("Running setup...\nuser=%s\nca=%s\nc=%s\nmailer%s\n", user, ca, c, mailer)
+		log.Printf("Running setup...\nuser=%v\nca=%v\nc=%v\nmailer%v\n", user, ca, c, mailer)
 		cacert, err := GenCACert(ca.Name, ca.Duration)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -93,28 +94,34 @@ func setup(w http.ResponseWriter, r *http.Request) {
 		}
 		log.Printf("CA=%s\nCert=%s\n", cacert, cert)
 		log.Printf("Saving config...")
-		if err = NewConfig(user, cacert, cert, mailer).Save(); err != nil {
+		cfg := NewConfig(user, cacert, cert, mailer)
+		cfg.Listen = s.Listen
+		if err = cfg.Save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = s.switchToWeb(); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		setupDone = true
-		rootFunc = restart
-		go webCA()
 	}
-	restart(w, r)
+	s.restart(w, r)
 }
 
 // restart tells the user the setup is already done so she can proceed to the WebCA
-func restart(w http.ResponseWriter, r *http.Request) {
+func (s *Server) restart(w http.ResponseWriter, r *http.Request) {
 	cfg := LoadConfig()
+	if cfg == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 	ps := PageStatus{}
 	ps["Message"] = tr("Setup is done!")
 	ps["CAName"] = cfg.getWebCert().Parent.Crt.Subject.CommonName
 	ps["CertName"] = cfg.getWebCert().Crt.Subject.CommonName
-	ps["WebCAURL"] = webCAURL(cfg)
+	ps["WebCAURL"] = s.WebURL()
 	err := templates.ExecuteTemplate(w, "restart", ps)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
-
@@ -60,7 +60,18 @@ WebCA Setup:
 {{template "style.css"}}
 </style>
   <div class="loggedUser">
-{{if .LoggedUser}} Logged as: {{.LoggedUser.Fullname}} (<a href="/logout">logout</a>)
+{{if .LoggedUser}} Logged as: {{.LoggedUser.Fullname}}
+<form action="/logout" method="post" style="display: inline">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+(<input type="submit" class="link" value="logout">,
+<input type="submit" class="link" name="everywhere" value='{{tr "everywhere"}}'>)
+</form>
+(<a href="/clientCert">{{tr "client certificate"}}</a>)
+(<a href="/totp">{{tr "two-factor"}}</a>)
+{{if .LoggedUser.Can "admin"}}(<a href="/users">{{tr "users"}}</a>){{end}}
+{{if .LoggedUser.Can "audit"}}(<a href="/audit">{{tr "audit log"}}</a>){{end}}
+(<a href="/health">{{tr "health"}}</a>)
+{{if .LoggedUser.Can "request"}}(<a href="/requests">{{tr "requests"}}</a>){{end}}
 {{end}}
   </div>
 </div>
@@ -162,6 +173,29 @@ WebCA Setup:
         onkeyup="checkPassword(this)"></td></tr>
 {{end}}
 
+{{define "constraintFields"}}
+<tr><th colspan="2">{{tr "Name constraints of the CA, empty fields do not restrict anything"}}</th></tr>
+<tr><td class="label">{{tr "Permitted domains"}}:</td>
+    <td><input type="text" name="Cert.PermittedDNS" value='{{join .PermittedDNS ", "}}' placeholder="example.com"></td></tr>
+<tr><td class="label">{{tr "Excluded domains"}}:</td>
+    <td><input type="text" name="Cert.ExcludedDNS" value='{{join .ExcludedDNS ", "}}'></td></tr>
+<tr><td class="label">{{tr "Permitted IP ranges"}}:</td>
+    <td><input type="text" name="Cert.PermittedIPs" value='{{join .PermittedIPs ", "}}' placeholder="10.0.0.0/8"></td></tr>
+<tr><td class="label">{{tr "Excluded IP ranges"}}:</td>
+    <td><input type="text" name="Cert.ExcludedIPs" value='{{join .ExcludedIPs ", "}}'></td></tr>
+<tr><td class="label">{{tr "Permitted email domains"}}:</td>
+    <td><input type="text" name="Cert.PermittedEmails" value='{{join .PermittedEmails ", "}}' placeholder="example.com"></td></tr>
+<tr><td class="label">{{tr "Excluded email domains"}}:</td>
+    <td><input type="text" name="Cert.ExcludedEmails" value='{{join .ExcludedEmails ", "}}'></td></tr>
+<tr><td class="label">{{tr "Permitted URI domains"}}:</td>
+    <td><input type="text" name="Cert.PermittedURIs" value='{{join .PermittedURIs ", "}}' placeholder="example.com"></td></tr>
+<tr><td class="label">{{tr "Excluded URI domains"}}:</td>
+    <td><input type="text" name="Cert.ExcludedURIs" value='{{join .ExcludedURIs ", "}}'></td></tr>
+<tr><td class="label">{{tr "Critical"}}:</td>
+    <td><label><input type="checkbox" name="Cert.Critical" {{if .Critical}}checked="checked"{{end}}>
+        {{tr "Relying parties must understand the constraints"}}</label></td></tr>
+{{end}}
+
 {{define "certNode"}}
 <div class="indent">
 {{range .}}
@@ -169,10 +203,20 @@ WebCA Setup:
 <a href="certControl?cert={{.Crt.Subject.CommonName}}">{{.Crt.Subject.CommonName}}</a>
 </span>
 <span class="period">{{showPeriod .Crt}}</span>
+{{template "healthBadge" .}}
+{{template "crossBadge" .}}
 {{template "certNode" .Childs}}
 {{end}}
 </div>
 {{end}}
+
+{{define "crossBadge"}}
+{{range .Cross}}<span class="period">({{tr "also issued by %s" .Parent.Crt.Subject.CommonName}})</span>{{end}}
+{{end}}
+
+{{define "healthBadge"}}
+{{with problemsOf .}}<a href="/health" class="broken" title='{{join . "; "}}'>&#9888; {{len .}}</a>{{end}}
+{{end}}
 `
 
 	//
@@ -414,7 +458,7 @@ function checkPassword(el) {
 <b>{{.CAName}}.pem</b> <p/>
 <p/>
 {{tr "Once you are done, you can start using your WebCA right away..."}} <p/>
-<a href="https://{{.WebCAURL}}">{{tr "Click here to go into your WebCA"}}</a><p/>
+<a href="{{.WebCAURL}}">{{tr "Click here to go into your WebCA"}}</a><p/>
 </div>
 <script type="text/javascript">
 {{template "JSSetupDone"}}
@@ -433,6 +477,7 @@ function checkPassword(el) {
 </div>
 {{end}}
 <form action="/login" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
 <input type="hidden" id="_SESSION_ID" name="_SESSION_ID" value="{{._SESSION_ID}}"/>
 <input type="hidden" id="URL" name="URL" value="{{.URL}}"/>
 <table class="form">
@@ -449,6 +494,9 @@ function checkPassword(el) {
 </tr>
 </table>
 </form>
+{{if .SSO}}
+<p><a href="/sso?URL={{.URL}}">{{tr "Log in with SSO"}}</a></p>
+{{end}}
 
 {{template "htmlfooter"}}
 {{end}}
@@ -464,12 +512,20 @@ function checkPassword(el) {
 {{.Crt.Subject.CommonName}}
 </span></a>
 <span class="period">{{showPeriod .Crt}}</span></span>
+{{template "healthBadge" .}}
+{{template "crossBadge" .}}
 {{template "certNode" .Childs}}
+{{if $.LoggedUser.Can "issue"}}
 <div class="Cert"><a href="/cert?parent={{qEsc .Crt.Subject.CommonName}}"
      >+ {{tr "Add more Certificates to %s..." .Crt.Subject.CommonName}}</a></div><br/>
 {{end}}
+{{end}}
 <p/>
+{{if .LoggedUser.Can "issue"}}
 <div class="CA"><a href="/cert">+ {{tr "Add more CAs..."}}</a></div>
+{{else if .LoggedUser.Can "request"}}
+<div class="CA"><a href="/requests">+ {{tr "Request a certificate..."}}</a></div>
+{{end}}
 <!--
 <div class="CATitle">{{tr "Externally Managed Certificates:"}}</div>
 {{range .Others}}
@@ -487,6 +543,7 @@ function checkPassword(el) {
 {{template "htmlheader" .}}
 <h2>{{.Title}}</h2>
 <form action="/gen" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
 <table class="form">
 <input type="hidden" name="parent" value="{{.parent}}"/>
 {{if .Error}}
@@ -500,6 +557,12 @@ function checkPassword(el) {
 </tr>
 {{.LoadCrt .Cert "Cert" 365}}
 {{template "certCommonFields" .}}
+{{if .parent}}
+<tr><td class="label">{{tr "Intermediate CA"}}:</td>
+    <td><label><input type="checkbox" name="Cert.IsCA" {{if .Cert.IsCA}}checked="checked"{{end}}>
+        {{tr "Can issue certificates itself"}}</label></td></tr>
+{{end}}
+{{template "constraintFields" .Constraints}}
 <tr>
 <td colspan="2"><input type="submit" id="submit" name="submit" value='{{.Action}}'></td>
 </tr>
@@ -511,10 +574,68 @@ function checkPassword(el) {
 {{define "certControl"}}
 {{template "htmlheader" .}}
 <h2>{{.Title}}</h2>
-<form action="/ctrl" method="post">
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+{{with .Renewal}}
+<div class="explanation">
+{{if .SameKey}}
+{{tr "The CA was renewed keeping its key, all its children remain valid."}}
+{{else}}
+{{tr "The CA was renewed with a new key."}}
+{{if .Rollover}}{{tr "Its old and new keys were cross-signed, download the rollover certificates below."}}{{end}}
+{{if .Reissued}}<br/>{{tr "Re-issued under the new key"}}:
+{{range .Reissued}} <a href="/certControl?cert={{.Crt.Subject.CommonName}}">{{.Crt.Subject.CommonName}}</a>{{end}}{{end}}
+{{if .Orphaned}}<br/>{{if .Rollover}}{{tr "Still signed by the old key, valid through the OldWithNew certificate only"}}{{else}}{{tr "Still signed by the old key, no longer valid"}}{{end}}:
+{{range .Orphaned}} <a href="/certControl?cert={{.Crt.Subject.CommonName}}">{{.Crt.Subject.CommonName}}</a>{{end}}{{end}}
+{{if .Failed}}<br/>{{tr "Failed to re-issue"}}:{{range .Failed}}<br/>{{.}}{{end}}{{end}}
+{{end}}
+</div>
+{{end}}
 <table class="form">
 <tr><td colspan="4" class="bigger">{{.Cert.Crt.Subject.CommonName}}</td></tr>
 <tr><td colspan="4"><span class="period">{{showPeriod .Cert.Crt}}</span></td></tr>
+{{with .Constraints}}
+<tr><td colspan="4"><b>{{tr "Name constraints"}}{{if .Critical}} ({{tr "critical"}}){{end}}:</b>
+{{if .PermittedDNS}}<br/>{{tr "Permitted domains"}}: {{join .PermittedDNS ", "}}{{end}}
+{{if .ExcludedDNS}}<br/>{{tr "Excluded domains"}}: {{join .ExcludedDNS ", "}}{{end}}
+{{if .PermittedIPs}}<br/>{{tr "Permitted IP ranges"}}: {{join .PermittedIPs ", "}}{{end}}
+{{if .ExcludedIPs}}<br/>{{tr "Excluded IP ranges"}}: {{join .ExcludedIPs ", "}}{{end}}
+{{if .PermittedEmails}}<br/>{{tr "Permitted email domains"}}: {{join .PermittedEmails ", "}}{{end}}
+{{if .ExcludedEmails}}<br/>{{tr "Excluded email domains"}}: {{join .ExcludedEmails ", "}}{{end}}
+{{if .PermittedURIs}}<br/>{{tr "Permitted URI domains"}}: {{join .PermittedURIs ", "}}{{end}}
+{{if .ExcludedURIs}}<br/>{{tr "Excluded URI domains"}}: {{join .ExcludedURIs ", "}}{{end}}
+</td></tr>
+{{end}}
+{{with .Findings}}
+<tr><td colspan="4"><b>{{tr "Lint findings"}}</b> (<a href="/lint.json?cert={{qEsc $.Cert.Crt.Subject.CommonName}}">JSON</a>):
+{{range .}}<br/><span {{if eq .Level "error"}}class="broken"{{end}}>{{.Level}} {{.Rule}}: {{.Message}}</span>{{end}}
+</td></tr>
+{{end}}
+<tr><td colspan="4"><b>{{tr "Download chain"}}</b>:
+{{range .Chains}} <a href="/chain?cert={{qEsc $.Cert.Crt.Subject.CommonName}}&via={{qEsc .Via}}"
+  >{{if .Via}}{{tr "via %s" .Via}}{{else}}{{tr "through its issuers"}}{{end}}</a>{{end}}
+</td></tr>
+{{if .Cert.Crt.IsCA}}
+<tr><td colspan="4"><b>{{tr "Cross-signed by"}}</b>:
+{{range .Cert.Cross}} <a href="/cross?cert={{qEsc $.Cert.Crt.Subject.CommonName}}&signer={{qEsc .Parent.Crt.Subject.CommonName}}"
+  >{{.Parent.Crt.Subject.CommonName}}</a> <span class="period">{{showPeriod .Crt}}</span>{{else}}{{tr "none"}}{{end}}
+{{if and (.LoggedUser.Can "admin") .CrossSigners}}
+<form action="/crossSign" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<select name="signer">{{range .CrossSigners}}<option value="{{.}}">{{.}}</option>{{end}}</select>
+<input type="submit" value='{{tr "Cross-sign"}}'>
+</form>
+{{end}}
+</td></tr>
+{{end}}
+{{if and .Cert.Crt.IsCA .Cert.Key (.LoggedUser.Can "issue")}}
+<tr><td colspan="4"><a href="/cert?parent={{qEsc .Cert.Crt.Subject.CommonName}}"
+     >+ {{tr "Add more Certificates to %s..." .Cert.Crt.Subject.CommonName}}</a></td></tr>
+{{end}}
 {{with .Cert.Crt.Subject}}
 <tr><td colspan="4">{{indexOf .OrganizationalUnit 0}}</td></tr>
 <tr><td colspan="4">{{indexOf .Organization 0}}</td></tr>
@@ -524,10 +645,30 @@ function checkPassword(el) {
 <tr>
 <td><a href="/cert/{{.CommonName}}.pem" title='{{tr "Download"}}'>
 <img width="64px" src="/img/download.png"/></a></td>
-<td><a href="/renew?cert={{.CommonName}}" title='{{tr "Renew"}}'>
-<img width="64px" src="/img/renew.png"/></a></td>
-<td><a href="/clone?cert={{.CommonName}}" title='{{tr "Clone"}}'>
-<img width="64px" src="/img/copy.png"/></a></td>
+{{end}}
+{{if and .Cert.Key (.LoggedUser.Can "keys")}}
+{{with .Cert.Crt.Subject}}
+<td><a href="/key/{{.CommonName}}.key.pem" title='{{tr "Download Key"}}'>
+<img width="64px" src="/img/download.png" style="opacity:0.6; filter:alpha(opacity=60);"/></a></td>
+{{end}}
+{{end}}
+{{with .Cert.Crt.Subject}}
+<td><form action="/renew" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.CommonName}}"/>
+<input type="image" width="64px" src="/img/renew.png" title='{{tr "Renew"}}' alt='{{tr "Renew"}}'/><br/>
+<label><input type="radio" name="key" value="same" {{if not $.Cert.Key}}checked="checked"{{end}}/>{{tr "same key"}}</label>
+<label><input type="radio" name="key" value="new" {{if $.Cert.Key}}checked="checked"{{end}}/>{{tr "new key"}}</label>
+{{if and $.Cert.Crt.IsCA $.Cert.Childs}}<br/>
+<label title='{{tr "With a new key, the children are signed again by it keeping their own keys"}}'>
+<input type="checkbox" name="reissue" value="true"/>{{tr "re-issue the %d children" (len $.Cert.Childs)}}</label>
+{{end}}
+</form></td>
+<td><form action="/clone" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.CommonName}}"/>
+<input type="image" width="64px" src="/img/copy.png" title='{{tr "Clone"}}' alt='{{tr "Clone"}}'/>
+</form></td>
 {{end}}
 {{if .Cert.Childs}}
 {{with .Cert.Crt.Subject}}
@@ -538,14 +679,654 @@ function checkPassword(el) {
 {{end}}
 {{else}}
 {{with .Cert.Crt.Subject}}
-<td><a href="/del?cert={{.CommonName}}" title='{{tr "Delete"}}'
-       onclick="return confirm('{{tr "Are you sure you want to delete this Certificate?"}}')">
-<img width="64px" src="/img/delete.png"/></a></td>
+<td><form action="/del" method="post"
+      onsubmit="return confirm('{{tr "Are you sure you want to delete this Certificate?"}}')">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.CommonName}}"/>
+<input type="image" width="64px" src="/img/delete.png" title='{{tr "Delete"}}' alt='{{tr "Delete"}}'/>
+</form></td>
 {{end}}
 {{end}}
 </tr>
+{{if .Cert.Crt.IsCA}}
+<tr><td colspan="4">
+{{if eq .ClientCA .Cert.Crt.Subject.CommonName}}
+{{tr "Issues and verifies the users' client certificates for logging in"}}
+{{else}}
+<form action="/clientCA" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="submit" value='{{tr "Use to issue and verify the users' client certificates for logging in"}}'>
+</form>
+{{end}}
+</td></tr>
+{{if and .Cert.Key (.LoggedUser.Can "admin")}}
+<tr><td colspan="4">
+<form action="/acmePolicy" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+{{if .ACME}}
+{{tr "Serves ACME at"}} <code>{{.ACMEURL}}</code> {{tr "for"}} {{range .ACME.Domains}}{{.}} {{end}}
+<input type="submit" value='{{tr "Disable ACME"}}'>
+{{else}}
+<label>{{tr "Allowed domains"}} <input type="text" name="domains" placeholder="example.com, example.org"/></label>
+<label>{{tr "Days"}} <input type="number" name="days" min="1" placeholder="90"/></label>
+<input type="submit" name="enable" value='{{tr "Enable ACME"}}'>
+{{end}}
+</form>
+</td></tr>
+<tr><td colspan="4">
+{{if .EST}}
+{{tr "Enrolls devices through EST at"}} <code>{{.ESTURL}}</code>
+({{tr "profile"}} {{if .EST.Profile}}{{.EST.Profile}}{{else}}client{{end}}{{if .EST.Days}}, {{.EST.Days}} {{tr "days"}}{{end}})
+<form action="/est" method="post" style="display: inline">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="disable"/>
+<input type="submit" value='{{tr "Disable EST"}}'>
+</form>
+<table class="form">
+<tr><th>{{tr "Device"}}</th><th></th></tr>
+{{range .EST.DeviceNames}}
+<tr><td>{{.}}</td><td><form action="/est" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{$.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="removeDevice"/>
+<input type="hidden" name="Device" value="{{.}}"/>
+<input type="submit" value='{{tr "Remove"}}'>
+</form></td></tr>
+{{end}}
+<tr><td colspan="2"><form action="/est" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="addDevice"/>
+<label>{{tr "Device"}} <input type="text" name="Device"/></label>
+<label>{{tr "Password"}} <input type="password" name="Password" autocomplete="new-password"/></label>
+<input type="submit" value='{{tr "Add device"}}'>
+</form></td></tr>
 </table>
+{{else}}
+<form action="/est" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="enable"/>
+<label>{{tr "Profile"}} <select name="Profile">
+{{range .ESTProfiles}}<option value="{{.}}">{{.}}</option>{{end}}
+</select></label>
+<label>{{tr "Days"}} <input type="number" name="Days" min="1" placeholder="365"/></label>
+<input type="submit" value='{{tr "Use to enroll devices through EST"}}'>
+</form>
+{{end}}
+</td></tr>
+<tr><td colspan="4">
+{{if .SCEP}}
+{{tr "Enrolls equipment through SCEP at"}} <code>{{.SCEPURL}}</code>
+({{tr "profile"}} {{if .SCEP.Profile}}{{.SCEP.Profile}}{{else}}client{{end}}{{if .SCEP.Days}}, {{.SCEP.Days}} {{tr "days"}}{{end}})
+<form action="/scepSettings" method="post" style="display: inline">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="disable"/>
+<input type="submit" value='{{tr "Disable SCEP"}}'>
 </form>
+{{if .SCEPPassword}}
+<p class="notice">{{tr "New challenge password, it won't be shown again:"}} <code>{{.SCEPPassword}}</code></p>
+{{end}}
+<table class="form">
+<tr><th>{{tr "Challenge"}}</th><th>{{tr "Subject"}}</th><th>{{tr "Expires"}}</th><th>{{tr "Created by"}}</th><th></th></tr>
+{{range .SCEP.Challenges}}{{if not .Expired}}
+<tr><td>{{.ID}}</td><td>{{.Subject}}</td>
+<td>{{.Expires.Format "2006/01/02 15:04"}}</td><td>{{.CreatedBy}}</td>
+<td><form action="/scepSettings" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{$.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="revoke"/>
+<input type="hidden" name="ID" value="{{.ID}}"/>
+<input type="submit" value='{{tr "Revoke"}}'>
+</form></td></tr>
+{{end}}{{end}}
+<tr><td colspan="5"><form action="/scepSettings" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="challenge"/>
+<label>{{tr "Subject"}} <input type="text" name="Subject" required="required"/></label>
+<label>{{tr "Hours"}} <input type="number" name="Hours" min="1" placeholder="24"/></label>
+<input type="submit" value='{{tr "New challenge password"}}'>
+</form></td></tr>
+</table>
+{{else}}
+<form action="/scepSettings" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="action" value="enable"/>
+<label>{{tr "Profile"}} <select name="Profile">
+{{range .ESTProfiles}}<option value="{{.}}">{{.}}</option>{{end}}
+</select></label>
+<label>{{tr "Days"}} <input type="number" name="Days" min="1" placeholder="365"/></label>
+<input type="submit" value='{{tr "Use to enroll equipment through SCEP"}}'>
+</form>
+{{end}}
+</td></tr>
+{{if .Cert.Crt.IsCA}}
+<tr><td colspan="4">
+<form action="/issuancePolicy" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{.Cert.Crt.Subject.CommonName}}"/>
+<table class="form">
+<tr><th colspan="4">{{tr "Issuance policy, empty fields do not restrict anything"}}</th></tr>
+{{with .Policy}}
+<tr><td class="label">{{tr "Permitted domains"}}:</td>
+    <td><input type="text" name="PermittedDNS" value='{{join .PermittedDNS ", "}}' placeholder="example.com"></td>
+    <td class="label">{{tr "Excluded domains"}}:</td>
+    <td><input type="text" name="ExcludedDNS" value='{{join .ExcludedDNS ", "}}'></td></tr>
+<tr><td class="label">{{tr "Permitted IP ranges"}}:</td>
+    <td><input type="text" name="PermittedIPs" value='{{join .PermittedIPs ", "}}' placeholder="10.0.0.0/8"></td>
+    <td class="label">{{tr "Excluded IP ranges"}}:</td>
+    <td><input type="text" name="ExcludedIPs" value='{{join .ExcludedIPs ", "}}'></td></tr>
+<tr><td class="label">{{tr "Key types"}}:</td>
+    <td>{{range $.KeyTypes}}<label><input type="checkbox" name="KeyType.{{.}}"
+        {{if $.Policy.HasKeyType .}}checked="checked"{{end}}>{{.}}</label> {{end}}</td>
+    <td class="label">{{tr "Minimum key bits"}}:</td>
+    <td><label>RSA <input type="number" name="MinRSABits" min="0" value="{{if .MinRSABits}}{{.MinRSABits}}{{end}}"></label>
+        <label>EC <input type="number" name="MinECBits" min="0" value="{{if .MinECBits}}{{.MinECBits}}{{end}}"></label></td></tr>
+<tr><td class="label">{{tr "Required subject fields"}}:</td>
+    <td>{{range $.SubjectFields}}<label><input type="checkbox" name="Required.{{.}}"
+        {{if $.Policy.Requires .}}checked="checked"{{end}}>{{.}}</label> {{end}}</td>
+    <td class="label">{{tr "Maximum days"}}:</td>
+    <td><input type="number" name="MaxDays" min="0" value="{{if .MaxDays}}{{.MaxDays}}{{end}}"></td></tr>
+<tr><td class="label">{{tr "Wildcards"}}:</td>
+    <td colspan="3"><label><input type="checkbox" name="NoWildcards" {{if .NoWildcards}}checked="checked"{{end}}>
+        {{tr "Forbid wildcard names"}}</label></td></tr>
+{{end}}
+<tr><td colspan="4" style="text-align: center"><input type="submit" value='{{tr "Set issuance policy"}}'></td></tr>
+</table>
+</form>
+</td></tr>
+{{end}}
+{{end}}
+{{end}}
+</table>
+{{if gt (len .Versions) 1}}
+<h3>{{tr "Versions"}}</h3>
+<table class="form">
+<tr><th>{{tr "Serial"}}</th><th>{{tr "Valid from"}}</th><th>{{tr "Valid to"}}</th><th>{{tr "Renewed by"}}</th><th></th>
+    <th>{{tr "Rollover"}}</th></tr>
+{{range .Versions}}
+<tr><td>{{.Serial}}</td><td>{{.NotBefore.Format "2006/01/02"}}</td><td>{{.NotAfter.Format "2006/01/02"}}</td>
+<td>{{.RenewedBy}}</td>
+{{if .Current}}<td>{{tr "Current"}}</td>{{else}}
+<td><a href="/version/cert?cert={{$.Cert.Crt.Subject.CommonName}}&serial={{.Serial}}">{{tr "Download"}}</a>
+{{if and $.Cert.Key ($.LoggedUser.Can "keys")}}
+<a href="/version/key?cert={{$.Cert.Crt.Subject.CommonName}}&serial={{.Serial}}">{{tr "Download Key"}}</a>
+{{end}}
+{{if and .Valid ($.LoggedUser.Can "issue")}}
+<form action="/rollback" method="post" style="display: inline"
+      onsubmit="return confirm('{{tr "Make this version current again?"}}')">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="cert" value="{{$.Cert.Crt.Subject.CommonName}}"/>
+<input type="hidden" name="serial" value="{{.Serial}}"/>
+<input type="submit" value='{{tr "Roll back"}}'>
+</form>
+{{end}}</td>{{end}}
+<td>{{if .Rollover}}
+<a href="/version/rollover?cert={{$.Cert.Crt.Subject.CommonName}}&serial={{.Serial}}&kind=OldWithNew"
+   title='{{tr "The previous CA key certified by this version key"}}'>OldWithNew</a>
+<a href="/version/rollover?cert={{$.Cert.Crt.Subject.CommonName}}&serial={{.Serial}}&kind=NewWithOld"
+   title='{{tr "This version key certified by the previous CA key"}}'>NewWithOld</a>
+{{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "login2"}}
+{{template "htmlheader" .}}
+
+<h2>{{tr "WebCA's Login"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<form action="/login2" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" id="URL" name="URL" value="{{.URL}}"/>
+<table class="form">
+<tr><td class="label">{{tr "Authenticator or Recovery Code"}}:</td>
+    <td><input type="text" class="main" name="Code" autocomplete="one-time-code" autofocus>
+    </td></tr>
+<tr><td class="label" colspan="2" style="text-align: center">
+<input type="submit" id="submit" name="submit" value='{{tr "Login"}}'>
+</td></tr>
+</table>
+</form>
+
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "totp"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Two-Factor Authentication"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<div class="explanation">
+{{if .Enrolled}}
+{{tr "Two-factor authentication is enabled. Enrolling again replaces your authenticator and recovery codes."}}<p/>
+{{else if .Required}}
+{{tr "Your role requires two-factor authentication, you need to enrol before logging in."}}<p/>
+{{end}}
+{{tr "Scan this QR code with your authenticator app, or type the secret, then type the code it shows."}}
+</div>
+<img src="/totp/qr.png" alt="{{.Secret}}"/>
+<div class="explanation"><b>{{.Secret}}</b></div>
+<form action="/totp" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<table class="form">
+<tr><td class="label">{{tr "Code"}}:</td>
+    <td><input type="text" class="main" name="Code" autocomplete="one-time-code"></td></tr>
+<tr><td class="label" colspan="2" style="text-align: center">
+<input type="submit" id="submit" name="submit" value='{{tr "Enable"}}'>
+</td></tr>
+</table>
+</form>
+{{if and .Enrolled (not .Required)}}
+<form action="/totp/disable" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="submit" value='{{tr "Disable two-factor authentication"}}'
+       onclick="return confirm('{{tr "Are you sure you want to disable two-factor authentication?"}}')">
+</form>
+{{end}}
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "totpDone"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Two-Factor Authentication"}}</h2>
+<div class="explanation">
+{{tr "Two-factor authentication is enabled."}}<p/>
+{{tr "Keep these recovery codes safe, each one lets you log in once without your authenticator:"}}
+</div>
+<ul class="data">
+{{range .RecoveryCodes}}<li><b>{{.}}</b></li>{{end}}
+</ul>
+<a href="/">{{tr "Back to WebCA"}}</a>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "users"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Users"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<table class="form">
+<tr><th>{{tr "Username"}}</th><th>{{tr "Fullname"}}</th><th>{{tr "Source"}}</th>
+    <th>{{tr "Role"}}</th><th>{{tr "Two-factor"}}</th><th>{{tr "Sessions"}}</th><th>{{tr "Lockout"}}</th></tr>
+{{range .Users}}
+<tr><td>{{.Username}}</td><td>{{.Fullname}}</td><td>{{if .Source}}{{.Source}}{{else}}{{tr "local"}}{{end}}</td>
+<td>{{if .Source}}{{.Role}}{{else}}<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="role"/>
+<input type="hidden" name="Username" value="{{.Username}}"/>
+<select name="Role" onchange="this.form.submit()">
+{{$role := .Role}}{{if not $role}}{{$role = "admin"}}{{end}}
+{{range $.Roles}}<option value="{{.}}" {{if eq . $role}}selected="selected"{{end}}>{{.}}</option>{{end}}
+</select>
+</form>{{end}}</td>
+<td>{{if .TOTPSecret}}
+<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="reset2FA"/>
+<input type="hidden" name="Username" value="{{.Username}}"/>
+{{tr "Enabled"}} <input type="submit" value='{{tr "Reset"}}'>
+</form>
+{{else}}{{tr "Disabled"}}{{end}}</td>
+<td><form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="logout"/>
+<input type="hidden" name="Username" value="{{.Username}}"/>
+<input type="submit" value='{{tr "Log out everywhere"}}'>
+</form></td>
+<td>{{if .Locked}}
+<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="unlock"/>
+<input type="hidden" name="Username" value="{{.Username}}"/>
+{{tr "Locked until"}} {{.LockedUntil.Format "2006-01-02 15:04"}} <input type="submit" value='{{tr "Unlock"}}'>
+</form>
+{{else}}-{{end}}</td>
+</tr>
+{{end}}
+</table>
+<h3>{{tr "Failed logins"}}</h3>
+<div class="explanation">
+{{tr "Repeated failed logins slow down further attempts from the same user or address and lock the account for a while, failed logins are logged for auditing."}}
+</div>
+<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="notifyLockouts"/>
+<label><input type="checkbox" name="NotifyLockouts" value="true"
+              {{if .NotifyLockouts}}checked="checked"{{end}}/>{{tr "Email the admins when an account gets locked"}}</label>
+<input type="submit" value='{{tr "Save"}}'>
+</form>
+<h3>{{tr "Require two-factor authentication for roles with access to CA keys"}}</h3>
+<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="require2FA"/>
+{{range .KeyRoles}}
+<label><input type="checkbox" name="Require2FA.{{.}}" value="true"
+              {{if index $.Require2FA .}}checked="checked"{{end}}/>{{.}}</label>
+{{end}}
+<input type="submit" value='{{tr "Save"}}'>
+</form>
+<h3>{{tr "LDAP Directory"}}</h3>
+<div class="explanation">
+{{tr "Users in the LDAP directory log in with their directory password and get the role mapped from their groups, leave the URL empty to use local users only."}}
+</div>
+<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="ldap"/>
+{{with .LDAP}}
+<table class="form">
+<tr><td class="label">{{tr "URL"}}:</td>
+    <td><input type="text" class="main" name="URL" value="{{.URL}}" placeholder="ldaps://ldap.example.com"></td></tr>
+<tr><td class="label">{{tr "Trusted CA"}}:</td>
+    <td><input type="text" class="main" name="CACert" value="{{.CACert}}"></td></tr>
+<tr><td class="label">{{tr "Bind DN"}}:</td>
+    <td><input type="text" class="main" name="BindDN" value="{{.BindDN}}"></td></tr>
+<tr><td class="label">{{tr "Bind Password"}}:</td>
+    <td><input type="password" class="main" name="BindPassword" autocomplete="off"></td></tr>
+<tr><td class="label">{{tr "Base DN"}}:</td>
+    <td><input type="text" class="main" name="BaseDN" value="{{.BaseDN}}"></td></tr>
+<tr><td class="label">{{tr "User Filter"}}:</td>
+    <td><input type="text" class="main" name="UserFilter" value="{{.UserFilter}}"></td></tr>
+<tr><td class="label">{{tr "Group Attribute"}}:</td>
+    <td><input type="text" class="main" name="GroupAttr" value="{{.GroupAttr}}"></td></tr>
+<tr><td class="label">{{tr "Group Roles"}}:</td>
+    <td><textarea name="GroupRoles" rows="4" cols="60"
+        placeholder="cn=pki-admins,ou=groups,dc=example,dc=com = admin">{{.GroupRolesText}}</textarea></td></tr>
+<tr><td class="label">{{tr "Local admins fallback"}}:</td>
+    <td><input type="checkbox" name="LocalFallback" value="true" {{if .LocalFallback}}checked="checked"{{end}}></td></tr>
+</table>
+{{end}}
+<input type="submit" value='{{tr "Save"}}'>
+</form>
+<h3>{{tr "Single Sign-On"}}</h3>
+<div class="explanation">
+{{tr "Users can log in with an OpenID Connect provider and get the role mapped from their groups claim, leave the issuer empty to disable it."}}
+</div>
+<form action="/users" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="action" value="oidc"/>
+{{with .OIDC}}
+<table class="form">
+<tr><td class="label">{{tr "Issuer"}}:</td>
+    <td><input type="text" class="main" name="Issuer" value="{{.Issuer}}" placeholder="https://sso.example.com"></td></tr>
+<tr><td class="label">{{tr "Client ID"}}:</td>
+    <td><input type="text" class="main" name="ClientID" value="{{.ClientID}}"></td></tr>
+<tr><td class="label">{{tr "Client Secret"}}:</td>
+    <td><input type="password" class="main" name="ClientSecret" autocomplete="off"></td></tr>
+<tr><td class="label">{{tr "Trusted CA"}}:</td>
+    <td><input type="text" class="main" name="CACert" value="{{.CACert}}"></td></tr>
+<tr><td class="label">{{tr "Redirect URL"}}:</td>
+    <td><input type="text" class="main" name="RedirectURL" value="{{.RedirectURL}}" placeholder="https://webca.example.com/sso/callback"></td></tr>
+<tr><td class="label">{{tr "Username Claim"}}:</td>
+    <td><input type="text" class="main" name="UsernameClaim" value="{{.UsernameClaim}}"></td></tr>
+<tr><td class="label">{{tr "Groups Claim"}}:</td>
+    <td><input type="text" class="main" name="GroupsClaim" value="{{.GroupsClaim}}"></td></tr>
+<tr><td class="label">{{tr "Group Roles"}}:</td>
+    <td><textarea name="GroupRoles" rows="4" cols="60" placeholder="pki-admins = admin">{{.GroupRolesText}}</textarea></td></tr>
+<tr><td class="label">{{tr "Default Role"}}:</td>
+    <td><select name="DefaultRole">
+    <option value="">{{tr "none (refuse users in no mapped group)"}}</option>
+    {{$role := .DefaultRole}}
+    {{range $.Roles}}<option value="{{.}}" {{if eq . $role}}selected="selected"{{end}}>{{.}}</option>{{end}}
+    </select></td></tr>
+</table>
+{{end}}
+<input type="submit" value='{{tr "Save"}}'>
+</form>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "health"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Certificates Health"}}</h2>
+<div class="explanation">
+{{if .Broken}}{{tr "%d of the %d certificates have problems." .Broken (len .Report)}}
+{{else}}{{tr "All the %d certificates verify against the CAs above them." (len .Report)}}{{end}}
+</div>
+<table class="form">
+<tr><th>{{tr "Certificate"}}</th><th>{{tr "Issuer"}}</th><th>{{tr "Valid to"}}</th><th>{{tr "Problems"}}</th></tr>
+{{range .Report}}
+<tr><td><a href="/certControl?cert={{qEsc .Cert.Crt.Subject.CommonName}}">{{.Cert.Crt.Subject.CommonName}}</a></td>
+<td>{{.Cert.Crt.Issuer.CommonName}}</td><td>{{.Cert.Crt.NotAfter.Format "2006-01-02"}}</td>
+<td>{{if .Problems}}<span class="broken">{{range .Problems}}&#9888; {{.}}<br/>{{end}}</span>{{else}}{{tr "OK"}}{{end}}</td></tr>
+{{end}}
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "audit"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Audit Log"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<div class="explanation">
+{{if .Verified}}{{tr "Every entry is chained to the previous one and the chain is intact."}}{{end}}
+{{tr "Showing the most recent of %d matching entries." .Total}}
+</div>
+<form action="/audit" method="get">
+<table class="form">
+<tr><td class="label">{{tr "User"}}:</td>
+    <td><input type="text" name="User" value='{{.Filter.Get "User"}}'></td>
+    <td class="label">{{tr "Action"}}:</td>
+    <td><input type="text" name="Action" value='{{.Filter.Get "Action"}}'></td>
+    <td class="label">{{tr "Certificate, user or serial"}}:</td>
+    <td><input type="text" name="Target" value='{{.Filter.Get "Target"}}'></td></tr>
+<tr><td class="label">{{tr "From"}}:</td>
+    <td><input type="text" name="From" value='{{.Filter.Get "From"}}' placeholder="YYYY-MM-DD"></td>
+    <td class="label">{{tr "To"}}:</td>
+    <td><input type="text" name="To" value='{{.Filter.Get "To"}}' placeholder="YYYY-MM-DD"></td>
+    <td class="label">{{tr "Outcome"}}:</td>
+    <td><select name="Outcome">{{$outcome := .Filter.Get "Outcome"}}
+    <option value="">{{tr "any"}}</option>
+    <option value="ok" {{if eq $outcome "ok"}}selected="selected"{{end}}>ok</option>
+    <option value="failed" {{if eq $outcome "failed"}}selected="selected"{{end}}>failed</option>
+    </select></td></tr>
+</table>
+<input type="submit" value='{{tr "Filter"}}'>
+<a href="/audit.jsonl?{{.Query}}">{{tr "Export as JSON lines"}}</a>
+</form>
+<table class="form">
+<tr><th>#</th><th>{{tr "Time"}}</th><th>{{tr "User"}}</th><th>{{tr "Address"}}</th><th>{{tr "Action"}}</th>
+    <th>{{tr "Target"}}</th><th>{{tr "Serial"}}</th><th>{{tr "Outcome"}}</th><th>{{tr "Detail"}}</th></tr>
+{{range .Entries}}
+<tr><td>{{.Seq}}</td><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.User}}</td><td>{{.IP}}</td>
+<td>{{.Action}}</td><td>{{.Target}}</td><td>{{.Serial}}</td><td>{{.Outcome}}</td><td>{{.Detail}}</td></tr>
+{{end}}
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "requestSettings"}}
+<tr><td class="label">{{tr "CA"}}:</td>
+    <td><select name="CA">{{$ca := .CA}}
+    {{range $.CAs}}<option value="{{.}}" {{if eq . $ca}}selected="selected"{{end}}>{{.}}</option>{{end}}
+    </select></td></tr>
+<tr><td class="label">{{tr "Certificate Name"}}:</td>
+    <td><input type="text" class="main" name="CommonName" value="{{.CommonName}}"></td></tr>
+<tr><td class="label">{{tr "Alternative names"}}:</td>
+    <td><input type="text" class="main" name="SANs" value="{{.SANs}}"
+         placeholder="www.example.com, 10.0.0.1, admin@example.com"></td></tr>
+<tr><td class="label">{{tr "Profile"}}:</td>
+    <td><select name="Profile">{{$profile := .Profile}}
+    {{range $.Profiles}}<option value="{{.}}" {{if eq . $profile}}selected="selected"{{end}}>{{.}}</option>{{end}}
+    </select></td></tr>
+<tr><td class="label">{{tr "Days"}}:</td>
+    <td><input type="number" name="Days" min="1" value="{{.Days}}" placeholder="365"></td></tr>
+{{end}}
+
+{{define "requestRows"}}
+{{range .}}
+<tr><td><a href="/request?id={{.ID}}">#{{.ID}}</a></td><td>{{.Created.Format "2006-01-02 15:04"}}</td>
+<td>{{.Requester}}</td><td>{{.CommonName}}</td><td>{{.CA}}</td><td>{{.Profile}}</td><td>{{.Status}}</td>
+<td>{{.Approver}}</td></tr>
+{{end}}
+{{end}}
+
+{{define "requests"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Certificate Requests"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+<h3>{{tr "Pending"}}</h3>
+<table class="form">
+<tr><th>#</th><th>{{tr "Created"}}</th><th>{{tr "Requester"}}</th><th>{{tr "Name"}}</th><th>{{tr "CA"}}</th>
+    <th>{{tr "Profile"}}</th><th>{{tr "Status"}}</th><th>{{tr "Decided by"}}</th></tr>
+{{template "requestRows" .Queue}}
+</table>
+<h3>{{tr "New Request"}}</h3>
+<div class="explanation">
+{{tr "Paste a CSR to keep your key, its name and alternative names are used unless you type others. Without a CSR, WebCA generates the key and you download it with the certificate once approved."}}
+</div>
+<form action="/requests" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<table class="form">
+<tr><td class="label">{{tr "CSR"}}:</td>
+    <td><textarea name="CSR" rows="6" cols="64" placeholder="-----BEGIN CERTIFICATE REQUEST-----">{{.CSR}}</textarea></td></tr>
+{{template "requestSettings" .Settings}}
+<tr><td class="label">{{tr "Justification"}}:</td>
+    <td><textarea name="Justification" rows="3" cols="64">{{.Justification}}</textarea></td></tr>
+<tr><td class="label" colspan="2" style="text-align: center">
+<input type="submit" value='{{tr "Request"}}'>
+</td></tr>
+</table>
+</form>
+<h3>{{tr "History"}}</h3>
+<a href="/requests.json">{{tr "Export as JSON"}}</a>
+<table class="form">
+<tr><th>#</th><th>{{tr "Created"}}</th><th>{{tr "Requester"}}</th><th>{{tr "Name"}}</th><th>{{tr "CA"}}</th>
+    <th>{{tr "Profile"}}</th><th>{{tr "Status"}}</th><th>{{tr "Decided by"}}</th></tr>
+{{template "requestRows" .History}}
+</table>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "request"}}
+{{template "htmlheader" .}}
+{{with .Request}}
+<h2>{{tr "Certificate Request #%d" .ID}}: {{.CommonName}}</h2>
+{{end}}
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+{{with .Request}}
+<table class="form">
+<tr><td class="label">{{tr "Status"}}:</td><td>{{.Status}}{{if .Approver}} ({{.Approver}}){{end}}
+    {{if .Reason}}: {{.Reason}}{{end}}</td></tr>
+<tr><td class="label">{{tr "Requester"}}:</td><td>{{.Requester}}, {{.Created.Format "2006-01-02 15:04"}}</td></tr>
+<tr><td class="label">{{tr "CA"}}:</td><td>{{.CA}}</td></tr>
+<tr><td class="label">{{tr "Alternative names"}}:</td><td>{{range .SANs}}{{.}} {{end}}</td></tr>
+<tr><td class="label">{{tr "Profile"}}:</td><td>{{.Profile}}, {{.Days}} {{tr "days"}}</td></tr>
+<tr><td class="label">{{tr "Key"}}:</td>
+    <td>{{if .Generated}}{{tr "generated by WebCA"}}{{else}}{{tr "from the requester's CSR"}}{{end}}</td></tr>
+<tr><td class="label">{{tr "Justification"}}:</td><td>{{.Justification}}</td></tr>
+{{if .Serial}}<tr><td class="label">{{tr "Serial"}}:</td>
+    <td>{{.Serial}} <a href="/request/download?id={{.ID}}">{{tr "Download certificate"}}</a></td></tr>{{end}}
+</table>
+{{end}}
+{{if .CanDownloadKey}}
+<form action="/request/download" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="id" value="{{.Request.ID}}"/>
+<label>{{tr "Password"}} <input type="password" name="Password"></label>
+<input type="submit" value='{{tr "Download with its key as PKCS#12"}}'>
+</form>
+{{end}}
+{{if .CanDecide}}
+<h3>{{tr "Decision"}}</h3>
+{{range .Request.Collisions}}<p class="broken">&#9888; {{.}}</p>{{end}}
+<form action="/request" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="id" value="{{.Request.ID}}"/>
+<table class="form">
+{{template "requestSettings" .Settings}}
+<tr><td class="label" colspan="2" style="text-align: center">
+<button type="submit" name="action" value="approve">{{tr "Approve and issue"}}</button>
+<button type="submit" name="action" value="edit">{{tr "Save changes"}}</button>
+</td></tr>
+</table>
+</form>
+<form action="/request" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="id" value="{{.Request.ID}}"/>
+<input type="hidden" name="action" value="reject"/>
+<label>{{tr "Reason"}} <input type="text" name="Reason"></label>
+<input type="submit" value='{{tr "Reject"}}'>
+</form>
+{{end}}
+{{if .CanCancel}}
+<form action="/request" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<input type="hidden" name="id" value="{{.Request.ID}}"/>
+<input type="hidden" name="action" value="cancel"/>
+<input type="submit" value='{{tr "Cancel request"}}'>
+</form>
+{{end}}
+<h3>{{tr "History"}}</h3>
+<table class="form">
+<tr><th>{{tr "Time"}}</th><th>{{tr "User"}}</th><th>{{tr "Action"}}</th><th>{{tr "Detail"}}</th></tr>
+{{range .Request.History}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.User}}</td><td>{{.Action}}</td><td>{{.Detail}}</td></tr>
+{{end}}
+</table>
+<a href="/requests">{{tr "All requests"}}</a>
+{{template "htmlfooter"}}
+{{end}}
+
+{{define "clientCert"}}
+{{template "htmlheader" .}}
+<h2>{{tr "Client Certificate"}}</h2>
+{{if .Error}}
+<div class="notice" id="notice">
+<label class="notice" id="noticeText">{{.Error}}<label>
+</div>
+{{end}}
+{{if .CA}}
+<div class="explanation">
+{{tr "A client certificate lets your browser log you in as %s without a password." .LoggedUser.Username}}<p/>
+{{if .Cert}}
+{{tr "Your current client certificate"}}: <span class="period">{{showPeriod .Cert.Crt}}</span><p/>
+{{end}}
+{{tr "Issuing a new one replaces it. Choose a password to protect the PKCS#12 file to import in your browser."}}
+</div>
+<form action="/clientCert" method="post">
+<input type="hidden" name="_csrf" value="{{$.CSRFToken}}"/>
+<table class="form">
+<tr><td class="label">{{tr "Password"}}:</td>
+    <td><input type="password" class="main" name="Password"></td></tr>
+<tr><td class="label" colspan="2" style="text-align: center">
+<input type="submit" id="submit" name="submit" value='{{tr "Issue and Download"}}'>
+</td></tr>
+</table>
+</form>
+{{else}}
+<div class="explanation">{{tr "There is no CA configured to issue client certificates."}}</div>
+{{end}}
 {{template "htmlfooter"}}
 {{end}}
 `
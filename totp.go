@@ -0,0 +1,336 @@
+package webca
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTPSECRET     = "TOTPSecret" // session key of the secret being enrolled
+	TOTP_ISSUER    = "WebCA"
+	TOTP_PERIOD    = 30 // seconds each code lasts
+	TOTP_DIGITS    = 6
+	TOTP_SKEW      = 1 // periods of clock skew accepted before and after the current one
+	RECOVERY_CODES = 10
+)
+
+// totpEncoding is the base32 encoding authenticator apps expect for secrets
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// errWrongCode and errRequired2FA reject a second factor code and disabling a required one
+var errWrongCode = fmt.Errorf("wrong second factor code")
+var errRequired2FA = fmt.Errorf("second factor required")
+
+// newTOTPSecret generates a random base32 TOTP secret
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpURI returns the otpauth:// provisioning URI of the secret for the User
+func totpURI(u User, secret string) string {
+	label := url.PathEscape(TOTP_ISSUER + ":" + u.Username)
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s&digits=%d&period=%d",
+		label, secret, url.QueryEscape(TOTP_ISSUER), TOTP_DIGITS, TOTP_PERIOD)
+}
+
+// totpCode computes the RFC 6238 code of the secret for the given time step counter
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("Wrong TOTP secret: %s", err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, code%modulus), nil
+}
+
+// checkTOTP verifies code against the secret at time now, accepting TOTP_SKEW periods of clock
+// skew. Codes for time steps up to last were already used and are refused to prevent replays.
+// It returns the time step counter matched
+func checkTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if secret == "" || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := now.Unix() / TOTP_PERIOD
+	for counter := current - TOTP_SKEW; counter <= current+TOTP_SKEW; counter++ {
+		if counter <= last {
+			continue
+		}
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes generates the one-time recovery codes shown to the user on enrolment
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, RECOVERY_CODES)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the form a recovery code is stored in, so the config never holds them
+// in clear
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// enrolTOTP enables two-factor authentication for the User with the secret already verified at
+// the counter time step, returning the new recovery codes in clear
+func (u *User) enrolTOTP(secret string, counter int64) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.TOTPSecret = secret
+	u.TOTPLast = counter
+	u.RecoveryCodes = make([]string, len(codes))
+	for i, code := range codes {
+		u.RecoveryCodes[i] = hashRecoveryCode(code)
+	}
+	return codes, nil
+}
+
+// disableTOTP removes the User's two-factor authentication enrolment
+func (u *User) disableTOTP() {
+	u.TOTPSecret = ""
+	u.TOTPLast = 0
+	u.RecoveryCodes = nil
+}
+
+// checkSecondFactor verifies a TOTP code or an unused recovery code for the User, updating its
+// replay counter or consuming the recovery code when accepted
+func (u *User) checkSecondFactor(code string, now time.Time) bool {
+	if counter, ok := checkTOTP(u.TOTPSecret, code, now, u.TOTPLast); ok {
+		u.TOTPLast = counter
+		return true
+	}
+	hashed := hashRecoveryCode(code)
+	for i, rc := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(hashed)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// needs2FA tells whether the User must pass a second factor to log in: because it is enrolled
+// or because its role is required to
+func (u User) needs2FA(cfg *config) bool {
+	return u.TOTPSecret != "" || cfg.Require2FA[u.role()]
+}
+
+// login2 checks the second factor of the user that already passed the password
+func login2(w http.ResponseWriter, r *http.Request) {
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	name := s[PENDINGUSER]
+	if name == "" {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	cfg := LoadConfig()
+	var u User
+	now := time.Now()
+	err = loginAllowed(cfg, name, r, now)
+	if err == nil {
+		err = cfg.update(func(cfg *config) error { // so each code is accepted just once
+			u = cfg.Users[name]
+			if !u.checkSecondFactor(r.FormValue("Code"), now) {
+				return errWrongCode
+			}
+			cfg.Users[name] = u
+			return nil
+		})
+	}
+	if err == errWrongCode {
+		loginFailed(cfg, name, r, err.Error(), now)
+		err = fmt.Errorf(tr("Wrong code!"))
+	}
+	if err != nil {
+		ps := newPageStatus(r)
+		ps["Error"] = err.Error()
+		ps["URL"] = r.FormValue("URL")
+		err := templates.ExecuteTemplate(w, "login2", ps)
+		handleError(w, r, err)
+		return
+	}
+	if handleError(w, r, s.Rotate(w, r)) {
+		return
+	}
+	delete(s, PENDINGUSER)
+	s[LOGGEDUSER] = u.Username
+	s.Save()
+	loginSucceeded(name)
+	auditRequest(r, "login", u.Username, nil)
+	redirectToTarget(w, r, r.FormValue("URL"))
+}
+
+// totpUser returns the logged user or, if its role requires a second factor it is not enrolled
+// in yet, the user pending to log in
+func totpUser(s session) (User, bool) {
+	if u, ok := s.User(); ok {
+		return u, true
+	}
+	if name := s[PENDINGUSER]; name != "" {
+		if u := LoadConfig().getUser(name); u.TOTPSecret == "" {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// totp shows the enrolment page with a fresh secret and its QR code and, when the form is
+// posted, enables the second factor once the user proves it with a valid code
+func totp(w http.ResponseWriter, r *http.Request) {
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	u, ok := totpUser(s)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	if !checkCSRF(w, r, s) {
+		return
+	}
+	ps := newPageStatus(r)
+	if u, ok := s.User(); ok {
+		ps[LOGGEDUSER] = u
+	}
+	secret := s[TOTPSECRET]
+	if r.Method == "POST" && secret != "" {
+		counter, ok := checkTOTP(secret, r.FormValue("Code"), time.Now(), 0)
+		if ok {
+			var codes []string
+			err := LoadConfig().update(func(cfg *config) error {
+				u = cfg.Users[u.Username]
+				var err error
+				codes, err = u.enrolTOTP(secret, counter)
+				cfg.Users[u.Username] = u
+				return err
+			})
+			if handleError(w, r, err) {
+				return
+			}
+			delete(s, TOTPSECRET)
+			if s[LOGGEDUSER] == "" {
+				if handleError(w, r, s.Rotate(w, r)) {
+					return
+				}
+				delete(s, PENDINGUSER)
+			}
+			s[LOGGEDUSER] = u.Username
+			s.Save()
+			ps[LOGGEDUSER] = u
+			ps[CSRFTOKEN] = s[CSRFTOKEN]
+			ps["RecoveryCodes"] = codes
+			err = templates.ExecuteTemplate(w, "totpDone", ps)
+			handleError(w, r, err)
+			return
+		}
+		ps["Error"] = tr("Wrong code!")
+	}
+	if secret == "" {
+		if secret, err = newTOTPSecret(); handleError(w, r, err) {
+			return
+		}
+		s[TOTPSECRET] = secret
+		s.Save()
+	}
+	ps["Secret"] = secret
+	ps["Enrolled"] = u.TOTPSecret != ""
+	ps["Required"] = LoadConfig().Require2FA[u.role()]
+	err = templates.ExecuteTemplate(w, "totp", ps)
+	handleError(w, r, err)
+}
+
+// totpQR serves the QR code of the secret being enrolled
+func totpQR(w http.ResponseWriter, r *http.Request) {
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	u, ok := totpUser(s)
+	secret := s[TOTPSECRET]
+	if !ok || secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	if handleError(w, r, QRCodePNG(buf, []byte(totpURI(u, secret)))) {
+		return
+	}
+	w.Header().Set("Content-type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// totpDisable removes the logged user's second factor, unless its role requires one
+func totpDisable(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	name := ps[LOGGEDUSER].(User).Username
+	err := LoadConfig().update(func(cfg *config) error {
+		u := cfg.Users[name]
+		if r.Method != "POST" || cfg.Require2FA[u.role()] {
+			return errRequired2FA
+		}
+		u.disableTOTP()
+		cfg.Users[name] = u
+		return nil
+	})
+	if err == errRequired2FA {
+		http.Error(w, tr("Two-factor authentication is required for your role!"), http.StatusForbidden)
+		return
+	}
+	if handleError(w, r, err) {
+		return
+	}
+	http.Redirect(w, r, "/totp", 302)
+}
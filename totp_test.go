@@ -0,0 +1,84 @@
+package webca
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B SHA1 secret "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTP(t *testing.T) {
+	for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924"} {
+		got, err := totpCode(rfcSecret, unix/TOTP_PERIOD)
+		dieOnError(t, err)
+		if got != code {
+			t.Fatalf("Expected code %s at %d but got %s", code, unix, got)
+		}
+	}
+	now := time.Unix(1111111109, 0)
+	counter, ok := checkTOTP(rfcSecret, "081804", now.Add(TOTP_PERIOD*time.Second), 0)
+	if !ok {
+		t.Fatal("Code from the previous period was refused")
+	}
+	if _, ok := checkTOTP(rfcSecret, "081804", now, counter); ok {
+		t.Fatal("Replayed code was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	u := User{Username: "test"}
+	secret, err := newTOTPSecret()
+	dieOnError(t, err)
+	codes, err := u.enrolTOTP(secret, 0)
+	dieOnError(t, err)
+	if len(codes) != RECOVERY_CODES || u.RecoveryCodes[0] == codes[0] {
+		t.Fatalf("Unexpected recovery codes %v stored as %v", codes, u.RecoveryCodes)
+	}
+	if !u.checkSecondFactor(codes[3], time.Now()) {
+		t.Fatal("Recovery code was refused")
+	}
+	if u.checkSecondFactor(codes[3], time.Now()) {
+		t.Fatal("Recovery code was accepted twice")
+	}
+	if !u.needs2FA(NewConfig(u, nil, nil, Mailer{})) {
+		t.Fatal("Enrolled user does not need 2FA")
+	}
+}
+
+func TestSecondFactorReplay(t *testing.T) {
+	inTempDir(t, func() {
+		cfg := testConfig(t)
+		secret, err := newTOTPSecret()
+		dieOnError(t, err)
+		dieOnError(t, cfg.update(func(cfg *config) error {
+			u := cfg.Users["admin"]
+			_, err := u.enrolTOTP(secret, 0)
+			cfg.Users["admin"] = u
+			return err
+		}))
+		code, err := totpCode(secret, time.Now().Unix()/TOTP_PERIOD)
+		dieOnError(t, err)
+		logged := make(chan bool)
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			s, err := SessionFor(w, httptest.NewRequest("GET", "/", nil))
+			dieOnError(t, err)
+			s[PENDINGUSER] = "admin"
+			s.Save()
+			r := withCookies(t, w)
+			r.Method, r.Form = "POST", url.Values{"Code": {code}}
+			go func() {
+				w := httptest.NewRecorder()
+				login2(w, r)
+				logged <- w.Code == http.StatusFound
+			}()
+		}
+		if first, second := <-logged, <-logged; first == second {
+			t.Fatalf("The same code logged in %v and %v, instead of just once", first, second)
+		}
+	})
+}
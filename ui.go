@@ -1,6 +1,7 @@
 package webca
 
 import (
+	"crypto/x509"
 	"fmt"
 	"html/template"
 	"log"
@@ -9,43 +10,22 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	PORT       = 443
-	PORTFIX    = 8000
-	REQUEST    = "Request"
-	LOGGEDUSER = "LoggedUser"
+	PORT        = 443
+	REQUEST     = "Request"
+	LOGGEDUSER  = "LoggedUser"
+	PENDINGUSER = "PendingUser" // user that passed the password but still needs a second factor
+	CLIENT_DAYS = 365 // validity of users' client certificates
 )
 
-// address is a complex bind address
-type address struct {
-	addr, certfile, keyfile string
-	tls                     bool
-}
-
 // fakedLogin for development environments
 var fakedLogin bool
 
-// portFix contains the port correction when low ports are not permited
-var portFix int
-
-// listenAndServe starts the server with or without TLS on the address
-func (a address) listenAndServe(smux *http.ServeMux) error {
-	if a.tls {
-		return http.ListenAndServeTLS(a.addr, a.certfile, a.keyfile, smux)
-	}
-	return http.ListenAndServe(a.addr, smux)
-}
-
-// String prints this address properly
-func (a address) String() string {
-	prefix := "http"
-	if a.tls {
-		prefix = "https"
-	}
-	return prefix + "://" + a.addr
-}
+// fakeUser is the User logged in when faking logins
+var fakeUser = User{Username: "fuser", Fullname: "Faked User", Password: "****", Email: "fuser@fuser.com"}
 
 // templates contains all web templates
 var templates *template.Template
@@ -67,7 +47,8 @@ func init() {
 	templates = template.New("webcaTemplates")
 	templates.Funcs(template.FuncMap{
 		// The name "title" is what the function will be called in the template text.
-		"tr": tr, "indexOf": indexOf, "showPeriod": showPeriod, "qEsc": qEsc,
+		"tr": tr, "indexOf": indexOf, "showPeriod": showPeriod, "qEsc": qEsc, "join": strings.Join,
+		"problemsOf": problemsOf,
 	})
 	template.Must(templates.Parse(htmlTemplates))
 	template.Must(templates.Parse(jsTemplates))
@@ -121,85 +102,95 @@ func qEsc(s string, args ...interface{}) string {
 	return url.QueryEscape(fmt.Sprintf(s, args...))
 }
 
-// WebCA starts the prepares and serves the WebApp 
-func WebCA() {
-	smux := http.DefaultServeMux
-	addr := PrepareServer(smux)
-	err := addr.listenAndServe(smux)
-	if portFix == 0 { // port Fixing is only applied once
-		if err != nil {
-			log.Printf("Could not start server on address %v!: %s\n", addr, err)
-		}
-		portFix = PORTFIX
-		addr = fixAddress(addr)
-		log.Printf("(Warning) Failed to listen on standard port, go to %v\n", addr)
-		err = addr.listenAndServe(smux)
-	}
-	if err != nil {
-		log.Fatalf("Could not start!: %s", err)
-	}
-}
-
-// webCA will start the WebApp once it has been configured properly on a NEW http.ServeMux
-func webCA() {
-	smux := http.NewServeMux()
-	addr := PrepareServer(smux)
-	log.Printf("Go to %v\n", addr)
-	err := addr.listenAndServe(smux)
-	if err != nil {
-		log.Fatalf("Could not start!: %s", err)
-	}
-}
-
-// fixAddress returns a repaired alternate address by portFix
-func fixAddress(a address) address {
-	port := 80
-	if strings.Contains(a.addr, ":") {
-		parts := strings.Split(a.addr, ":")
-		a.addr = parts[0]
-		var err error
-		port, err = strconv.Atoi(parts[1])
-		if err != nil {
-			port = 80
-		}
-	}
-	a.addr = fmt.Sprintf("%s:%v", a.addr, port+portFix)
-	return a
-}
-
-// prepareServer prepares the Web handlers for the setup wizard if there is no HTTPS config or 
+// PrepareServer prepares the Web handlers for the setup wizard if there is no HTTPS config or
 // the normal app if the app is already configured
 func PrepareServer(smux *http.ServeMux) address {
-	// load config...
-	cfg := LoadConfig()
-	if cfg == nil { // if config is empty then run the setup
-		return PrepareSetup(smux) // always on the default serve mux
-	}
-	// otherwise start the normal app
+	return NewServer().prepare(smux)
+}
+
+// prepareWebCA prepares the Web handlers for the normal app
+func prepareWebCA(smux *http.ServeMux) {
 	log.Printf("Starting WebCA normal startup...")
-	smux.Handle("/", accessControl(index))
-	smux.HandleFunc("/login", login)
+	preparePublic(smux)
+	smux.Handle("/", permControl(PERM_READ, index))
+	smux.Handle("/login", postOnly(login))
+	smux.Handle("/login2", postOnly(login2))
+	smux.Handle("/logout", postOnly(logout))
+	smux.Handle("/cert", permControl(PERM_ISSUE, cert))
+	smux.Handle("/gen", permControlHandler(PERM_ISSUE, postOnly(gen)))
+	smux.Handle("/certControl", permControl(PERM_READ, certControl))
+	smux.Handle("/cert/", authCertServer("/cert/", http.Dir(".")))
+	smux.Handle("/key/", authKeyServer("/key/"))
+	smux.Handle("/renew", permControlHandler(PERM_ISSUE, postOnly(renew)))
+	smux.Handle("/clone", permControlHandler(PERM_ISSUE, postOnly(clone)))
+	smux.Handle("/del", permControlHandler(PERM_ISSUE, postOnly(del)))
+	smux.Handle("/rollback", permControlHandler(PERM_ISSUE, postOnly(rollback)))
+	smux.Handle("/version/cert", permControl(PERM_READ, versionServer(ReadCertVersion, CERT_SUFFIX)))
+	smux.Handle("/version/key", permControl(PERM_KEYS, versionServer(ReadCertVersionKey, KEY_SUFFIX)))
+	smux.Handle("/version/rollover", permControl(PERM_READ, rolloverServer))
+	smux.Handle("/clientCert", accessControl(clientCert))
+	smux.Handle("/clientCA", permControlHandler(PERM_ADMIN, postOnly(clientCA)))
+	smux.HandleFunc("/totp", totp)
+	smux.HandleFunc("/totp/qr.png", totpQR)
+	smux.Handle("/totp/disable", accessControlHandler(postOnly(totpDisable)))
+	smux.Handle("/users", permControl(PERM_ADMIN, users))
+	smux.Handle("/audit", permControl(PERM_AUDIT, audit))
+	smux.Handle("/health", permControl(PERM_READ, health))
+	smux.Handle("/lint.json", permControl(PERM_READ, lintExport))
+	smux.Handle("/crossSign", permControlHandler(PERM_ADMIN, postOnly(crossSignCA)))
+	smux.Handle("/cross", permControl(PERM_READ, crossServer))
+	smux.Handle("/chain", permControl(PERM_READ, chainServer))
+	smux.Handle("/audit.jsonl", permControl(PERM_AUDIT, auditExport))
+	smux.HandleFunc("/sso", sso)
+	smux.HandleFunc("/sso/callback", ssoCallback)
+	smux.Handle("/acmePolicy", permControlHandler(PERM_ADMIN, postOnly(acmePolicy)))
+	smux.HandleFunc("/acme/", acmeServer)
+	smux.Handle("/est", permControlHandler(PERM_ADMIN, postOnly(est)))
+	smux.HandleFunc(EST_PATH, estServer)
+	smux.Handle("/scepSettings", permControlHandler(PERM_ADMIN, postOnly(scep)))
+	smux.HandleFunc(SCEP_PATH, scepServer)
+	smux.Handle("/issuancePolicy", permControlHandler(PERM_ADMIN, postOnly(issuancePolicy)))
+	smux.Handle("/requests", permControl(PERM_REQUEST, requests))
+	smux.Handle("/requests.json", permControl(PERM_REQUEST, requestsExport))
+	smux.Handle("/request", permControl(PERM_REQUEST, request))
+	smux.Handle("/request/download", permControl(PERM_REQUEST, requestDownload))
+}
+
+// preparePublic prepares the Web handlers that need no login, also served on plain HTTP
+func preparePublic(smux *http.ServeMux) {
 	smux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("img"))))
 	smux.Handle("/favicon.ico", http.FileServer(http.Dir("img")))
-	smux.Handle("/cert", accessControl(cert))
-	smux.Handle("/gen", accessControl(gen))
-	smux.Handle("/certControl", accessControl(certControl))
-	smux.Handle("/cert/", authCertServer("/cert/", http.Dir(".")))
-	smux.Handle("/renew", accessControl(renew))
-	smux.Handle("/clone", accessControl(clone))
-	smux.Handle("/del", accessControl(del))
-	return address{webCAURL(cfg), certFile(cfg.getWebCert()), keyFile(cfg.getWebCert()), true}
-}
-
-// webCAURL returns the WebCA URL
-func webCAURL(cfg *config) string {
-	certName := cfg.getWebCert().Crt.Subject.CommonName
-	return fmt.Sprintf("%s:%v", certName, PORT+portFix)
+	smux.Handle("/crt/", http.StripPrefix("/crt/", certServer(http.Dir("."))))
+	smux.Handle("/crl/", http.StripPrefix("/crl/", http.HandlerFunc(crlServer)))
 }
 
 // authCertServer returns a authorized certServer for downloading certificates
 func authCertServer(prefix string, dir http.Dir) http.Handler {
-	return accessControlHandler(http.StripPrefix(prefix, certServer(dir)))
+	return permControlHandler(PERM_READ, http.StripPrefix(prefix, certServer(dir)))
+}
+
+// authKeyServer returns an authorized server for downloading the <name>.key.pem private keys
+func authKeyServer(prefix string) http.Handler {
+	return permControlHandler(PERM_KEYS, http.StripPrefix(prefix, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, KEY_SUFFIX) {
+				http.NotFound(w, r)
+				return
+			}
+			c := FindCert(strings.TrimSuffix(r.URL.Path, KEY_SUFFIX))
+			if c == nil || c.Key == nil {
+				http.NotFound(w, r)
+				return
+			}
+			key, err := ReadCertKey(c)
+			auditCert(r, "downloadKey", c.Crt.Subject.CommonName, c, err)
+			if handleError(w, r, err) {
+				return
+			}
+			w.Header().Set("Content-disposition", "attachment; filename="+r.URL.Path)
+			w.Header().Set("Content-type", "application/x-pem-file")
+			w.Write(key)
+		})))
 }
 
 // certServer returns a certificate server filtering the downloadable cert files properly
@@ -216,6 +207,25 @@ func certServer(dir http.Dir) http.Handler {
 	})
 }
 
+// crlServer serves the CRL of the CA named as the requested <name>.crl file
+func crlServer(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, CRL_SUFFIX) {
+		http.NotFound(w, r)
+		return
+	}
+	ca := FindCert(strings.TrimSuffix(r.URL.Path, CRL_SUFFIX))
+	if ca == nil || !ca.Crt.IsCA || ca.Key == nil { // only CAs able to sign have a CRL
+		http.NotFound(w, r)
+		return
+	}
+	crl, err := CachedCRL(ca)
+	if handleError(w, r, err) {
+		return
+	}
+	w.Header().Set("Content-type", "application/pkix-crl")
+	w.Write(crl)
+}
+
 // readUser reads the user data from the request
 func readUser(r *http.Request) User {
 	u := User{}
@@ -243,6 +253,10 @@ func readCertSetup(prefix string, r *http.Request) (*CertSetup, error) {
 		return nil, fmt.Errorf("%s: %v", tr("Wrong duration!"), err)
 	}
 	cs.Duration = duration
+	cs.IsCA = r.FormValue(prefix+".IsCA") != ""
+	if cs.Constraints, err = readConstraints(prefix, r); err != nil {
+		return nil, err
+	}
 	return &cs, nil
 }
 
@@ -301,6 +315,7 @@ func cert(w http.ResponseWriter, r *http.Request) {
 		ps["parent"] = parent
 		ps["Cert"] = &CertSetup{Name: pc.Crt.Subject}
 	}
+	ps["Constraints"] = &NameConstraints{}
 	setCertPageTexts(ps, parent)
 	err := templates.ExecuteTemplate(w, "cert", ps)
 	handleError(w, r, err)
@@ -314,27 +329,45 @@ func gen(w http.ResponseWriter, r *http.Request) {
 	}
 	parent := r.FormValue("parent")
 	cs, err := readCertSetup("Cert", r)
-	handleError(w, r, err)
+	if handleError(w, r, err) {
+		return
+	}
 	if cs.Name.CommonName == "" {
-		ps["Error"] = tr("Can't create a certificate with no name!")
-		ps["Cert"] = cs
-		ps["parent"] = parent
-		setCertPageTexts(ps, parent)
-		err := templates.ExecuteTemplate(w, "cert", ps)
-		handleError(w, r, err)
+		genFormError(w, r, ps, cs, parent, tr("Can't create a certificate with no name!"))
 		return
 	}
 	if parent != "" {
-		cacert := FindCert(parent)
+		cacert, err := FindCertOrFail(parent)
 		if handleError(w, r, err) {
 			return
 		}
-		_, err = GenCert(cacert, cs.Name.CommonName, cs.Duration)
+		if !cs.IsCA && cs.Constraints != nil {
+			genFormError(w, r, ps, cs, parent, tr("Only CAs can have name constraints!"))
+			return
+		}
+		var c *Cert
+		if cs.IsCA {
+			c, err = GenIntermediateCert(cacert, cs.Name.CommonName, cs.Duration, cs.Constraints)
+			auditCert(r, "genIntermediate", cs.Name.CommonName, c, err)
+		} else {
+			c, err = GenCert(cacert, cs.Name.CommonName, cs.Duration)
+			auditCert(r, "gen", cs.Name.CommonName, c, err)
+		}
+		switch err.(type) {
+		case *PolicyError, *LintError:
+			genFormError(w, r, ps, cs, parent, err.Error())
+			return
+		}
 		if handleError(w, r, err) {
 			return
 		}
 	} else {
-		_, err := GenCACert(cs.Name, cs.Duration)
+		c, err := GenCACertWith(cs.Name, cs.Duration, cs.Constraints)
+		auditCert(r, "genCA", cs.Name.CommonName, c, err)
+		if _, ok := err.(*LintError); ok {
+			genFormError(w, r, ps, cs, parent, err.Error())
+			return
+		}
 		if handleError(w, r, err) {
 			return
 		}
@@ -342,44 +375,181 @@ func gen(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", 302)
 }
 
+// genFormError shows the certificate form again with the error that prevented generating it
+func genFormError(w http.ResponseWriter, r *http.Request, ps PageStatus, cs *CertSetup, parent, msg string) {
+	ps["Error"] = msg
+	ps["Cert"] = cs
+	ps["parent"] = parent
+	ps["Constraints"] = &NameConstraints{}
+	if cs.Constraints != nil {
+		ps["Constraints"] = cs.Constraints
+	}
+	setCertPageTexts(ps, parent)
+	err := templates.ExecuteTemplate(w, "cert", ps)
+	handleError(w, r, err)
+}
+
 // certControl allows the web user to manage a certificate
 func certControl(w http.ResponseWriter, r *http.Request) {
 	ps := newLoggedPage(w, r)
 	if ps == nil {
 		return
 	}
-	cert := r.FormValue("cert")
-	if cert != "" {
-		c, err := FindCertOrFail(cert)
-		if handleError(w, r, err) {
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	certControlPage(w, r, ps, c)
+}
+
+// certControlPage shows the management page of the certificate, with its past versions
+func certControlPage(w http.ResponseWriter, r *http.Request, ps PageStatus, c *Cert) {
+	ps["Cert"] = c
+	versions, err := CertVersions(c)
+	if err != nil {
+		log.Printf("(Warning) %v", err)
+	}
+	ps["Versions"] = versions
+	setClientCA(ps)
+	setACME(ps, c)
+	setEST(ps, c)
+	setSCEP(ps, c)
+	setPolicy(ps, c)
+	ps["Constraints"] = constraintsOf(c.Crt)
+	ps["Findings"] = LintCert(c)
+	setCross(ps, c)
+	err = templates.ExecuteTemplate(w, "certControl", ps)
+	handleError(w, r, err)
+}
+
+// setClientCA sets the name of the CA for client certificates on the page, if any
+func setClientCA(ps PageStatus) {
+	ps["ClientCA"] = ""
+	if ca := LoadConfig().getClientCA(); ca != nil {
+		ps["ClientCA"] = ca.Crt.Subject.CommonName
+	}
+}
+
+// clientCert shows the logged user's client certificate status and issues a new one
+// downloaded as PKCS#12 when the form is posted
+func clientCert(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	u := ps[LOGGEDUSER].(User)
+	ca := LoadConfig().getClientCA()
+	c := FindCert(u.Username)
+	if ca != nil && c != nil && c.Parent != ca {
+		ps["Error"] = tr("Name %s is already taken by another certificate!", u.Username)
+	} else if ca != nil && r.Method == "POST" {
+		password := r.FormValue("Password")
+		if password == "" {
+			ps["Error"] = tr("Type some password!")
+		} else {
+			c, err := GenClientCert(ca, u, CLIENT_DAYS)
+			auditCert(r, "genClientCert", u.Username, c, err)
+			if handleError(w, r, err) {
+				return
+			}
+			p12, err := EncodePKCS12(c, password)
+			if handleError(w, r, err) {
+				return
+			}
+			w.Header().Set("Content-disposition", "attachment; filename="+u.Username+P12_SUFFIX)
+			w.Header().Set("Content-type", "application/x-pkcs12")
+			w.Write(p12)
 			return
 		}
-		ps["Cert"] = c
 	}
-	err := templates.ExecuteTemplate(w, "certControl", ps)
+	ps["CA"] = ca
+	ps["Cert"] = c
+	err := templates.ExecuteTemplate(w, "clientCert", ps)
 	handleError(w, r, err)
 }
 
-// renew the certificate requested
+// clientCA sets the CA issuing and verifying users' client certificates
+func clientCA(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	if !c.Crt.IsCA || c.Key == nil {
+		handleError(w, r, fmt.Errorf(tr("%s can't issue client certificates!", c.Crt.Subject.CommonName)))
+		return
+	}
+	cfg := LoadConfig()
+	if other := cfg.sharedCA(c.Crt.Subject.CommonName); other != "" {
+		handleError(w, r, fmt.Errorf(tr("%s can't issue client certificates, it also issues for %s!",
+			c.Crt.Subject.CommonName, other)))
+		return
+	}
+	cfg.ClientCA = c.Crt.Subject.CommonName
+	err = cfg.Save()
+	auditCert(r, "setClientCA", c.Crt.Subject.CommonName, c, err)
+	if handleError(w, r, err) {
+		return
+	}
+	certControlPage(w, r, ps, c)
+}
+
+// renew the certificate requested, with a new key unless asked to keep the same one
 func renew(w http.ResponseWriter, r *http.Request) {
 	ps := newLoggedPage(w, r)
 	if ps == nil {
 		return
 	}
 	cert := r.FormValue("cert")
-	if cert != "" {
-		c, err := FindCertOrFail(cert)
-		if handleError(w, r, err) {
-			return
-		}
-		c, err = RenewCert(c)
-		if handleError(w, r, err) {
-			return
-		}
-		ps["Cert"] = c
+	c, err := FindCertOrFail(cert)
+	if handleError(w, r, err) {
+		return
 	}
-	err := templates.ExecuteTemplate(w, "certControl", ps)
-	handleError(w, r, err)
+	action, renewCert := "renew", RenewCertBy
+	if r.FormValue("key") == "same" {
+		action, renewCert = "renewSameKey", ResignCertBy
+	}
+	if c.Crt.IsCA && len(c.Childs) > 0 {
+		renewCA(w, r, ps, c, action)
+		return
+	}
+	renewed, err := renewCert(c, requestUsername(r))
+	if err == nil {
+		c = renewed
+	}
+	auditCert(r, action, cert, c, err)
+	if handleError(w, r, err) {
+		return
+	}
+	certControlPage(w, r, ps, c)
+}
+
+// renewCA renews a CA with children, re-issuing them if requested, and reports how it went
+func renewCA(w http.ResponseWriter, r *http.Request, ps PageStatus, c *Cert, action string) {
+	cert := c.Crt.Subject.CommonName
+	report, err := RenewCABy(c, action == "renew", r.FormValue("reissue") != "", requestUsername(r))
+	if report != nil {
+		c = report.CA
+	}
+	auditCert(r, action, cert, c, err)
+	if report == nil {
+		handleError(w, r, err)
+		return
+	}
+	if err != nil {
+		ps["Error"] = tr("Failed to issue the rollover certificates: %s", err)
+	}
+	for _, child := range report.Reissued {
+		auditCert(r, "reissue", child.Crt.Subject.CommonName, child, nil)
+	}
+	for _, failed := range report.Failed {
+		auditRequest(r, "reissue", cert, fmt.Errorf("%s", failed))
+	}
+	ps["Renewal"] = report
+	certControlPage(w, r, ps, c)
 }
 
 // clone the certificate requested
@@ -395,6 +565,7 @@ func clone(w http.ResponseWriter, r *http.Request) {
 		if handleError(w, r, err) {
 			return
 		}
+		auditCert(r, "clone", cert, c, nil)
 		c = CloneCert(c, tr("clone of %v", c.Crt.Subject.CommonName))
 		ps["Cert"] = c
 		ps["parent"] = c.Parent.Crt.Subject.CommonName
@@ -420,17 +591,21 @@ func del(w http.ResponseWriter, r *http.Request) {
 		if handleError(w, r, err) {
 			return
 		}
-		ps["Cert"] = c
 		if c.Childs == nil || len(c.Childs) == 0 {
-			DeleteCert(c)
+			if !DeleteCert(c) {
+				err = fmt.Errorf(tr("Failed to delete %s", cert))
+			}
+			auditCert(r, "delete", cert, c, err)
 			index(w, r)
 			return
 		} else if c.Crt.IsCA {
 			ps["PendingConfirmation"] = true
 			ps["Childs"] = c.Childs
 		}
+		certControlPage(w, r, ps, c)
+		return
 	}
-	err = templates.ExecuteTemplate(w, "certControl", ps)
+	err = fmt.Errorf("%s", tr("Nothing to delete!"))
 	handleError(w, r, err)
 }
 
@@ -441,7 +616,9 @@ func newLoggedPage(w http.ResponseWriter, r *http.Request) PageStatus {
 		return nil
 	}
 	ps := newPageStatus(r)
-	ps[LOGGEDUSER] = s[LOGGEDUSER]
+	if u, ok := s.User(); ok {
+		ps[LOGGEDUSER] = u
+	}
 	return ps
 }
 
@@ -457,54 +634,159 @@ func accessControlHandler(h http.Handler) http.Handler {
 		if handleError(w, r, err) {
 			return
 		}
-		if s[LOGGEDUSER] == nil {
+		if _, ok := s.User(); !ok {
+			loginErr := ""
+			if u, ok := clientCertUser(r); ok {
+				cfg := LoadConfig()
+				err := loginAllowed(cfg, u.Username, r, time.Now())
+				if err == nil && u.needs2FA(cfg) {
+					logUserIn(w, r, s, cfg, u, r.URL.RequestURI())
+					return
+				}
+				if err == nil {
+					if handleError(w, r, s.Rotate(w, r)) {
+						return
+					}
+					s[LOGGEDUSER] = u.Username
+					s.Save()
+					auditRequest(r, "login", u.Username, nil)
+					h.ServeHTTP(w, r)
+					return
+				}
+				auditRequest(r, "login", u.Username, err)
+				loginErr = err.Error()
+			}
 			if fakedLogin {
-				s[LOGGEDUSER] = User{"fuser", "Faked User", "****", "fuser@fuser.com"}
+				s[LOGGEDUSER] = fakeUser.Username
 				s.Save()
 				h.ServeHTTP(w, r)
 				return
 			}
 			ps := newPageStatus(r)
 			ps[SESSIONID] = s.Id()
+			ps["Error"] = loginErr
+			ps["URL"] = r.URL.RequestURI()
+			ps["SSO"] = LoadConfig().OIDC != nil
 			err := templates.ExecuteTemplate(w, "login", ps)
 			handleError(w, r, err)
 			return
 		}
-		h.ServeHTTP(w, r)
+		if checkCSRF(w, r, s) {
+			h.ServeHTTP(w, r)
+		}
 	})
 }
 
-// login handles login action
+// clientCertUser returns the User named as the subject of the verified TLS client certificate,
+// as long as it is the client certificate last issued to that User by the client CA
+func clientCertUser(r *http.Request) (User, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return User{}, false
+	}
+	cfg := LoadConfig()
+	ca := cfg.getClientCA()
+	for _, chain := range r.TLS.VerifiedChains { // other CAs, such as EST's, may verify it too
+		if ca == nil || !chain[len(chain)-1].Equal(ca.Crt) {
+			continue
+		}
+		crt := chain[0]
+		u := cfg.getUser(crt.Subject.CommonName)
+		if u.ClientSerial == "" || u.ClientSerial != crt.SerialNumber.String() {
+			return User{}, false
+		}
+		for _, usage := range crt.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageClientAuth {
+				return u, true
+			}
+		}
+		return User{}, false
+	}
+	return User{}, false
+}
+
+// login handles login action, asking for a second factor when the User needs it
 func login(w http.ResponseWriter, r *http.Request) {
 	Username := r.FormValue("Username")
-	Password := crypt(r.FormValue("Password"))
 	cfg := LoadConfig()
-	u := cfg.getUser(Username)
-	if u.Password != Password {
-		ps := newPageStatus(r)
-		ps["Error"] = tr("Access Denied")
-		err := templates.ExecuteTemplate(w, "login", ps)
-		handleError(w, r, err)
-		return
-	} else {
-		s, err := SessionFor(w, r)
-		if handleError(w, r, err) {
+	now := time.Now()
+	err := loginAllowed(cfg, Username, r, now)
+	if err == nil {
+		var u User
+		u, err = cfg.authenticate(Username, r.FormValue("Password"))
+		if err == nil {
+			s, err := SessionFor(w, r)
+			if handleError(w, r, err) {
+				return
+			}
+			logUserIn(w, r, s, cfg, u, r.FormValue("URL"))
 			return
 		}
-		s[LOGGEDUSER] = u
+		loginFailed(cfg, Username, r, err.Error(), now)
+		err = fmt.Errorf(tr("Access Denied"))
+	}
+	ps := newPageStatus(r)
+	ps["Error"] = err.Error()
+	ps["URL"] = r.FormValue("URL")
+	ps["SSO"] = cfg.OIDC != nil
+	err = templates.ExecuteTemplate(w, "login", ps)
+	handleError(w, r, err)
+}
+
+// logUserIn stores the authenticated User in the session and goes to the target URL, unless
+// the User needs to pass a second factor first
+func logUserIn(w http.ResponseWriter, r *http.Request, s session, cfg *config, u User, target string) {
+	if handleError(w, r, s.Rotate(w, r)) {
+		return
+	}
+	if u.needs2FA(cfg) {
+		s[PENDINGUSER] = u.Username
 		s.Save()
-		targetUrl := r.FormValue("URL")
-		if targetUrl == "" {
-			targetUrl = "/"
+		if u.TOTPSecret == "" { // required but not enrolled yet
+			http.Redirect(w, r, "/totp", 302)
+			return
 		}
-		http.Redirect(w, r, targetUrl, 302)
+		ps := newPageStatus(r)
+		ps["URL"] = target
+		err := templates.ExecuteTemplate(w, "login2", ps)
+		handleError(w, r, err)
+		return
+	}
+	s[LOGGEDUSER] = u.Username
+	s.Save()
+	loginSucceeded(u.Username)
+	auditRequest(r, "login", u.Username, nil)
+	redirectToTarget(w, r, target)
+}
+
+// logout destroys the session and, when asked to, all other sessions of the same user
+func logout(w http.ResponseWriter, r *http.Request) {
+	s, err := SessionFor(w, r)
+	if handleError(w, r, err) {
+		return
+	}
+	if name := s[LOGGEDUSER]; name != "" {
+		auditRequest(r, "logout", name, nil)
+		if r.FormValue("everywhere") != "" {
+			destroySessionsOf(name)
+		}
+	}
+	s.Destroy(w, r)
+	http.Redirect(w, r, "/", 302)
+}
+
+// redirectToTarget redirects to the URL the user was going to before logging in
+func redirectToTarget(w http.ResponseWriter, r *http.Request, targetUrl string) {
+	if targetUrl == "" || !strings.HasPrefix(targetUrl, "/") || strings.HasPrefix(targetUrl, "//") {
+		targetUrl = "/"
 	}
+	http.Redirect(w, r, targetUrl, 302)
 }
 
 // newPageStatus generates a new PageStatus including the Request
 func newPageStatus(r *http.Request) PageStatus {
 	ps := PageStatus{}
 	ps[REQUEST] = r
+	ps[CSRFTOKEN] = requestCSRFToken(r)
 	return ps
 }
 
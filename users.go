@@ -0,0 +1,234 @@
+package webca
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// sortedUsers returns the configured users ordered by username, with oneCfg held
+func (cfg *config) sortedUsers() []User {
+	users := make([]User, 0, len(cfg.Users))
+	for _, u := range cfg.Users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// users shows the user management page and applies its posted actions
+func users(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	cfg := LoadConfig()
+	if r.Method == "POST" {
+		err := cfg.update(func(cfg *config) error { return applyUserAction(cfg, r) })
+		e := requestEntry(r, "users."+r.FormValue("action"), r.FormValue("Username"), err)
+		if r.FormValue("action") == "role" {
+			e.Detail = strings.TrimSpace(e.Detail + " " + r.FormValue("Role"))
+		}
+		record(e)
+		if err != nil {
+			ps["Error"] = err.Error()
+		}
+	}
+	oneCfg.RLock()
+	ps["Users"] = cfg.sortedUsers()
+	oneCfg.RUnlock()
+	ps["Roles"] = roleNames()
+	ps["KeyRoles"] = keyRoles()
+	ps["Require2FA"] = cfg.Require2FA
+	ps["NotifyLockouts"] = cfg.NotifyLockouts
+	ps["LDAP"] = cfg.LDAP
+	if cfg.LDAP == nil {
+		ps["LDAP"] = &LDAPConfig{UserFilter: LDAP_USER_FILTER, GroupAttr: LDAP_GROUP_ATTR, LocalFallback: true}
+	}
+	ps["OIDC"] = cfg.OIDC
+	if cfg.OIDC == nil {
+		ps["OIDC"] = &OIDCConfig{UsernameClaim: OIDC_USERNAME_CLAIM, GroupsClaim: OIDC_GROUPS_CLAIM}
+	}
+	err := templates.ExecuteTemplate(w, "users", ps)
+	handleError(w, r, err)
+}
+
+// applyUserAction applies the user management action requested on the config
+func applyUserAction(cfg *config, r *http.Request) error {
+	action := r.FormValue("action")
+	if action == "require2FA" {
+		if cfg.Require2FA == nil {
+			cfg.Require2FA = make(map[string]bool)
+		}
+		for _, role := range keyRoles() {
+			cfg.Require2FA[role] = r.FormValue("Require2FA."+role) != ""
+		}
+		return nil
+	}
+	if action == "notifyLockouts" {
+		cfg.NotifyLockouts = r.FormValue("NotifyLockouts") != ""
+		return nil
+	}
+	if action == "ldap" {
+		return applyLDAPSettings(cfg, r)
+	}
+	if action == "oidc" {
+		return applyOIDCSettings(cfg, r)
+	}
+	u, ok := cfg.Users[r.FormValue("Username")]
+	if !ok {
+		return fmt.Errorf(tr("Unknown user %s!", r.FormValue("Username")))
+	}
+	switch action {
+	case "role":
+		role := r.FormValue("Role")
+		if _, ok := roles[role]; !ok {
+			return fmt.Errorf(tr("Unknown role %s!", role))
+		}
+		if u.Source != "" {
+			return fmt.Errorf(tr("The role of %s comes from its %s groups!", u.Username, u.Source))
+		}
+		if u.role() == ROLE_ADMIN && role != ROLE_ADMIN && len(cfg.usersWithRole(ROLE_ADMIN)) == 1 {
+			return fmt.Errorf(tr("Can't leave WebCA without admins!"))
+		}
+		u.Role = role
+	case "reset2FA":
+		u.disableTOTP()
+	case "logout":
+		destroySessionsOf(u.Username)
+		return nil
+	case "unlock":
+		u.unlock()
+		cfg.Users[u.Username] = u
+		return nil
+	default:
+		return fmt.Errorf(tr("Unknown action %s!", action))
+	}
+	cfg.Users[u.Username] = u
+	destroySessionsOf(u.Username) // sessions hold a copy of the User, make it log in again
+	return nil
+}
+
+// usersWithRole returns the usernames with the given role
+func (cfg *config) usersWithRole(role string) []string {
+	names := make([]string, 0)
+	for _, u := range cfg.sortedUsers() {
+		if u.role() == role {
+			names = append(names, u.Username)
+		}
+	}
+	return names
+}
+
+// applyLDAPSettings sets or, when its URL is empty, removes the LDAP directory settings. Group
+// roles are posted one per line as "group DN = role"
+func applyLDAPSettings(cfg *config, r *http.Request) error {
+	lc := &LDAPConfig{
+		URL:           strings.TrimSpace(r.FormValue("URL")),
+		CACert:        strings.TrimSpace(r.FormValue("CACert")),
+		BindDN:        strings.TrimSpace(r.FormValue("BindDN")),
+		BindPassword:  r.FormValue("BindPassword"),
+		BaseDN:        strings.TrimSpace(r.FormValue("BaseDN")),
+		UserFilter:    strings.TrimSpace(r.FormValue("UserFilter")),
+		GroupAttr:     strings.TrimSpace(r.FormValue("GroupAttr")),
+		LocalFallback: r.FormValue("LocalFallback") != "",
+	}
+	if lc.URL == "" {
+		cfg.LDAP = nil
+		return nil
+	}
+	if lc.BindPassword == "" && cfg.LDAP != nil && lc.BindDN == cfg.LDAP.BindDN {
+		lc.BindPassword = cfg.LDAP.BindPassword // not shown on the page, so keep it
+	}
+	if strings.Count(withDefault(lc.UserFilter, LDAP_USER_FILTER), "%s") != 1 {
+		return fmt.Errorf(tr("The user filter must contain %%s once!"))
+	}
+	if _, err := parseLDAPFilter(fmt.Sprintf(withDefault(lc.UserFilter, LDAP_USER_FILTER), "x")); err != nil {
+		return err
+	}
+	groupRoles, err := parseGroupRoles(r.FormValue("GroupRoles"))
+	if err != nil {
+		return err
+	}
+	lc.GroupRoles = groupRoles
+	cfg.LDAP = lc
+	return nil
+}
+
+// applyOIDCSettings sets or, when its issuer is empty, removes the OpenID Connect settings
+func applyOIDCSettings(cfg *config, r *http.Request) error {
+	oc := &OIDCConfig{
+		Issuer:        strings.TrimSpace(r.FormValue("Issuer")),
+		ClientID:      strings.TrimSpace(r.FormValue("ClientID")),
+		ClientSecret:  r.FormValue("ClientSecret"),
+		CACert:        strings.TrimSpace(r.FormValue("CACert")),
+		RedirectURL:   strings.TrimSpace(r.FormValue("RedirectURL")),
+		UsernameClaim: strings.TrimSpace(r.FormValue("UsernameClaim")),
+		GroupsClaim:   strings.TrimSpace(r.FormValue("GroupsClaim")),
+		DefaultRole:   r.FormValue("DefaultRole"),
+	}
+	if oc.Issuer == "" {
+		cfg.OIDC = nil
+		return nil
+	}
+	if oc.ClientID == "" {
+		return fmt.Errorf(tr("The client ID is required!"))
+	}
+	if _, ok := roles[oc.DefaultRole]; oc.DefaultRole != "" && !ok {
+		return fmt.Errorf(tr("Unknown role %s!", oc.DefaultRole))
+	}
+	if oc.ClientSecret == "" && cfg.OIDC != nil && oc.ClientID == cfg.OIDC.ClientID {
+		oc.ClientSecret = cfg.OIDC.ClientSecret // not shown on the page, so keep it
+	}
+	groupRoles, err := parseGroupRoles(r.FormValue("GroupRoles"))
+	if err != nil {
+		return err
+	}
+	oc.GroupRoles = groupRoles
+	if _, err := oc.client(); err != nil {
+		return err
+	}
+	cfg.OIDC = oc
+	return nil
+}
+
+// parseGroupRoles parses group to role mappings posted one per line as "group = role"
+func parseGroupRoles(text string) (map[string]string, error) {
+	groupRoles := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sep := strings.LastIndex(line, "=")
+		if sep < 0 {
+			return nil, fmt.Errorf(tr("Wrong group mapping %s!", line))
+		}
+		group, role := strings.TrimSpace(line[:sep]), strings.TrimSpace(line[sep+1:])
+		if _, ok := roles[role]; !ok {
+			return nil, fmt.Errorf(tr("Unknown role %s!", role))
+		}
+		groupRoles[group] = role
+	}
+	return groupRoles, nil
+}
+
+// groupRolesText returns the group to role mappings as edited on the users page
+func groupRolesText(groupRoles map[string]string) string {
+	lines := make([]string, 0, len(groupRoles))
+	for group, role := range groupRoles {
+		lines = append(lines, group+" = "+role)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// GroupRolesText returns the group to role mappings as edited on the users page
+func (lc *LDAPConfig) GroupRolesText() string {
+	return groupRolesText(lc.GroupRoles)
+}
+
+// GroupRolesText returns the group to role mappings as edited on the users page
+func (oc *OIDCConfig) GroupRolesText() string {
+	return groupRolesText(oc.GroupRoles)
+}
@@ -0,0 +1,277 @@
+package webca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	VERSIONS_DIR  = ".webca.versions" // past versions of each certificate, on a dir per name
+	VERSIONS_FILE = "versions.json"   // index of the versions of a certificate
+)
+
+// CertVersion describes an issued version of a certificate, its files are kept under the
+// certificate's versions dir named after its serial number
+type CertVersion struct {
+	Serial    string // serial number in hex
+	NotBefore time.Time
+	NotAfter  time.Time
+	RenewedBy string // user who renewed the certificate into this version, "" if issued otherwise
+	Current   bool   `json:"-"`
+	Rollover  bool   `json:"-"` // whether the CA was cross-signed when re-keyed into this version
+}
+
+// Valid tells whether the version has not expired yet
+func (cv CertVersion) Valid() bool {
+	return time.Now().Before(cv.NotAfter)
+}
+
+// serialOf returns the serial number of the certificate in hex
+func serialOf(crt *x509.Certificate) string {
+	return fmt.Sprintf("%X", crt.SerialNumber)
+}
+
+// versionsDir returns the dir keeping the versions of the named certificate
+func versionsDir(certname string) string {
+	return filepath.Join(VERSIONS_DIR, filename(certname))
+}
+
+// readVersions reads the versions index of the named certificate, oldest first
+func readVersions(certname string) ([]CertVersion, error) {
+	versions := make([]CertVersion, 0)
+	data, err := ioutil.ReadFile(filepath.Join(versionsDir(certname), VERSIONS_FILE))
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("Failed to read the versions of %s: %s", certname, err)
+	}
+	return versions, nil
+}
+
+// writeVersions replaces the versions index of the named certificate
+func writeVersions(certname string, versions []CertVersion) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(versionsDir(certname), VERSIONS_FILE)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// findVersion returns the index of the version with the serial, or -1
+func findVersion(versions []CertVersion, serial string) int {
+	for i, v := range versions {
+		if v.Serial == serial {
+			return i
+		}
+	}
+	return -1
+}
+
+// addVersion records cert as a version of its name, renewed by the named user
+func addVersion(cert *Cert, renewedBy string) error {
+	certname := cert.Crt.Subject.CommonName
+	if err := os.MkdirAll(versionsDir(certname), 0700); err != nil {
+		return err
+	}
+	versions, err := readVersions(certname)
+	if err != nil {
+		return err
+	}
+	if findVersion(versions, serialOf(cert.Crt)) >= 0 {
+		return nil
+	}
+	versions = append(versions, CertVersion{Serial: serialOf(cert.Crt), NotBefore: cert.Crt.NotBefore,
+		NotAfter: cert.Crt.NotAfter, RenewedBy: renewedBy})
+	return writeVersions(certname, versions)
+}
+
+// archiveVersion keeps a copy of the current cert and key files of cert as one of its versions
+func archiveVersion(cert *Cert) error {
+	if err := addVersion(cert, ""); err != nil { // no-op if it was recorded when issued
+		return err
+	}
+	base := filepath.Join(versionsDir(cert.Crt.Subject.CommonName), serialOf(cert.Crt))
+	if err := copyFile(certFile(*cert), base+CERT_SUFFIX, 0644); err != nil {
+		return err
+	}
+	if cert.Key == nil {
+		return nil
+	}
+	return copyFile(keyFile(*cert), base+KEY_SUFFIX, 0600)
+}
+
+// copyFile copies src to dst, replacing it
+func copyFile(src, dst string, perm os.FileMode) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dst+".tmp", data, perm); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// CertVersions returns the versions of cert, last issued first, marking the current one
+func CertVersions(cert *Cert) ([]CertVersion, error) {
+	versions, err := readVersions(cert.Crt.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+	current := serialOf(cert.Crt)
+	if findVersion(versions, current) < 0 {
+		versions = append(versions, CertVersion{Serial: current, NotBefore: cert.Crt.NotBefore,
+			NotAfter: cert.Crt.NotAfter})
+	}
+	for i := range versions {
+		versions[i].Current = versions[i].Serial == current
+		_, err := os.Stat(rolloverFile(cert.Crt.Subject.CommonName, versions[i].Serial, OLD_WITH_NEW))
+		versions[i].Rollover = err == nil
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// versionFile returns the file of the version of cert with the serial and suffix, failing if
+// there is no such version archived
+func versionFile(cert *Cert, serial, suffix string) (string, error) {
+	versions, err := readVersions(cert.Crt.Subject.CommonName)
+	if err != nil {
+		return "", err
+	}
+	if findVersion(versions, serial) < 0 { // also keeps serial from escaping the versions dir
+		return "", fmt.Errorf(tr("%s has no version %s!", cert.Crt.Subject.CommonName, serial))
+	}
+	file := filepath.Join(versionsDir(cert.Crt.Subject.CommonName), serial+suffix)
+	if _, err := os.Stat(file); err != nil {
+		return "", fmt.Errorf(tr("%s has no version %s!", cert.Crt.Subject.CommonName, serial))
+	}
+	return file, nil
+}
+
+// ReadCertVersion reads the certificate contents of a version of cert
+func ReadCertVersion(cert *Cert, serial string) ([]byte, error) {
+	file, err := versionFile(cert, serial, CERT_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+// ReadCertVersionKey reads the key contents of a version of cert
+func ReadCertVersionKey(cert *Cert, serial string) ([]byte, error) {
+	file, err := versionFile(cert, serial, KEY_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+// RollbackCert makes a past version of cert current again, as long as it is still valid, it
+// was issued by the current parent and, for CAs, it verifies all current children
+func RollbackCert(cert *Cert, serial string) (*Cert, error) {
+	certname := cert.Crt.Subject.CommonName
+	if serial == serialOf(cert.Crt) {
+		return nil, fmt.Errorf(tr("Version %s of %s is already the current one!", serial, certname))
+	}
+	file, err := versionFile(cert, serial, CERT_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	old, err := readCert(file)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(old.Crt.NotAfter) {
+		return nil, fmt.Errorf(tr("Version %s of %s has expired!", serial, certname))
+	}
+	if cert.Parent != nil && cert.Parent != cert && cert.Parent.Crt.Raw != nil &&
+		old.Crt.CheckSignatureFrom(cert.Parent.Crt) != nil {
+		return nil, fmt.Errorf(tr("Version %s of %s was not issued by the current %s!", serial,
+			certname, cert.Parent.Crt.Subject.CommonName))
+	}
+	for _, child := range cert.Childs {
+		if child.Crt.CheckSignatureFrom(old.Crt) != nil {
+			return nil, fmt.Errorf(tr("Version %s of %s did not issue the current %s!", serial,
+				certname, child.Crt.Subject.CommonName))
+		}
+	}
+	if err := archiveVersion(cert); err != nil {
+		return nil, err
+	}
+	defer invalidateCertree() // even if only partially restored
+	if err := copyFile(file, certFile(*cert), 0644); err != nil {
+		return nil, err
+	}
+	if old.Key != nil {
+		if err := copyFile(filepath.Join(filepath.Dir(file), serial+KEY_SUFFIX), keyFile(*cert), 0600); err != nil {
+			return nil, err
+		}
+	} else if err := os.Remove(keyFile(*cert)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	old.Parent, old.Childs = cert.Parent, cert.Childs
+	return old, nil
+}
+
+// versionServer serves the cert or key file of a past version of a certificate
+func versionServer(read func(cert *Cert, serial string) ([]byte, error), suffix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := FindCertOrFail(r.FormValue("cert"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		serial := r.FormValue("serial")
+		data, err := read(c, serial)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if suffix == KEY_SUFFIX {
+			e := requestEntry(r, "downloadKey", c.Crt.Subject.CommonName, nil)
+			e.Serial = serial
+			record(e)
+		}
+		w.Header().Set("Content-disposition",
+			"attachment; filename="+c.Crt.Subject.CommonName+"-"+serial+suffix)
+		w.Header().Set("Content-type", "application/x-pem-file")
+		w.Write(data)
+	}
+}
+
+// rollback makes the requested past version of a certificate current again
+func rollback(w http.ResponseWriter, r *http.Request) {
+	ps := newLoggedPage(w, r)
+	if ps == nil {
+		return
+	}
+	c, err := FindCertOrFail(r.FormValue("cert"))
+	if handleError(w, r, err) {
+		return
+	}
+	old, err := RollbackCert(c, r.FormValue("serial"))
+	auditCert(r, "rollback", c.Crt.Subject.CommonName, old, err)
+	if err != nil {
+		ps["Error"] = err.Error()
+	} else {
+		c = old
+	}
+	certControlPage(w, r, ps, c)
+}
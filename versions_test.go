@@ -0,0 +1,52 @@
+package webca
+
+import (
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestRenewalHistory(t *testing.T) {
+	inTempDir(t, func() {
+		ca, err := GenCACert(pkix.Name{CommonName: "TestCA"}, 365)
+		dieOnError(t, err)
+		first, err := GenCert(ca, "host", 365)
+		dieOnError(t, err)
+		second, err := RenewCertBy(FindCert("host"), "alice")
+		dieOnError(t, err)
+		versions, err := CertVersions(FindCert("host"))
+		dieOnError(t, err)
+		if len(versions) != 2 || !versions[0].Current || versions[0].Serial != serialOf(second.Crt) ||
+			versions[0].RenewedBy != "alice" || versions[1].Serial != serialOf(first.Crt) {
+			t.Fatalf("Unexpected versions %v", versions)
+		}
+		old, err := ReadCertVersionKey(FindCert("host"), serialOf(first.Crt))
+		dieOnError(t, err)
+		key, err := ReadCertKey(FindCert("host"))
+		dieOnError(t, err)
+		if string(key) == string(old) {
+			t.Fatal("Renewal did not replace the key file")
+		}
+		if _, err := ReadCertVersion(FindCert("host"), "../../host"); err == nil {
+			t.Fatal("Version read out of the versions dir")
+		}
+		_, err = RollbackCert(FindCert("host"), serialOf(first.Crt))
+		dieOnError(t, err)
+		if c := FindCert("host"); serialOf(c.Crt) != serialOf(first.Crt) || c.Key.N.Cmp(first.Key.N) != 0 {
+			t.Fatal("Rollback did not restore the first version")
+		}
+		versions, err = CertVersions(FindCert("host"))
+		dieOnError(t, err)
+		if len(versions) != 2 || versions[0].Current {
+			t.Fatalf("Unexpected versions after rollback %v", versions)
+		}
+
+		caV1 := serialOf(ca.Crt)
+		_, err = RenewCertBy(FindCert("TestCA"), "alice")
+		dieOnError(t, err)
+		_, err = GenCert(FindCert("TestCA"), "other", 365)
+		dieOnError(t, err)
+		if _, err := RollbackCert(FindCert("TestCA"), caV1); err == nil {
+			t.Fatal("Rolled back a CA that did not issue its current children")
+		}
+	})
+}